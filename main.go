@@ -2,14 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
@@ -21,9 +32,86 @@ import (
 
 const KILO_VERSION = "0.1.0"
 const KILO_TAB_STOP = 8
+
+// How many seconds status messages stay up, and how many more times quit has to be
+// pressed with unsaved changes. Change them with message_timeout and quit_times.
 const KILO_MESSAGE_TIMEOUT = 5
 const KILO_QUIT_TIMES = 3
 
+// The least space between a cell and the next column when elastic tabstops are on.
+const KILO_ELASTIC_PADDING = 2
+
+// How many indented lines are looked at to guess whether a file indents with tabs or spaces.
+const KILO_INDENT_SAMPLE_LINES = 100
+
+// How many edit locations are remembered for jumping back to.
+const KILO_EDIT_RING_SIZE = 10
+
+// How long, in milliseconds, the cursor has to stay on a word before other
+// places it's used are highlighted, so moving quickly doesn't flicker.
+const KILO_WORD_HIGHLIGHT_DELAY = 250
+
+// How long, in milliseconds, each frame of a smooth scroll stays up.
+const KILO_SMOOTH_SCROLL_FRAME = 15
+
+// How many places are remembered in the jump list.
+const KILO_JUMP_LIST_SIZE = 100
+
+// How many keypresses' worth of changes can be undone.
+const KILO_UNDO_LEVELS = 1000
+
+// If a file started with a UTF-8 byte order mark, write it back out on save.
+// Change it with preserve_bom in the rc file.
+const KILO_PRESERVE_BOM = true
+
+// The default command run by the build action. Change it with build_command in the rc file.
+const KILO_BUILD_COMMAND = "go build -o /dev/null ./..."
+
+// The word list used for spell checking. Change it with spell_dictionary in the rc file.
+const KILO_SPELL_DICTIONARY = "/usr/share/dict/words"
+
+// Background color of the ruler, a bright black.
+const KILO_RULER_COLOR = "\x1b[100m"
+
+// Words highlighted in comments. Change them with todo_keywords in the rc file.
+const KILO_TODO_KEYWORDS = "TODO FIXME XXX HACK"
+
+// Background color of whitespace at the end of a line, also a red.
+const KILO_TRAILING_COLOR = "\x1b[41m"
+
+// Background color of the line the cursor is on, a dark gray.
+const KILO_CURSOR_LINE_COLOR = "\x1b[48;5;236m"
+
+// How long, in milliseconds, the status bar flashes after a save, and the SGR colors
+// it flashes in, black on green. Change them with save_flash and save_flash_color.
+const KILO_SAVE_FLASH = 300
+const KILO_SAVE_FLASH_COLOR = "30;42"
+
+// The most pairs of lines compared when working out how a file differs from git.
+// Past it, everything between the first and last difference is marked as changed.
+const KILO_DIFF_LIMIT = 4 << 20
+
+// Drawn in the scrollbar where the thumb isn't.
+const KILO_SCROLLBAR_TRACK = "│"
+
+// Glyphs drawn in place of spaces and tabs when showing whitespace.
+// Change them with whitespace_space and whitespace_tab in the rc file.
+const KILO_WHITESPACE_SPACE = '·'
+const KILO_WHITESPACE_TAB = '→'
+
+// The UTF-8 byte order mark some editors put at the start of files.
+const UTF8_BOM = "\uFEFF"
+
+// Files bigger than this many bytes are too big to edit comfortably.
+// Searching across files skips them.
+const KILO_PAGED_THRESHOLD = 64 << 20
+
+// How often the screen shows how far along opening a file is.
+const KILO_LOAD_PROGRESS_INTERVAL = 100 * time.Millisecond
+
+// How many rows above and below the screen stay in memory when paging a file.
+const KILO_PAGED_WINDOW = 1000
+
 /*
 Define keys we care about and give them really high numbers
 to avoid conflict with existing keys.
@@ -39,6 +127,27 @@ const (
 	END_KEY
 	PAGE_UP
 	PAGE_DOWN
+	F1_KEY
+	// Shift+<key>, for selecting text.
+	SHIFT_ARROW_LEFT
+	SHIFT_ARROW_RIGHT
+	SHIFT_ARROW_UP
+	SHIFT_ARROW_DOWN
+	SHIFT_HOME_KEY
+	SHIFT_END_KEY
+	// Ctrl+<arrow> and Alt+<arrow>, for moving by words.
+	CTRL_ARROW_LEFT
+	CTRL_ARROW_RIGHT
+	ALT_ARROW_LEFT
+	ALT_ARROW_RIGHT
+	// An escape sequence that isn't a key we know, like a color code in pasted text.
+	UNKNOWN_SEQUENCE
+	// The terminal puts these around pasted text. Once the whole paste has been read,
+	// editorReadKey returns PASTE_START with the text in pastedText.
+	PASTE_START
+	PASTE_END
+	// Not a key. Everything from ARROW_LEFT up to here is a special key.
+	SPECIAL_KEYS_END
 )
 
 const RED = 31
@@ -49,6 +158,11 @@ const MAGENTA = 35
 const CYAN = 36
 const WHITE = 37
 const DEFAULT = 39
+const BRIGHT_RED = 91
+const BG_RED = 41
+const BRIGHT_YELLOW = 93
+const BRIGHT_MAGENTA = 95
+const BRIGHT_CYAN = 96
 
 const (
 	HL_NORMAL uint8 = iota
@@ -59,16 +173,53 @@ const (
 	HL_MATCH
 	HL_KEYWORD1
 	HL_KEYWORD2
+	HL_ESCAPE
+	HL_TRAILING
+	// Words like TODO in comments.
+	HL_TODO
+	// Brackets colored by how deeply they're nested, cycling through these.
+	HL_BRACKET1
+	HL_BRACKET2
+	HL_BRACKET3
+	// Words in prose that aren't in the spelling word list.
+	HL_MISSPELLED
+)
+
+// Added to the highlight of characters past max_line_length. They keep their
+// own color, and the background is changed to this one's.
+const HL_OVERFLOW uint8 = 1 << 7
+
+// How a row differs from the file as it was last saved.
+const (
+	CHANGE_NONE uint8 = iota
+	CHANGE_ADDED
+	CHANGE_MODIFIED
+	// Lines were deleted right above this one.
+	CHANGE_DELETED
 )
 
+// The sign shown in the change gutter for each kind of change.
+var changeSigns = map[uint8]string{
+	CHANGE_NONE:     " ",
+	CHANGE_ADDED:    "\x1b[32m+\x1b[39m",
+	CHANGE_MODIFIED: "\x1b[33m~\x1b[39m",
+	CHANGE_DELETED:  "\x1b[31m_\x1b[39m",
+}
+
 var syntaxColors = map[uint8]int{
-	HL_NUMBER:    RED,
-	HL_MATCH:     BLUE,
-	HL_STRING:    MAGENTA,
-	HL_COMMENT:   CYAN,
-	HL_MLCOMMENT: CYAN,
-	HL_KEYWORD1:  YELLOW,
-	HL_KEYWORD2:  GREEN,
+	HL_NUMBER:     RED,
+	HL_MATCH:      BLUE,
+	HL_STRING:     MAGENTA,
+	HL_COMMENT:    CYAN,
+	HL_MLCOMMENT:  CYAN,
+	HL_KEYWORD1:   YELLOW,
+	HL_KEYWORD2:   GREEN,
+	HL_BRACKET1:   BRIGHT_YELLOW,
+	HL_BRACKET2:   BRIGHT_MAGENTA,
+	HL_BRACKET3:   BRIGHT_CYAN,
+	HL_TODO:       BRIGHT_YELLOW,
+	HL_MISSPELLED: BRIGHT_RED,
+	HL_OVERFLOW:   BG_RED,
 }
 
 const ESC = '\x1b' // 27
@@ -79,6 +230,14 @@ func CTRL_KEY(k rune) int {
 	return int(k) & 0x1f
 }
 
+// Alt+<key> is reported past the end of Unicode so it can't clash with typed characters.
+const ALT_KEY_BASE = 0x110000
+
+// ALT_KEY is the key code for Alt+k.
+func ALT_KEY(k rune) int {
+	return ALT_KEY_BASE + int(k)
+}
+
 func MIN(a, b int) int {
 	if a < b {
 		return a
@@ -117,10 +276,39 @@ type editorSyntax struct {
 	keywords map[uint8][]string
 	// Bit field to control highlighting rules
 	flags int
+	// Shell command that reads the file on stdin and writes it back formatted.
+	formatter string
+}
+
+// Settings that can differ from file to file, like how to indent.
+type fileSettings struct {
+	// How many columns a tab takes up.
+	tabStop int
+	// If True, the Tab key inserts spaces, up to the next multiple of indentSize.
+	softTabs   bool
+	indentSize int
+	// Written at the end of each line on save.
+	lineEnding string
+	// If True, spaces and tabs at the end of lines are removed on save.
+	trimTrailingWhitespace bool
+	// If not 0, how many columns a line can take up before the rest is highlighted.
+	maxLineLength int
+	// If True, the last line always ends with a line ending. Otherwise, it only
+	// does if it did when the file was opened.
+	insertFinalNewline bool
+}
+
+// What each file starts with before its .editorconfig is applied.
+var defaultFileSettings = fileSettings{
+	tabStop:            KILO_TAB_STOP,
+	indentSize:         KILO_TAB_STOP,
+	lineEnding:         "\n",
+	insertFinalNewline: true,
 }
 
 // Maintain state of the editor.
 type editorConfig struct {
+	fileSettings
 	originalTermios *unix.Termios
 	// terminal size
 	screenrows, screencols int
@@ -146,19 +334,188 @@ type editorConfig struct {
 	statusMsgTime time.Time
 	// Current highlight rules for the file
 	syntax *editorSyntax
+	// Modification time and size of the file when it was last read or written.
+	// Used to detect changes made by other programs.
+	fileModTime time.Time
+	fileSize    int64
+	// If True, spaces and tabs are drawn as visible glyphs.
+	showWhitespace bool
+	// The glyphs drawn for spaces and tabs.
+	whitespaceSpace rune
+	whitespaceTab   rune
+	// If True, typing an opening bracket or quote also inserts its closer.
+	autoPair bool
+	// If True, the cursor and the anchor are opposite corners of a rectangular selection.
+	blockSelect bool
+	// The corner of the block selection that stays put, as a row and a render column.
+	blockAnchorY, blockAnchorRx int
+	// Cursors besides the one at cx/cy. Typing and moving happen at all of them.
+	cursors []editorCursor
+	// Tab stops of the last expanded snippet that Tab hasn't reached yet.
+	snippetStops []editorCursor
+	// The tab stop Tab last moved to, and the size of the file and of its row then,
+	// so the stops after it can be moved along with what's typed there.
+	snippetAt                  editorCursor
+	snippetRows, snippetRowLen int
+	// The rows the snippet takes up, and the edit count when the stops were last known good.
+	snippetTop, snippetBottom int
+	snippetEdits              int
+	// Shell command run to build or lint.
+	buildCommand string
+	// Locations found by the last build or grep, and which one was jumped to last.
+	locations     []editorLocation
+	locationIndex int
+	// Where the cursor was before each jump to a definition, most recent last.
+	tagStack []editorLocation
+	// Counts every change to the rows, so it's easy to tell if something edited them.
+	edits int
+	// Where the most recent edits were, oldest first.
+	editRing []editorCursor
+	// Named places in the file, kept on the same line as rows are added and removed.
+	marks map[rune]editorCursor
+	// Where the cursor was before each jump, oldest first, and where in the list
+	// jump-back and jump-forward have got to. jumpIndex is len(jumps) when they haven't been used.
+	jumps     []editorCursor
+	jumpIndex int
+	// Go time layout used when inserting the date.
+	dateFormat string
+	// Where the date comes from, so it can be fixed in tests.
+	now func() time.Time
+	// If True, the last column shows where the screen is in the file.
+	showScrollbar bool
+	// If True, the line the cursor is on has a different background.
+	showCursorLine bool
+	// If True, the word at the cursor is highlighted everywhere it's on screen.
+	highlightWord bool
+	// If True, searching past the end of the file carries on from the top, and the other way around.
+	searchWrap bool
+	// If True, typing past the last line starts a new one. Otherwise it goes on the end of the last line.
+	growAtEOF bool
+	// If True, the buffer is scratch space. It's never saved, so there are no changes to lose.
+	scratch bool
+	// If True, Backspace on an empty line only removes it, instead of joining it onto the line above.
+	deleteEmptyRow bool
+	// If True, escape sequences and control characters that aren't keys kilo knows are
+	// dropped instead of typed, so pasting colored text doesn't fill the file with them.
+	stripControls bool
+	// Shown on an empty buffer that isn't a file yet, instead of the version.
+	welcome []string
+	// If True, tabs line up into columns with the tabs on the lines around them.
+	elasticTabs bool
+	// How many rows to keep on screen above and below the cursor, and
+	// columns to its left and right.
+	scrollOff     int
+	sideScrollOff int
+	// If True, jumps of more than half a screen scroll there a few lines at a time.
+	smoothScroll bool
+	// If True, the text between selectAnchor and the cursor is selected.
+	selecting    bool
+	selectAnchor editorCursor
+	// If True, the file is shown and edited as a hex dump of hexData, which
+	// stands in for the rows until hex view is left.
+	hexMode   bool
+	hexData   []byte
+	hexCursor int
+	// Which half of the byte at the cursor the next hex digit sets, 0 for the high one.
+	hexNibble int
+	// The first line of the dump on screen.
+	hexRowOffset int
+	// If True, hexData has been edited since hex view was entered.
+	hexEdited bool
+	// If True, brackets are colored by how deeply they're nested.
+	rainbowBrackets bool
+	// If True, whitespace at the end of lines is highlighted.
+	highlightTrailing bool
+	// Words highlighted where they're in comments, like TODO.
+	todoKeywords []string
+	// If True, the status bar shows the file's path from the working directory
+	// when it's under it, and the absolute path when it isn't.
+	relativePath bool
+	// If True, a column left of the text marks lines changed since the last save.
+	showChanges bool
+	// The DECSCUSR number for the cursor's shape, or 0 to leave it to the terminal.
+	cursorShape int
+	// How long the status bar flashes after a save, in milliseconds, and in what colors.
+	saveFlash      int
+	saveFlashColor string
+	// How many seconds status messages stay up, or 0 to leave them until the next one.
+	messageTimeout int
+	// How many more times quit has to be pressed when there are unsaved changes.
+	quitTimes int
+	// The status bar is drawn in saveFlashColor until then.
+	flashUntil time.Time
+	// If not 0, the column, counting from 1, to draw a vertical guide line at.
+	rulerColumn int
+	// If True, words missing from the word list at spellDictionary are underlined.
+	spellCheck      bool
+	spellDictionary string
+	// Whether the file started with a UTF-8 byte order mark. It's kept out of the rows.
+	hasBOM bool
+	// If True, a file's byte order mark is written back out when it's saved.
+	preserveBOM bool
+	// Whether the file has bytes that aren't UTF-8 text, like NULs or invalid sequences.
+	binary bool
+	// Whether the last line of the file ended with a line ending when it was opened.
+	finalNewline bool
+	// If not 0, files bigger than this many megabytes are paged in from disk
+	// instead of read all at once.
+	pagedThreshold int
+	// When paging a large file, the open handle rows are read from on demand.
+	// nil when the whole file is in memory.
+	pagedFile *os.File
+	// When paging, how many rows from the top have their comment state at the
+	// end worked out, so rows below them highlight correctly. Edits set it back.
+	pagedSyntaxRows int
+	// Changes that can be undone, oldest first, and undone changes that can be redone.
+	undoStack, redoStack []undoGroup
+	// If True, changes go in the last undo group instead of starting a new one.
+	undoGroupOpen bool
+	// Where the cursor was when the current keypress started, for the next undo group.
+	undoCursor editorCursor
+	// If True, changes aren't recorded for undo, like while a file is read in or an undo is put back.
+	undoPaused bool
+	// If not 0, saving also keeps up to this many undo groups in a file next to the
+	// file, so they can still be undone after it's opened again.
+	undoFileLevels int
 }
 
+// The editor being run. Core row and edit operations take the editor to work on
+// as a parameter, so they can be used on others too.
 var config editorConfig
 
+// A position in the content of the rows.
+type editorCursor struct {
+	cx, cy int
+}
+
+// A line in some file, and what's there, like a compiler error.
+type editorLocation struct {
+	filename string
+	// Both start at 1. col is a byte offset into the line, 0 if unknown.
+	line, col int
+	message   string
+}
+
 // Holds the main viewport of the editor.
 var mainBuffer strings.Builder
 
+// Output to the terminal goes through here, so each frame is a single write.
+var terminal = bufio.NewWriter(os.Stdout)
+
+// When set, these lines are drawn in place of the rows, like for the help screen.
+var overlayLines []string
+
+// What was drawn on each line of the screen during the last refresh.
+// Lines that haven't changed since then aren't sent to the terminal again.
+var previousFrame []string
+
 // Represents a row of text in the editor.
 type editorRow struct {
 	// The row's place in the overall editor
 	id int
 	// The literal text of the row.
-	content string
+	// Kept in a gap buffer so runs of edits at the cursor are cheap.
+	content gapBuffer
 	// Our render of the content, with tabs expanded.
 	render []rune
 	// The syntax-highlight properties for the row.
@@ -166,6 +523,29 @@ type editorRow struct {
 	highlights []uint8
 	// If True, this row is part of an open, multi-line comment
 	isOpenComment bool
+	// How many brackets are still open at the end of this row, when rainbow brackets are on.
+	bracketDepth int
+	// If True, render and highlights are out of date and must be rebuilt before use.
+	// Rows are rendered lazily so opening a huge file doesn't process every line up front.
+	stale bool
+	// When paging a large file, where the row's line starts in the file and how many
+	// bytes it spans. offset is -1 if the row no longer matches what's on disk.
+	offset int64
+	length int
+	// If True, content hasn't been read from the paged file yet.
+	unloaded bool
+	// How the row has changed since the file was last saved.
+	change uint8
+	// With elastic tabstops, the render column each tab ends at, and whether
+	// they're up to date with the rows around this one.
+	tabStops    []int
+	tabsLaidOut bool
+	// The words this row adds to wordCounts, and whether they're up to date with content.
+	words        []string
+	wordsCounted bool
+	// How the row's line ended in the file, if not with the file's lineEnding, so
+	// files with mixed line endings are saved as they were.
+	lineEnding string
 }
 
 // Track how many times Quit has been attempted
@@ -174,7 +554,7 @@ type editorRow struct {
 var quitTimes = KILO_QUIT_TIMES
 
 func (e editorRow) Len() int {
-	return len(e.content)
+	return e.content.Len()
 }
 
 func (e editorRow) RLen() int {
@@ -202,6 +582,15 @@ var GO_HL_keywords = map[uint8][]string{
 		"make", "new", "panic", "print", "println", "real", "recover"},
 }
 
+var SH_HL_extensions = []string{".sh", ".bash", ".bashrc", ".profile"}
+var SH_HL_keywords = map[uint8][]string{
+	HL_KEYWORD1: {"if", "then", "else", "elif", "fi", "case", "esac",
+		"for", "while", "until", "do", "done", "in", "function", "select",
+		"return", "exit", "break", "continue", "local", "export", "readonly"},
+	HL_KEYWORD2: {"echo", "printf", "read", "cd", "test", "true", "false",
+		"set", "unset", "shift", "source", "eval", "exec", "trap"},
+}
+
 var highlightDB = []editorSyntax{
 	{
 		filetype:            "go",
@@ -211,6 +600,14 @@ var highlightDB = []editorSyntax{
 		multiCommentEnd:     "*/",
 		keywords:            GO_HL_keywords,
 		flags:               HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS,
+		formatter:           "gofmt",
+	},
+	{
+		filetype:            "sh",
+		associatedFileTypes: SH_HL_extensions,
+		singleCommentStart:  "#",
+		keywords:            SH_HL_keywords,
+		flags:               HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS,
 	},
 }
 
@@ -218,13 +615,10 @@ var highlightDB = []editorSyntax{
 // =============== Terminal =================
 // ==========================================
 
-// Thin wrapper around panic to gracefully exit.
-func exit() {
-	if r := recover(); r != nil {
-		cleanScreen(&mainBuffer)
-		fmt.Print(mainBuffer.String())
-		log.Fatalf("%+v. Quitting kilo...\r\n", r)
-	}
+// Whether file is a terminal, as opposed to a pipe or regular file.
+func isTerminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
 }
 
 // enableRawMode turns on raw mode for the terminal. It remembers the settings of the terminal
@@ -232,11 +626,11 @@ func exit() {
 //
 // Raw mode (as opposed to canonical mode) sends each input directly to program
 // instead of buffering it and sending it when Enter is pressed.
-func enableRawMode() {
+func enableRawMode() error {
 	var err error
 	config.originalTermios, err = unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
 	if err != nil {
-		panic("Failed to obtain terminal settings: " + err.Error())
+		return fmt.Errorf("failed to obtain terminal settings: %w", err)
 	}
 	raw := *config.originalTermios
 	// IXON: disable flow control
@@ -259,28 +653,181 @@ func enableRawMode() {
 	raw.Cc[unix.VMIN] = 0
 	raw.Cc[unix.VTIME] = 1
 
-	unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, &raw)
+	if err := unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, &raw); err != nil {
+		return fmt.Errorf("failed to enable raw mode: %w", err)
+	}
+	return nil
 }
 
 // disableRawMode restores the terminal to its previous settings.
-func disableRawMode() {
+func disableRawMode() error {
+	if config.cursorShape != 0 {
+		// Back to the terminal's own cursor.
+		terminal.WriteString(cursorShapeSequence(cursorShapes["default"]))
+	}
+	// Pastes go back to looking like typing.
+	terminal.WriteString("\x1b[?2004l")
+	// Don't leave anything behind that was meant for raw mode.
+	terminal.Flush()
 	if err := unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, config.originalTermios); err != nil {
-		panic("Failed to restore terminal settings: " + err.Error())
+		return fmt.Errorf("failed to restore terminal settings: %w", err)
 	}
+	return nil
 }
 
+// Keypresses decoded by editorDecodeKeys arrive here.
+var keyEvents = make(chan int)
+
+// Set before keyEvents is closed, explaining why reading the terminal stopped.
+var keyEventsErr error
+
+// Receives a signal whenever the terminal window changes size.
+var resizeEvents = make(chan os.Signal, 1)
+
+// Ticks periodically so time-based parts of the screen, like the status message timeout, get redrawn.
+var tickEvents <-chan time.Time
+
+// Fires when the status bar should stop flashing.
+var flashEvents <-chan time.Time
+
+// Fires when the cursor has been on a word long enough to highlight it.
+var wordHighlightEvents <-chan time.Time
+
+// Fires when the next frame of a smooth scroll should be drawn.
+var scrollEvents <-chan time.Time
+
+// Where the result of a build running in the background arrives.
+// nil when there's no build running.
+var buildEvents <-chan buildResult
+
 // editorReadKey waits for and returns a single keypress from the terminal.
-func editorReadKey() (key int) {
-	var err error
+// While waiting, it keeps the screen up to date with resizes and timers.
+// If the terminal can't be read anymore, it returns Esc along with the error,
+// so any prompt backs out on the way to the main loop giving up.
+func editorReadKey() (int, error) {
+	if headless {
+		// Nobody to press anything. Escape backs out of prompts and overlays.
+		return ESC, nil
+	}
+	for {
+		select {
+		case key, ok := <-keyEvents:
+			if !ok {
+				return ESC, fmt.Errorf("failed to read from the terminal: %w", keyEventsErr)
+			}
+			switch key {
+			case UNKNOWN_SEQUENCE:
+				if config.stripControls {
+					// Most likely pasted along with some text. Leave it out.
+					continue
+				}
+				// It starts with an Esc, so take it as one.
+				key = ESC
+			case PASTE_START:
+				var err error
+				if pastedText, err = editorReadPaste(); err != nil {
+					return ESC, err
+				}
+			}
+			// Don't make them wait for a scroll to finish.
+			if scrollEvents != nil {
+				scrollEvents = nil
+				config.rowOffset = scrollTarget
+			}
+			return key, nil
+		case <-resizeEvents:
+			// If the new size can't be found, keep drawing at the old one.
+			if err := editorUpdateWindowSize(); err == nil {
+				editorRefreshScreen()
+			}
+		case <-tickEvents:
+			// Nothing else to do, so catch up on counting words for completion.
+			editorUpdateDictionary()
+			editorRefreshScreen()
+		case <-flashEvents:
+			flashEvents = nil
+			editorRefreshScreen()
+		case <-wordHighlightEvents:
+			wordHighlightEvents = nil
+			editorRefreshScreen()
+		case <-scrollEvents:
+			// Left set so the next frame knows a scroll is underway.
+			editorRefreshScreen()
+		case result := <-buildEvents:
+			editorBuildFinished(result)
+			editorRefreshScreen()
+		}
+	}
+}
+
+// The text of the last paste, set when editorReadKey returns PASTE_START.
+var pastedText string
+
+// Collect the pasted text that editorDecodeKeys sends after a PASTE_START.
+func editorReadPaste() (string, error) {
+	var text strings.Builder
+	for key := range keyEvents {
+		if key == PASTE_END {
+			return text.String(), nil
+		}
+		text.WriteRune(rune(key))
+	}
+	return "", fmt.Errorf("failed to read from the terminal: %w", keyEventsErr)
+}
+
+// editorDecodeKeys reads input until it fails, sending each decoded keypress to keys.
+// It's meant to run in its own goroutine so the editor isn't stuck waiting on the terminal.
+func editorDecodeKeys(input io.Reader, keys chan<- int) {
+	// Point a Reader at the input. It's shared across keypresses so nothing buffered is lost.
+	reader := bufio.NewReader(input)
+	for {
+		key, err := editorDecodeKey(reader)
+		if err != nil {
+			keyEventsErr = err
+			close(keys)
+			return
+		}
+		keys <- key
+		if key == PASTE_START {
+			if err := editorDecodePaste(reader, keys); err != nil {
+				keyEventsErr = err
+				close(keys)
+				return
+			}
+		}
+	}
+}
+
+// The terminal ends pasted text with this, after an Esc.
+const PASTE_END_SEQUENCE = "[201~"
+
+// Send each rune of pasted text to keys as it is, escapes and all, then PASTE_END.
+func editorDecodePaste(reader *bufio.Reader, keys chan<- int) error {
+	for {
+		char, _, err := reader.ReadRune()
+		if err != nil {
+			return err
+		}
+		if char == ESC {
+			if next, err := reader.Peek(len(PASTE_END_SEQUENCE)); err == nil && string(next) == PASTE_END_SEQUENCE {
+				reader.Discard(len(PASTE_END_SEQUENCE))
+				keys <- PASTE_END
+				return nil
+			}
+		}
+		keys <- int(char)
+	}
+}
+
+// editorDecodeKey waits for and returns a single keypress from the reader.
+func editorDecodeKey(reader *bufio.Reader) (key int, err error) {
 	var char rune
-	// Point a Reader at STDIN
-	reader := bufio.NewReader(os.Stdin)
 
 	for {
 		// Read a single character
 		char, _, err = reader.ReadRune()
 		if err != nil && err != io.EOF {
-			panic("Failed to read character from terminal: " + err.Error())
+			return 0, err
 		}
 		if char != '\u0000' {
 			break
@@ -294,11 +841,15 @@ func editorReadKey() (key int) {
 		// Read the next 2 bytes. If these fail, they probably typed <esc>
 		seq[0], _, err = reader.ReadRune()
 		if err != nil {
-			return ESC
+			return ESC, nil
+		}
+		if seq[0] != '[' && seq[0] != 'O' && unicode.IsPrint(seq[0]) {
+			// Terminals send Alt+<key> as <esc><key>
+			return ALT_KEY(seq[0]), nil
 		}
 		seq[1], _, err = reader.ReadRune()
 		if err != nil {
-			return ESC
+			return ESC, nil
 		}
 
 		if seq[0] == '[' {
@@ -307,57 +858,110 @@ func editorReadKey() (key int) {
 				seq[2], _, err = reader.ReadRune()
 				if err != nil {
 					// We don't recognize this sequence
-					return ESC
+					return ESC, nil
+				}
+				// Handle escape sequences with a modifier, like <esc>[1;2A for Shift+Up
+				if seq[2] == ';' {
+					modifier, _, err := reader.ReadRune()
+					if err != nil {
+						return ESC, nil
+					}
+					final, _, err := reader.ReadRune()
+					if err != nil {
+						return ESC, nil
+					}
+					key, ok := map[rune]int{'A': ARROW_UP, 'B': ARROW_DOWN, 'C': ARROW_RIGHT, 'D': ARROW_LEFT, 'H': HOME_KEY, 'F': END_KEY}[final]
+					if !ok {
+						skipControlSequence(reader, final)
+						return UNKNOWN_SEQUENCE, nil
+					}
+					switch {
+					case modifier == '2':
+						return shiftKey(key), nil
+					case modifier == '5' && key == ARROW_LEFT:
+						return CTRL_ARROW_LEFT, nil
+					case modifier == '5' && key == ARROW_RIGHT:
+						return CTRL_ARROW_RIGHT, nil
+					case modifier == '3' && key == ARROW_LEFT:
+						return ALT_ARROW_LEFT, nil
+					case modifier == '3' && key == ARROW_RIGHT:
+						return ALT_ARROW_RIGHT, nil
+					}
+					// Other modifiers aren't used, treat it as the plain key.
+					return key, nil
+				}
+				// Pasted text starts with <esc>[200~
+				if seq[1] == '2' && seq[2] == '0' {
+					if next, err := reader.Peek(2); err == nil && string(next) == "0~" {
+						reader.Discard(2)
+						return PASTE_START, nil
+					}
 				}
 				// Handle escape sequences like <esc>[5~
 				if seq[2] == '~' {
 					switch seq[1] {
 					case '1':
-						return HOME_KEY
+						return HOME_KEY, nil
 					case '3':
-						return DEL_KEY
+						return DEL_KEY, nil
 					case '4':
-						return END_KEY
+						return END_KEY, nil
 					case '5':
-						return PAGE_UP
+						return PAGE_UP, nil
 					case '6':
-						return PAGE_DOWN
+						return PAGE_DOWN, nil
 					case '7':
-						return HOME_KEY
+						return HOME_KEY, nil
 					case '8':
-						return END_KEY
+						return END_KEY, nil
 					}
 				}
+				skipControlSequence(reader, seq[2])
 			} else {
 				// Handle escape sequences like <esc>[A
 				switch seq[1] {
 				case 'A':
-					return ARROW_UP
+					return ARROW_UP, nil
 				case 'B':
-					return ARROW_DOWN
+					return ARROW_DOWN, nil
 				case 'C':
-					return ARROW_RIGHT
+					return ARROW_RIGHT, nil
 				case 'D':
-					return ARROW_LEFT
+					return ARROW_LEFT, nil
 				case 'H':
-					return HOME_KEY
+					return HOME_KEY, nil
 				case 'F':
-					return END_KEY
+					return END_KEY, nil
 				}
+				skipControlSequence(reader, seq[1])
 			}
+			return UNKNOWN_SEQUENCE, nil
 		} else if seq[0] == 'O' {
 			// Handle escape sequences like <esc>OH
 			switch seq[1] {
 			case 'H':
-				return HOME_KEY
+				return HOME_KEY, nil
 			case 'F':
-				return END_KEY
+				return END_KEY, nil
+			case 'P':
+				return F1_KEY, nil
 			}
 		}
 		// We don't recognize this sequence
-		return ESC
+		return ESC, nil
 	} else {
-		return int(char)
+		return int(char), nil
+	}
+}
+
+// Read the rest of a control sequence, so none of it is taken as typed text.
+// last is the last rune of it read so far. Everything before the final rune is a digit or punctuation.
+func skipControlSequence(reader *bufio.Reader, last rune) {
+	for last >= ' ' && last <= '?' {
+		var err error
+		if last, _, err = reader.ReadRune(); err != nil {
+			return
+		}
 	}
 }
 
@@ -376,7 +980,7 @@ func getCursorPosition() (row int, col int, err error) {
 			if err == io.EOF {
 				break
 			}
-			panic("Failed to read character from terminal: " + err.Error())
+			return 0, 0, fmt.Errorf("failed to read cursor position: %w", err)
 		}
 
 		buf[i] = char
@@ -404,21 +1008,21 @@ func getCursorPosition() (row int, col int, err error) {
 }
 
 // getWindowSize uses low-level terminal requests to obtain the window size.
-func getWindowSize() (row int, col int) {
+func getWindowSize() (row int, col int, err error) {
 	winSize, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
 	if err != nil || winSize.Col == 0 {
 		// As a fallback, shove the cursor in the bottom-right corner and record the cursor position.
 		fmt.Print("\x1b[999C\x1b[999B")
 		row, col, err = getCursorPosition()
 		if err != nil {
-			panic("Failed to obtain cursor position: " + err.Error())
+			return 0, 0, fmt.Errorf("failed to obtain window size: %w", err)
 		}
 	} else {
 		row = int(winSize.Row)
 		col = int(winSize.Col)
 	}
 
-	return row, col
+	return row, col, nil
 }
 
 // ==========================================
@@ -437,13 +1041,49 @@ func editorSyntaxToColor(syntax uint8) int {
 	}
 }
 
-// Apply syntax highlighting to row
-func editorUpdateSyntax(row *editorRow) {
-	row.highlights = make([]uint8, len(row.render))
+// Apply syntax highlighting to row, and to the rows after it if their highlighting depends on it.
+func editorUpdateSyntax(e *editorConfig, row *editorRow) {
+	// A single line edit could toggle a multiline comment change, so we'll
+	// need to redo the syntax in rows after the current one.
+	// But, we only need to do that until the comment status stops changing,
+	// everything past that point is the same as on the previous paint loop.
+	// Rows that haven't been rendered yet will pick up the change when they are.
+	for editorHighlightRow(e, row) && row.id+1 < e.numrows {
+		row = &e.rows[row.id+1]
+		if row.stale {
+			// A paged out row can't pick up the change from the row above
+			// when it's read back in, so its state has to be worked out again.
+			if row.unloaded {
+				e.pagedSyntaxRows = MIN(e.pagedSyntaxRows, row.id)
+			}
+			break
+		}
+	}
+}
+
+// Apply syntax highlighting to a single row.
+// Returns whether the row's open comment status changed.
+func editorHighlightRow(e *editorConfig, row *editorRow) (changed bool) {
+	// Escaped characters are marked last so nothing else paints over them.
+	// Overflow is added on top of whatever a character ends up with.
+	defer editorHighlightOverflow(e, row)
+	defer editorHighlightEscapes(e, row)
+	defer editorHighlightTrailing(e, row)
+	defer editorHighlightMisspelled(e, row)
+
+	// Reuse the existing highlight storage when it's big enough.
+	if cap(row.highlights) >= len(row.render) {
+		row.highlights = row.highlights[:len(row.render)]
+		for i := range row.highlights {
+			row.highlights[i] = HL_NORMAL
+		}
+	} else {
+		row.highlights = make([]uint8, len(row.render))
+	}
 
-	if config.syntax == nil {
+	if e.syntax == nil {
 		// we don't have a highlight rules for this file type
-		return
+		return false
 	}
 
 	// For smarter highlight behavior, track separators in the row
@@ -451,11 +1091,11 @@ func editorUpdateSyntax(row *editorRow) {
 	// Track if we are in a string
 	var inStringChar rune
 	// Tracks if we are in comment
-	inComment := row.id > 0 && config.rows[row.id-1].isOpenComment
+	inComment := row.id > 0 && e.rows[row.id-1].isOpenComment
 
-	singleCommentStartLen := len(config.syntax.singleCommentStart)
-	multiCommentStartLen := len(config.syntax.multiCommentStart)
-	multiCommentEndLen := len(config.syntax.multiCommentEnd)
+	singleCommentStartLen := len(e.syntax.singleCommentStart)
+	multiCommentStartLen := len(e.syntax.multiCommentStart)
+	multiCommentEndLen := len(e.syntax.multiCommentEnd)
 
 	// Apply highlight rules in priority-order
 	for i := 0; i < row.RLen(); i++ {
@@ -469,7 +1109,7 @@ func editorUpdateSyntax(row *editorRow) {
 		// set the rest of the row highlight accordingly
 		if singleCommentStartLen > 0 && inStringChar == 0 && !inComment {
 			offset := i + singleCommentStartLen
-			if offset < row.RLen() && config.syntax.singleCommentStart == string(row.render[i:offset]) {
+			if offset < row.RLen() && e.syntax.singleCommentStart == string(row.render[i:offset]) {
 				for j := i; j < row.RLen(); j++ {
 					row.highlights[j] = HL_COMMENT
 				}
@@ -481,7 +1121,7 @@ func editorUpdateSyntax(row *editorRow) {
 			if inComment {
 				row.highlights[i] = HL_MLCOMMENT
 				offset := i + multiCommentEndLen
-				if offset < row.RLen() && config.syntax.multiCommentEnd == string(row.render[i:offset]) {
+				if offset < row.RLen() && e.syntax.multiCommentEnd == string(row.render[i:offset]) {
 					for j := i; j < multiCommentEndLen; j++ {
 						row.highlights[j] = HL_MLCOMMENT
 					}
@@ -492,7 +1132,7 @@ func editorUpdateSyntax(row *editorRow) {
 				} else {
 					continue
 				}
-			} else if offset := i + multiCommentStartLen; offset < row.RLen() && config.syntax.multiCommentStart == string(row.render[i:offset]) {
+			} else if offset := i + multiCommentStartLen; offset < row.RLen() && e.syntax.multiCommentStart == string(row.render[i:offset]) {
 				for j := i; j < multiCommentStartLen; j++ {
 					row.highlights[j] = HL_MLCOMMENT
 				}
@@ -502,7 +1142,7 @@ func editorUpdateSyntax(row *editorRow) {
 			}
 		}
 
-		if config.syntax.flags&HL_HIGHLIGHT_STRINGS > 0 {
+		if e.syntax.flags&HL_HIGHLIGHT_STRINGS > 0 {
 			if inStringChar > 0 {
 				row.highlights[i] = HL_STRING
 				if char == '\\' && i+1 < row.RLen() {
@@ -524,7 +1164,7 @@ func editorUpdateSyntax(row *editorRow) {
 			}
 		}
 
-		if config.syntax.flags&HL_HIGHLIGHT_NUMBERS > 0 {
+		if e.syntax.flags&HL_HIGHLIGHT_NUMBERS > 0 {
 			if (unicode.IsDigit(char) && (prevCharWasSeparator || prevCharHighlight == HL_NUMBER)) ||
 				(char == '.' && prevCharHighlight == HL_NUMBER) {
 				row.highlights[i] = HL_NUMBER
@@ -532,7 +1172,7 @@ func editorUpdateSyntax(row *editorRow) {
 			}
 		}
 
-		for keywordClass, keywords := range config.syntax.keywords {
+		for keywordClass, keywords := range e.syntax.keywords {
 			for _, keyword := range keywords {
 				offset := i + len(keyword)
 				if offset < row.RLen() && keyword == string(row.render[i:offset]) {
@@ -552,17 +1192,147 @@ func editorUpdateSyntax(row *editorRow) {
 		prevCharWasSeparator = isSeparator(char)
 	}
 
-	// Record if the comment status changed
-	changed := row.isOpenComment != inComment
+	if len(e.todoKeywords) > 0 {
+		editorHighlightTodos(e, row)
+	}
+
+	// Record if the comment or bracket status changed
+	changed = row.isOpenComment != inComment
+	if e.rainbowBrackets && editorHighlightBrackets(e, row) {
+		changed = true
+	}
 	// Update row's comment status
 	row.isOpenComment = inComment
 
-	// A single line edit could toggle a multiline comment change, so we'll
-	// need to redo all the syntax in rows after the current one.
-	// But, we only need to do that when comment status changes, otherwise
-	// we did it on the previous paint loop.
-	if changed && row.id+1 < config.numrows {
-		editorUpdateSyntax(&config.rows[row.id+1])
+	return changed
+}
+
+// Color brackets outside of strings and comments by how deeply they're nested.
+// Returns true if the number still open at the end of the row changed.
+func editorHighlightBrackets(e *editorConfig, row *editorRow) (changed bool) {
+	depth := 0
+	if row.id > 0 {
+		depth = e.rows[row.id-1].bracketDepth
+	}
+	for i, char := range row.render {
+		switch row.highlights[i] {
+		case HL_STRING, HL_COMMENT, HL_MLCOMMENT:
+			continue
+		}
+		switch char {
+		case '(', '[', '{':
+			row.highlights[i] = HL_BRACKET1 + uint8(depth%3)
+			depth++
+		case ')', ']', '}':
+			depth = MAX(depth-1, 0)
+			row.highlights[i] = HL_BRACKET1 + uint8(depth%3)
+		}
+	}
+	changed = row.bracketDepth != depth
+	row.bracketDepth = depth
+	return changed
+}
+
+// Mark the whitespace at the end of the row.
+func editorHighlightTrailing(e *editorConfig, row *editorRow) {
+	if !e.highlightTrailing {
+		return
+	}
+	// Leave the NUL at the end alone.
+	for i := row.RLen() - 2; i >= 0 && (row.render[i] == ' ' || row.render[i] == '\t'); i-- {
+		row.highlights[i] = HL_TRAILING
+	}
+}
+
+// Where a row's render goes past the maximum line length, counting the columns
+// each character takes up on screen. -1 if it doesn't, or there's no maximum.
+func editorOverflowStart(e *editorConfig, row *editorRow) int {
+	if e.maxLineLength <= 0 {
+		return -1
+	}
+	cols := 0
+	// Leave the NUL at the end alone.
+	for i := 0; i < row.RLen()-1; i++ {
+		cols += runeWidth(row.render[i])
+		if cols > e.maxLineLength {
+			return i
+		}
+	}
+	return -1
+}
+
+// Mark the part of a row past the maximum line length, if there is one.
+func editorHighlightOverflow(e *editorConfig, row *editorRow) {
+	from := editorOverflowStart(e, row)
+	if from < 0 {
+		return
+	}
+	// Leave the NUL at the end alone.
+	for i := from; i < row.RLen()-1; i++ {
+		row.highlights[i] |= HL_OVERFLOW
+	}
+}
+
+// Characters that take up two columns in a terminal, mostly East Asian scripts and emoji.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F}, {0x2E80, 0x303E}, {0x3041, 0x33FF}, {0x3400, 0x4DBF},
+	{0x4E00, 0x9FFF}, {0xA000, 0xA4CF}, {0xAC00, 0xD7A3}, {0xF900, 0xFAFF},
+	{0xFE30, 0xFE4F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6}, {0x1F300, 0x1F64F},
+	{0x1F900, 0x1F9FF}, {0x20000, 0x3FFFD},
+}
+
+// How many columns a character takes up on screen.
+func runeWidth(char rune) int {
+	if unicode.In(char, unicode.Mn, unicode.Me) {
+		// Combining marks go on top of the character before them.
+		return 0
+	}
+	for _, r := range wideRanges {
+		if char >= r[0] && char <= r[1] {
+			return 2
+		}
+	}
+	return 1
+}
+
+// Mark words like TODO where they're in comments.
+func editorHighlightTodos(e *editorConfig, row *editorRow) {
+	isComment := func(i int) bool {
+		return row.highlights[i] == HL_COMMENT || row.highlights[i] == HL_MLCOMMENT
+	}
+	for i := 0; i < row.RLen(); i++ {
+		if !isComment(i) || (i > 0 && isWordChar(row.render[i-1])) {
+			continue
+		}
+		for _, keyword := range e.todoKeywords {
+			end := i + len([]rune(keyword))
+			if end > row.RLen() || string(row.render[i:end]) != keyword || (end < row.RLen() && isWordChar(row.render[end])) {
+				continue
+			}
+			for j := i; j < end && isComment(j); j++ {
+				row.highlights[j] = HL_TODO
+			}
+			i = end - 1
+			break
+		}
+	}
+}
+
+// Mark the parts of the render that stand in for characters that can't be shown.
+func editorHighlightEscapes(e *editorConfig, row *editorRow) {
+	rx, tab := 0, 0
+	for _, char := range row.content.Runes() {
+		if char == '\t' {
+			rx += editorTabWidth(e, row, tab, rx)
+			tab++
+		} else if escape := editorRenderEscape(char); escape != nil {
+			for j := rx; j < rx+len(escape); j++ {
+				row.highlights[j] = HL_ESCAPE
+			}
+			rx += len(escape)
+		} else {
+			rx++
+		}
 	}
 }
 
@@ -573,53 +1343,168 @@ func editorSelectSyntaxHighlight() {
 		return
 	}
 
-	_, fileExt, foundFileExt := strings.Cut(config.filename, ".")
+	fileExt := filepath.Ext(config.filename)
 	for _, supportedSyntax := range highlightDB {
 		for _, fileType := range supportedSyntax.associatedFileTypes {
 			isExtPattern := fileType[0] == '.'
-			if isExtPattern && foundFileExt && "."+fileExt == fileType ||
+			if isExtPattern && fileExt == fileType ||
 				(!isExtPattern && strings.Contains(config.filename, fileType)) {
 				config.syntax = &supportedSyntax
 
 				// Apply a possibly fresh syntax to the editor.
-				for i := range config.rows {
-					editorUpdateSyntax(&config.rows[i])
-				}
+				editorRehighlightRows()
 				return
 			}
 		}
 	}
 }
 
+// ==========================================
+// =============== Gap Buffer ===============
+// ==========================================
+
+// The initial size of the gap, and how much it grows by when it fills up.
+const GAP_BUFFER_MIN_GAP = 16
+
+// gapBuffer holds a run of text with an empty "gap" at the last edit point.
+// Inserting or deleting at the gap is cheap. Moving the gap somewhere else costs
+// only the distance moved, so typing never has to shift the rest of the text.
+type gapBuffer struct {
+	buf []rune
+	// The gap is buf[gapStart:gapEnd]
+	gapStart, gapEnd int
+}
+
+func newGapBuffer(text []rune) gapBuffer {
+	buf := make([]rune, len(text)+GAP_BUFFER_MIN_GAP)
+	copy(buf, text)
+	return gapBuffer{buf: buf, gapStart: len(text), gapEnd: len(buf)}
+}
+
+// The number of runes of text, not counting the gap.
+func (g *gapBuffer) Len() int {
+	return len(g.buf) - (g.gapEnd - g.gapStart)
+}
+
+// Relocate the gap so it starts at the given text index.
+func (g *gapBuffer) moveGap(at int) {
+	if at < g.gapStart {
+		// Shift the text between at and the gap to the right side of the gap.
+		n := g.gapStart - at
+		copy(g.buf[g.gapEnd-n:g.gapEnd], g.buf[at:g.gapStart])
+		g.gapStart -= n
+		g.gapEnd -= n
+	} else if at > g.gapStart {
+		// Shift the text after the gap to the left side of it.
+		n := at - g.gapStart
+		copy(g.buf[g.gapStart:g.gapStart+n], g.buf[g.gapEnd:g.gapEnd+n])
+		g.gapStart += n
+		g.gapEnd += n
+	}
+}
+
+// Make sure the gap can hold at least n more runes.
+func (g *gapBuffer) grow(n int) {
+	if g.gapEnd-g.gapStart >= n {
+		return
+	}
+	// Double in size so repeated inserts are amortized.
+	newSize := MAX(2*len(g.buf), len(g.buf)+n+GAP_BUFFER_MIN_GAP)
+	buf := make([]rune, newSize)
+	copy(buf, g.buf[:g.gapStart])
+	tail := len(g.buf) - g.gapEnd
+	copy(buf[newSize-tail:], g.buf[g.gapEnd:])
+	g.gapEnd = newSize - tail
+	g.buf = buf
+}
+
+// Insert runes at the given text index.
+func (g *gapBuffer) Insert(at int, runes ...rune) {
+	g.grow(len(runes))
+	g.moveGap(at)
+	copy(g.buf[g.gapStart:], runes)
+	g.gapStart += len(runes)
+}
+
+// Remove n runes starting at the given text index.
+func (g *gapBuffer) Delete(at, n int) {
+	g.moveGap(at)
+	g.gapEnd += n
+}
+
+// Drop everything from the given text index to the end.
+func (g *gapBuffer) Truncate(at int) {
+	g.Delete(at, g.Len()-at)
+}
+
+// The rune at text index i.
+func (g *gapBuffer) At(i int) rune {
+	if i < g.gapStart {
+		return g.buf[i]
+	}
+	return g.buf[i+g.gapEnd-g.gapStart]
+}
+
+// Copy of the text between the from and to indexes.
+func (g *gapBuffer) Slice(from, to int) []rune {
+	result := make([]rune, 0, to-from)
+	if from < g.gapStart {
+		result = append(result, g.buf[from:MIN(to, g.gapStart)]...)
+	}
+	if to > g.gapStart {
+		gapLen := g.gapEnd - g.gapStart
+		result = append(result, g.buf[MAX(from, g.gapStart)+gapLen:to+gapLen]...)
+	}
+	return result
+}
+
+// Copy of all the text.
+func (g *gapBuffer) Runes() []rune {
+	return g.Slice(0, g.Len())
+}
+
+// The raw bytes of the text, including any bytes that weren't valid UTF-8.
+func (g *gapBuffer) String() string {
+	return encodeLine(g.Runes())
+}
+
 // ==========================================
 // ============ Row Operations ==============
 // ==========================================
 
 // Convert content x-coord to render x-coord.
 // Basically, deal with tabs.
-func editorRowCxToRx(row *editorRow, cx int) int {
+func editorRowCxToRx(e *editorConfig, row *editorRow, cx int) int {
 	// Copy cx coordinates to rx, unless a tab is encountered.
 	// Then, increment rx by the tab's width.
-	rx := 0
-	for _, char := range row.content[:cx] {
+	rx, tab := 0, 0
+	for i := 0; i < cx; i++ {
+		char := row.content.At(i)
 		if char == '\t' {
-			// '\t' already consumes 1 space, so TAB_STOP - 1 is the total amount of tabs
-			// Then, subtract off the amount of space already consumed in the TAB_STOP.
-			rx += (KILO_TAB_STOP - 1) - (rx % KILO_TAB_STOP)
+			// '\t' already consumes 1 space, the rest of its width is added.
+			rx += editorTabWidth(e, row, tab, rx) - 1
+			tab++
+		} else if escape := editorRenderEscape(char); escape != nil {
+			// Escaped characters take up more than one column.
+			rx += len(escape) - 1
 		}
 		rx++
 	}
 	return rx
 }
 
-func editorRowRxToCx(row *editorRow, rx int) int {
+func editorRowRxToCx(e *editorConfig, row *editorRow, rx int) int {
 	cx := 0
 	currentRx := 0
-	for _, char := range row.content {
+	tab := 0
+	for i := 0; i < row.Len(); i++ {
+		char := row.content.At(i)
 		if char == '\t' {
-			// '\t' already consumes 1 space, so TAB_STOP - 1 is the total amount of tabs
-			// Then, subtract off the amount of space already consumed in the TAB_STOP.
-			currentRx += (KILO_TAB_STOP - 1) - (currentRx % KILO_TAB_STOP)
+			// '\t' already consumes 1 space, the rest of its width is added.
+			currentRx += editorTabWidth(e, row, tab, currentRx) - 1
+			tab++
+		} else if escape := editorRenderEscape(char); escape != nil {
+			currentRx += len(escape) - 1
 		}
 		currentRx++
 
@@ -633,760 +1518,6502 @@ func editorRowRxToCx(row *editorRow, rx int) int {
 }
 
 // Fully render a row's content.
-func editorUpdateRow(row *editorRow) {
-	tabs := 0
-	// Count how many tabs are in the row.
-	for _, char := range row.content {
-		if char == '\t' {
-			tabs++
-		}
+func editorUpdateRow(e *editorConfig, row *editorRow) {
+	if e.elasticTabs && !row.tabsLaidOut {
+		editorLayoutTabs(e, row.id)
 	}
-
-	// Allocate max space for the render, which is the content + expanded tabs.
-	row.render = make([]rune, len(row.content)+(tabs*(KILO_TAB_STOP-1))+1)
-	idx := 0
-	// Copy content to render, replacing tabs with spaces.
-	for _, char := range row.content {
+	// Reuse the previous render's storage.
+	row.render = row.render[:0]
+	// Copy content to render, replacing tabs with spaces and
+	// characters that can't be shown with their escapes.
+	tab := 0
+	for i := 0; i < row.Len(); i++ {
+		char := row.content.At(i)
 		if char == '\t' {
-			row.render[idx] = ' '
-			idx++
-			for ; idx%KILO_TAB_STOP != 0; idx++ {
-				row.render[idx] = ' '
+			for width := editorTabWidth(e, row, tab, len(row.render)); width > 0; width-- {
+				row.render = append(row.render, ' ')
 			}
+			tab++
+		} else if escape := editorRenderEscape(char); escape != nil {
+			row.render = append(row.render, escape...)
 		} else {
-			row.render[idx] = char
-			idx++
+			row.render = append(row.render, char)
 		}
 	}
-	row.render[idx] = '\x00'
+	row.render = append(row.render, '\x00')
 
-	editorUpdateSyntax(row)
+	editorUpdateSyntax(e, row)
+	row.stale = false
 }
 
-// Add a new row to global editor rows, ensuring to render it too.
-func editorInsertRow(at int, rowContent string) {
-	if at < 0 || at > config.numrows {
-		return
+// How many columns the tab-th tab in row takes up, starting at render column rx.
+func editorTabWidth(e *editorConfig, row *editorRow, tab, rx int) int {
+	if e.elasticTabs && !row.tabsLaidOut {
+		// Edited since it was last rendered.
+		editorLayoutTabs(e, row.id)
 	}
+	if e.elasticTabs && tab < len(row.tabStops) {
+		return MAX(row.tabStops[tab]-rx, 1)
+	}
+	return e.tabStop - (rx % e.tabStop)
+}
 
-	config.rows = slices.Insert(config.rows, at, editorRow{content: rowContent})
-
-	for i := at; i < config.numrows-1; i++ {
-		config.rows[i].id++
+// Work out elastic tabstops for the block of rows with tabs around row at.
+// The text between tabs is a cell, and the cells in the same column of
+// adjacent rows line up, as wide as the widest plus some padding.
+// Rows whose tabs moved are rendered again.
+func editorLayoutTabs(e *editorConfig, at int) {
+	hasTabs := func(i int) bool {
+		return !e.rows[i].unloaded && slices.Contains(e.rows[i].content.Runes(), '\t')
+	}
+	start, end := at, at+1
+	for start > 0 && hasTabs(start-1) {
+		start--
+	}
+	for end < e.numrows && hasTabs(end) {
+		end++
 	}
 
-	config.rows[at].id = at
+	// The width of every cell that ends with a tab.
+	cells := make([][]int, end-start)
+	for i := range cells {
+		width := 0
+		for _, char := range e.rows[start+i].content.Runes() {
+			if char == '\t' {
+				cells[i] = append(cells[i], width)
+				width = 0
+			} else if escape := editorRenderEscape(char); escape != nil {
+				width += len(escape)
+			} else {
+				width++
+			}
+		}
+	}
+	stops := make([][]int, len(cells))
+	for i := range cells {
+		stops[i] = make([]int, len(cells[i]))
+	}
+	// Each run of adjacent rows that reach a column is lined up together.
+	for col, more := 0, true; more; col++ {
+		more = false
+		for i := 0; i < len(cells); {
+			if len(cells[i]) <= col {
+				i++
+				continue
+			}
+			more = true
+			j, width := i, e.tabStop
+			for ; j < len(cells) && len(cells[j]) > col; j++ {
+				width = MAX(width, cells[j][col]+KILO_ELASTIC_PADDING)
+			}
+			for ; i < j; i++ {
+				stops[i][col] = width
+				if col > 0 {
+					stops[i][col] += stops[i][col-1]
+				}
+			}
+		}
+	}
 
-	editorUpdateRow(&config.rows[config.numrows])
-	config.numrows++
-	config.dirty = true
+	for i := range cells {
+		row := &e.rows[start+i]
+		if !slices.Equal(row.tabStops, stops[i]) {
+			row.tabStops = stops[i]
+			row.stale = true
+		}
+		row.tabsLaidOut = true
+	}
 }
 
-// Insert a single character into row at the given index.
-func editorRowInsertChar(row *editorRow, at int, char rune) {
-	// Only allow inserts in a valid location.
-	if at < 0 || at > row.Len() {
-		at = row.Len()
+// Lay out tabs around row at again, after rows next to it were added or removed.
+func editorInvalidateTabs(e *editorConfig, at int) {
+	if e.elasticTabs && at >= 0 && at < e.numrows {
+		e.rows[at].tabsLaidOut = false
+		e.rows[at].stale = true
 	}
-	// Insert the character and re-render the row.
-	row.content = string(slices.Insert([]rune(row.content), at, char))
-	editorUpdateRow(row)
-	config.dirty = true
 }
 
-// Append a string to the end of a row
-func editorRowAppendString(row *editorRow, s string) {
-	row.content += s
-	editorUpdateRow(row)
-	config.dirty = true
+// Make sure every row up to and including the given index has a fresh render.
+// Highlighting depends on the rows above, so they are brought up to date in order.
+func editorRenderRowsThrough(at int) {
+	at = MIN(at, config.numrows-1)
+	start := 0
+	if config.pagedFile != nil {
+		// Rows far above the screen aren't kept in memory. They're only read
+		// to find out if a multi-line comment is still open at their end.
+		start = MAX(0, config.rowOffset-KILO_PAGED_WINDOW)
+		editorCarrySyntaxThrough(start)
+	}
+	if config.elasticTabs {
+		// An edit can move the tabs of the rows above it, which then have to be
+		// rendered again too, so tabs are laid out before rendering anything.
+		for i := start; i <= at; i++ {
+			if !config.rows[i].unloaded && !config.rows[i].tabsLaidOut {
+				editorLayoutTabs(&config, i)
+			}
+		}
+	}
+	for i := start; i <= at; i++ {
+		if config.rows[i].unloaded {
+			editorPageInRow(&config.rows[i])
+		}
+		if config.rows[i].stale {
+			editorUpdateRow(&config, &config.rows[i])
+		}
+	}
 }
 
-// Remove a single character from row at the given index.
-func editorRowDelChar(row *editorRow, at int) {
-	// Don't delete from invalid locations.
-	if at < 0 || at > row.Len() {
+// Work out the comment state at the end of every row above the given index,
+// reading rows that aren't in memory from disk without keeping them.
+func editorCarrySyntaxThrough(end int) {
+	if config.syntax == nil {
 		return
 	}
-
-	// Delete character and re-render the row.
-	row.content = string(slices.Delete([]rune(row.content), at, at+1))
-	editorUpdateRow(row)
-	config.dirty = true
-}
+	for i := config.pagedSyntaxRows; i < end; i++ {
+		row := &config.rows[i]
+		if !row.unloaded {
+			if row.stale {
+				editorUpdateRow(&config, row)
+			}
+			continue
+		}
+		editorPageInRow(row)
+		editorUpdateRow(&config, row)
+		editorPageOutRow(row)
+	}
+	config.pagedSyntaxRows = MAX(config.pagedSyntaxRows, end)
+}
+
+// How a character that can't be shown as itself appears in the render.
+// Returns nil for characters that are displayed normally.
+func editorRenderEscape(char rune) []rune {
+	if b, ok := rawByte(char); ok {
+		// A byte that wasn't valid UTF-8, show its value.
+		return []rune(fmt.Sprintf("\\x%02X", b))
+	}
+	if char == '\t' || !unicode.IsControl(char) {
+		return nil
+	}
+	if char < ' ' || char == '\x7f' {
+		// Caret notation, where ^A is 0x01 and ^? is DEL.
+		return []rune{'^', char ^ 0x40}
+	}
+	return []rune(fmt.Sprintf("\\u%04X", char))
+}
+
+// Add a new row to global editor rows, ensuring to render it too.
+func editorInsertRow(e *editorConfig, at int, rowContent string) {
+	if at < 0 || at > e.numrows {
+		return
+	}
+
+	editorRecordUndo(e, at, 1, nil)
+	// The row is rendered when it's first needed.
+	row := editorRow{id: at, content: newGapBuffer(decodeLine(rowContent)), stale: true, offset: -1, change: CHANGE_ADDED}
+	if at == len(e.rows) {
+		// Append leaves room to grow, so reading a file in row by row isn't quadratic.
+		e.rows = append(e.rows, row)
+	} else {
+		e.rows = slices.Insert(e.rows, at, row)
+	}
+	e.numrows++
+	e.edits++
+	e.pagedSyntaxRows = MIN(e.pagedSyntaxRows, at)
+	editorShiftMarks(e, at, 1)
+
+	// Every row after the new one moved down a spot.
+	for i := at + 1; i < e.numrows; i++ {
+		e.rows[i].id++
+	}
+
+	e.dirty = true
+}
+
+// Insert a single character into row at the given index.
+func editorRowInsertChar(e *editorConfig, row *editorRow, at int, char rune) {
+	// Only allow inserts in a valid location.
+	if at < 0 || at > row.Len() {
+		at = row.Len()
+	}
+	editorRecordRowUndo(e, row)
+	row.content.Insert(at, char)
+	row.offset = -1
+	editorMarkModified(e, row)
+	e.dirty = true
+}
+
+// Append a string to the end of a row
+func editorRowAppendString(e *editorConfig, row *editorRow, s string) {
+	editorRecordRowUndo(e, row)
+	row.content.Insert(row.Len(), decodeLine(s)...)
+	row.offset = -1
+	editorMarkModified(e, row)
+	e.dirty = true
+}
+
+// Remove a single character from row at the given index.
+func editorRowDelChar(e *editorConfig, row *editorRow, at int) {
+	// Don't delete from invalid locations.
+	if at < 0 || at >= row.Len() {
+		return
+	}
+
+	editorRecordRowUndo(e, row)
+	row.content.Delete(at, 1)
+	row.offset = -1
+	editorMarkModified(e, row)
+	e.dirty = true
+}
+
+// Replace n characters of row, starting at the given index, with runes.
+func editorRowReplace(e *editorConfig, row *editorRow, at, n int, runes []rune) {
+	editorRecordRowUndo(e, row)
+	row.content.Delete(at, n)
+	row.content.Insert(at, runes...)
+	row.offset = -1
+	editorMarkModified(e, row)
+	e.dirty = true
+}
+
+// Note that row has changed since the last save.
+// It's rendered again when it's next needed, so a run of edits only renders it once.
+func editorMarkModified(e *editorConfig, row *editorRow) {
+	e.edits++
+	row.stale = true
+	e.pagedSyntaxRows = MIN(e.pagedSyntaxRows, row.id)
+	row.tabsLaidOut = false
+	editorUncountWords(row)
+	if row.change != CHANGE_ADDED {
+		row.change = CHANGE_MODIFIED
+	}
+}
 
 // Remove an entire row
-func editorDelRow(at int) {
-	if at < 0 || at >= config.numrows {
+func editorDelRow(e *editorConfig, at int) {
+	if at < 0 || at >= e.numrows {
 		// nothing to delete
 		return
 	}
-	slices.Delete(config.rows, at, at+1)
+	editorRecordUndo(e, at, 0, []string{encodeLine(e.rows[at].content.Runes())})
+	editorUncountWords(&e.rows[at])
+	e.rows = slices.Delete(e.rows, at, at+1)
+	e.edits++
+	e.pagedSyntaxRows = MIN(e.pagedSyntaxRows, at)
+	editorShiftMarks(e, at+1, -1)
+	if at < len(e.rows) && e.rows[at].change == CHANGE_NONE {
+		e.rows[at].change = CHANGE_DELETED
+	}
 
-	for ; at < config.numrows-1; at++ {
-		config.rows[at].id--
+	for i := at; i < e.numrows-1; i++ {
+		e.rows[i].id--
 	}
 
-	config.numrows--
-	config.dirty = true
+	e.numrows--
+	editorInvalidateTabs(e, MIN(at, e.numrows-1))
+	e.dirty = true
 }
 
 // ==========================================
 // ========== Editor Operations =============
 // ==========================================
 
-func editorInsertChar(char rune) {
-	if config.cy == config.numrows {
-		// Cursor on tilde lin after end of file, so we need a new row.
-		editorInsertRow(config.numrows, "")
+// Brackets and quotes that are closed automatically when auto_pair is on.
+var autoPairs = map[rune]rune{
+	'(':  ')',
+	'[':  ']',
+	'{':  '}',
+	'"':  '"',
+	'\'': '\'',
+	'`':  '`',
+}
+
+func editorInsertChar(e *editorConfig, char rune) {
+	if e.cy == e.numrows {
+		if e.growAtEOF || e.numrows == 0 {
+			// Cursor on tilde lin after end of file, so we need a new row.
+			editorInsertRow(e, e.numrows, "")
+		} else {
+			// Type at the end of the last line instead.
+			e.cy--
+			e.cx = e.rows[e.cy].Len()
+		}
+	}
+	row := &e.rows[e.cy]
+	if !isWordChar(char) {
+		editorExpandAbbreviation(e, row)
+	}
+	if char == '\t' && e.softTabs {
+		// Indent with spaces instead.
+		n := e.indentSize - editorRowCxToRx(e, row, e.cx)%e.indentSize
+		editorRowReplace(e, row, e.cx, 0, []rune(strings.Repeat(" ", n)))
+		e.cx += n
+		return
+	}
+	if e.autoPair && editorAutoPair(e, row, char) {
+		return
+	}
+	editorRowInsertChar(e, row, e.cx, char)
+	e.cx++
+}
+
+// Words that are replaced as soon as they're typed, like "teh" with "the".
+var abbreviations = map[string]string{}
+
+// Add an abbreviation from the rc file. It must be a single word.
+func editorAddAbbreviation(word, replacement string) error {
+	if len(word) == 0 || strings.IndexFunc(word, func(char rune) bool { return !isWordChar(char) }) >= 0 {
+		return fmt.Errorf("abbreviation must be a single word, got %q", word)
+	}
+	abbreviations[word] = replacement
+	return nil
+}
+
+// Replace the word just before the cursor if it's an abbreviation.
+func editorExpandAbbreviation(e *editorConfig, row *editorRow) {
+	if len(abbreviations) == 0 {
+		return
+	}
+	start := e.cx
+	for start > 0 && isWordChar(row.content.At(start-1)) {
+		start--
+	}
+	expansion, ok := abbreviations[encodeLine(row.content.Slice(start, e.cx))]
+	if start == e.cx || !ok {
+		return
+	}
+	runes := decodeLine(expansion)
+	editorRowReplace(e, row, start, e.cx-start, runes)
+	e.cx = start + len(runes)
+}
+
+// Handle typing a bracket or quote when auto-pairing is on.
+// Returns false if the character should be inserted normally.
+func editorAutoPair(e *editorConfig, row *editorRow, char rune) bool {
+	var next, prev rune
+	if e.cx < row.Len() {
+		next = row.content.At(e.cx)
+	}
+	if e.cx > 0 {
+		prev = row.content.At(e.cx - 1)
+	}
+
+	isCloser := false
+	for _, closer := range autoPairs {
+		isCloser = isCloser || closer == char
+	}
+	if isCloser && next == char {
+		// It's already there, step over it.
+		e.cx++
+		return true
+	}
+
+	closer, isOpener := autoPairs[char]
+	if !isOpener || (closer == char && isWordChar(prev)) {
+		// Quotes after a word are probably apostrophes, like in don't.
+		return false
 	}
-	editorRowInsertChar(&config.rows[config.cy], config.cx, char)
-	config.cx++
+	editorRowReplace(e, row, e.cx, 0, []rune{char, closer})
+	e.cx++
+	return true
 }
 
 // Insert a newline when Enter is pressed
-func editorInsertNewline() {
-	if config.cx == 0 {
+func editorInsertNewline(e *editorConfig) {
+	if e.cy < e.numrows {
+		editorExpandAbbreviation(e, &e.rows[e.cy])
+	}
+	if e.cx == 0 {
 		// We're at the beginning of a line, so insert a new blank row
-		editorInsertRow(config.cy, "")
+		editorInsertRow(e, e.cy, "")
 	} else {
 		// In the middle of a line, we need to split it
-		rowContent := config.rows[config.cy].content[config.cx:]
+		row := &e.rows[e.cy]
+		rowContent := encodeLine(row.content.Slice(e.cx, row.Len()))
 		// Put content after the cursor on the next line
-		editorInsertRow(config.cy+1, rowContent)
+		editorInsertRow(e, e.cy+1, rowContent)
 		// Get new reference to current row, it just changed
-		row := &config.rows[config.cy]
-		// Update current row to only include content before cursor
-		row.content = row.content[0:config.cx]
-		editorUpdateRow(row)
+		row = &e.rows[e.cy]
+		// Update current row to only include content before cursor.
+		// At the end of the row there's nothing to take off, so it isn't changed.
+		if e.cx < row.Len() {
+			editorRecordRowUndo(e, row)
+			row.content.Truncate(e.cx)
+			row.offset = -1
+			editorMarkModified(e, row)
+		}
 	}
 	// Update cursor to new line.
-	config.cy++
-	config.cx = 0
+	e.cy++
+	e.cx = 0
+}
+
+// Matches escape sequences terminals use for colors and the like.
+var controlSequencePattern = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// Take escape sequences and control characters out of text, other than tabs and line breaks.
+func stripControlSequences(text string) string {
+	text = controlSequencePattern.ReplaceAllString(text, "")
+	return strings.Map(func(char rune) rune {
+		if unicode.IsControl(char) && char != '\t' && char != '\n' && char != '\r' {
+			return -1
+		}
+		return char
+	}, text)
+}
+
+// Put pasted text in at the cursor all at once, exactly as it is. Unlike typing
+// it, nothing is auto-indented, paired or expanded.
+func editorPaste(e *editorConfig, text string) {
+	if e.stripControls {
+		text = stripControlSequences(text)
+	}
+	// Terminals send the line breaks in a paste as carriage returns.
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	if len(text) == 0 {
+		return
+	}
+	lines := strings.Split(text, "\n")
+	last := len(lines) - 1
+	cx := utf8.RuneCountInString(lines[last])
+
+	// The pasted lines go between the parts of the row before and after the cursor.
+	end := e.cy
+	if e.cy < e.numrows {
+		row := &e.rows[e.cy]
+		if last == 0 {
+			cx += e.cx
+		}
+		lines[0] = encodeLine(row.content.Slice(0, e.cx)) + lines[0]
+		lines[last] += encodeLine(row.content.Slice(e.cx, row.Len()))
+		end++
+	}
+	editorReplaceLines(e, e.cy, end, lines)
+	e.cy += last
+	e.cx = cx
 }
 
-func editorDelChar() {
-	if config.cy == config.numrows {
+func editorDelChar(e *editorConfig) {
+	if e.cy == e.numrows {
 		// Past end of file, nothing to delete
 		return
 	}
-	if config.cx == 0 && config.cy == 0 {
+	if e.cx == 0 && e.cy == 0 {
 		// At top left of file, nothing to delete
 		return
 	}
 
-	row := &config.rows[config.cy]
-	if config.cx > 0 {
+	row := &e.rows[e.cy]
+	// Whether the cursor is between an opener and its closer.
+	inEmptyPair := false
+	if e.autoPair && e.cx > 0 && e.cx < row.Len() {
+		closer, isOpener := autoPairs[row.content.At(e.cx-1)]
+		inEmptyPair = isOpener && closer == row.content.At(e.cx)
+	}
+	if inEmptyPair {
+		// Deleting the opener of an empty pair takes the closer with it.
+		editorRowReplace(e, row, e.cx-1, 2, nil)
+		e.cx--
+	} else if e.cx > 0 {
 		// We're not in the first column, delete the previous character.
-		editorRowDelChar(row, config.cx-1)
+		editorRowDelChar(e, row, e.cx-1)
 		// Move the cursor back.
-		config.cx--
+		e.cx--
+	} else if e.deleteEmptyRow && row.Len() == 0 {
+		// An empty row only has to go, leaving the previous one untouched.
+		editorDelRow(e, e.cy)
+		e.cy--
+		e.cx = e.rows[e.cy].Len()
 	} else {
 		// We're in the first column, delete the current row and append
 		// its contents to previous row
-		config.cx = config.rows[config.cy-1].Len()
-		editorRowAppendString(&config.rows[config.cy-1], row.content)
-		editorDelRow(config.cy)
-		config.cy--
+		e.cx = e.rows[e.cy-1].Len()
+		editorRowAppendString(e, &e.rows[e.cy-1], row.content.String())
+		editorDelRow(e, e.cy)
+		e.cy--
 	}
 }
 
-// ==========================================
-// =============== File I/O =================
-// ==========================================
-
-// Convert editor rows to one string.
-func editorRowsToString(rows *[]editorRow) string {
-	var result strings.Builder
-	for _, row := range *rows {
-		result.WriteString(row.content + "\n")
+// Swap the character before the cursor with the one under it, then move past both.
+// At the end of a line the last two characters are swapped instead, like readline.
+func editorTransposeChars(e *editorConfig) {
+	if e.cy >= e.numrows {
+		return
 	}
-
-	return result.String()
+	row := &e.rows[e.cy]
+	if e.cx == 0 || row.Len() < 2 {
+		// Nothing before the cursor to swap with.
+		return
+	}
+	at := MIN(e.cx, row.Len()-1)
+	editorRowReplace(e, row, at-1, 2, []rune{row.content.At(at), row.content.At(at - 1)})
+	e.cx = at + 1
 }
 
-func editorOpen(filename string) {
-	config.filename = filename
-	editorSelectSyntaxHighlight()
-
-	// Open file for reading
-	file, err := os.Open(filename)
-	if err != nil {
-		panic("Failed to open " + filename + " file: " + err.Error())
+// Join the next line onto the end of the current one, separated by a single space.
+// The cursor is left where the lines were joined.
+func editorJoinLines(e *editorConfig) {
+	if e.cy+1 >= e.numrows {
+		// Nothing below to join.
+		return
 	}
-	defer file.Close()
+	row := &e.rows[e.cy]
+	next := strings.TrimLeftFunc(e.rows[e.cy+1].content.String(), unicode.IsSpace)
+	// Whitespace at the end of this line would end up doubled with the space.
+	joinAt := row.Len()
+	for joinAt > 0 && unicode.IsSpace(row.content.At(joinAt-1)) {
+		joinAt--
+	}
+	if joinAt < row.Len() {
+		editorRowReplace(e, row, joinAt, row.Len()-joinAt, nil)
+	}
+	if joinAt > 0 && len(next) > 0 {
+		next = " " + next
+	}
+	editorRowAppendString(e, row, next)
+	editorDelRow(e, e.cy+1)
+	e.cx = joinAt
+}
 
-	// Read line
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		editorInsertRow(config.numrows, scanner.Text())
+// Delete from the start of the line up to the cursor, like Ctrl-U in a shell.
+// At the start of a line there's nothing to delete, so nothing happens.
+func editorDeleteToLineStart(e *editorConfig) {
+	if e.cy >= e.numrows || e.cx == 0 {
+		return
 	}
-	config.dirty = false
+	editorRowReplace(e, &e.rows[e.cy], 0, e.cx, nil)
+	e.cx = 0
 }
 
-func editorSave() {
-	if len(config.filename) == 0 {
-		var err error
-		config.filename, err = editorPrompt("Save as: %s", nil)
-		if err != nil {
-			editorSetStatusMessage("Save aborted: %s", err.Error())
-			return
-		}
-		editorSelectSyntaxHighlight()
+// Comment out the rows from start to end, or uncomment them if they all already are.
+// The comment marker goes after each row's indentation. Blank rows are left alone.
+func editorToggleCommentRows(e *editorConfig, start, end int) {
+	if e.syntax == nil || len(e.syntax.singleCommentStart) == 0 {
+		editorSetStatusMessage("Don't know how to comment this file type")
+		return
 	}
+	marker := []rune(e.syntax.singleCommentStart)
 
-	editorString := editorRowsToString(&config.rows)
-	file, err := os.Create(config.filename)
-	if err != nil {
-		panic("Failed to create " + config.filename + " file: " + err.Error())
+	// Whether a row, past its indentation, starts with the marker.
+	isCommented := func(row *editorRow) bool {
+		_, indent := editorRowIndent(row)
+		return indent+len(marker) <= row.Len() && slices.Equal(row.content.Slice(indent, indent+len(marker)), marker)
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(editorString)
+	uncomment := true
+	for y := start; y <= end; y++ {
+		row := &e.rows[y]
+		if !editorRowIsBlank(row) && !isCommented(row) {
+			uncomment = false
+			break
+		}
+	}
 
-	if err != nil {
-		editorSetStatusMessage("Can't save! I/O error: %s", err.Error())
-	} else {
-		config.dirty = false
-		editorSetStatusMessage("%d bytes written to disk", len(editorString))
+	for y := start; y <= end; y++ {
+		row := &e.rows[y]
+		if editorRowIsBlank(row) {
+			continue
+		}
+		_, indent := editorRowIndent(row)
+		// Keep a column on this row on the same text as the marker comes or goes.
+		var shift func(cx int) int
+		if uncomment {
+			// Take the space after the marker too, if there is one.
+			n := len(marker)
+			if indent+n < row.Len() && row.content.At(indent+n) == ' ' {
+				n++
+			}
+			editorRowReplace(e, row, indent, n, nil)
+			shift = func(cx int) int {
+				if cx > indent {
+					return MAX(cx-n, indent)
+				}
+				return cx
+			}
+		} else {
+			editorRowReplace(e, row, indent, 0, append(slices.Clone(marker), ' '))
+			shift = func(cx int) int {
+				if cx >= indent {
+					return cx + len(marker) + 1
+				}
+				return cx
+			}
+		}
+		if y == e.cy {
+			e.cx = shift(e.cx)
+		}
+		if e.selecting && y == e.selectAnchor.cy {
+			e.selectAnchor.cx = shift(e.selectAnchor.cx)
+		}
 	}
 }
 
-// ==========================================
-// ================= Find ===================
-// ==========================================
-// TODO: No static variables in Go so these are global for now.
-// -1 means no match
-var lastMatch int
-
-// 1 means forward, -1 means backward
-var direction int
-
-// Restore highlight after search
-var savedHighlightIndex int = 0
-var savedHighlights []uint8 = nil
+// Toggle comments on the selected lines, or the current one.
+func editorToggleComment(e *editorConfig) {
+	start, end := e.cy, MIN(e.cy+1, e.numrows)
+	if e.blockSelect || e.selecting {
+		start, end = editorSelectedLines(e)
+	}
+	if start >= end {
+		return
+	}
+	editorToggleCommentRows(e, start, end-1)
+}
 
-func editorOnInputFind(query string, key int) {
+// Insert the current date and time at the cursor, laid out like dateFormat.
+func editorInsertDate(e *editorConfig) {
+	if e.cy == e.numrows {
+		editorInsertRow(e, e.numrows, "")
+	}
+	date := []rune(e.now().Format(e.dateFormat))
+	editorRowReplace(e, &e.rows[e.cy], e.cx, 0, date)
+	e.cx += len(date)
+}
 
-	if savedHighlights != nil {
-		// Restore highlights
-		for i := range config.rows[savedHighlightIndex].render {
-			config.rows[savedHighlightIndex].highlights[i] = savedHighlights[i]
+// Add delta to the number at or after the cursor on the current line. A number
+// padded with zeros keeps its width, and a - right before it makes it negative.
+func editorAddToNumber(e *editorConfig, delta int64) {
+	if e.cy >= e.numrows {
+		return
+	}
+	row := &e.rows[e.cy]
+	content := row.content.Runes()
+	isDigit := func(char rune) bool { return char >= '0' && char <= '9' }
+	// Find the digits, then whether there's a sign in front of them.
+	start := MIN(e.cx, len(content))
+	if start < len(content) && isDigit(content[start]) {
+		// On a number, go back to where it starts.
+		for start > 0 && isDigit(content[start-1]) {
+			start--
 		}
-		savedHighlightIndex = 0
-		savedHighlights = nil
+	}
+	for start < len(content) && !isDigit(content[start]) {
+		start++
+	}
+	if start == len(content) {
+		editorSetStatusMessage("No number on this line")
+		return
+	}
+	end := start
+	for end < len(content) && isDigit(content[end]) {
+		end++
+	}
+	digits := string(content[start:end])
+	if start > 0 && content[start-1] == '-' && (start == 1 || !isWordChar(content[start-2])) {
+		start--
 	}
 
-	if key == '\r' || key == ESC {
-		// reset values
-		lastMatch = -1
-		direction = 1
+	n, err := strconv.ParseInt(string(content[start:end]), 10, 64)
+	if err != nil || (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n <= math.MinInt64-delta) {
+		editorSetStatusMessage("Number is too big")
 		return
-	} else if key == ARROW_RIGHT || key == ARROW_DOWN {
-		direction = 1
-	} else if key == ARROW_LEFT || key == ARROW_UP {
-		direction = -1
+	}
+	n += delta
+	width := 0
+	if len(digits) > 1 && digits[0] == '0' {
+		width = len(digits)
+	}
+	var number string
+	if n < 0 {
+		number = fmt.Sprintf("-%0*d", width, -n)
 	} else {
-		// reset values
-		lastMatch = -1
-		direction = 1
+		number = fmt.Sprintf("%0*d", width, n)
 	}
+	editorRowReplace(e, row, start, end-start, []rune(number))
+	// Leave the cursor on the last digit, ready to go again.
+	e.cx = start + len(number) - 1
+}
 
-	if lastMatch == -1 {
-		// no match, search forward
-		direction = 1
+// Ask how much to add to the number at or after the cursor. It can be negative.
+func editorAddToNumberPrompt() {
+	answer, err := editorPrompt("Add to number: %s", nil)
+	if err != nil {
+		return
 	}
+	delta, err := strconv.ParseInt(answer, 10, 64)
+	if err != nil {
+		editorSetStatusMessage("Not a number: %s", answer)
+		return
+	}
+	editorAddToNumber(&config, delta)
+}
 
-	// If there was a last match, currentRow is the line after (or before, if searching backwards).
-	// If there wasn’t, it starts at the top of the file and searches in the forward direction to find the first match.
-	currentRow := lastMatch
-	for range config.rows {
-		currentRow += direction
-
-		// Wrap around search
-		if currentRow == -1 {
-			currentRow = config.numrows - 1
-		} else if currentRow == config.numrows {
-			currentRow = 0
+// The completions being cycled through, starting with the word as it was typed,
+// which one is in the file now, and where the word starts.
+var completeCycle []string
+var completeIndex int
+var completeStart editorCursor
+
+// How many times each word is in the loaded rows, for completion.
+// Rows add their words as they're counted and take them away again when they change.
+var wordCounts = map[string]int{}
+
+// The words in content, in order, repeats and all.
+func wordsIn(content []rune) []string {
+	var words []string
+	for x := 0; x < len(content); {
+		if !isWordChar(content[x]) {
+			x++
+			continue
 		}
+		start := x
+		for x < len(content) && isWordChar(content[x]) {
+			x++
+		}
+		words = append(words, encodeLine(content[start:x]))
+	}
+	return words
+}
 
-		row := &config.rows[currentRow]
-		if matchIndex := strings.Index(string(row.render), query); matchIndex != -1 {
-			// Set lastMatch so if user presses arrow keys, we search from this point
-			lastMatch = currentRow
-			config.cy = currentRow
-			config.cx = editorRowRxToCx(row, matchIndex)
-			// Put the finding at the top of the screen
-			config.rowOffset = config.numrows
+// Add the row's words to wordCounts.
+func editorCountWords(row *editorRow) {
+	row.words = wordsIn(row.content.Runes())
+	row.wordsCounted = true
+	for _, word := range row.words {
+		wordCounts[word]++
+	}
+}
 
-			// Record highlight
-			savedHighlightIndex = currentRow
-			savedHighlights = make([]uint8, row.RLen())
-			for i := range row.render {
-				savedHighlights[i] = row.highlights[i]
-			}
+// Take the row's words back out of wordCounts, until it's counted again.
+func editorUncountWords(row *editorRow) {
+	for _, word := range row.words {
+		if wordCounts[word]--; wordCounts[word] <= 0 {
+			delete(wordCounts, word)
+		}
+	}
+	row.words = nil
+	row.wordsCounted = false
+}
 
-			for i := range query {
-				row.highlights[matchIndex+i] = HL_MATCH
-			}
-			break
+// Count the words in rows that are new or have changed since they were last counted.
+func editorUpdateDictionary() {
+	for i := range config.rows {
+		if row := &config.rows[i]; !row.wordsCounted && !row.unloaded {
+			editorCountWords(row)
 		}
 	}
 }
 
-// Find a string in the editor, with incremental search
-func editorFind() {
-	// Save current cursor and scrollback position
-	currCx := config.cx
-	currCy := config.cy
-	curColOff := config.colOffset
-	curRowOff := config.rowOffset
+// Words in the file that start with prefix, the most used first.
+// The word being completed, at completeStart, isn't included.
+func editorCompletions(prefix string) []string {
+	editorUpdateDictionary()
+	// Find all of the word being completed, which may go on past the cursor.
+	content := config.rows[completeStart.cy].content.Runes()
+	end := completeStart.cx
+	for end < len(content) && isWordChar(content[end]) {
+		end++
+	}
+	current := encodeLine(content[completeStart.cx:end])
 
-	query, _ := editorPrompt("Search: %s (Use ESC/Arrows/Enter)", editorOnInputFind)
-	if len(query) == 0 {
-		// User cancelled
-		config.cx = currCx
-		config.cy = currCy
-		config.colOffset = curColOff
-		config.rowOffset = curRowOff
+	var words []string
+	counts := map[string]int{}
+	for word, count := range wordCounts {
+		if word == current {
+			count--
+		}
+		if count > 0 && word != prefix && strings.HasPrefix(word, prefix) {
+			words = append(words, word)
+			counts[word] = count
+		}
 	}
+	slices.SortFunc(words, func(a, b string) bool {
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		return a < b
+	})
+	return words
 }
 
-// ==========================================
-// ================ Output ==================
-// ==========================================
-
-// Set the status message.
-func editorSetStatusMessage(format string, args ...interface{}) {
-	config.statusMsg = fmt.Sprintf(format, args...)
-	config.statusMsgTime = time.Now()
+// Complete the word before the cursor with another word from the file that starts
+// the same way. Doing it again moves on to the next one, and eventually back to
+// what was typed.
+func editorComplete() {
+	if config.cy >= config.numrows {
+		return
+	}
+	row := &config.rows[config.cy]
+	start := config.cx
+	for start > 0 && isWordChar(row.content.At(start-1)) {
+		start--
+	}
+	word := encodeLine(row.content.Slice(start, config.cx))
+	at := editorCursor{cx: start, cy: config.cy}
+	if len(completeCycle) == 0 || completeStart != at || completeCycle[completeIndex] != word {
+		// A new word, start over.
+		if len(word) == 0 {
+			editorSetStatusMessage("No word to complete")
+			return
+		}
+		completeStart = at
+		completeCycle = append([]string{word}, editorCompletions(word)...)
+		completeIndex = 0
+	}
+	if len(completeCycle) == 1 {
+		completeCycle = nil
+		editorSetStatusMessage("No completions for %s", word)
+		return
+	}
+	completeIndex = (completeIndex + 1) % len(completeCycle)
+	completion := decodeLine(completeCycle[completeIndex])
+	editorRowReplace(&config, row, start, config.cx-start, completion)
+	config.cx = start + len(completion)
+	editorSetStatusMessage("Completion %d of %d", completeIndex, len(completeCycle)-1)
 }
 
-// Draw the status bar at the bottom of the screen.
-func editorDrawStatusBar(buf *strings.Builder) {
-	// Invert colors
-	buf.WriteString("\x1b[7m")
+// Whether char can be part of a word, like an identifier.
+func isWordChar(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_'
+}
 
-	// Add filename and line count.
-	displayFilename := config.filename
-	if len(config.filename) == 0 {
-		displayFilename = "[No Name]"
+// The start and end of the word under the cursor, or the one just before it.
+// ok is false if there's no word there.
+func editorWordAtCursor() (start, end int, ok bool) {
+	if config.cy >= config.numrows {
+		return 0, 0, false
 	}
-	dirtyStatus := ""
-	if config.dirty {
-		dirtyStatus = "(modified)"
+	content := config.rows[config.cy].content.Runes()
+	start = MIN(config.cx, len(content))
+	if start == len(content) || !isWordChar(content[start]) {
+		// Not on a word, see if one ends right before the cursor.
+		if start == 0 || !isWordChar(content[start-1]) {
+			return 0, 0, false
+		}
+		start--
 	}
-	status := fmt.Sprintf("%.20s - %d lines %s", displayFilename, config.numrows, dirtyStatus)
-	// Truncate if longer than screen width.
-	statusLen := MIN(len(status), config.screencols)
-	buf.WriteString(status[0:statusLen])
+	for start > 0 && isWordChar(content[start-1]) {
+		start--
+	}
+	end = start
+	for end < len(content) && isWordChar(content[end]) {
+		end++
+	}
+	return start, end, true
+}
 
-	// Define right status view, showing current line number and file type
-	filetypeStatus := "no ft"
-	if config.syntax != nil {
-		filetypeStatus = config.syntax.filetype
+// Apply transform to the word at the cursor and move the cursor after it.
+// With a selection, the selected words are transformed instead.
+func editorTransformWord(transform func([]rune) []rune) {
+	if config.selecting {
+		editorTransformSelection(transform)
+		return
+	}
+	start, end, ok := editorWordAtCursor()
+	if !ok {
+		return
 	}
-	rightStatus := fmt.Sprintf("%s %d/%d", filetypeStatus, config.cy+1, config.numrows)
-	rightStatusLen := len(rightStatus)
+	row := &config.rows[config.cy]
+	editorRowReplace(&config, row, start, end-start, transform(row.content.Slice(start, end)))
+	config.cx = end
+}
 
-	// Print the rest of the status.
-	for statusLen < config.screencols {
-		// Show the right status view, if it fits.
-		if config.screencols-statusLen == rightStatusLen {
-			buf.WriteString(rightStatus[0:rightStatusLen])
-			// The entire status has been printed. Bail out.
-			break
-		} else {
-			// Add a bunch of spaces, effectively making a white bar.
-			buf.WriteRune(' ')
-			statusLen++
+// Apply transform to each word in the selection, or the part of it that's selected.
+func editorTransformSelection(transform func([]rune) []rune) {
+	start, end := editorSelectionBounds(&config)
+	for y := start.cy; y <= end.cy && y < config.numrows; y++ {
+		row := &config.rows[y]
+		from, to := 0, row.Len()
+		if y == start.cy {
+			from = start.cx
+		}
+		if y == end.cy {
+			to = end.cx
+		}
+		if from >= to {
+			continue
+		}
+		text := row.content.Slice(from, to)
+		for i := 0; i < len(text); {
+			if !isWordChar(text[i]) {
+				i++
+				continue
+			}
+			wordEnd := i
+			for wordEnd < len(text) && isWordChar(text[wordEnd]) {
+				wordEnd++
+			}
+			copy(text[i:wordEnd], transform(text[i:wordEnd]))
+			i = wordEnd
 		}
+		editorRowReplace(&config, row, from, to-from, text)
 	}
+}
 
-	// Put the colors back to normal
-	buf.WriteString("\x1b[m")
-	// Put another newline, giving room for the status message.
-	buf.WriteString("\r\n")
+func editorUpcaseWord() {
+	editorTransformWord(func(word []rune) []rune {
+		for i := range word {
+			word[i] = unicode.ToUpper(word[i])
+		}
+		return word
+	})
 }
 
-func editorDrawMessageBar(buf *strings.Builder) {
-	// Clear any existing content
-	buf.WriteString("\x1b[K")
-	// Truncate message if it doesn't fit
-	messageLen := MIN(len(config.statusMsg), config.screencols)
-	// Show message, if it fits and is within timer bounds.
-	if messageLen > 0 && time.Since(config.statusMsgTime).Seconds() < KILO_MESSAGE_TIMEOUT {
-		buf.WriteString(config.statusMsg[0:messageLen])
-	}
+func editorDowncaseWord() {
+	editorTransformWord(func(word []rune) []rune {
+		for i := range word {
+			word[i] = unicode.ToLower(word[i])
+		}
+		return word
+	})
 }
 
-// editorScroll detects scroll based on cursor position.
-func editorScroll() {
-	config.rx = 0
-	// If we have an active editor row, compute the render x-coord.
-	if config.cy < config.numrows {
-		config.rx = editorRowCxToRx(&config.rows[config.cy], config.cx)
+func editorTitlecaseWord() {
+	editorTransformWord(func(word []rune) []rune {
+		for i := range word {
+			if i == 0 {
+				word[i] = unicode.ToTitle(word[i])
+			} else {
+				word[i] = unicode.ToLower(word[i])
+			}
+		}
+		return word
+	})
+}
+
+// ==========================================
+// ============ Block Selection =============
+// ==========================================
+
+// Start selecting a rectangle from the cursor, or stop if already selecting.
+func editorToggleBlockSelect() {
+	if config.blockSelect {
+		config.blockSelect = false
+		return
 	}
+	config.blockSelect = true
+	config.blockAnchorY = config.cy
+	config.blockAnchorRx = editorCursorRx(&config)
+	editorSetStatusMessage("Block select: type to insert, Backspace/Delete to delete, Esc to stop")
+}
 
-	// Check if cursor is above visible window
-	if config.cy < config.rowOffset {
-		config.rowOffset = config.cy
+// The render column of the cursor.
+func editorCursorRx(e *editorConfig) int {
+	if e.cy >= e.numrows {
+		return 0
 	}
+	return editorRowCxToRx(e, &e.rows[e.cy], e.cx)
+}
 
-	// Check if cursor is below visible window
-	if config.cy >= config.rowOffset+config.screenrows {
-		config.rowOffset = config.cy - config.screenrows + 1
+// The rows and render columns covered by the block selection.
+// Rows run from top to bottom inclusive, columns from left up to but not including right.
+func editorBlockBounds(e *editorConfig) (top, bottom, left, right int) {
+	top, bottom = e.blockAnchorY, e.cy
+	if top > bottom {
+		top, bottom = bottom, top
 	}
+	left, right = e.blockAnchorRx, editorCursorRx(e)
+	if left > right {
+		left, right = right, left
+	}
+	// The column under the cursor is always part of the block.
+	return top, MIN(bottom, e.numrows-1), left, right + 1
+}
 
-	// Check if cursor is to the left of visible window
-	if config.rx < config.colOffset {
-		config.colOffset = config.rx
+// Shrink the block to a single column at rx, keeping its rows.
+func editorCollapseBlock(rx int) {
+	config.blockAnchorRx = rx
+	if config.cy < config.numrows {
+		config.cx = editorRowRxToCx(&config, &config.rows[config.cy], rx)
 	}
+}
 
-	// Check if cursor is to the right of visible window
-	if config.rx >= config.colOffset+config.screencols {
-		config.colOffset = config.rx - config.screencols + 1
+// Insert char in every row of the block, in front of its left column.
+// Rows too short to reach the column are left alone.
+func editorBlockInsert(char rune) {
+	top, bottom, left, _ := editorBlockBounds(&config)
+	next := -1
+	for y := top; y <= bottom; y++ {
+		row := &config.rows[y]
+		if editorRowCxToRx(&config, row, row.Len()) < left {
+			continue
+		}
+		at := editorRowRxToCx(&config, row, left)
+		editorRowInsertChar(&config, row, at, char)
+		if next < 0 {
+			next = editorRowCxToRx(&config, row, at+1)
+		}
+	}
+	if next >= 0 {
+		// Keep going from after what was typed.
+		editorCollapseBlock(next)
 	}
 }
 
-// editorRefreshScreen is called every cycle to repaint the screen.
-func editorRefreshScreen() {
-	// Compute screen position based on cursor position.
-	editorScroll()
+// Delete the columns of the block from every row in it.
+func editorBlockDelete() {
+	top, bottom, left, right := editorBlockBounds(&config)
+	for y := top; y <= bottom; y++ {
+		row := &config.rows[y]
+		start := editorRowRxToCx(&config, row, left)
+		end := editorRowRxToCx(&config, row, right)
+		if start < end {
+			editorRowReplace(&config, row, start, end-start, nil)
+		}
+	}
+	editorCollapseBlock(left)
+}
 
-	// Hide the cursor before painting screen
-	mainBuffer.WriteString("\x1b[?25l")
-	// Reposition cursor to top left
-	mainBuffer.WriteString("\x1b[H")
+// Handle a key that acts on the block selection.
+// Returns false for keys that should be handled as usual, like movement.
+func editorProcessBlockKey(key int) bool {
+	switch key {
+	case ESC, '\r':
+		config.blockSelect = false
+	case BACKSPACE, CTRL_KEY('h'), DEL_KEY:
+		editorBlockDelete()
+	default:
+		if !isTypedChar(key) {
+			return false
+		}
+		editorBlockInsert(rune(key))
+	}
+	return true
+}
 
-	// Draw all of the content, broken into rows.
-	editorDrawRows(&mainBuffer)
+// ==========================================
+// =============== Selection ================
+// ==========================================
 
-	// Draw the status bar.
-	editorDrawStatusBar(&mainBuffer)
-	editorDrawMessageBar(&mainBuffer)
+// Shifted keys, and the key they move the cursor like.
+var shiftedKeys = map[int]int{
+	SHIFT_ARROW_LEFT:  ARROW_LEFT,
+	SHIFT_ARROW_RIGHT: ARROW_RIGHT,
+	SHIFT_ARROW_UP:    ARROW_UP,
+	SHIFT_ARROW_DOWN:  ARROW_DOWN,
+	SHIFT_HOME_KEY:    HOME_KEY,
+	SHIFT_END_KEY:     END_KEY,
+}
 
-	// Draw cursor
-	// +1 to put the cursor into terminal coordinates.
-	// Account for scroll changing the screen position.
-	fmt.Fprintf(&mainBuffer, "\x1b[%d;%dH", (config.cy-config.rowOffset)+1, (config.rx-config.colOffset)+1)
-	// Bring the cursor back
-	mainBuffer.WriteString("\x1b[?25h")
+// The shifted version of key.
+func shiftKey(key int) int {
+	for shifted, plain := range shiftedKeys {
+		if plain == key {
+			return shifted
+		}
+	}
+	return key
+}
 
-	// Flush the buffer to the screen.
-	fmt.Print(mainBuffer.String())
+// Start selecting from the cursor, unless there's a selection already.
+func editorStartSelection() {
+	if !config.selecting {
+		config.selecting = true
+		config.selectAnchor = editorCursor{config.cx, config.cy}
+	}
+}
 
-	mainBuffer.Reset()
+// The start and end of the selection in the order they're in the file.
+// end is just past the last selected character.
+func editorSelectionBounds(e *editorConfig) (start, end editorCursor) {
+	// Edits since the selection started may have taken the anchor's text away.
+	anchor := e.selectAnchor
+	anchor.cy = MIN(anchor.cy, e.numrows)
+	if anchor.cy < e.numrows {
+		anchor.cx = MIN(anchor.cx, e.rows[anchor.cy].Len())
+	} else {
+		anchor.cx = 0
+	}
+	start, end = anchor, editorCursor{e.cx, e.cy}
+	if positionBefore(end.cy, end.cx, start.cy, start.cx) {
+		start, end = end, start
+	}
+	return start, end
 }
 
-// Clear the entire screen
-// https://vt100.net/docs/vt100-ug/chapter3.html#ED
-func cleanScreen(buf *strings.Builder) {
-	// Wipe screen
-	buf.WriteString("\x1b[2J")
-	// Reposition cursor to top left
-	buf.WriteString("\x1b[H")
+// The render columns selected in row y, from left up to but not including right.
+func editorSelectedColumns(y int) (left, right int) {
+	if !config.selecting || y >= config.numrows {
+		return 0, 0
+	}
+	start, end := editorSelectionBounds(&config)
+	if y < start.cy || y > end.cy {
+		return 0, 0
+	}
+	row := &config.rows[y]
+	right = row.RLen()
+	if y == start.cy {
+		left = editorRowCxToRx(&config, row, start.cx)
+	}
+	if y == end.cy {
+		right = editorRowCxToRx(&config, row, end.cx)
+	}
+	return left, right
 }
 
-// editorDrawRows draws each visible line of the editor.
-func editorDrawRows(buf *strings.Builder) {
-	// Iterate over every row on the screen and determine the content that should be there.
-	for y := 0; y < config.screenrows; y++ {
-		// Figure out the line of the file we are viewing.
-		fileRow := y + config.rowOffset
-		if fileRow >= config.numrows {
-			// The current line is outside of the file, what to draw?
-			if config.numrows == 0 && y == config.screenrows/3 {
-				// If the file is empty, show a welcome message.
-				welcomeMsg := fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION)
-				welcomeLen := MIN(len(welcomeMsg), config.screencols)
-				// Center the welcome message
-				padding := (config.screencols - welcomeLen) / 2
-				if padding > 0 {
-					buf.WriteString("~")
-					padding--
-				}
-				for ; padding > 0; padding-- {
-					buf.WriteRune(' ')
-				}
-				// Truncate the welcome message to the screen width.
-				buf.WriteString(welcomeMsg[0:welcomeLen])
-			} else {
-				// Fill the right column with tildes for the rest of the file.
-				buf.WriteString("~")
-			}
-		} else {
-			// Show the row contents
-			// The size of the row is determined by the number of columns that have been scrolled
-			// plus the render length
-			rowSize := config.rows[fileRow].RLen() - config.colOffset
-			// Don't allow negative row sizes.
-			rowSize = MAX(rowSize, 0)
-			// Don't allow row sizes greater than the screen width.
-			rowSize = MIN(rowSize, config.screencols)
-			// Track syntax color so we're not spamming escape sequences if the color doesn't change
-			currentColor := DEFAULT
-			// Draw the row if it should be shown, based on horizontal scroll
-			if rowSize > config.colOffset {
-				rowRender := string(config.rows[fileRow].render)
-				truncatedRow := rowRender[config.colOffset:rowSize]
-				highlights := config.rows[fileRow].highlights
-				for i, char := range truncatedRow {
-					// Friendly print control characters
-					// Avoiding control code 0 because that seems to be at every new line
-					// and we don't need to show that.
-					if char > 0 && unicode.IsControl(char) {
-						symbol := "?"
-						if char <= 26 {
-							symbol = string('@' + char)
-						}
-						// Invert color when printing control characters.
-						buf.WriteString("\x1b[7m")
-						buf.WriteString(symbol)
-						buf.WriteString("\x1b[m")
-						if currentColor != DEFAULT {
-							buf.WriteString(fmt.Sprintf("\x1b[%dm", currentColor))
-						}
-					} else if highlights[i] == HL_NORMAL {
-						if currentColor != DEFAULT {
-							buf.WriteString(fmt.Sprintf("\x1b[%dm", DEFAULT))
-							currentColor = DEFAULT
-						}
-						buf.WriteRune(char)
-					} else {
-						color := editorSyntaxToColor(highlights[i])
-						if color != currentColor {
-							buf.WriteString(fmt.Sprintf("\x1b[%dm", color))
-							currentColor = color
-						}
-						buf.WriteRune(char)
-					}
-				}
-			}
-			buf.WriteString(fmt.Sprintf("\x1b[%dm", DEFAULT))
-		}
+// Delete the selected text and put the cursor where it was.
+func editorDeleteSelection() {
+	start, end := editorSelectionBounds(&config)
+	config.selecting = false
+	config.cx, config.cy = start.cx, start.cy
+	if start == end || start.cy >= config.numrows {
+		return
+	}
+	// Join what's left of the first and last rows, then drop the rows in between.
+	var rest []rune
+	if end.cy < config.numrows {
+		last := &config.rows[end.cy]
+		rest = last.content.Slice(end.cx, last.Len())
+	}
+	first := &config.rows[start.cy]
+	if end.cy == start.cy {
+		editorRowReplace(&config, first, start.cx, end.cx-start.cx, nil)
+		return
+	}
+	editorRowReplace(&config, first, start.cx, first.Len()-start.cx, rest)
+	for y := MIN(end.cy, config.numrows-1); y > start.cy; y-- {
+		editorDelRow(&config, y)
+	}
+}
 
-		// Delete the rest of the line. This effectively clears
-		// the screen when this function runs the first time.
-		buf.WriteString("\x1b[K")
+// Select from the start of the file to the end.
+func editorSelectAll() {
+	if config.numrows == 0 {
+		return
+	}
+	config.selecting = true
+	config.selectAnchor = editorCursor{0, 0}
+	config.cy = config.numrows - 1
+	config.cx = config.rows[config.cy].Len()
+}
 
-		// Add new line to each row.
-		buf.WriteString("\r\n")
+// Handle a key while text is selected. Shifted keys keep selecting.
+// Backspace and Delete delete the selection, and typing replaces it.
+// Other keys let go of it. Returns false for keys that should be
+// handled as usual, like movement and typing.
+func editorProcessSelectionKey(key int) bool {
+	switch key {
+	case ESC:
+		config.selecting = false
+		return true
+	case BACKSPACE, CTRL_KEY('h'), DEL_KEY:
+		editorDeleteSelection()
+		return true
+	case '\r', '\t':
+		editorDeleteSelection()
+		return false
+	}
+	if isTypedChar(key) {
+		editorDeleteSelection()
+		return false
 	}
+	config.selecting = false
+	return false
 }
 
 // ==========================================
-// ================ Input ===================
+// ============= Multiple Cursors ===========
 // ==========================================
 
-func editorPrompt(prompt string, onInput func(string, int)) (string, error) {
-	var userInput string
+// Add a cursor on the row below the lowest cursor, in the same column as the main one.
+func editorAddCursorBelow() {
+	bottom := config.cy
+	for _, cursor := range config.cursors {
+		bottom = MAX(bottom, cursor.cy)
+	}
+	if bottom+1 >= config.numrows {
+		editorSetStatusMessage("No row below to add a cursor to")
+		return
+	}
+	row := &config.rows[bottom+1]
+	cx := editorRowRxToCx(&config, row, editorCursorRx(&config))
+	config.cursors = append(config.cursors, editorCursor{cx, bottom + 1})
+}
 
-	for {
-		editorSetStatusMessage(prompt, userInput)
-		editorRefreshScreen()
+// Add a cursor on the next whole-word match of the word at the main cursor,
+// after the last cursor and wrapping around the end of the file.
+func editorAddCursorAtNextMatch() {
+	start, end, ok := editorWordAtCursor()
+	if !ok {
+		editorSetStatusMessage("No word at the cursor")
+		return
+	}
+	word := config.rows[config.cy].content.Slice(start, end)
+	// Land in the same spot of the match as the main cursor is in its word.
+	offset := config.cx - start
+
+	last := editorCursor{start, config.cy}
+	for _, cursor := range config.cursors {
+		if positionBefore(last.cy, last.cx, cursor.cy, cursor.cx-offset) {
+			last = editorCursor{cursor.cx - offset, cursor.cy}
+		}
+	}
 
-		char := editorReadKey()
-		if char == DEL_KEY || char == CTRL_KEY('h') || char == BACKSPACE {
-			if len(userInput) > 0 {
-				userInput = userInput[0 : len(userInput)-1]
+	for n := 0; n <= config.numrows; n++ {
+		y := (last.cy + n) % config.numrows
+		content := config.rows[y].content.Runes()
+		for x := 0; x+len(word) <= len(content); x++ {
+			if n == 0 && x <= last.cx {
+				continue
 			}
-		} else if char == ESC {
-			editorSetStatusMessage("")
-			if onInput != nil {
-				onInput(userInput, char)
+			if !slices.Equal(content[x:x+len(word)], word) ||
+				x > 0 && isWordChar(content[x-1]) ||
+				x+len(word) < len(content) && isWordChar(content[x+len(word)]) {
+				continue
 			}
-			return "", errors.New("user cancelled")
-		} else if char == '\r' {
-			if len(userInput) > 0 {
-				editorSetStatusMessage("")
-				if onInput != nil {
-					onInput(userInput, char)
-				}
-				return userInput, nil
+			cursor := editorCursor{x + offset, y}
+			if cursor == (editorCursor{config.cx, config.cy}) || slices.Contains(config.cursors, cursor) {
+				editorSetStatusMessage("Every match already has a cursor")
+				return
 			}
-		} else if !unicode.IsControl(rune(char)) && char < 128 {
-			userInput += string(rune(char))
-		}
-
-		if onInput != nil {
-			onInput(userInput, char)
+			config.cursors = append(config.cursors, cursor)
+			return
 		}
 	}
 }
 
-// Perform arithmetic to figure out new cursor position
-func editorMoveCursor(key int) {
-	// Fetch the current row so we can get it's dimensions and figure out how to move.
-	var row string
-	if config.cy < config.numrows {
-		row = config.rows[config.cy].content
+// Run edit once at each cursor, with config.cx and config.cy set to that cursor.
+// Cursors are visited from the end of the file backwards, so an edit never
+// moves the text under a cursor that hasn't been visited yet.
+func editorEachCursor(edit func()) {
+	all := append([]editorCursor{{config.cx, config.cy}}, config.cursors...)
+	order := make([]int, len(all))
+	for i := range order {
+		order[i] = i
 	}
-
-	switch key {
-	case ARROW_UP:
-		// Move the cursor up one row if it's not already at the first row.
-		if config.cy != 0 {
-			config.cy--
-		}
-	case ARROW_LEFT:
-		// Move the cursor left one column if it's not already at the first column.
-		if config.cx != 0 {
-			config.cx--
-		} else if config.cy > 0 {
-			// Cursor is already at the first column, move it to the end of the previous row.
-			config.cy--
-			config.cx = config.rows[config.cy].Len()
-		}
-	case ARROW_DOWN:
-		// Move the cursor down one row if it's not already at the last row.
-		if config.cy < config.numrows {
-			config.cy++
+	slices.SortFunc(order, func(a, b int) bool {
+		return positionBefore(all[b].cy, all[b].cx, all[a].cy, all[a].cx)
+	})
+
+	for n, i := range order {
+		config.cx, config.cy = all[i].cx, all[i].cy
+		rowLen := func() int {
+			if config.cy < config.numrows {
+				return config.rows[config.cy].Len()
+			}
+			return 0
 		}
-	case ARROW_RIGHT:
-		// Move the cursor right one column if it's not already at the last column.
-		if len(row) >= 0 && config.cx < len(row) {
-			config.cx++
-		} else if len(row) > 0 && config.cx == len(row) {
-			// Cursor is already at the last column, move it to the beginning of the next row.
-			config.cy++
-			config.cx = 0
+		y, before := config.cy, rowLen()
+		edit()
+		all[i] = editorCursor{config.cx, config.cy}
+		// Cursors already visited on the same row sit after the edit, shift them along with their text.
+		if config.cy == y {
+			delta := rowLen() - before
+			for _, j := range order[:n] {
+				if all[j].cy == y {
+					all[j].cx += delta
+				}
+			}
 		}
 	}
 
-	// Re-calculate current row with new cursor position.
-	if config.cy >= config.numrows {
-		row = ""
-	} else {
-		row = config.rows[config.cy].content
+	config.cx, config.cy = all[0].cx, all[0].cy
+	// Cursors that ran into each other become one.
+	config.cursors = config.cursors[:0]
+	for _, cursor := range all[1:] {
+		if cursor != all[0] && !slices.Contains(config.cursors, cursor) {
+			config.cursors = append(config.cursors, cursor)
+		}
 	}
+}
 
-	rowLength := MAX(len(row), 0)
-
-	// Snap cursor to the end of the row.
-	if config.cx > rowLength {
-		config.cx = rowLength
+// Handle a key when there is more than one cursor.
+// Returns false for keys that only apply to the main cursor. Those drop the other cursors.
+func editorProcessMultiCursorKey(key int) bool {
+	switch key {
+	case ESC:
+		config.cursors = nil
+	case ARROW_UP, ARROW_DOWN, ARROW_LEFT, ARROW_RIGHT:
+		editorEachCursor(func() { editorMoveCursor(&config, key) })
+	case HOME_KEY:
+		editorEachCursor(func() { config.cx = 0 })
+	case END_KEY:
+		editorEachCursor(func() {
+			if config.cy < config.numrows {
+				config.cx = config.rows[config.cy].Len()
+			}
+		})
+	case BACKSPACE, CTRL_KEY('h'):
+		editorEachCursor(func() {
+			// Joining lines would pull other cursors around, so stop at the start of the line.
+			if config.cx > 0 {
+				editorDelChar(&config)
+			}
+		})
+	default:
+		if !isTypedChar(key) {
+			config.cursors = nil
+			return false
+		}
+		editorEachCursor(func() { editorInsertChar(&config, rune(key)) })
 	}
+	return true
 }
 
-// Handle user input
-func editorProcessKeypress() bool {
-	char := editorReadKey()
+// ==========================================
+// ================ Hex View ================
+// ==========================================
 
-	switch char {
-	case '\r':
-		editorInsertNewline()
-	case CTRL_KEY('q'):
-		// Quit
-		if config.dirty && quitTimes > 0 {
-			editorSetStatusMessage("HEY!! The file has unsaved changes. Press Ctrl+Q %d more times to quit.", quitTimes)
-			quitTimes--
-			return true
-		}
-		cleanScreen(&mainBuffer)
-		fmt.Print(mainBuffer.String())
-		return false
+// How many bytes each line of the hex dump shows.
+const KILO_HEX_LINE_BYTES = 16
 
-	case CTRL_KEY('s'):
-		editorSave()
+// Actions that still work in hex view. The rest work on rows, which are out of date.
+var hexActions = []string{"save", "help", "hex-view"}
 
-	case CTRL_KEY('f'):
-		editorFind()
+// Switch between editing text and editing the file's bytes.
+func editorToggleHexView() {
+	if config.hexMode {
+		editorLeaveHexView()
+		return
+	}
+	if config.pagedFile != nil {
+		editorSetStatusMessage("File is too big for hex view")
+		return
+	}
+	config.hexData = []byte(editorFileContents())
+	config.hexCursor, config.hexNibble, config.hexRowOffset = 0, 0, 0
+	config.hexEdited = false
+	config.blockSelect = false
+	config.selecting = false
+	config.cursors = nil
+	config.hexMode = true
+}
 
-	case HOME_KEY:
-		// Move the cursor to the beginning of the current row
-		config.cx = 0
-	case END_KEY:
+// Go back to editing text, turning the bytes back into rows if they were changed.
+func editorLeaveHexView() {
+	config.hexMode = false
+	if !config.hexEdited {
+		return
+	}
+	data := string(config.hexData)
+	config.hasBOM = strings.HasPrefix(data, UTF8_BOM)
+	data = strings.TrimPrefix(data, UTF8_BOM)
+	config.binary = !utf8.ValidString(data) || strings.IndexByte(data, 0) >= 0
+	config.finalNewline = strings.HasSuffix(data, "\n")
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+	}
+	if config.lineEnding == "\r\n" {
+		for i := range lines {
+			lines[i] = strings.TrimSuffix(lines[i], "\r")
+		}
+	}
+	// The rows match the bytes, so they're only unsaved if the bytes were.
+	dirty := config.dirty
+	editorReplaceLines(&config, 0, config.numrows, lines)
+	config.dirty = dirty
+	config.cy = MIN(config.cy, config.numrows)
+	config.cx = 0
+}
+
+// Handle a key in hex view. Arrows and paging move over bytes, hex digits
+// overwrite them, and Escape goes back to text.
+func editorProcessHexKey(key int) {
+	if name, ok := keyBindings[key]; ok {
+		if slices.Contains(hexActions, name) {
+			editorActions[name].run()
+		} else {
+			editorSetStatusMessage("%s doesn't work in hex view", name)
+		}
+		return
+	}
+	last := MAX(len(config.hexData)-1, 0)
+	moveTo := func(at int) {
+		config.hexCursor = MAX(MIN(at, last), 0)
+		config.hexNibble = 0
+	}
+	switch key {
+	case ARROW_LEFT:
+		moveTo(config.hexCursor - 1)
+	case ARROW_RIGHT:
+		moveTo(config.hexCursor + 1)
+	case ARROW_UP:
+		moveTo(config.hexCursor - KILO_HEX_LINE_BYTES)
+	case ARROW_DOWN:
+		moveTo(config.hexCursor + KILO_HEX_LINE_BYTES)
+	case PAGE_UP:
+		moveTo(config.hexCursor - KILO_HEX_LINE_BYTES*config.screenrows)
+	case PAGE_DOWN:
+		moveTo(config.hexCursor + KILO_HEX_LINE_BYTES*config.screenrows)
+	case HOME_KEY:
+		moveTo(config.hexCursor - config.hexCursor%KILO_HEX_LINE_BYTES)
+	case END_KEY:
+		moveTo(config.hexCursor - config.hexCursor%KILO_HEX_LINE_BYTES + KILO_HEX_LINE_BYTES - 1)
+	case ESC:
+		editorLeaveHexView()
+	default:
+		digit, err := strconv.ParseUint(string(rune(key)), 16, 8)
+		if key >= 128 || err != nil || len(config.hexData) == 0 {
+			return
+		}
+		b := &config.hexData[config.hexCursor]
+		if config.hexNibble == 0 {
+			*b = *b&0x0f | byte(digit)<<4
+			config.hexNibble = 1
+		} else {
+			*b = *b&0xf0 | byte(digit)
+			// On the last byte there's nowhere to go, so the next digit starts it again.
+			moveTo(config.hexCursor + 1)
+		}
+		config.hexEdited = true
+		config.dirty = true
+	}
+}
+
+// Draw the hex dump into the frame: each line's offset, its bytes in hex, and
+// the bytes that are printable. Returns where the cursor goes on screen.
+func editorDrawHex(frame []string) (cursorRow, cursorCol int) {
+	line := config.hexCursor / KILO_HEX_LINE_BYTES
+	if line < config.hexRowOffset {
+		config.hexRowOffset = line
+	} else if line >= config.hexRowOffset+config.screenrows {
+		config.hexRowOffset = line - config.screenrows + 1
+	}
+	// Where a byte's hex digits start in a line. The two halves of a line are split by an extra space.
+	column := func(i int) int {
+		col := 10 + i*3
+		if i >= KILO_HEX_LINE_BYTES/2 {
+			col++
+		}
+		return col
+	}
+	var buf strings.Builder
+	for y := range frame[:config.screenrows] {
+		start := (config.hexRowOffset + y) * KILO_HEX_LINE_BYTES
+		if start >= len(config.hexData) && (start > 0 || y > 0) {
+			frame[y] = "~"
+			continue
+		}
+		end := MIN(start+KILO_HEX_LINE_BYTES, len(config.hexData))
+		buf.Reset()
+		fmt.Fprintf(&buf, "%08x  ", start)
+		for i := 0; i < KILO_HEX_LINE_BYTES; i++ {
+			if i == KILO_HEX_LINE_BYTES/2 {
+				buf.WriteByte(' ')
+			}
+			if start+i < end {
+				fmt.Fprintf(&buf, "%02x ", config.hexData[start+i])
+			} else {
+				buf.WriteString("   ")
+			}
+		}
+		buf.WriteString(" |")
+		cursorAt := -1
+		for i, b := range config.hexData[start:end] {
+			if start+i == config.hexCursor {
+				cursorAt = buf.Len()
+			}
+			if b >= ' ' && b < 0x7f {
+				buf.WriteByte(b)
+			} else {
+				buf.WriteByte('.')
+			}
+		}
+		buf.WriteString("|")
+		// Cut the line to fit the screen. It's all ASCII, so bytes are columns.
+		text := buf.String()
+		text = text[:MIN(len(text), config.screencols)]
+		if cursorAt >= 0 && cursorAt < len(text) {
+			// Show which character the cursor is on.
+			text = text[:cursorAt] + "\x1b[7m" + text[cursorAt:cursorAt+1] + "\x1b[m" + text[cursorAt+1:]
+		}
+		frame[y] = text
+	}
+	cursorCol = column(config.hexCursor%KILO_HEX_LINE_BYTES) + config.hexNibble
+	return line - config.hexRowOffset, MIN(cursorCol, config.screencols-1)
+}
+
+// ==========================================
+// ============= Line Commands ==============
+// ==========================================
+
+// The rows line commands work on, from start up to end: the rows of the
+// selection, or the whole file if nothing is selected.
+func editorSelectedLines(e *editorConfig) (start, end int) {
+	if e.blockSelect {
+		top, bottom, _, _ := editorBlockBounds(e)
+		return top, MIN(bottom+1, e.numrows)
+	}
+	if e.selecting {
+		first, last := editorSelectionBounds(e)
+		if last.cx == 0 && last.cy > first.cy {
+			// Nothing on the last row is selected, leave it out.
+			return first.cy, last.cy
+		}
+		return first.cy, MIN(last.cy+1, e.numrows)
+	}
+	return 0, e.numrows
+}
+
+// Replace the rows from start up to end with what transform makes of their lines.
+// Returns false if there are no lines to transform.
+func editorTransformLines(name string, start, end int, transform func([]string) []string) bool {
+	if config.pagedFile != nil {
+		editorSetStatusMessage("File is too big to %s", name)
+		return false
+	}
+	if start >= end {
+		editorSetStatusMessage("No lines to %s", name)
+		return false
+	}
+	lines := make([]string, 0, end-start)
+	for i := start; i < end; i++ {
+		lines = append(lines, config.rows[i].content.String())
+	}
+	editorReplaceLines(&config, start, end, transform(lines))
+	config.blockSelect = false
+	config.selecting = false
+	config.cy = MIN(config.cy, config.numrows)
+	config.cx = 0
+	return true
+}
+
+// The number a line starts with, ignoring leading whitespace.
+var leadingNumberPattern = regexp.MustCompile(`^\s*[-+]?(\d+\.?\d*|\.\d+)`)
+
+// Sort the selected lines. Asks whether to sort in reverse, ignore case, or by the number each line starts with.
+// Lines that don't start with a number sort before those that do.
+func editorSortLines() {
+	how, err := editorPrompt("Sort by (a)lphabet, plus (r)everse, (i)gnore case, (n)umber: %s", nil)
+	if err != nil {
+		editorSetStatusMessage("Sort aborted")
+		return
+	}
+	if strings.Trim(how, "arin") != "" {
+		editorSetStatusMessage("Unknown sort %q", how)
+		return
+	}
+	reverse, ignoreCase, numeric := strings.Contains(how, "r"), strings.Contains(how, "i"), strings.Contains(how, "n")
+
+	less := func(a, b string) bool {
+		if numeric {
+			x, xErr := strconv.ParseFloat(strings.TrimSpace(leadingNumberPattern.FindString(a)), 64)
+			y, yErr := strconv.ParseFloat(strings.TrimSpace(leadingNumberPattern.FindString(b)), 64)
+			if (xErr == nil) != (yErr == nil) {
+				return xErr != nil
+			}
+			if xErr == nil && x != y {
+				return x < y
+			}
+		}
+		if ignoreCase {
+			return strings.ToLower(a) < strings.ToLower(b)
+		}
+		return a < b
+	}
+	start, end := editorSelectedLines(&config)
+	editorTransformLines("sort", start, end, func(lines []string) []string {
+		slices.SortStableFunc(lines, func(a, b string) bool {
+			if reverse {
+				return less(b, a)
+			}
+			return less(a, b)
+		})
+		return lines
+	})
+}
+
+// Remove repeated lines from the selection, or the whole file, keeping the first of each.
+// Asks whether to only remove repeats right after each other, like uniq, or all of them.
+func editorDedupeLines() {
+	how, err := editorPrompt("Remove (a)djacent or (g)lobal duplicates: %s", nil)
+	if err != nil || (how != "a" && how != "g") {
+		editorSetStatusMessage("Remove duplicates aborted")
+		return
+	}
+	removed := 0
+	start, end := editorSelectedLines(&config)
+	ok := editorTransformLines("dedupe", start, end, func(lines []string) []string {
+		seen := map[string]bool{}
+		var kept []string
+		for i, line := range lines {
+			if how == "a" && i > 0 && line == lines[i-1] || how == "g" && seen[line] {
+				removed++
+				continue
+			}
+			seen[line] = true
+			kept = append(kept, line)
+		}
+		return kept
+	})
+	if ok {
+		editorSetStatusMessage("Removed %d duplicate lines", removed)
+	}
+}
+
+// Reverse the order of the selected lines, or the whole file.
+// The cursor stays on the line it was on, wherever that ends up.
+func editorReverseLines() {
+	start, end := editorSelectedLines(&config)
+	cx, cy := config.cx, config.cy
+	if !editorTransformLines("reverse", start, end, func(lines []string) []string {
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+		return lines
+	}) {
+		return
+	}
+	if cy >= start && cy < end {
+		config.cy = start + end - 1 - cy
+		config.cx = cx
+	}
+}
+
+// Apply ROT13 to the selected lines, or the current one. Only ASCII letters change,
+// each moving 13 places along the alphabet, so doing it twice gets the text back.
+func editorRot13() {
+	start, end := config.cy, MIN(config.cy+1, config.numrows)
+	if config.blockSelect || config.selecting {
+		start, end = editorSelectedLines(&config)
+	}
+	cx, cy := config.cx, config.cy
+	rot13 := func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z':
+			return 'a' + (char-'a'+13)%26
+		case char >= 'A' && char <= 'Z':
+			return 'A' + (char-'A'+13)%26
+		}
+		return char
+	}
+	if editorTransformLines("ROT13", start, end, func(lines []string) []string {
+		for i := range lines {
+			// Work on runes, so raw bytes that aren't UTF-8 come through as they were.
+			runes := decodeLine(lines[i])
+			for j, char := range runes {
+				runes[j] = rot13(char)
+			}
+			lines[i] = encodeLine(runes)
+		}
+		return lines
+	}) {
+		config.cx, config.cy = cx, cy
+	}
+}
+
+// Redo the indentation of every line in the file's indent style, tabs or spaces.
+// Only the whitespace a line starts with is changed, keeping its width.
+func editorCleanUpIndent() {
+	if config.pagedFile != nil {
+		editorSetStatusMessage("File is too big to clean up")
+		return
+	}
+	changed := 0
+	for i := range config.rows {
+		row := &config.rows[i]
+		oldLen, width := 0, 0
+		for ; oldLen < row.Len(); oldLen++ {
+			if char := row.content.At(oldLen); char == '\t' {
+				width += config.tabStop - width%config.tabStop
+			} else if char == ' ' {
+				width++
+			} else {
+				break
+			}
+		}
+		indent := strings.Repeat(" ", width)
+		if !config.softTabs {
+			indent = strings.Repeat("\t", width/config.tabStop) + strings.Repeat(" ", width%config.tabStop)
+		}
+		if slices.Equal(row.content.Slice(0, oldLen), []rune(indent)) {
+			continue
+		}
+		editorRowReplace(&config, row, 0, oldLen, []rune(indent))
+		if i == config.cy {
+			// Keep the cursor on the same character.
+			if config.cx >= oldLen {
+				config.cx += len(indent) - oldLen
+			} else {
+				config.cx = MIN(config.cx, len(indent))
+			}
+		}
+		changed++
+	}
+	editorSetStatusMessage("Cleaned up the indentation of %d lines", changed)
+}
+
+// ==========================================
+// ================ Snippets ================
+// ==========================================
+
+// Snippet bodies, by the word that expands them.
+var snippets = map[string]string{}
+
+// Add a snippet from the rc file. The trigger must be a single word.
+func editorAddSnippet(trigger, body string) error {
+	if len(trigger) == 0 || strings.IndexFunc(trigger, func(char rune) bool { return !isWordChar(char) }) >= 0 {
+		return fmt.Errorf("snippet trigger must be a single word, got %q", trigger)
+	}
+	snippets[trigger] = body
+	return nil
+}
+
+// Split a snippet body into lines. \n starts a new line, \t is a tab and \\ a backslash.
+// $1 to $9 mark where Tab stops, in order, and $0 where it stops last. $$ is a dollar sign.
+// The stops are returned in the order they're visited, as a line and a column in it.
+func parseSnippet(body string) (lines []string, stops []editorCursor) {
+	type stop struct {
+		order int
+		at    editorCursor
+	}
+	var found []stop
+	var line []rune
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
+		var next rune
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case char == '\\' && next == 'n':
+			lines = append(lines, string(line))
+			line = nil
+			i++
+		case char == '\\' && next == 't':
+			line = append(line, '\t')
+			i++
+		case char == '\\' && next == '\\':
+			line = append(line, '\\')
+			i++
+		case char == '$' && next == '$':
+			line = append(line, '$')
+			i++
+		case char == '$' && next >= '0' && next <= '9':
+			order := int(next - '0')
+			if order == 0 {
+				order = 10
+			}
+			found = append(found, stop{order, editorCursor{cx: len(line), cy: len(lines)}})
+			i++
+		default:
+			line = append(line, char)
+		}
+	}
+	lines = append(lines, string(line))
+
+	slices.SortStableFunc(found, func(a, b stop) bool { return a.order < b.order })
+	for _, s := range found {
+		stops = append(stops, s.at)
+	}
+	return lines, stops
+}
+
+// Expand the snippet named by the word just before the cursor. Later lines of the
+// snippet are indented like the current one. Returns false if there's no snippet.
+func editorExpandSnippet() bool {
+	if config.cy >= config.numrows || config.pagedFile != nil {
+		return false
+	}
+	row := &config.rows[config.cy]
+	start := config.cx
+	for start > 0 && isWordChar(row.content.At(start-1)) {
+		start--
+	}
+	body, ok := snippets[encodeLine(row.content.Slice(start, config.cx))]
+	if start == config.cx || !ok {
+		return false
+	}
+
+	lines, stops := parseSnippet(body)
+	_, indentLen := editorRowIndent(row)
+	indent := encodeLine(row.content.Slice(0, MIN(indentLen, start)))
+	rest := encodeLine(row.content.Slice(config.cx, row.Len()))
+	editorRowReplace(&config, row, start, row.Len()-start, decodeLine(lines[0]))
+	for i := 1; i < len(lines); i++ {
+		editorInsertRow(&config, config.cy+i, indent+lines[i])
+	}
+	last := &config.rows[config.cy+len(lines)-1]
+	end := editorCursor{cx: last.Len(), cy: config.cy + len(lines) - 1}
+	editorRowAppendString(&config, last, rest)
+
+	// Make the stops relative to the file instead of the snippet.
+	for i := range stops {
+		if stops[i].cy == 0 {
+			stops[i].cx += start
+		} else {
+			stops[i].cx += len(decodeLine(indent))
+		}
+		stops[i].cy += config.cy
+	}
+	config.snippetStops = stops
+	config.snippetTop, config.snippetBottom = config.cy, end.cy
+	// Nothing's been typed at any stop yet.
+	config.snippetAt = end
+	config.snippetRows = config.numrows
+	config.snippetRowLen = config.rows[end.cy].Len()
+	config.snippetEdits = config.edits
+	if !editorNextSnippetStop() {
+		config.cx, config.cy = end.cx, end.cy
+	}
+	return true
+}
+
+// Move the cursor to the next tab stop of the last snippet.
+// Returns false if there are none left.
+func editorNextSnippetStop() bool {
+	if len(config.snippetStops) == 0 {
+		return false
+	}
+	if end, ok := editorSnippetStopEnd(); ok {
+		// Whatever was typed at the last stop pushed the ones after it along.
+		at := config.snippetAt
+		for i, stop := range config.snippetStops {
+			if stop.cy > at.cy {
+				config.snippetStops[i].cy += end.cy - at.cy
+			} else if stop.cy == at.cy && stop.cx > at.cx {
+				config.snippetStops[i] = editorCursor{cx: end.cx + stop.cx - at.cx, cy: end.cy}
+			}
+		}
+		config.snippetBottom += end.cy - at.cy
+	}
+
+	next := config.snippetStops[0]
+	config.snippetStops = config.snippetStops[1:]
+	config.cy = MIN(next.cy, config.numrows-1)
+	config.cx = MIN(next.cx, config.rows[config.cy].Len())
+	config.snippetAt = editorCursor{cx: config.cx, cy: config.cy}
+	config.snippetRows = config.numrows
+	config.snippetRowLen = config.rows[config.cy].Len()
+	config.snippetEdits = config.edits
+	return true
+}
+
+// Where what's been typed at the current snippet stop ends, just before the text
+// that was after the stop. Returns false if that text isn't there anymore.
+func editorSnippetStopEnd() (editorCursor, bool) {
+	at := config.snippetAt
+	end := editorCursor{cy: at.cy + config.numrows - config.snippetRows}
+	if end.cy < at.cy || end.cy >= config.numrows {
+		return end, false
+	}
+	end.cx = config.rows[end.cy].Len() - (config.snippetRowLen - at.cx)
+	return end, end.cy > at.cy || end.cx >= at.cx
+}
+
+// Whether the cursor is in what's been typed at the current snippet stop.
+func editorInSnippetStop() bool {
+	end, ok := editorSnippetStopEnd()
+	if len(config.snippetStops) == 0 || !ok {
+		return false
+	}
+	start := config.snippetAt
+	if config.cy < start.cy || config.cy > end.cy {
+		return false
+	}
+	return (config.cy > start.cy || config.cx >= start.cx) && (config.cy < end.cy || config.cx <= end.cx)
+}
+
+// Forget the snippet's stops once the cursor leaves its rows, or anything is edited
+// other than at the current stop, since they can't be kept in the right place.
+// wasInStop is whether the cursor was at the stop before the last keypress.
+func editorCheckSnippetStops(wasInStop bool) {
+	if len(config.snippetStops) == 0 {
+		return
+	}
+	bottom := config.snippetBottom + config.numrows - config.snippetRows
+	if config.cy < config.snippetTop || config.cy > bottom ||
+		config.edits != config.snippetEdits && (!wasInStop || !editorInSnippetStop()) {
+		config.snippetStops = nil
+		return
+	}
+	config.snippetEdits = config.edits
+}
+
+// ==========================================
+// =============== Navigation ===============
+// ==========================================
+
+// Whether a row has nothing but whitespace in it.
+func editorRowIsBlank(row *editorRow) bool {
+	for _, char := range editorRowText(row) {
+		if !unicode.IsSpace(char) {
+			return false
+		}
+	}
+	return true
+}
+
+// The width of a row's leading whitespace with tabs expanded, and how many characters it spans.
+func editorRowIndent(row *editorRow) (width int, length int) {
+	for _, char := range editorRowText(row) {
+		if char == '\t' {
+			width += config.tabStop - (width % config.tabStop)
+		} else if char == ' ' {
+			width++
+		} else {
+			break
+		}
+		length++
+	}
+	return width, length
+}
+
+// Move the cursor to the next line, in the given direction, indented the same as the current one.
+// Blank lines are skipped over.
+func editorMoveToSameIndent(direction int) {
+	if config.cy >= config.numrows {
+		return
+	}
+	width, _ := editorRowIndent(&config.rows[config.cy])
+	for y := config.cy + direction; y >= 0 && y < config.numrows; y += direction {
+		row := &config.rows[y]
+		if editorRowIsBlank(row) {
+			continue
+		}
+		if rowWidth, length := editorRowIndent(row); rowWidth == width {
+			config.cy = y
+			config.cx = length
+			return
+		}
+	}
+	editorSetStatusMessage("No other line at this indentation")
+}
+
+func editorNextSameIndent() {
+	editorMoveToSameIndent(1)
+}
+
+func editorPrevSameIndent() {
+	editorMoveToSameIndent(-1)
+}
+
+// Remember where the cursor is if anything was edited since edits was counted.
+// Edits on the same line as the last one just move it.
+func editorRecordEdit(edits int) {
+	if config.edits == edits || !config.dirty {
+		// Nothing changed, or a file was just opened.
+		return
+	}
+	at := editorCursor{config.cx, config.cy}
+	if n := len(config.editRing); n > 0 && config.editRing[n-1].cy == at.cy {
+		config.editRing[n-1] = at
+		return
+	}
+	config.editRing = append(config.editRing, at)
+	if len(config.editRing) > KILO_EDIT_RING_SIZE {
+		config.editRing = config.editRing[1:]
+	}
+}
+
+// Jump to where the last edit was. Doing it again from there goes to the one before,
+// and from the oldest back to the most recent.
+func editorLastEdit() {
+	n := len(config.editRing)
+	if n == 0 {
+		editorSetStatusMessage("No edits yet")
+		return
+	}
+	next := n - 1
+	if i := slices.Index(config.editRing, editorCursor{config.cx, config.cy}); i >= 0 {
+		next = (i + n - 1) % n
+	}
+	editorPushJump(config.cx, config.cy)
+	editorMoveToJump(config.editRing[next])
+	editorSetStatusMessage("Edit %d of %d", n-next, n)
+}
+
+// Remember a place the cursor is jumping away from, for jump-back. These motions
+// are jumps: searching, paging up and down, going to a mark or the last edit, and
+// going to a location like a build error, grep result or definition.
+func editorPushJump(cx, cy int) {
+	// Jumping from somewhere reached by jump-back starts a new history from there.
+	config.jumps = append(config.jumps[:config.jumpIndex], editorCursor{cx, cy})
+	if len(config.jumps) > KILO_JUMP_LIST_SIZE {
+		config.jumps = config.jumps[1:]
+	}
+	config.jumpIndex = len(config.jumps)
+}
+
+// Go back to where the cursor was before the last jump.
+func editorJumpBack() {
+	if config.jumpIndex == 0 {
+		editorSetStatusMessage("No earlier jumps")
+		return
+	}
+	if config.jumpIndex == len(config.jumps) {
+		// Remember where this is, so jump-forward can come back.
+		config.jumps = append(config.jumps, editorCursor{config.cx, config.cy})
+	}
+	config.jumpIndex--
+	editorMoveToJump(config.jumps[config.jumpIndex])
+}
+
+// Undo a jump-back.
+func editorJumpForward() {
+	if config.jumpIndex >= len(config.jumps)-1 {
+		editorSetStatusMessage("No later jumps")
+		return
+	}
+	config.jumpIndex++
+	editorMoveToJump(config.jumps[config.jumpIndex])
+}
+
+// Put the cursor back at a remembered place, as near to it as the file now allows.
+func editorMoveToJump(at editorCursor) {
+	config.cy = MIN(at.cy, config.numrows)
+	config.cx = 0
+	if config.cy < config.numrows {
+		config.cx = MIN(at.cx, config.rows[config.cy].Len())
+	}
+}
+
+// Move the marks on or after row at by n rows, since rows were added or removed before them.
+func editorShiftMarks(e *editorConfig, at, n int) {
+	for name, mark := range e.marks {
+		if mark.cy >= at {
+			mark.cy = MAX(mark.cy+n, at+MIN(n, 0))
+			e.marks[name] = mark
+		}
+	}
+}
+
+// Ask for the letter naming a mark.
+func editorReadMarkName(prompt string) (rune, bool) {
+	editorSetStatusMessage("%s", prompt)
+	editorRefreshScreen()
+	key, _ := editorReadKey()
+	if key >= 0x80 || !unicode.IsLetter(rune(key)) {
+		editorSetStatusMessage("")
+		return 0, false
+	}
+	return rune(key), true
+}
+
+// Name the cursor's place with a letter, to jump back to later.
+func editorSetMark() {
+	name, ok := editorReadMarkName("Set mark (a letter):")
+	if !ok {
+		return
+	}
+	if config.marks == nil {
+		config.marks = map[rune]editorCursor{}
+	}
+	config.marks[name] = editorCursor{config.cx, config.cy}
+	editorSetStatusMessage("Mark %c set", name)
+}
+
+// Jump to a mark set earlier.
+func editorGoToMark() {
+	name, ok := editorReadMarkName("Go to mark:")
+	if !ok {
+		return
+	}
+	mark, ok := config.marks[name]
+	if !ok {
+		editorSetStatusMessage("No mark %c", name)
+		return
+	}
+	editorPushJump(config.cx, config.cy)
+	editorMoveToJump(mark)
+	editorSetStatusMessage("")
+}
+
+// Move the cursor past the end of the paragraph, to the blank line after it.
+func editorNextParagraph() {
+	y := config.cy
+	for y < config.numrows && editorRowIsBlank(&config.rows[y]) {
+		y++
+	}
+	for y < config.numrows && !editorRowIsBlank(&config.rows[y]) {
+		y++
+	}
+	if y >= config.numrows {
+		// No blank line left, stop at the very end.
+		editorMoveToEnd()
+		return
+	}
+	config.cy, config.cx = y, 0
+}
+
+// Move the cursor before the start of the paragraph, to the blank line above it.
+func editorPrevParagraph() {
+	y := config.cy
+	for y >= 0 && y < config.numrows && editorRowIsBlank(&config.rows[y]) {
+		y--
+	}
+	for y >= 0 && !editorRowIsBlank(&config.rows[y]) {
+		y--
+	}
+	config.cy, config.cx = MAX(y, 0), 0
+}
+
+// Move the cursor to the end of the last row.
+func editorMoveToEnd() {
+	if config.numrows == 0 {
+		config.cy, config.cx = 0, 0
+		return
+	}
+	config.cy = config.numrows - 1
+	if config.rows[config.cy].unloaded {
+		editorPageInRow(&config.rows[config.cy])
+	}
+	config.cx = config.rows[config.cy].Len()
+}
+
+// The first row of the paragraph containing row y.
+func editorParagraphTop(y int) int {
+	for y > 0 && !editorRowIsBlank(&config.rows[y-1]) {
+		y--
+	}
+	return y
+}
+
+// Call visit with the position of each sentence start from the top row onwards, until it returns false.
+// Sentences start a paragraph, or follow a . ! or ? and some whitespace.
+func editorEachSentenceStart(top int, visit func(y, x int) bool) {
+	// Whether the next non-space character starts a sentence
+	atStart := true
+	for y := top; y < config.numrows; y++ {
+		if editorRowIsBlank(&config.rows[y]) {
+			atStart = true
+			continue
+		}
+		sawEnd := false
+		for x, char := range editorRowText(&config.rows[y]) {
+			if unicode.IsSpace(char) {
+				atStart = atStart || sawEnd
+				sawEnd = false
+				continue
+			}
+			if atStart {
+				if !visit(y, x) {
+					return
+				}
+				atStart = false
+			}
+			sawEnd = strings.ContainsRune(".!?", char)
+		}
+		// The end of a line counts as whitespace.
+		atStart = atStart || sawEnd
+	}
+}
+
+// Whether position a comes before position b.
+func positionBefore(ay, ax, by, bx int) bool {
+	return ay < by || (ay == by && ax < bx)
+}
+
+// Move the cursor to the start of the next sentence.
+func editorNextSentence() {
+	if config.cy >= config.numrows {
+		return
+	}
+	found := false
+	editorEachSentenceStart(editorParagraphTop(config.cy), func(y, x int) bool {
+		if positionBefore(config.cy, config.cx, y, x) {
+			config.cy, config.cx = y, x
+			found = true
+			return false
+		}
+		return true
+	})
+	if !found {
+		editorMoveToEnd()
+	}
+}
+
+// Move the cursor to the start of the sentence, or the previous one if it's already there.
+func editorPrevSentence() {
+	y := MIN(config.cy, config.numrows-1)
+	for y >= 0 {
+		top := editorParagraphTop(y)
+		foundY, foundX := -1, -1
+		editorEachSentenceStart(top, func(y, x int) bool {
+			if !positionBefore(y, x, config.cy, config.cx) {
+				return false
+			}
+			foundY, foundX = y, x
+			return true
+		})
+		if foundY >= 0 {
+			config.cy, config.cx = foundY, foundX
+			return
+		}
+		// Nothing before the cursor in this paragraph, try the one above.
+		// Its last row is the first one that isn't blank going up.
+		for y = top - 1; y >= 0; y-- {
+			if !editorRowIsBlank(&config.rows[y]) {
+				break
+			}
+		}
+	}
+	config.cy, config.cx = 0, 0
+}
+
+// Whether a subword starts at runes[i], inside a word: at a capital after a
+// lowercase letter, at the last capital of a run of them that's followed by
+// a lowercase letter, and where a run of digits starts or ends.
+// getHTTPResponse2 splits into get, HTTP, Response and 2.
+func isSubwordStart(runes []rune, i int) bool {
+	prev, char := runes[i-1], runes[i]
+	switch {
+	case unicode.IsLower(prev) && unicode.IsUpper(char):
+		return true
+	case unicode.IsUpper(prev) && unicode.IsUpper(char):
+		return i+1 < len(runes) && unicode.IsLower(runes[i+1])
+	}
+	return unicode.IsDigit(prev) != unicode.IsDigit(char)
+}
+
+// Move the cursor to the end of the next word. With subwords, parts of
+// camelCase and snake_case names count as words, and underscores don't.
+// At the end of a line, the cursor moves to the start of the next one.
+func editorMoveWordRight(subwords bool) {
+	if config.cy >= config.numrows {
+		return
+	}
+	runes := config.rows[config.cy].content.Runes()
+	if config.cx >= len(runes) {
+		if config.cy+1 < config.numrows {
+			config.cy, config.cx = config.cy+1, 0
+		}
+		return
+	}
+	inWord := func(char rune) bool { return isWordChar(char) && !(subwords && char == '_') }
+	i := config.cx
+	for i < len(runes) && !inWord(runes[i]) {
+		i++
+	}
+	for i < len(runes) && inWord(runes[i]) {
+		i++
+		if subwords && i < len(runes) && inWord(runes[i]) && isSubwordStart(runes, i) {
+			break
+		}
+	}
+	config.cx = i
+}
+
+// Move the cursor to the start of the word before it, the reverse of editorMoveWordRight.
+func editorMoveWordLeft(subwords bool) {
+	if config.cy >= config.numrows || config.cx == 0 {
+		if config.cy > 0 {
+			config.cy--
+			config.cx = config.rows[config.cy].Len()
+		}
+		return
+	}
+	runes := config.rows[config.cy].content.Runes()
+	inWord := func(char rune) bool { return isWordChar(char) && !(subwords && char == '_') }
+	i := MIN(config.cx, len(runes))
+	for i > 0 && !inWord(runes[i-1]) {
+		i--
+	}
+	for i > 0 && inWord(runes[i-1]) {
+		i--
+		if subwords && i > 0 && inWord(runes[i-1]) && isSubwordStart(runes, i) {
+			break
+		}
+	}
+	config.cx = i
+}
+
+func editorNextWord() {
+	editorMoveWordRight(false)
+}
+
+func editorPrevWord() {
+	editorMoveWordLeft(false)
+}
+
+func editorNextSubword() {
+	editorMoveWordRight(true)
+}
+
+func editorPrevSubword() {
+	editorMoveWordLeft(true)
+}
+
+// ==========================================
+// =============== File I/O =================
+// ==========================================
+
+// Bytes that aren't valid UTF-8 are stored in rows as runes in this range,
+// one per byte, so they can be written back out exactly as they were read.
+const RAW_BYTE_RUNE_BASE = 0xDC00
+
+// Convert the raw bytes of a line to runes, keeping any invalid UTF-8 bytes.
+func decodeLine(line string) []rune {
+	runes := make([]rune, 0, len(line))
+	for i := 0; i < len(line); {
+		char, size := utf8.DecodeRuneInString(line[i:])
+		if char == utf8.RuneError && size == 1 {
+			char = RAW_BYTE_RUNE_BASE + rune(line[i])
+		}
+		runes = append(runes, char)
+		i += size
+	}
+	return runes
+}
+
+// Convert runes back to the raw bytes of a line, the reverse of decodeLine.
+func encodeLine(runes []rune) string {
+	var line strings.Builder
+	for _, char := range runes {
+		if b, ok := rawByte(char); ok {
+			line.WriteByte(b)
+		} else {
+			line.WriteRune(char)
+		}
+	}
+	return line.String()
+}
+
+// If char stands for a raw byte from decodeLine, return that byte.
+func rawByte(char rune) (byte, bool) {
+	if char >= RAW_BYTE_RUNE_BASE+0x80 && char <= RAW_BYTE_RUNE_BASE+0xFF {
+		return byte(char - RAW_BYTE_RUNE_BASE), true
+	}
+	return 0, false
+}
+
+// Convert editor rows to one string.
+func editorRowsToString(rows *[]editorRow) string {
+	var result strings.Builder
+	for _, row := range *rows {
+		result.WriteString(row.content.String())
+		result.WriteRune('\n')
+	}
+
+	return result.String()
+}
+
+func editorOpen(filename string) error {
+	config.filename = filename
+	editorSelectSyntaxHighlight()
+
+	// Open file for reading
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+
+	config.hasBOM = false
+	config.binary = false
+	config.scratch = false
+	config.selecting = false
+	config.editRing = nil
+	config.marks = nil
+	config.jumps, config.jumpIndex = nil, 0
+	config.undoStack, config.redoStack = nil, nil
+	// Reading the file in isn't a change to undo.
+	config.undoPaused = true
+	defer func() { config.undoPaused = false }()
+	config.fileSettings = defaultFileSettings
+	config.lineEnding, config.finalNewline = detectLineEndings(file)
+	detected := config.lineEnding
+	if softTabs, width, ok := detectIndent(file); ok {
+		config.softTabs = softTabs
+		if softTabs {
+			config.indentSize = width
+		}
+	}
+	// Indent rules say for sure, so they go after guessing. An .editorconfig
+	// is more specific than the rc file, so it goes last.
+	editorApplyIndentRule()
+	editorApplyEditorConfig()
+	// Lines that end unlike the first keep their endings, unless all of them were asked to be the same.
+	keepEndings := config.lineEnding == detected
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	if config.pagedThreshold > 0 && size > int64(config.pagedThreshold)<<20 {
+		// Too big to comfortably hold in memory, page it in as needed.
+		return editorOpenPaged(file, size, keepEndings)
+	}
+	defer file.Close()
+
+	// Read line by line. A line can be any length, so it's not split up into tokens.
+	progress := newLoadProgress(size)
+	var read int64
+	hash := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(file, hash))
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			progress.done()
+			return fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		if len(text) == 0 {
+			break
+		}
+		read += int64(len(text))
+		progress.update(read)
+		line, ending := cutLineEnding(text)
+		if config.numrows == 0 && strings.HasPrefix(line, UTF8_BOM) {
+			// The BOM isn't text, don't show it or let it be edited.
+			line = strings.TrimPrefix(line, UTF8_BOM)
+			config.hasBOM = true
+		}
+		if !config.binary && (!utf8.ValidString(line) || strings.IndexByte(line, 0) >= 0) {
+			config.binary = true
+		}
+		editorInsertRow(&config, config.numrows, line)
+		if keepEndings && ending != "" && ending != config.lineEnding {
+			config.rows[config.numrows-1].lineEnding = ending
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	progress.done()
+	config.dirty = false
+	editorRefreshChanges()
+	editorRecordFileStat()
+	editorLoadUndoFile(hash.Sum(nil))
+	return nil
+}
+
+// Forget how rows have changed, once they match the file on disk.
+func editorClearChanges() {
+	for i := range config.rows {
+		config.rows[i].change = CHANGE_NONE
+	}
+}
+
+// Shows how much of a file has been read while it's opened, so a big file
+// doesn't leave the screen frozen.
+type loadProgress struct {
+	size int64
+	// When the screen is next brought up to date.
+	next  time.Time
+	shown bool
+}
+
+func newLoadProgress(size int64) *loadProgress {
+	return &loadProgress{size: size, next: time.Now().Add(KILO_LOAD_PROGRESS_INTERVAL)}
+}
+
+// Note that read bytes have been read. Now and then, the screen is redrawn to show it.
+func (p *loadProgress) update(read int64) {
+	if p.size == 0 || time.Now().Before(p.next) {
+		return
+	}
+	editorSetStatusMessage("Loading %s… %d%%", filepath.Base(config.filename), MIN(int(read*100/p.size), 100))
+	editorRefreshScreen()
+	p.next = time.Now().Add(KILO_LOAD_PROGRESS_INTERVAL)
+	p.shown = true
+}
+
+// Clear the progress once the whole file has been read.
+func (p *loadProgress) done() {
+	if p.shown {
+		editorSetStatusMessage("")
+	}
+}
+
+// Split the line ending off the end of a line read from a file.
+func cutLineEnding(line string) (string, string) {
+	for _, ending := range []string{"\r\n", "\n"} {
+		if content, ok := strings.CutSuffix(line, ending); ok {
+			return content, ending
+		}
+	}
+	return line, ""
+}
+
+// The line ending to write after row.
+func editorRowLineEnding(row *editorRow) string {
+	if row.lineEnding != "" {
+		return row.lineEnding
+	}
+	return config.lineEnding
+}
+
+// Figure out how the file ends its lines, judging by the first line, and whether its last line has an ending.
+func detectLineEndings(file *os.File) (lineEnding string, finalNewline bool) {
+	lineEnding, finalNewline = defaultFileSettings.lineEnding, true
+	start := make([]byte, 64<<10)
+	n, _ := file.ReadAt(start, 0)
+	if i := bytes.IndexByte(start[:n], '\n'); i > 0 && start[i-1] == '\r' {
+		lineEnding = "\r\n"
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil {
+			finalNewline = last[0] == '\n'
+		}
+	}
+	return lineEnding, finalNewline
+}
+
+// Guess whether the file indents with tabs or spaces from how most of its
+// first indented lines start. For spaces, width is the smallest indent.
+func detectIndent(file *os.File) (softTabs bool, width int, ok bool) {
+	start := make([]byte, 64<<10)
+	n, _ := file.ReadAt(start, 0)
+	tabs, spaces := 0, 0
+	for _, line := range bytes.Split(start[:n], []byte("\n")) {
+		if tabs+spaces == KILO_INDENT_SAMPLE_LINES {
+			break
+		}
+		indent := len(line) - len(bytes.TrimLeft(line, " "))
+		if len(line) > 0 && line[0] == '\t' {
+			tabs++
+		} else if indent > 1 && indent < len(line) {
+			// A single space is more likely to line something up, like a
+			// comment's *, than to be the indentation.
+			spaces++
+			if width == 0 || indent < width {
+				width = indent
+			}
+		}
+	}
+	if tabs == spaces {
+		return false, 0, false
+	}
+	return spaces > tabs, width, true
+}
+
+// Whether the line ending goes after the last line when saving.
+func editorEndsWithNewline() bool {
+	return config.insertFinalNewline || config.finalNewline
+}
+
+// The text to write to disk for the rows, with the file's line endings.
+func editorFileContents() string {
+	if config.hexMode {
+		return string(config.hexData)
+	}
+	var result strings.Builder
+	if config.hasBOM && config.preserveBOM {
+		result.WriteString(UTF8_BOM)
+	}
+	for i := range config.rows {
+		result.WriteString(config.rows[i].content.String())
+		if i < config.numrows-1 || editorEndsWithNewline() {
+			result.WriteString(editorRowLineEnding(&config.rows[i]))
+		}
+	}
+	return result.String()
+}
+
+// Remove spaces and tabs from the ends of rows. Rows that are still on disk are left as they are.
+func editorTrimTrailingWhitespace() {
+	for i := range config.rows {
+		row := &config.rows[i]
+		if row.unloaded {
+			continue
+		}
+		content := row.content.Runes()
+		end := len(content)
+		for end > 0 && (content[end-1] == ' ' || content[end-1] == '\t') {
+			end--
+		}
+		if end < len(content) {
+			editorRowReplace(&config, row, end, len(content)-end, nil)
+		}
+	}
+	if config.cy < config.numrows {
+		config.cx = MIN(config.cx, config.rows[config.cy].Len())
+	}
+}
+
+// Remember the on-disk state of the file so later saves can tell if someone else changed it.
+func editorRecordFileStat() {
+	info, err := os.Stat(config.filename)
+	if err != nil {
+		config.fileModTime = time.Time{}
+		config.fileSize = 0
+		return
+	}
+	config.fileModTime = info.ModTime()
+	config.fileSize = info.Size()
+}
+
+// Check if the file was modified on disk since we last read or wrote it.
+func editorFileChangedOnDisk() bool {
+	if config.fileModTime.IsZero() {
+		// We never saw this file on disk, so there's nothing to compare against.
+		return false
+	}
+	info, err := os.Stat(config.filename)
+	if err != nil {
+		// The file went away. Saving will recreate it, which is fine.
+		return false
+	}
+	return !info.ModTime().Equal(config.fileModTime) || info.Size() != config.fileSize
+}
+
+// Make filename the file being edited, unless it already is.
+// Returns false, with a message saying why, if it can't be opened.
+func editorSwitchFile(filename string) bool {
+	current, _ := filepath.Abs(config.filename)
+	if target, _ := filepath.Abs(filename); target == current {
+		return true
+	}
+	if editorHasUnsavedChanges() {
+		editorSetStatusMessage("Save your changes before opening %s", filename)
+		return false
+	}
+	if _, err := os.Stat(filename); err != nil {
+		editorSetStatusMessage("Can't open %s: %s", filename, err.Error())
+		return false
+	}
+	config.filename = filename
+	config.cursors = nil
+	config.blockSelect = false
+	config.selecting = false
+	if err := editorReload(); err != nil {
+		editorSetStatusMessage("%s", err.Error())
+		return false
+	}
+	return true
+}
+
+// Throw away the current buffer and read the file from disk again.
+func editorReload() error {
+	editorClosePaged()
+	config.rows = nil
+	wordCounts = map[string]int{}
+	config.numrows = 0
+	config.cx, config.cy, config.rx = 0, 0, 0
+	config.rowOffset, config.colOffset = 0, 0
+	return editorOpen(config.filename)
+}
+
+// Check if quitting or opening another file would lose changes.
+func editorHasUnsavedChanges() bool {
+	return config.dirty && !config.scratch
+}
+
+// Swap the buffer for an empty scratch buffer, for notes that don't need keeping.
+func editorNewScratch() {
+	if editorHasUnsavedChanges() {
+		editorSetStatusMessage("Save your changes before starting a scratch buffer")
+		return
+	}
+	editorClosePaged()
+	config.rows = nil
+	wordCounts = map[string]int{}
+	config.numrows = 0
+	config.cx, config.cy, config.rx = 0, 0, 0
+	config.rowOffset, config.colOffset = 0, 0
+	config.filename = ""
+	editorSelectSyntaxHighlight()
+	config.cursors = nil
+	config.blockSelect = false
+	config.selecting = false
+	config.editRing = nil
+	config.marks = nil
+	config.jumps, config.jumpIndex = nil, 0
+	config.fileModTime, config.fileSize = time.Time{}, 0
+	config.scratch = true
+	// Start with a line to type on, so the welcome message doesn't show.
+	editorInsertRow(&config, 0, "")
+	config.undoStack, config.redoStack = nil, nil
+	config.dirty = false
+	editorClearChanges()
+	editorSetStatusMessage("Scratch buffer, it won't be saved")
+}
+
+func editorSave() {
+	if config.scratch {
+		editorSetStatusMessage("Scratch buffers aren't saved")
+		return
+	}
+	if len(config.filename) == 0 {
+		var err error
+		config.filename, err = editorPrompt("Save as: %s", nil)
+		if err != nil {
+			editorSetStatusMessage("Save aborted: %s", err.Error())
+			return
+		}
+		editorSelectSyntaxHighlight()
+	} else if editorFileChangedOnDisk() {
+		// Someone else wrote to the file, don't blindly clobber their changes.
+		choice, err := editorPrompt("File changed on disk! (o)verwrite, (r)eload, (c)ancel: %s", nil)
+		if err != nil {
+			editorSetStatusMessage("Save aborted")
+			return
+		}
+		switch strings.ToLower(choice) {
+		case "o", "overwrite":
+		case "r", "reload":
+			if err := editorReload(); err != nil {
+				editorSetStatusMessage("Reload failed: %s", err.Error())
+			} else {
+				editorSetStatusMessage("Reloaded %s from disk", config.filename)
+			}
+			return
+		default:
+			editorSetStatusMessage("Save aborted")
+			return
+		}
+	}
+
+	if config.trimTrailingWhitespace {
+		editorTrimTrailingWhitespace()
+	}
+	if config.pagedFile != nil {
+		editorSavePaged()
+		return
+	}
+
+	editorString := editorFileContents()
+	file, err := os.Create(config.filename)
+	if err != nil {
+		editorSetStatusMessage("Can't save! %s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(editorString)
+
+	if err != nil {
+		editorSetStatusMessage("Can't save! I/O error: %s", err.Error())
+	} else {
+		editorSaved(len(editorString))
+		if err := editorSaveUndoFile(editorString); err != nil {
+			editorSetStatusMessage("%d bytes written to disk, but can't keep undo history: %s", len(editorString), err.Error())
+		}
+	}
+}
+
+// Catch up once the file has been written: it's no longer dirty, the change gutter
+// starts over from what's on disk, and the status bar says how much went out.
+func editorSaved(written int) {
+	config.dirty = false
+	editorRefreshChanges()
+	editorRecordFileStat()
+	editorSetStatusMessage("%d bytes written to disk", written)
+	editorFlashStatusBar()
+}
+
+// Flash the status bar for a moment, to show something happened.
+func editorFlashStatusBar() {
+	if config.saveFlash == 0 {
+		return
+	}
+	duration := time.Duration(config.saveFlash) * time.Millisecond
+	config.flashUntil = time.Now().Add(duration)
+	flashEvents = time.After(duration)
+}
+
+// ==========================================
+// ================= Undo ===================
+// ==========================================
+
+// A change to put back: the count rows from start are replaced with lines.
+type undoChange struct {
+	Start int      `json:"start"`
+	Count int      `json:"count"`
+	Lines []string `json:"lines"`
+}
+
+// The changes made by one keypress, undone all at once, and where the cursor was before them.
+type undoGroup struct {
+	Changes []undoChange `json:"changes"`
+	Cx      int          `json:"cx"`
+	Cy      int          `json:"cy"`
+}
+
+// The undo history kept next to a file, and a hash of the file it leads back from.
+type undoFile struct {
+	Hash string      `json:"hash"`
+	Undo []undoGroup `json:"undo"`
+}
+
+// Start a new undo group with the next change, so everything one keypress
+// changes is undone together.
+func editorStartUndoGroup(e *editorConfig) {
+	e.undoGroupOpen = false
+	e.undoCursor = editorCursor{e.cx, e.cy}
+}
+
+// Remember how to undo a change to the rows: the count rows from start will
+// need to be replaced with lines.
+func editorRecordUndo(e *editorConfig, start, count int, lines []string) {
+	if e.undoPaused || e.pagedFile != nil {
+		return
+	}
+	if !e.undoGroupOpen || len(e.undoStack) == 0 {
+		e.undoStack = append(e.undoStack, undoGroup{Cx: e.undoCursor.cx, Cy: e.undoCursor.cy})
+		if len(e.undoStack) > KILO_UNDO_LEVELS {
+			e.undoStack = e.undoStack[1:]
+		}
+		e.undoGroupOpen = true
+	}
+	group := &e.undoStack[len(e.undoStack)-1]
+	group.Changes = append(group.Changes, undoChange{start, count, lines})
+	e.redoStack = nil
+}
+
+// Remember how to undo a change to the text of row.
+func editorRecordRowUndo(e *editorConfig, row *editorRow) {
+	if e.undoGroupOpen && len(e.undoStack) > 0 {
+		changes := e.undoStack[len(e.undoStack)-1].Changes
+		if last := changes[len(changes)-1]; last.Start == row.id && last.Count == 1 && len(last.Lines) == 1 {
+			// The row was just changed, and undoing that already puts it back.
+			return
+		}
+	}
+	editorRecordUndo(e, row.id, 1, []string{encodeLine(row.content.Runes())})
+}
+
+// Put back the rows changed by the last keypress that changed any, and the cursor where it was.
+func editorUndo() {
+	if !editorCanUndo() {
+		return
+	}
+	if len(config.undoStack) == 0 {
+		editorSetStatusMessage("Nothing to undo")
+		return
+	}
+	group := config.undoStack[len(config.undoStack)-1]
+	config.undoStack = config.undoStack[:len(config.undoStack)-1]
+	config.redoStack = append(config.redoStack, editorApplyUndo(&config, group))
+}
+
+// Make the last change that was undone again.
+func editorRedo() {
+	if !editorCanUndo() {
+		return
+	}
+	if len(config.redoStack) == 0 {
+		editorSetStatusMessage("Nothing to redo")
+		return
+	}
+	group := config.redoStack[len(config.redoStack)-1]
+	config.redoStack = config.redoStack[:len(config.redoStack)-1]
+	config.undoStack = append(config.undoStack, editorApplyUndo(&config, group))
+}
+
+// Whether the buffer's changes are being kept track of, with a message saying why not if they aren't.
+func editorCanUndo() bool {
+	if config.pagedFile != nil {
+		editorSetStatusMessage("File is too big to undo")
+		return false
+	}
+	if config.hexMode {
+		editorSetStatusMessage("Leave hex view to undo")
+		return false
+	}
+	return true
+}
+
+// Make the changes in group, latest first, and move the cursor to where it was before them.
+// Returns the group that changes the rows back.
+func editorApplyUndo(e *editorConfig, group undoGroup) undoGroup {
+	e.undoPaused = true
+	defer func() { e.undoPaused = false }()
+
+	inverse := undoGroup{Cx: e.cx, Cy: e.cy}
+	for i := len(group.Changes) - 1; i >= 0; i-- {
+		change := group.Changes[i]
+		old := make([]string, change.Count)
+		for j := range old {
+			old[j] = encodeLine(e.rows[change.Start+j].content.Runes())
+		}
+		inverse.Changes = append(inverse.Changes, undoChange{change.Start, len(change.Lines), old})
+		editorReplaceLines(e, change.Start, change.Start+change.Count, change.Lines)
+	}
+	e.cursors = nil
+	e.blockSelect = false
+	e.selecting = false
+	e.cy = MIN(group.Cy, e.numrows)
+	e.cx = 0
+	if e.cy < e.numrows {
+		e.cx = MIN(group.Cx, e.rows[e.cy].Len())
+	}
+	// The next change doesn't belong with the ones before the undo.
+	editorStartUndoGroup(e)
+	return inverse
+}
+
+// Where the undo history of filename is kept: a hidden file next to it.
+func undoFilePath(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".kilo-undo")
+}
+
+// Keep the most recent undo groups next to the file, so they can be undone
+// when it's opened again. contents is what was just written to the file.
+func editorSaveUndoFile(contents string) error {
+	if config.undoFileLevels <= 0 {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(contents))
+	history := undoFile{Hash: hex.EncodeToString(hash[:]), Undo: config.undoStack}
+	if len(history.Undo) > config.undoFileLevels {
+		history.Undo = history.Undo[len(history.Undo)-config.undoFileLevels:]
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(undoFilePath(config.filename), data, 0644)
+}
+
+// Pick up the undo history kept for the file, as long as the file, with the
+// given hash, is still what it was saved as. A history that can't be read is ignored.
+func editorLoadUndoFile(hash []byte) {
+	if config.undoFileLevels <= 0 {
+		return
+	}
+	data, err := os.ReadFile(undoFilePath(config.filename))
+	if err != nil {
+		return
+	}
+	var history undoFile
+	if err := json.Unmarshal(data, &history); err != nil || history.Hash != hex.EncodeToString(hash) {
+		return
+	}
+	config.undoStack = history.Undo
+}
+
+// ==========================================
+// ============== Paged Files ===============
+// ==========================================
+
+// Index the lines of a large file without reading their content. Each row
+// remembers where it lives in the file and is read in when it nears the screen.
+// Lines that don't end with the file's lineEnding keep their own ending if keepEndings is set.
+func editorOpenPaged(file *os.File, size int64, keepEndings bool) error {
+	config.pagedFile = file
+	config.pagedSyntaxRows = 0
+
+	reader := bufio.NewReader(file)
+	if start, _ := reader.Peek(len(UTF8_BOM)); string(start) == UTF8_BOM {
+		config.hasBOM = true
+	}
+	progress := newLoadProgress(size)
+	var offset int64
+	for {
+		progress.update(offset)
+		line, err := reader.ReadSlice('\n')
+		length := len(line)
+		// The byte before the newline may be the end of an earlier piece of the line.
+		var beforeNewline byte
+		// Long lines overflow the reader's buffer, keep going until the newline.
+		for err == bufio.ErrBufferFull {
+			beforeNewline = line[len(line)-1]
+			line, err = reader.ReadSlice('\n')
+			length += len(line)
+		}
+		if err != nil && err != io.EOF {
+			editorClosePaged()
+			return fmt.Errorf("failed to read %s: %w", config.filename, err)
+		}
+		if length == 0 {
+			break
+		}
+		if len(line) > 1 {
+			beforeNewline = line[len(line)-2]
+		}
+		ending := ""
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			ending = "\n"
+			if beforeNewline == '\r' {
+				ending = "\r\n"
+			}
+		}
+		config.rows = append(config.rows, editorRow{
+			id:       config.numrows,
+			offset:   offset,
+			length:   length,
+			unloaded: true,
+			stale:    true,
+		})
+		if keepEndings && ending != "" && ending != config.lineEnding {
+			config.rows[config.numrows].lineEnding = ending
+		}
+		config.numrows++
+		offset += int64(length)
+		if err == io.EOF {
+			break
+		}
+	}
+	progress.done()
+	config.dirty = false
+	editorRecordFileStat()
+	return nil
+}
+
+// Read a row's line from the paged file, without the line ending.
+func editorReadPagedLine(row *editorRow) ([]byte, error) {
+	line := make([]byte, row.length)
+	if _, err := config.pagedFile.ReadAt(line, row.offset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %s: %w", config.filename, err)
+	}
+	if row.offset == 0 {
+		line = bytes.TrimPrefix(line, []byte(UTF8_BOM))
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// Bring a row's content into memory. If it can't be read, the row is left
+// unloaded, so it shows up blank, and the error goes in the status bar.
+func editorPageInRow(row *editorRow) {
+	line, err := editorReadPagedLine(row)
+	if err != nil {
+		editorSetStatusMessage("Can't read line %d: %s", row.id+1, err.Error())
+		return
+	}
+	row.content = newGapBuffer(decodeLine(string(line)))
+	row.unloaded = false
+	row.stale = true
+}
+
+// A row's text. If it isn't in memory, it's read from disk without keeping it,
+// so scanning through a paged file doesn't pull all of it in.
+func editorRowText(row *editorRow) []rune {
+	if !row.unloaded {
+		return row.content.Runes()
+	}
+	line, err := editorReadPagedLine(row)
+	if err != nil {
+		editorSetStatusMessage("Can't read line %d: %s", row.id+1, err.Error())
+		return nil
+	}
+	return decodeLine(string(line))
+}
+
+// Drop a row's content from memory if it can be read back from disk later.
+func editorPageOutRow(row *editorRow) {
+	if row.unloaded || row.offset < 0 {
+		// Already gone, or it has edits that only live in memory.
+		return
+	}
+	editorUncountWords(row)
+	row.content = gapBuffer{}
+	row.render = nil
+	row.highlights = nil
+	row.unloaded = true
+	row.stale = true
+}
+
+// Drop every row that has wandered far enough away from the screen.
+func editorPageOutDistantRows() {
+	if config.pagedFile == nil {
+		return
+	}
+	low := config.rowOffset - KILO_PAGED_WINDOW
+	high := config.rowOffset + config.screenrows + KILO_PAGED_WINDOW
+	for i := range config.rows {
+		if i < low || i > high {
+			editorPageOutRow(&config.rows[i])
+		}
+	}
+}
+
+func editorClosePaged() {
+	if config.pagedFile != nil {
+		config.pagedFile.Close()
+		config.pagedFile = nil
+	}
+}
+
+// Write a paged file back out. Rows still on disk are copied straight from the
+// old file, so a temporary file is written and then moved into place.
+func editorSavePaged() {
+	tmp, err := os.CreateTemp(filepath.Dir(config.filename), ".kilo-*")
+	if err != nil {
+		editorSetStatusMessage("Can't save! I/O error: %s", err.Error())
+		return
+	}
+	writer := bufio.NewWriter(tmp)
+	written := 0
+	if config.hasBOM && config.preserveBOM {
+		written, _ = writer.WriteString(UTF8_BOM)
+	}
+	for i := range config.rows {
+		row := &config.rows[i]
+		var n int
+		if row.unloaded {
+			var line []byte
+			if line, err = editorReadPagedLine(row); err == nil {
+				n, err = writer.Write(line)
+			}
+		} else {
+			n, err = writer.WriteString(row.content.String())
+		}
+		written += n
+		if err == nil && (i < config.numrows-1 || editorEndsWithNewline()) {
+			n, err = writer.WriteString(editorRowLineEnding(row))
+			written += n
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		if info, statErr := os.Stat(config.filename); statErr == nil {
+			os.Chmod(tmp.Name(), info.Mode())
+		}
+		err = os.Rename(tmp.Name(), config.filename)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		editorSetStatusMessage("Can't save! I/O error: %s", err.Error())
+		return
+	}
+
+	// The row offsets point into the old file, so index the new one.
+	cx, cy, rowOffset, colOffset := config.cx, config.cy, config.rowOffset, config.colOffset
+	if err := editorReload(); err != nil {
+		editorSetStatusMessage("Saved, but reading it back failed: %s", err.Error())
+		return
+	}
+	config.cx, config.cy, config.rowOffset, config.colOffset = cx, cy, rowOffset, colOffset
+	editorSaved(written)
+}
+
+// Reload the current file from disk, discarding any unsaved changes.
+func editorReloadCommand() {
+	if len(config.filename) == 0 {
+		editorSetStatusMessage("Nothing to reload, buffer has no file")
+		return
+	}
+	if config.dirty {
+		answer, err := editorPrompt("Discard unsaved changes and reload? (y/n): %s", nil)
+		if err != nil || strings.ToLower(answer) != "y" {
+			editorSetStatusMessage("Reload aborted")
+			return
+		}
+	}
+	if err := editorReload(); err != nil {
+		editorSetStatusMessage("Reload failed: %s", err.Error())
+		return
+	}
+	editorSetStatusMessage("Reloaded %s from disk", config.filename)
+}
+
+// ==========================================
+// =========== External Commands ============
+// ==========================================
+
+// Run a shell command with input on stdin and return what it wrote to stdout.
+// If it fails, the error has the first line of what it wrote to stderr.
+func editorRunCommand(command string, input string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); len(msg) > 0 {
+			return "", errors.New(msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// Replace the rows from start up to end with the lines of text.
+func editorReplaceRows(start, end int, text string) {
+	var lines []string
+	if len(text) > 0 {
+		lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	}
+	editorReplaceLines(&config, start, end, lines)
+}
+
+// Replace the rows from start up to end with lines.
+// Rows that come out the same are kept as they were, so they aren't marked as changed.
+func editorReplaceLines(e *editorConfig, start, end int, lines []string) {
+	newRows := make([]editorRow, len(lines))
+	kept := make([]bool, end-start)
+	for i, line := range lines {
+		if old := start + i; old < end && !e.rows[old].unloaded && encodeLine(e.rows[old].content.Runes()) == line {
+			newRows[i] = e.rows[old]
+			kept[i] = true
+			continue
+		}
+		newRows[i] = editorRow{content: newGapBuffer(decodeLine(line)), stale: true, offset: -1, change: CHANGE_MODIFIED}
+	}
+	if len(lines) == end-start && !slices.Contains(kept, false) {
+		// Nothing changed.
+		return
+	}
+	old := make([]string, end-start)
+	for i := start; i < end; i++ {
+		old[i-start] = encodeLine(e.rows[i].content.Runes())
+	}
+	editorRecordUndo(e, start, len(lines), old)
+	for i := start; i < end; i++ {
+		if !kept[i-start] {
+			editorUncountWords(&e.rows[i])
+		}
+	}
+	e.rows = slices.Replace(e.rows, start, end, newRows...)
+	e.edits++
+	editorShiftMarks(e, end, len(newRows)-(end-start))
+	e.numrows = len(e.rows)
+	for i := start; i < e.numrows; i++ {
+		e.rows[i].id = i
+	}
+	editorInvalidateTabs(e, start+len(newRows))
+	e.dirty = true
+}
+
+// Pipe the whole file through the formatter for its file type.
+// The file is only changed if the formatter succeeds.
+func editorFormat() {
+	if config.syntax == nil || len(config.syntax.formatter) == 0 {
+		editorSetStatusMessage("No formatter for this file type")
+		return
+	}
+	if config.pagedFile != nil {
+		editorSetStatusMessage("File is too big to format")
+		return
+	}
+	input := editorRowsToString(&config.rows)
+	output, err := editorRunCommand(config.syntax.formatter, input)
+	if err != nil {
+		editorSetStatusMessage("Format failed: %s", err.Error())
+		return
+	}
+	if output == input {
+		editorSetStatusMessage("Already formatted")
+		return
+	}
+	editorReplaceRows(0, config.numrows, output)
+	// Stay on the same line, it's probably close to where it was.
+	config.cy = MIN(config.cy, config.numrows)
+	if config.cy < config.numrows {
+		config.cx = MIN(config.cx, config.rows[config.cy].Len())
+	} else {
+		config.cx = 0
+	}
+	editorSetStatusMessage("Formatted with %s", config.syntax.formatter)
+}
+
+// Replace the current line, or the selected rows, with what a
+// shell command prints when given them on stdin.
+func editorFilterCommand() {
+	if config.pagedFile != nil {
+		editorSetStatusMessage("File is too big to filter")
+		return
+	}
+	start, end := config.cy, config.cy
+	if config.blockSelect || config.selecting {
+		start, end = editorSelectedLines(&config)
+		end--
+	}
+	if start >= config.numrows {
+		editorSetStatusMessage("Nothing to filter")
+		return
+	}
+
+	command, err := editorPrompt("Filter through: %s", nil)
+	if err != nil {
+		editorSetStatusMessage("Filter aborted")
+		return
+	}
+	rows := config.rows[start : end+1]
+	output, err := editorRunCommand(command, editorRowsToString(&rows))
+	if err != nil {
+		editorSetStatusMessage("Filter failed: %s", err.Error())
+		return
+	}
+	if len(output) == 0 {
+		editorSetStatusMessage("%s printed nothing, lines left alone", command)
+		return
+	}
+	editorReplaceRows(start, end+1, output)
+	config.blockSelect = false
+	config.selecting = false
+	config.cy, config.cx = start, 0
+}
+
+// Matches a location in build output, like main.go:12:5: undefined: x
+var buildErrorPattern = regexp.MustCompile(`^([^:\s][^:]*):(\d+):(?:(\d+):)?\s*(.*)$`)
+
+// Pick out the locations reported in the output of a build or lint command.
+// Lines that don't name an existing file are skipped.
+func parseBuildErrors(output string) []editorLocation {
+	var locations []editorLocation
+	for _, line := range strings.Split(output, "\n") {
+		match := buildErrorPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		if _, err := os.Stat(match[1]); err != nil {
+			continue
+		}
+		location := editorLocation{filename: match[1], message: match[4]}
+		location.line, _ = strconv.Atoi(match[2])
+		location.col, _ = strconv.Atoi(match[3])
+		locations = append(locations, location)
+	}
+	return locations
+}
+
+// What a build command printed, and how it exited.
+type buildResult struct {
+	command string
+	output  []byte
+	err     error
+}
+
+// Start the build command in the background. Editing carries on while it runs,
+// and the problems it reports can be jumped to once it's done.
+func editorBuild() {
+	if buildEvents != nil {
+		editorSetStatusMessage("Still running the last build")
+		return
+	}
+	results := make(chan buildResult, 1)
+	command := config.buildCommand
+	go func() {
+		output, err := exec.Command("sh", "-c", command).CombinedOutput()
+		results <- buildResult{command, output, err}
+	}()
+	if headless {
+		// There's no waiting for keys to pick the result up, so wait for it here.
+		editorBuildFinished(<-results)
+		return
+	}
+	buildEvents = results
+	editorSetStatusMessage("Running %s...", command)
+}
+
+// Take in the problems a finished build reported. The cursor is left alone,
+// since it has probably moved on since the build started.
+func editorBuildFinished(result buildResult) {
+	buildEvents = nil
+	config.locations = parseBuildErrors(string(result.output))
+	config.locationIndex = -1
+	if n := len(config.locations); n > 0 {
+		editorSetStatusMessage("%s found %d problems, %s goes to the first",
+			result.command, n, editorKeyForAction("next-error"))
+	} else if result.err != nil {
+		editorSetStatusMessage("%s failed: %s", result.command, result.err.Error())
+	} else {
+		editorSetStatusMessage("%s found no problems", result.command)
+	}
+}
+
+func editorNextLocation() {
+	editorMoveLocation(1)
+}
+
+func editorPrevLocation() {
+	editorMoveLocation(-1)
+}
+
+// Jump to the next or previous location from the last build or grep, wrapping around.
+func editorMoveLocation(direction int) {
+	if len(config.locations) == 0 {
+		editorSetStatusMessage("Nothing to jump to, run a build or grep first")
+		return
+	}
+	n := len(config.locations)
+	config.locationIndex = (config.locationIndex + direction + n) % n
+	editorJumpToLocation(config.locationIndex)
+}
+
+// Jump to one of the locations and show its message.
+func editorJumpToLocation(i int) {
+	config.locationIndex = i
+	location := config.locations[i]
+	if editorGoToLocation(location) {
+		editorSetStatusMessage("(%d/%d) %s", i+1, len(config.locations), location.message)
+	}
+}
+
+// Open the location's file and put the cursor there.
+func editorGoToLocation(location editorLocation) bool {
+	if !editorSwitchFile(location.filename) {
+		return false
+	}
+	editorPushJump(config.cx, config.cy)
+	config.cy = MAX(MIN(location.line-1, config.numrows-1), 0)
+	config.cx = 0
+	if config.cy < config.numrows && location.col > 0 {
+		if config.rows[config.cy].unloaded {
+			editorPageInRow(&config.rows[config.cy])
+		}
+		// The column counts bytes. Stop on the character it falls in, even part way through it.
+		row := &config.rows[config.cy]
+		for offset := 0; config.cx < row.Len(); config.cx++ {
+			char := row.content.At(config.cx)
+			size := utf8.RuneLen(char)
+			if _, ok := rawByte(char); ok {
+				size = 1
+			}
+			if offset += size; offset > location.col-1 {
+				break
+			}
+		}
+	}
+	return true
+}
+
+// ==========================================
+// ================== Git ===================
+// ==========================================
+
+// The lines of the file as they're staged in git. ok is false if the file
+// isn't in a git repo, or git doesn't know about it.
+func editorGitBase() (lines []string, ok bool) {
+	dir, name := filepath.Split(config.filename)
+	if len(dir) == 0 {
+		dir = "."
+	}
+	output, err := exec.Command("git", "-C", dir, "show", ":./"+name).Output()
+	if err != nil {
+		return nil, false
+	}
+	text := strings.TrimSuffix(string(output), "\n")
+	if len(text) == 0 {
+		return nil, true
+	}
+	lines = strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines, true
+}
+
+// Mark how the rows differ from the file as git has it. Outside of git, the
+// rows match the file as it was just read or saved, so they're all unchanged.
+func editorRefreshChanges() {
+	editorClearChanges()
+	if !config.showChanges || config.pagedFile != nil || len(config.filename) == 0 {
+		return
+	}
+	base, ok := editorGitBase()
+	if !ok {
+		return
+	}
+	current := make([]string, config.numrows)
+	for i := range config.rows {
+		current[i] = encodeLine(config.rows[i].content.Runes())
+	}
+	for i, change := range lineChanges(base, current) {
+		config.rows[i].change = change
+	}
+}
+
+// How each line of current differs from base.
+func lineChanges(base, current []string) []uint8 {
+	changes := make([]uint8, len(current))
+	// Mark current[from:to] as replacing deleted lines of base.
+	mark := func(deleted, from, to int) {
+		for i := from; i < to; i++ {
+			if i-from < deleted {
+				changes[i] = CHANGE_MODIFIED
+			} else {
+				changes[i] = CHANGE_ADDED
+			}
+		}
+		if deleted > to-from && to < len(changes) {
+			changes[to] = CHANGE_DELETED
+		}
+	}
+
+	// Lines that are the same at the start and end don't need comparing.
+	start := 0
+	for start < len(base) && start < len(current) && base[start] == current[start] {
+		start++
+	}
+	end := 0
+	for end < len(base)-start && end < len(current)-start && base[len(base)-1-end] == current[len(current)-1-end] {
+		end++
+	}
+	base, current = base[start:len(base)-end], current[start:len(current)-end]
+	if len(base)*len(current) > KILO_DIFF_LIMIT {
+		mark(len(base), start, start+len(current))
+		return changes
+	}
+
+	// lcs[i*width+j] is how many lines base[i:] and current[j:] have in common, in order.
+	width := len(current) + 1
+	lcs := make([]int32, (len(base)+1)*width)
+	for i := len(base) - 1; i >= 0; i-- {
+		for j := len(current) - 1; j >= 0; j-- {
+			if base[i] == current[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+				lcs[i*width+j] = lcs[(i+1)*width+j]
+			} else {
+				lcs[i*width+j] = lcs[i*width+j+1]
+			}
+		}
+	}
+	// Walk through the lines in common. Whatever is between them changed.
+	i, j := 0, 0
+	hunkI, hunkJ := 0, 0
+	for i < len(base) && j < len(current) {
+		if base[i] == current[j] {
+			mark(i-hunkI, start+hunkJ, start+j)
+			i++
+			j++
+			hunkI, hunkJ = i, j
+		} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	mark(len(base)-hunkI, start+hunkJ, start+len(current))
+	return changes
+}
+
+// ==========================================
+// ================== Tags ==================
+// ==========================================
+
+// The name of the index written by ctags.
+const KILO_TAGS_FILE = "tags"
+
+// Find the tags file for the current file, looking in its directory and then each one above it.
+func editorFindTagsFile() (string, bool) {
+	dir, err := filepath.Abs(filepath.Dir(config.filename))
+	if err != nil {
+		return "", false
+	}
+	for {
+		path := filepath.Join(dir, KILO_TAGS_FILE)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Look up name in a ctags file. Each line of the file is
+//
+//	name<Tab>file<Tab>address;"<Tab>extra fields
+//
+// where the address is a line number or a /^pattern$/ to search the file for.
+// Files are relative to the tags file.
+func lookupTag(tagsPath, name string) (editorLocation, error) {
+	file, err := os.Open(tagsPath)
+	if err != nil {
+		return editorLocation{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		location := editorLocation{filename: fields[1], message: name}
+		if !filepath.IsAbs(location.filename) {
+			location.filename = filepath.Join(filepath.Dir(tagsPath), location.filename)
+		}
+		address, _, _ := strings.Cut(fields[2], ";\"")
+		if line, err := strconv.Atoi(address); err == nil {
+			location.line = line
+		} else if location.line, err = findTagPattern(location.filename, address); err != nil {
+			return editorLocation{}, err
+		}
+		return location, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return editorLocation{}, err
+	}
+	return editorLocation{}, fmt.Errorf("no tag for %s", name)
+}
+
+// Find the line number in filename that a ctags search address, like /^func main() {$/, points to.
+func findTagPattern(filename, address string) (int, error) {
+	if len(address) < 2 || (address[0] != '/' && address[0] != '?') || address[len(address)-1] != address[0] {
+		return 0, fmt.Errorf("can't understand tag address %s", address)
+	}
+	pattern := address[1 : len(address)-1]
+	anchoredStart := strings.HasPrefix(pattern, "^")
+	anchoredEnd := strings.HasSuffix(pattern, "$") && !strings.HasSuffix(pattern, "\\$")
+	pattern = strings.TrimPrefix(pattern, "^")
+	if anchoredEnd {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+	pattern = strings.NewReplacer(`\/`, "/", `\?`, "?", `\\`, `\`).Replace(pattern)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		switch {
+		case anchoredStart && anchoredEnd && text == pattern,
+			anchoredStart && !anchoredEnd && strings.HasPrefix(text, pattern),
+			!anchoredStart && anchoredEnd && strings.HasSuffix(text, pattern),
+			!anchoredStart && !anchoredEnd && strings.Contains(text, pattern):
+			return line, nil
+		}
+	}
+	return 0, fmt.Errorf("%s not found in %s", address, filename)
+}
+
+// The cursor's position as a location, so it can be jumped back to.
+func editorCursorLocation() editorLocation {
+	location := editorLocation{filename: config.filename, line: config.cy + 1, col: 1}
+	if config.cy < config.numrows {
+		location.col = len(encodeLine(config.rows[config.cy].content.Slice(0, config.cx))) + 1
+	}
+	return location
+}
+
+// Jump to the definition of the identifier at the cursor, as listed in the tags file.
+func editorJumpToTag() {
+	start, end, ok := editorWordAtCursor()
+	if !ok {
+		editorSetStatusMessage("No identifier at the cursor")
+		return
+	}
+	name := string(config.rows[config.cy].content.Slice(start, end))
+	tagsPath, ok := editorFindTagsFile()
+	if !ok {
+		editorSetStatusMessage("No %s file found", KILO_TAGS_FILE)
+		return
+	}
+	location, err := lookupTag(tagsPath, name)
+	if err != nil {
+		editorSetStatusMessage("%s", err.Error())
+		return
+	}
+	from := editorCursorLocation()
+	if editorGoToLocation(location) {
+		config.tagStack = append(config.tagStack, from)
+		editorSetStatusMessage("%s: %s:%d", name, location.filename, location.line)
+	}
+}
+
+// Go back to where the cursor was before the last jump to a definition.
+func editorPopTag() {
+	if len(config.tagStack) == 0 {
+		editorSetStatusMessage("Tag stack is empty")
+		return
+	}
+	location := config.tagStack[len(config.tagStack)-1]
+	if editorGoToLocation(location) {
+		config.tagStack = config.tagStack[:len(config.tagStack)-1]
+	}
+}
+
+// ==========================================
+// ============== File Browser ==============
+// ==========================================
+
+// Cover the rows with a list of lines, marking the selected one. offset is
+// how far the list is scrolled, and is updated to keep the selection on screen.
+// Returns the selection, moved into range if it was past either end.
+func editorShowList(lines []string, selected int, offset *int) int {
+	selected = MAX(MIN(selected, len(lines)-1), 0)
+	if selected < *offset {
+		*offset = selected
+	} else if selected >= *offset+config.screenrows {
+		*offset = selected - config.screenrows + 1
+	}
+
+	overlayLines = []string{}
+	for i := *offset; i < len(lines); i++ {
+		marker := "  "
+		if i == selected {
+			marker = "> "
+		}
+		overlayLines = append(overlayLines, marker+lines[i])
+	}
+	if len(lines) == 0 {
+		overlayLines = append(overlayLines, "  (empty)")
+	}
+	return selected
+}
+
+// Move the selection in a list of n lines according to key.
+func editorMoveInList(key, selected, n int) int {
+	switch key {
+	case ARROW_UP:
+		selected--
+	case ARROW_DOWN:
+		selected++
+	case PAGE_UP:
+		selected -= config.screenrows
+	case PAGE_DOWN:
+		selected += config.screenrows
+	case HOME_KEY:
+		selected = 0
+	case END_KEY:
+		selected = n - 1
+	}
+	return MAX(MIN(selected, n-1), 0)
+}
+
+// A file or directory shown in the file browser.
+type fileTreeEntry struct {
+	path  string
+	isDir bool
+	// How many directories deep it is below the one being browsed.
+	depth int
+}
+
+// List the contents of dir, directories first, followed by the contents
+// of any directory that is expanded.
+func fileTreeEntries(dir string, depth int, expanded map[string]bool) []fileTreeEntry {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	slices.SortStableFunc(dirEntries, func(a, b os.DirEntry) bool {
+		return a.IsDir() && !b.IsDir()
+	})
+	var entries []fileTreeEntry
+	for _, dirEntry := range dirEntries {
+		entry := fileTreeEntry{path: filepath.Join(dir, dirEntry.Name()), isDir: dirEntry.IsDir(), depth: depth}
+		entries = append(entries, entry)
+		if entry.isDir && expanded[entry.path] {
+			entries = append(entries, fileTreeEntries(entry.path, depth+1, expanded)...)
+		}
+	}
+	return entries
+}
+
+// How an entry is drawn in the file browser.
+func (entry fileTreeEntry) String() string {
+	name := filepath.Base(entry.path)
+	if entry.isDir {
+		name += "/"
+	}
+	return strings.Repeat("  ", entry.depth) + name
+}
+
+// Show the files under dir. Enter opens the file under the cursor, or expands or
+// collapses a directory.
+func editorBrowse(dir string) {
+	savedMsg, savedMsgTime := config.statusMsg, config.statusMsgTime
+	defer func() {
+		overlayLines = nil
+		config.statusMsg, config.statusMsgTime = savedMsg, savedMsgTime
+	}()
+
+	expanded := map[string]bool{}
+	selected, offset := 0, 0
+	// Set when a file couldn't be opened, to show instead of the usual message.
+	problem := ""
+	for {
+		entries := fileTreeEntries(dir, 0, expanded)
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			lines[i] = entry.String()
+		}
+		selected = editorShowList(lines, selected, &offset)
+		if len(problem) > 0 {
+			editorSetStatusMessage("%s", problem)
+			problem = ""
+		} else {
+			editorSetStatusMessage("Browse %s: Enter to open, Esc to close", dir)
+		}
+		editorRefreshScreen()
+
+		key, _ := editorReadKey()
+		selected = editorMoveInList(key, selected, len(entries))
+		switch key {
+		case ESC:
+			return
+		case '\r':
+			if len(entries) == 0 {
+				continue
+			}
+			entry := entries[selected]
+			if entry.isDir {
+				expanded[entry.path] = !expanded[entry.path]
+			} else if editorSwitchFile(entry.path) {
+				return
+			} else {
+				problem = config.statusMsg
+			}
+		}
+	}
+}
+
+// Browse the directory of the current file.
+func editorBrowseCommand() {
+	editorBrowse(filepath.Dir(config.filename))
+}
+
+// ==========================================
+// =========== Search Across Files ==========
+// ==========================================
+
+// Find every line containing query in the text files under dir.
+// Hidden directories, like .git, and files too big to edit normally are skipped.
+func grepFiles(dir, query string) ([]editorLocation, error) {
+	var locations []editorLocation
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			// Skip what can't be read rather than giving up on the whole search.
+			return nil
+		}
+		if entry.IsDir() {
+			if path != dir && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := entry.Info(); err != nil || !info.Mode().IsRegular() || info.Size() > KILO_PAGED_THRESHOLD {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(content[:MIN(len(content), 8000)], 0) >= 0 {
+			// Files with NUL bytes are binary.
+			return nil
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			if col := strings.Index(line, query); col >= 0 {
+				locations = append(locations, editorLocation{
+					filename: path,
+					line:     i + 1,
+					col:      col + 1,
+					message:  strings.TrimSpace(line),
+				})
+			}
+		}
+		return nil
+	})
+	return locations, err
+}
+
+// Search the files under the current file's directory and list the matches.
+// Picking one opens it. next-error and prev-error step through the rest.
+func editorGrep() {
+	query, err := editorPrompt("Grep: %s", nil)
+	if err != nil {
+		editorSetStatusMessage("Grep aborted")
+		return
+	}
+	dir := filepath.Dir(config.filename)
+	locations, err := grepFiles(dir, query)
+	if err != nil {
+		editorSetStatusMessage("Grep failed: %s", err.Error())
+		return
+	}
+	if len(locations) == 0 {
+		editorSetStatusMessage("No matches for %s", query)
+		return
+	}
+	config.locations = locations
+	config.locationIndex = -1
+
+	lines := make([]string, len(locations))
+	for i, location := range locations {
+		name, err := filepath.Rel(dir, location.filename)
+		if err != nil {
+			name = location.filename
+		}
+		lines[i] = fmt.Sprintf("%s:%d: %s", name, location.line, location.message)
+	}
+	if i, ok := editorPickFromList(lines, fmt.Sprintf("%d matches for %s: Enter to open, Esc to close", len(lines), query)); ok {
+		editorJumpToLocation(i)
+	}
+}
+
+// Let the user pick one of the lines, returning its index.
+// ok is false if they backed out with Esc.
+func editorPickFromList(lines []string, message string) (selected int, ok bool) {
+	savedMsg, savedMsgTime := config.statusMsg, config.statusMsgTime
+	defer func() {
+		overlayLines = nil
+		config.statusMsg, config.statusMsgTime = savedMsg, savedMsgTime
+	}()
+
+	offset := 0
+	for {
+		selected = editorShowList(lines, selected, &offset)
+		editorSetStatusMessage("%s", message)
+		editorRefreshScreen()
+
+		key, _ := editorReadKey()
+		selected = editorMoveInList(key, selected, len(lines))
+		switch key {
+		case ESC:
+			return 0, false
+		case '\r':
+			return selected, true
+		}
+	}
+}
+
+// ==========================================
+// ============= Spell Checking =============
+// ==========================================
+
+// Every word in the word list, lowercased. nil until it's first needed.
+var spellDictionary map[string]bool
+
+// Read the word list, one word per line.
+func loadSpellDictionary(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dictionary := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); len(word) > 0 {
+			dictionary[strings.ToLower(word)] = true
+		}
+	}
+	return dictionary, scanner.Err()
+}
+
+// Whether char can be part of a word for spell checking.
+// Apostrophes count so contractions like don't are checked whole.
+func isSpellChar(char rune) bool {
+	return unicode.IsLetter(char) || char == '\''
+}
+
+func isSpelledRight(word string) bool {
+	return spellDictionary[strings.ToLower(strings.Trim(word, "'"))]
+}
+
+// Mark the misspelled words in a row's prose. In files with syntax highlighting,
+// only comments and strings are prose, so only they are checked.
+func editorHighlightMisspelled(e *editorConfig, row *editorRow) {
+	if !e.spellCheck {
+		return
+	}
+	if spellDictionary == nil {
+		dictionary, err := loadSpellDictionary(e.spellDictionary)
+		if err != nil {
+			e.spellCheck = false
+			editorSetStatusMessage("Can't spell check: %s", err.Error())
+			return
+		}
+		spellDictionary = dictionary
+	}
+
+	isProse := func(i int) bool {
+		if e.syntax == nil {
+			return true
+		}
+		switch row.highlights[i] {
+		case HL_COMMENT, HL_MLCOMMENT, HL_STRING:
+			return true
+		}
+		return false
+	}
+
+	for i := 0; i < row.RLen(); {
+		if !isSpellChar(row.render[i]) || !isProse(i) {
+			i++
+			continue
+		}
+		end := i
+		for end < row.RLen() && isSpellChar(row.render[end]) && isProse(end) {
+			end++
+		}
+		// Words stuck to digits or underscores are identifiers, not prose.
+		glued := i > 0 && isWordChar(row.render[i-1]) || end < row.RLen() && isWordChar(row.render[end])
+		if !glued && !isSpelledRight(string(row.render[i:end])) {
+			for j := i; j < end; j++ {
+				row.highlights[j] = HL_MISSPELLED
+			}
+		}
+		i = end
+	}
+}
+
+func editorToggleSpellCheck() {
+	config.spellCheck = !config.spellCheck
+	editorRehighlightRows()
+}
+
+// Words in the dictionary that are one edit away from word: a letter added,
+// removed, changed, or two letters swapped.
+func spellSuggestions(word string) []string {
+	lower := []rune(strings.ToLower(word))
+	seen := map[string]bool{}
+	var suggestions []string
+	try := func(candidate []rune) {
+		if s := string(candidate); !seen[s] && spellDictionary[s] {
+			seen[s] = true
+			suggestions = append(suggestions, s)
+		}
+	}
+	for i := 0; i <= len(lower); i++ {
+		if i < len(lower) {
+			try(append(slices.Clone(lower[:i]), lower[i+1:]...))
+		}
+		if i+1 < len(lower) {
+			swapped := slices.Clone(lower)
+			swapped[i], swapped[i+1] = swapped[i+1], swapped[i]
+			try(swapped)
+		}
+		for c := 'a'; c <= 'z'; c++ {
+			try(slices.Insert(slices.Clone(lower), i, c))
+			if i < len(lower) {
+				changed := slices.Clone(lower)
+				changed[i] = c
+				try(changed)
+			}
+		}
+	}
+	slices.Sort(suggestions)
+
+	// Keep the word's capitalization.
+	if first := []rune(word); len(first) > 0 && unicode.IsUpper(first[0]) {
+		for i, suggestion := range suggestions {
+			runes := []rune(suggestion)
+			runes[0] = unicode.ToUpper(runes[0])
+			suggestions[i] = string(runes)
+		}
+	}
+	return suggestions
+}
+
+// The suggestions being cycled through, starting with the word as it was typed,
+// and which one is in the file now.
+var spellCycle []string
+var spellCycleIndex int
+
+// Replace the word at the cursor with a spelling suggestion. Doing it again
+// moves on to the next suggestion, and eventually back to the original word.
+func editorSpellSuggest() {
+	if spellDictionary == nil {
+		if spellDictionary, _ = loadSpellDictionary(config.spellDictionary); spellDictionary == nil {
+			editorSetStatusMessage("Can't load word list %s", config.spellDictionary)
+			return
+		}
+	}
+	start, end, ok := editorWordAtCursor()
+	if !ok {
+		editorSetStatusMessage("No word at the cursor")
+		return
+	}
+	row := &config.rows[config.cy]
+	word := string(row.content.Slice(start, end))
+	if len(spellCycle) == 0 || spellCycle[spellCycleIndex] != word {
+		// A new word, start over.
+		spellCycle = append([]string{word}, spellSuggestions(word)...)
+		spellCycleIndex = 0
+	}
+	if len(spellCycle) == 1 {
+		spellCycle = nil
+		editorSetStatusMessage("No suggestions for %s", word)
+		return
+	}
+	spellCycleIndex = (spellCycleIndex + 1) % len(spellCycle)
+	editorRowReplace(&config, row, start, end-start, []rune(spellCycle[spellCycleIndex]))
+	config.cx = start + len([]rune(spellCycle[spellCycleIndex]))
+	editorSetStatusMessage("Suggestion %d of %d", spellCycleIndex, len(spellCycle)-1)
+}
+
+// ==========================================
+// ================= Find ===================
+// ==========================================
+// TODO: No static variables in Go so these are global for now.
+// -1 means no match
+var lastMatch int
+
+// 1 means forward, -1 means backward
+var direction int
+
+// Where a new query starts searching from, and which way.
+var searchOrigin = -1
+var searchDirection = 1
+
+// Restore highlight after search
+var savedHighlightIndex int = 0
+var savedHighlights []uint8 = nil
+
+// If True, search only matches whole words. Ctrl-W in the search prompt toggles it.
+var searchWholeWord bool
+
+// Where query first appears in render, or -1. If wholeWord, it mustn't be part of a longer word.
+func searchRender(render, query []rune, wholeWord bool) int {
+	for i := 0; i+len(query) <= len(render); i++ {
+		if !slices.Equal(render[i:i+len(query)], query) {
+			continue
+		}
+		if wholeWord && ((i > 0 && isWordChar(render[i-1])) ||
+			(i+len(query) < len(render) && isWordChar(render[i+len(query)]))) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func editorOnInputFind(query string, key int) {
+
+	if savedHighlights != nil {
+		// Restore highlights
+		for i := range config.rows[savedHighlightIndex].render {
+			config.rows[savedHighlightIndex].highlights[i] = savedHighlights[i]
+		}
+		savedHighlightIndex = 0
+		savedHighlights = nil
+	}
+
+	if key == '\r' || key == ESC {
+		// reset values
+		lastMatch = -1
+		direction = 1
+		return
+	} else if key == ARROW_RIGHT || key == ARROW_DOWN {
+		direction = 1
+	} else if key == ARROW_LEFT || key == ARROW_UP {
+		direction = -1
+	} else if key == CTRL_KEY('w') {
+		// Search again from the start with the new setting.
+		searchWholeWord = !searchWholeWord
+		lastMatch = searchOrigin
+		direction = searchDirection
+	} else {
+		// reset values
+		lastMatch = searchOrigin
+		direction = searchDirection
+	}
+
+	if lastMatch == -1 {
+		// no match, search forward
+		direction = 1
+	}
+
+	// Searching looks at the render of every row.
+	// Paged files are read in row by row as the search goes.
+	if config.pagedFile == nil {
+		editorRenderRowsThrough(config.numrows - 1)
+	}
+
+	// If there was a last match, currentRow is the line after (or before, if searching backwards).
+	// If there wasn’t, it starts at the top of the file and searches in the forward direction to find the first match.
+	currentRow := lastMatch
+	promptNote = ""
+	if searchWholeWord {
+		promptNote = "[whole word]"
+	}
+	runes := []rune(query)
+	for range config.rows {
+		currentRow += direction
+
+		if (currentRow == -1 || currentRow == config.numrows) && !config.searchWrap {
+			// Stay on the last match.
+			promptNote = strings.TrimSpace(promptNote + " (no more matches)")
+			break
+		}
+		// Wrap around search
+		if currentRow == -1 {
+			currentRow = config.numrows - 1
+		} else if currentRow == config.numrows {
+			currentRow = 0
+		}
+
+		row := &config.rows[currentRow]
+		pagedIn := row.unloaded
+		if pagedIn {
+			editorPageInRow(row)
+			editorUpdateRow(&config, row)
+		}
+		if matchIndex := searchRender(row.render, runes, searchWholeWord); matchIndex != -1 {
+			// Set lastMatch so if user presses arrow keys, we search from this point
+			lastMatch = currentRow
+			config.cy = currentRow
+			config.cx = editorRowRxToCx(&config, row, matchIndex)
+			// Put the finding at the top of the screen
+			config.rowOffset = config.numrows
+
+			// Record highlight
+			savedHighlightIndex = currentRow
+			savedHighlights = make([]uint8, row.RLen())
+			for i := range row.render {
+				savedHighlights[i] = row.highlights[i]
+			}
+
+			for i := range runes {
+				row.highlights[matchIndex+i] = HL_MATCH
+			}
+			break
+		}
+		if pagedIn {
+			// Don't let a long search pull the whole file into memory.
+			editorPageOutRow(row)
+		}
+	}
+}
+
+// The word the cursor was last seen on, and since when.
+var cursorWord string
+var cursorWordSince time.Time
+
+// The word at the cursor, once the cursor has stayed on it for a moment.
+// Empty if there's no word there, or it's too soon.
+func editorWordToHighlight() string {
+	word := ""
+	if start, end, ok := editorWordAtCursor(); ok {
+		word = encodeLine(config.rows[config.cy].content.Slice(start, end))
+	}
+	if word != cursorWord {
+		cursorWord, cursorWordSince = word, time.Now()
+		if len(word) > 0 {
+			wordHighlightEvents = time.After(KILO_WORD_HIGHLIGHT_DELAY * time.Millisecond)
+		}
+		return ""
+	}
+	if time.Since(cursorWordSince) < KILO_WORD_HIGHLIGHT_DELAY*time.Millisecond {
+		return ""
+	}
+	return word
+}
+
+// Which positions in a row's render are part of word, where it's a whole word by itself.
+func editorWordMatches(row *editorRow, word []rune) []bool {
+	var matches []bool
+	render := row.render[:MAX(row.RLen()-1, 0)]
+	for i := 0; i+len(word) <= len(render); i++ {
+		if (i > 0 && isWordChar(render[i-1])) || !slices.Equal(render[i:i+len(word)], word) ||
+			(i+len(word) < len(render) && isWordChar(render[i+len(word)])) {
+			continue
+		}
+		if matches == nil {
+			matches = make([]bool, len(render))
+		}
+		for j := range word {
+			matches[i+j] = true
+		}
+		i += len(word) - 1
+	}
+	return matches
+}
+
+func editorToggleWordHighlight() {
+	config.highlightWord = !config.highlightWord
+}
+
+// Find a string in the editor, with incremental search
+func editorFind() {
+	searchOrigin, searchDirection = -1, 1
+	editorSearch("Search: %s (Use ESC/Arrows/Enter, Ctrl-W for whole words)")
+}
+
+// Find a string above the cursor, nearest first.
+func editorFindBackward() {
+	searchOrigin, searchDirection = config.cy, -1
+	editorSearch("Reverse search: %s (Use ESC/Arrows/Enter, Ctrl-W for whole words)")
+}
+
+func editorSearch(prompt string) {
+	// Save current cursor and scrollback position
+	currCx := config.cx
+	currCy := config.cy
+	curColOff := config.colOffset
+	curRowOff := config.rowOffset
+
+	if _, err := editorPrompt(prompt, editorOnInputFind); err != nil {
+		// User cancelled, put everything back however far the search got.
+		config.cx = currCx
+		config.cy = currCy
+		config.colOffset = curColOff
+		config.rowOffset = curRowOff
+	} else if config.cx != currCx || config.cy != currCy {
+		editorPushJump(currCx, currCy)
+	}
+}
+
+// ==========================================
+// ================ Output ==================
+// ==========================================
+
+// Set the status message.
+func editorSetStatusMessage(format string, args ...interface{}) {
+	config.statusMsg = fmt.Sprintf(format, args...)
+	config.statusMsgTime = time.Now()
+}
+
+// How each line ending is shown in the status bar.
+var lineEndingNames = map[string]string{"\n": "LF", "\r\n": "CRLF", "\r": "CR"}
+
+// How the file's encoding is shown in the status bar.
+func editorEncodingName() string {
+	if config.binary {
+		return "binary"
+	} else if config.hasBOM {
+		return "UTF-8 BOM"
+	}
+	return "UTF-8"
+}
+
+// Draw the status bar at the bottom of the screen.
+func editorDrawStatusBar(buf *strings.Builder) {
+	if time.Now().Before(config.flashUntil) {
+		buf.WriteString("\x1b[" + config.saveFlashColor + "m")
+	} else {
+		// Invert colors
+		buf.WriteString("\x1b[7m")
+	}
+
+	// Add filename and line count.
+	displayFilename := editorDisplayFilename()
+	dirtyStatus := ""
+	if editorHasUnsavedChanges() {
+		dirtyStatus = "(modified)"
+	}
+	if config.blockSelect {
+		dirtyStatus += " [BLOCK]"
+	}
+	if len(config.cursors) > 0 {
+		dirtyStatus += fmt.Sprintf(" [%d cursors]", len(config.cursors)+1)
+	}
+	// Define right status view, showing current line number and file type
+	filetypeStatus := "no ft"
+	if config.syntax != nil {
+		filetypeStatus = config.syntax.filetype
+	}
+	rightStatus := fmt.Sprintf("%s %s %s %d/%d", editorEncodingName(), lineEndingNames[config.lineEnding], filetypeStatus, config.cy+1, config.numrows)
+	if config.hexMode {
+		rightStatus = fmt.Sprintf("hex %d/%d bytes", config.hexCursor, len(config.hexData))
+	}
+	rightStatusLen := utf8.RuneCountInString(rightStatus)
+
+	status := fmt.Sprintf(" - %d lines %s", config.numrows, dirtyStatus)
+	// Give the filename whatever room the rest of the bar leaves, but at least 20.
+	nameWidth := MAX(config.screencols-utf8.RuneCountInString(status)-rightStatusLen-1, 20)
+	status = shortenPath(displayFilename, nameWidth) + status
+	// Truncate if longer than screen width.
+	status = truncateRunes(status, config.screencols)
+	statusLen := utf8.RuneCountInString(status)
+	buf.WriteString(status)
+
+	// Print the rest of the status.
+	for statusLen < config.screencols {
+		// Show the right status view, if it fits.
+		if config.screencols-statusLen == rightStatusLen {
+			buf.WriteString(rightStatus)
+			// The entire status has been printed. Bail out.
+			break
+		} else {
+			// Add a bunch of spaces, effectively making a white bar.
+			buf.WriteRune(' ')
+			statusLen++
+		}
+	}
+
+	// Put the colors back to normal
+	buf.WriteString("\x1b[m")
+}
+
+func editorDrawMessageBar(buf *strings.Builder) {
+	// Show message, if it's within timer bounds. Truncate it if it doesn't fit.
+	if len(config.statusMsg) > 0 && (config.messageTimeout <= 0 || time.Since(config.statusMsgTime).Seconds() < float64(config.messageTimeout)) {
+		buf.WriteString(truncateRunes(config.statusMsg, config.screencols))
+	}
+}
+
+// The filename as the status bar shows it.
+func editorDisplayFilename() string {
+	if config.scratch {
+		return "[Scratch]"
+	}
+	if len(config.filename) == 0 {
+		return "[No Name]"
+	}
+	if !config.relativePath {
+		return config.filename
+	}
+	path, err := filepath.Abs(config.filename)
+	if err != nil {
+		return config.filename
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return rel
+	}
+	// Outside the working directory.
+	return path
+}
+
+// Shorten path to at most width characters by leaving out directories from the
+// start, like .../dir/file.go. The file name itself is only cut if it's too long alone.
+func shortenPath(path string, width int) string {
+	if utf8.RuneCountInString(path) <= width {
+		return path
+	}
+	parts := strings.Split(path, string(filepath.Separator))
+	for i := 1; i < len(parts)-1; i++ {
+		shortened := filepath.Join(append([]string{"..."}, parts[i:]...)...)
+		if utf8.RuneCountInString(shortened) <= width {
+			return shortened
+		}
+	}
+	return truncateRunes(parts[len(parts)-1], width)
+}
+
+// Cut s down to at most n characters, without splitting any of them.
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// Center msg in width columns, cut down to fit. The first column gets a
+// tilde like the other rows past the end of the file, if there's room.
+func centerWelcomeLine(msg string, width int) string {
+	// Count columns rather than characters, so wide ones don't run off the edge.
+	cols := 0
+	for i, char := range msg {
+		if cols+runeWidth(char) > width {
+			msg = msg[:i]
+			break
+		}
+		cols += runeWidth(char)
+	}
+	padding := (width - cols) / 2
+	if padding <= 0 {
+		return msg
+	}
+	return "~" + strings.Repeat(" ", padding-1) + msg
+}
+
+// editorScroll detects scroll based on cursor position.
+func editorScroll() {
+	config.rx = 0
+	// If we have an active editor row, compute the render x-coord.
+	if config.cy < config.numrows {
+		config.rx = editorRowCxToRx(&config, &config.rows[config.cy], config.cx)
+	}
+
+	from := config.rowOffset
+
+	// Rows kept on screen above and below the cursor. It can't be more than half the screen.
+	margin := MAX(MIN(config.scrollOff, (config.screenrows-1)/2), 0)
+
+	// Check if cursor is above visible window, or within the margin of its top
+	if config.cy < config.rowOffset+margin {
+		config.rowOffset = MAX(config.cy-margin, 0)
+	}
+
+	// Check if cursor is below visible window, or within the margin of its bottom
+	if config.cy >= config.rowOffset+config.screenrows-margin {
+		config.rowOffset = config.cy - config.screenrows + 1 + margin
+		// Don't scroll past the end of the file just for the margin.
+		config.rowOffset = MIN(config.rowOffset, MAX(config.numrows+1-config.screenrows, config.cy-config.screenrows+1))
+	}
+	editorSmoothScroll(from)
+
+	// The same goes for columns to the left and right of the cursor.
+	textCols := editorTextCols()
+	sideMargin := MAX(MIN(config.sideScrollOff, (textCols-1)/2), 0)
+
+	// Check if cursor is to the left of visible window, or within the margin of its left
+	if config.rx < config.colOffset+sideMargin {
+		config.colOffset = MAX(config.rx-sideMargin, 0)
+	}
+
+	// Check if cursor is to the right of visible window, or within the margin of its right
+	if config.rx >= config.colOffset+textCols-sideMargin {
+		config.colOffset = config.rx - textCols + 1 + sideMargin
+		// Don't scroll past the end of the row just for the margin.
+		// The row may not have been rendered since it was edited, so measure its content.
+		rowEnd := 0
+		if config.cy < config.numrows {
+			row := &config.rows[config.cy]
+			rowEnd = editorRowCxToRx(&config, row, row.Len())
+		}
+		config.colOffset = MIN(config.colOffset, MAX(rowEnd+1-textCols, config.rx-textCols+1))
+	}
+}
+
+// editorScrollTo puts the given row at the top of the screen, without
+// scrolling before the start of the file or further past its end than editorScroll would.
+func editorScrollTo(row int) {
+	config.rowOffset = MAX(MIN(row, config.numrows+1-config.screenrows), 0)
+}
+
+// Scroll so the cursor's line is in the middle of the screen.
+func editorCenterView() {
+	editorScrollTo(config.cy - config.screenrows/2)
+}
+
+// Scroll so the cursor's line is at the top of the screen.
+func editorViewTop() {
+	editorScrollTo(config.cy)
+}
+
+// Scroll so the cursor's line is at the bottom of the screen.
+func editorViewBottom() {
+	editorScrollTo(config.cy - config.screenrows + 1)
+}
+
+// Where a smooth scroll is headed.
+var scrollTarget int
+
+// editorSmoothScroll takes the row offset only part of the way from where it
+// was to where editorScroll wants it, and asks for another frame to go on.
+// Each frame covers a third of what's left, so the scroll slows as it lands.
+func editorSmoothScroll(from int) {
+	scrollTarget = config.rowOffset
+	distance := scrollTarget - from
+	if distance == 0 || !config.smoothScroll {
+		scrollEvents = nil
+		return
+	}
+	// Small moves aren't worth animating, unless they're the end of a bigger one.
+	if scrollEvents == nil && distance >= -config.screenrows/2 && distance <= config.screenrows/2 {
+		return
+	}
+	step := distance / 3
+	if step == 0 {
+		step = distance
+	}
+	config.rowOffset = from + step
+	if config.rowOffset == scrollTarget {
+		// Landed, so there's no frame to come.
+		scrollEvents = nil
+		return
+	}
+	scrollEvents = time.After(KILO_SMOOTH_SCROLL_FRAME * time.Millisecond)
+}
+
+// editorRefreshScreen is called every cycle to repaint the screen.
+func editorRefreshScreen() {
+	if headless {
+		return
+	}
+	// Hide the cursor before painting screen
+	mainBuffer.WriteString("\x1b[?25l")
+
+	// Draw all of the content, broken into rows, with the status bars underneath.
+	frame := make([]string, config.screenrows+2)
+	var cursorRow, cursorCol int
+	if config.hexMode {
+		cursorRow, cursorCol = editorDrawHex(frame)
+	} else {
+		// Compute screen position based on cursor position.
+		editorScroll()
+		// Only the rows on screen need to be rendered.
+		editorRenderRowsThrough(config.rowOffset + config.screenrows)
+		editorPageOutDistantRows()
+		editorDrawRows(frame)
+		// Account for scroll changing the screen position.
+		cursorRow, cursorCol = config.cy-config.rowOffset, config.rx-config.colOffset+editorGutterWidth()
+		// In the middle of a smooth scroll it may not be on screen yet.
+		cursorRow = MAX(MIN(cursorRow, config.screenrows-1), 0)
+	}
+
+	var bar strings.Builder
+	editorDrawStatusBar(&bar)
+	frame[config.screenrows] = bar.String()
+	bar.Reset()
+	editorDrawMessageBar(&bar)
+	frame[config.screenrows+1] = bar.String()
+
+	// Only send the lines that changed.
+	editorDrawFrame(&mainBuffer, frame)
+
+	// Draw cursor
+	// +1 to put the cursor into terminal coordinates.
+	fmt.Fprintf(&mainBuffer, "\x1b[%d;%dH", cursorRow+1, cursorCol+1)
+	// Bring the cursor back, unless it would be floating over an overlay or
+	// is still off screen while scrolling to it.
+	if overlayLines == nil && scrollEvents == nil {
+		mainBuffer.WriteString("\x1b[?25h")
+	}
+
+	// Flush the buffer to the screen.
+	flushBuffer(&mainBuffer)
+}
+
+// Send the contents of buf to the terminal and empty it.
+func flushBuffer(buf *strings.Builder) {
+	if headless {
+		// Stdout is for responses, there's no screen to update.
+		buf.Reset()
+		return
+	}
+	terminal.WriteString(buf.String())
+	terminal.Flush()
+	buf.Reset()
+}
+
+// Clear the entire screen
+// https://vt100.net/docs/vt100-ug/chapter3.html#ED
+func cleanScreen(buf *strings.Builder) {
+	// Wipe screen
+	buf.WriteString("\x1b[2J")
+	// Reposition cursor to top left
+	buf.WriteString("\x1b[H")
+	// Nothing from the last frame is on screen anymore.
+	previousFrame = nil
+}
+
+// Figure out where whitespace glyphs go in a row's render.
+// Each position holds the glyph to draw there, or 0 to draw the render as is.
+func editorWhitespaceGlyphs(row *editorRow) []rune {
+	glyphs := make([]rune, row.RLen())
+	rx, tab := 0, 0
+	for _, char := range row.content.Runes() {
+		switch char {
+		case ' ':
+			glyphs[rx] = config.whitespaceSpace
+			rx++
+		case '\t':
+			// The rest of the tab stays blank.
+			glyphs[rx] = config.whitespaceTab
+			rx += editorTabWidth(&config, row, tab, rx)
+			tab++
+		default:
+			if escape := editorRenderEscape(char); escape != nil {
+				rx += len(escape)
+			} else {
+				rx++
+			}
+		}
+	}
+	return glyphs
+}
+
+// Write each line of the frame that differs from the previous frame.
+func editorDrawFrame(buf *strings.Builder, frame []string) {
+	for y, line := range frame {
+		if y < len(previousFrame) && previousFrame[y] == line {
+			continue
+		}
+		// Move to the start of the line and clear it, in case the old one was longer.
+		// Clearing first means the line can draw all the way to the last column.
+		fmt.Fprintf(buf, "\x1b[%d;1H\x1b[2K", y+1)
+		buf.WriteString(line)
+	}
+	previousFrame = frame
+}
+
+// editorDrawRows draws each visible line of the editor into the frame.
+func editorDrawRows(frame []string) {
+	buf := &strings.Builder{}
+	// The block selection, if any. An empty range when there isn't one.
+	blockTop, blockBottom, blockLeft, blockRight := 0, -1, 0, 0
+	if config.blockSelect {
+		blockTop, blockBottom, blockLeft, blockRight = editorBlockBounds(&config)
+	}
+	textCols := editorTextCols()
+	thumbTop, thumbSize := editorScrollbarThumb()
+	// The welcome screen goes a third of the way down, or as low as it fits.
+	welcome := config.welcome
+	if len(welcome) == 0 {
+		welcome = []string{fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION)}
+	}
+	welcomeTop := MAX(MIN(config.screenrows/3, config.screenrows-len(welcome)), 0)
+	// The render column the ruler is drawn at, or -1 for no ruler.
+	ruler := config.rulerColumn - 1
+	// Where the extra cursors are, by row and render column. The terminal only draws the main one.
+	var word []rune
+	if config.highlightWord {
+		word = []rune(editorWordToHighlight())
+	}
+	cursorCells := map[editorCursor]bool{}
+	for _, cursor := range config.cursors {
+		if cursor.cy < config.numrows {
+			cursorCells[editorCursor{editorRowCxToRx(&config, &config.rows[cursor.cy], cursor.cx), cursor.cy}] = true
+		}
+	}
+	// Iterate over every row on the screen and determine the content that should be there.
+	for y := 0; y < config.screenrows; y++ {
+		buf.Reset()
+		if overlayLines != nil {
+			// Something is covering the rows, draw that instead.
+			if y < len(overlayLines) {
+				line := []rune(overlayLines[y])
+				buf.WriteString(string(line[:MIN(len(line), config.screencols)]))
+			}
+			frame[y] = buf.String()
+			continue
+		}
+		// Figure out the line of the file we are viewing.
+		fileRow := y + config.rowOffset
+		// Written after anything that resets the background, to bring the line's back.
+		lineColor := ""
+		if config.showCursorLine && fileRow == config.cy {
+			lineColor = KILO_CURSOR_LINE_COLOR
+			// Erasing fills the whole line with the background color.
+			buf.WriteString(lineColor + "\x1b[K")
+		}
+		if config.showChanges {
+			if fileRow < config.numrows {
+				buf.WriteString(changeSigns[config.rows[fileRow].change])
+			} else {
+				buf.WriteString(" ")
+			}
+		}
+		if fileRow >= config.numrows {
+			// The current line is outside of the file, what to draw?
+			if config.numrows == 0 && config.filename == "" && y >= welcomeTop && y < welcomeTop+len(welcome) {
+				// If there's no file, show a welcome message.
+				buf.WriteString(centerWelcomeLine(welcome[y-welcomeTop], textCols))
+			} else {
+				// Fill the right column with tildes for the rest of the file.
+				buf.WriteString("~")
+			}
+		} else {
+			// Show the row contents
+			row := &config.rows[fileRow]
+			// The render ends with a NUL that isn't shown.
+			renderLen := MAX(row.RLen()-1, 0)
+			// Only draw the part of the row that's on screen, based on horizontal scroll.
+			start := MIN(config.colOffset, renderLen)
+			end := MIN(start+textCols, renderLen)
+			// Track syntax color so we're not spamming escape sequences if the color doesn't change
+			currentColor := DEFAULT
+			highlights := row.highlights
+			inBlock := fileRow >= blockTop && fileRow <= blockBottom
+			selectLeft, selectRight := editorSelectedColumns(fileRow)
+			var glyphs []rune
+			if config.showWhitespace {
+				glyphs = editorWhitespaceGlyphs(row)
+			}
+			var wordMatches []bool
+			if len(word) > 0 {
+				wordMatches = editorWordMatches(row, word)
+			}
+			// Indenting a blank line shouldn't light it up while the cursor is still on it.
+			hideTrailing := fileRow == config.cy && len(strings.TrimSpace(string(row.render[:renderLen]))) == 0
+			for i := start; i < end; i++ {
+				char := row.render[i]
+				if glyphs != nil && glyphs[i] != 0 {
+					// Only what's drawn changes, the render still has the real whitespace.
+					char = glyphs[i]
+				}
+				highlight := highlights[i]
+				overflowed := highlight&HL_OVERFLOW != 0
+				highlight &^= HL_OVERFLOW
+				if wordMatches != nil && wordMatches[i] {
+					highlight = HL_MATCH
+				}
+				if highlight == HL_TRAILING && hideTrailing {
+					highlight = HL_NORMAL
+				}
+				if i == ruler {
+					buf.WriteString(KILO_RULER_COLOR)
+				}
+				if highlight == HL_TRAILING {
+					buf.WriteString(KILO_TRAILING_COLOR)
+					buf.WriteRune(char)
+					buf.WriteString("\x1b[49m" + lineColor)
+				} else {
+					color := DEFAULT
+					if highlight != HL_NORMAL && highlight != HL_ESCAPE {
+						color = editorSyntaxToColor(highlight)
+					}
+					if color != currentColor {
+						buf.WriteString(fmt.Sprintf("\x1b[%dm", color))
+						currentColor = color
+					}
+					// Escaped and selected characters are inverted, in the character's own
+					// color, and misspelled ones are underlined on top of their color.
+					// Past the maximum line length, the background changes too.
+					inverted := highlight == HL_ESCAPE || inBlock && i >= blockLeft && i < blockRight ||
+						i >= selectLeft && i < selectRight || cursorCells[editorCursor{i, fileRow}]
+					underlined := highlight == HL_MISSPELLED
+					if overflowed {
+						buf.WriteString(fmt.Sprintf("\x1b[%dm", editorSyntaxToColor(HL_OVERFLOW)))
+					}
+					if inverted {
+						buf.WriteString("\x1b[7m")
+					}
+					if underlined {
+						buf.WriteString("\x1b[4m")
+					}
+					buf.WriteRune(char)
+					if underlined {
+						buf.WriteString("\x1b[24m")
+					}
+					if inverted {
+						buf.WriteString("\x1b[27m")
+					}
+					if overflowed {
+						buf.WriteString("\x1b[49m" + lineColor)
+					}
+				}
+				if i == ruler {
+					// Back to the line's background.
+					buf.WriteString("\x1b[49m" + lineColor)
+				}
+			}
+			buf.WriteString(fmt.Sprintf("\x1b[%dm", DEFAULT))
+			// The render column the terminal cursor is now at.
+			drawnTo := MAX(end, config.colOffset)
+			if cursorCells[editorCursor{renderLen, fileRow}] && renderLen >= config.colOffset && renderLen < config.colOffset+textCols {
+				// A cursor past the end of the row still needs something to show it.
+				buf.WriteString("\x1b[7m \x1b[m" + lineColor)
+				drawnTo++
+			}
+			if ruler >= drawnTo && ruler < config.colOffset+textCols {
+				// The ruler is past the end of the row, pad out to it.
+				buf.WriteString(strings.Repeat(" ", ruler-drawnTo))
+				buf.WriteString(KILO_RULER_COLOR + " \x1b[49m" + lineColor)
+			}
+		}
+		if len(lineColor) > 0 {
+			buf.WriteString("\x1b[49m")
+		}
+
+		if config.showScrollbar {
+			// Jump to the last column, whatever was drawn before it.
+			fmt.Fprintf(buf, "\x1b[%dG", config.screencols)
+			if y >= thumbTop && y < thumbTop+thumbSize {
+				buf.WriteString("\x1b[7m \x1b[m")
+			} else {
+				buf.WriteString(KILO_SCROLLBAR_TRACK)
+			}
+		}
+
+		frame[y] = buf.String()
+	}
+}
+
+// How many columns of the screen are left for text.
+func editorTextCols() int {
+	cols := config.screencols - editorGutterWidth()
+	if config.showScrollbar {
+		// The last one is for the scrollbar.
+		cols--
+	}
+	return cols
+}
+
+// How many columns left of the text are taken by the gutter.
+func editorGutterWidth() int {
+	if config.showChanges {
+		return 1
+	}
+	return 0
+}
+
+// Where the scrollbar's thumb starts, in screen rows, and how many rows it covers.
+// The thumb is to the scrollbar what the screen is to the whole file.
+func editorScrollbarThumb() (top, size int) {
+	if config.numrows <= config.screenrows {
+		return 0, config.screenrows
+	}
+	size = MAX(config.screenrows*config.screenrows/config.numrows, 1)
+	top = config.rowOffset * config.screenrows / config.numrows
+	return MIN(top, config.screenrows-size), size
+}
+
+// ==========================================
+// ================ Input ===================
+// ==========================================
+
+// Shown after the prompt. onInput can set it to say how the input went.
+var promptNote string
+
+func editorPrompt(prompt string, onInput func(string, int)) (string, error) {
+	var userInput string
+
+	promptNote = ""
+	for {
+		editorSetStatusMessage(prompt, userInput)
+		if len(promptNote) > 0 {
+			config.statusMsg += " " + promptNote
+		}
+		editorRefreshScreen()
+
+		char, _ := editorReadKey()
+		if char == DEL_KEY || char == CTRL_KEY('h') || char == BACKSPACE {
+			if len(userInput) > 0 {
+				userInput = userInput[0 : len(userInput)-1]
+			}
+		} else if char == ESC {
+			editorSetStatusMessage("")
+			if onInput != nil {
+				onInput(userInput, char)
+			}
+			return "", errors.New("user cancelled")
+		} else if char == '\r' {
+			if len(userInput) > 0 {
+				editorSetStatusMessage("")
+				if onInput != nil {
+					onInput(userInput, char)
+				}
+				return userInput, nil
+			}
+		} else if char == PASTE_START {
+			// Only the first line of it, there's no room for more.
+			line, _, _ := strings.Cut(strings.ReplaceAll(pastedText, "\r", "\n"), "\n")
+			for _, pasted := range line {
+				if !unicode.IsControl(pasted) && pasted < 128 {
+					userInput += string(pasted)
+				}
+			}
+		} else if !unicode.IsControl(rune(char)) && char < 128 {
+			userInput += string(rune(char))
+		}
+
+		if onInput != nil {
+			onInput(userInput, char)
+		}
+	}
+}
+
+// Whether key is a character to type into the file, rather than a command.
+func isTypedChar(key int) bool {
+	return key < ALT_KEY_BASE && !unicode.IsControl(rune(key)) && (key < ARROW_LEFT || key >= SPECIAL_KEYS_END)
+}
+
+// Perform arithmetic to figure out new cursor position
+func editorMoveCursor(e *editorConfig, key int) {
+	// Fetch the current row's length, in runes like cx, so we can figure out how to move.
+	rowLength := 0
+	if e.cy < e.numrows {
+		rowLength = e.rows[e.cy].Len()
+	}
+
+	switch key {
+	case ARROW_UP:
+		// Move the cursor up one row if it's not already at the first row.
+		if e.cy != 0 {
+			e.cy--
+		}
+	case ARROW_LEFT:
+		// Move the cursor left one column if it's not already at the first column.
+		if e.cx != 0 {
+			e.cx--
+		} else if e.cy > 0 {
+			// Cursor is already at the first column, move it to the end of the previous row.
+			e.cy--
+			e.cx = e.rows[e.cy].Len()
+		}
+	case ARROW_DOWN:
+		// Move the cursor down one row if it's not already at the last row.
+		if e.cy < e.numrows {
+			e.cy++
+		}
+	case ARROW_RIGHT:
+		// Move the cursor right one column if it's not already at the last column.
+		if e.cx < rowLength {
+			e.cx++
+		} else if e.cy < e.numrows {
+			// Cursor is already at the last column, move it to the beginning of the next row.
+			e.cy++
+			e.cx = 0
+		}
+	}
+
+	// Re-calculate current row length with new cursor position.
+	rowLength = 0
+	if e.cy < e.numrows {
+		rowLength = e.rows[e.cy].Len()
+	}
+
+	// Snap cursor to the end of the row.
+	if e.cx > rowLength {
+		e.cx = rowLength
+	}
+}
+
+// Ask for a column and move the cursor to it on the current line.
+// Columns count from 1 and are as shown on screen, so a tab spans several.
+func editorGotoColumn() {
+	if config.cy >= config.numrows {
+		return
+	}
+	answer, err := editorPrompt("Go to column: %s", nil)
+	if err != nil {
+		return
+	}
+	col, err := strconv.Atoi(answer)
+	if err != nil || col < 1 {
+		editorSetStatusMessage("Not a column: %s", answer)
+		return
+	}
+	config.cx = editorRowRxToCx(&config, &config.rows[config.cy], col-1)
+}
+
+// Ask how many columns a tab shows as. The file itself isn't changed.
+func editorSetTabWidth() {
+	answer, err := editorPrompt(fmt.Sprintf("Tab width (now %d): %%s", config.tabStop), nil)
+	if err != nil {
+		return
+	}
+	width, err := strconv.Atoi(answer)
+	if err != nil || width < 1 {
+		editorSetStatusMessage("Not a tab width: %s", answer)
+		return
+	}
+	config.tabStop = width
+	editorRelayoutTabs()
+}
+
+func editorToggleElasticTabs() {
+	config.elasticTabs = !config.elasticTabs
+	editorRelayoutTabs()
+}
+
+// Render every row again when they're next needed, as their tabs have changed width.
+func editorRelayoutTabs() {
+	for i := range config.rows {
+		config.rows[i].stale = true
+		config.rows[i].tabsLaidOut = false
+	}
+}
+
+// Highlight every row again when it's next needed, as what's highlighted has changed.
+func editorRehighlightRows() {
+	for i := range config.rows {
+		config.rows[i].stale = true
+	}
+}
+
+// Handle user input
+// Returns false when it's time to stop, along with why if it wasn't quitting.
+func editorProcessKeypress() (bool, error) {
+	char, err := editorReadKey()
+	if err != nil {
+		return false, err
+	}
+	defer editorRecordEdit(config.edits)
+	defer editorCheckSnippetStops(editorInSnippetStop())
+	editorStartUndoGroup(&config)
+
+	if config.hexMode && keyBindings[char] != "quit" {
+		editorProcessHexKey(char)
+		quitTimes = config.quitTimes
+		return true, nil
+	}
+
+	if name, ok := keyBindings[char]; ok {
+		editorActions[name].run()
+		if shouldQuit {
+			// Quit, maybe from the command palette.
+			return false, nil
+		}
+		if name == "quit" {
+			// Don't reset the counter while the user is confirming.
+			return true, nil
+		}
+		quitTimes = config.quitTimes
+		return true, nil
+	}
+
+	if char == PASTE_START {
+		// The paste takes the place of the selection, and only goes in at the main cursor.
+		if config.selecting {
+			editorDeleteSelection()
+		}
+		config.blockSelect = false
+		config.cursors = nil
+		editorPaste(&config, pastedText)
+		quitTimes = config.quitTimes
+		return true, nil
+	}
+	if config.blockSelect && editorProcessBlockKey(char) {
+		quitTimes = config.quitTimes
+		return true, nil
+	}
+	if len(config.cursors) > 0 && editorProcessMultiCursorKey(char) {
+		quitTimes = config.quitTimes
+		return true, nil
+	}
+	if plain, ok := shiftedKeys[char]; ok {
+		// Select as far as the cursor moves.
+		editorStartSelection()
+		char = plain
+	} else if config.selecting && editorProcessSelectionKey(char) {
+		quitTimes = config.quitTimes
+		return true, nil
+	}
+
+	switch char {
+	case '\r':
+		editorInsertNewline(&config)
+
+	case '\t':
+		if !editorExpandSnippet() && !editorNextSnippetStop() {
+			editorInsertChar(&config, '\t')
+		}
+
+	case HOME_KEY:
+		// Move the cursor to the beginning of the current row
+		config.cx = 0
+	case END_KEY:
 		// Move the cursor to the end of the current row if it's not already at the last row.
 		if config.cy < config.numrows {
 			config.cx = config.rows[config.cy].Len()
 		}
 
-	case BACKSPACE:
-		fallthrough
-	case CTRL_KEY('h'):
-		fallthrough
-	case DEL_KEY:
-		if char == DEL_KEY {
-			editorMoveCursor(ARROW_RIGHT)
+	case BACKSPACE:
+		fallthrough
+	case CTRL_KEY('h'):
+		fallthrough
+	case DEL_KEY:
+		if char == DEL_KEY {
+			// Nothing comes after the end of the last line.
+			if config.cy >= config.numrows || config.cy == config.numrows-1 && config.cx == config.rows[config.cy].Len() {
+				break
+			}
+			// Deleting backwards from one character on does the same, joining the
+			// next line on when at the end of this one.
+			editorMoveCursor(&config, ARROW_RIGHT)
+		}
+		editorDelChar(&config)
+	case PAGE_UP:
+		fallthrough
+	case PAGE_DOWN:
+		editorPushJump(config.cx, config.cy)
+		// Move the cursor to the first/last visible row on the screen and scroll the view accordingly.
+		if char == PAGE_UP {
+			config.cy = config.rowOffset
+		} else if char == PAGE_DOWN {
+			config.cy = config.rowOffset + config.screenrows - 1
+			config.cy = MIN(config.cy, config.numrows)
+		}
+
+		// PAGE_UP/PAGE_DOWN is implemented as repeated ARROW_UP/ARROW_DOWN movements.
+		times := config.screenrows
+		for ; 0 < times; times-- {
+			if char == PAGE_UP {
+				editorMoveCursor(&config, ARROW_UP)
+			} else {
+				editorMoveCursor(&config, ARROW_DOWN)
+			}
+		}
+
+	case ARROW_UP:
+		fallthrough
+	case ARROW_LEFT:
+		fallthrough
+	case ARROW_DOWN:
+		fallthrough
+	case ARROW_RIGHT:
+		editorMoveCursor(&config, char)
+
+	// Ignore these
+	// Ctrl+l refreshes terminal screen but we're doing that all the time.
+	// It's bound to center-view, so this is only if that's been unbound.
+	case CTRL_KEY('l'):
+		break
+	case ESC:
+		// Done with the snippet.
+		config.snippetStops = nil
+
+	default:
+		if config.stripControls && char < ALT_KEY_BASE && !isTypedChar(char) {
+			// Not bound to anything, and not text either. Most likely pasted, so say nothing.
+			break
+		}
+		if char >= ALT_KEY_BASE || char < ' ' {
+			// There's no character to type for an Alt or Ctrl combination.
+			editorSetStatusMessage("%s isn't bound to anything", keyName(char))
+			break
+		}
+		editorInsertChar(&config, rune(char))
+	}
+
+	// Reset counter
+	quitTimes = config.quitTimes
+
+	return true, nil
+}
+
+// ==========================================
+// ============== Key Bindings ==============
+// ==========================================
+
+// A named command that keys can be bound to.
+type editorAction struct {
+	// What the action does, for the user's benefit.
+	description string
+	run         func()
+}
+
+// Every action, by name.
+var editorActions map[string]editorAction
+
+// Which action each key runs. Keys not in here are handled by editorProcessKeypress.
+var keyBindings = map[int]string{
+	CTRL_KEY('q'): "quit",
+	CTRL_KEY('s'): "save",
+	CTRL_KEY('f'): "find",
+	CTRL_KEY('r'): "reload",
+	CTRL_KEY('w'): "toggle-whitespace",
+	F1_KEY:        "help",
+	ALT_KEY('n'):  "next-same-indent",
+	ALT_KEY('p'):  "prev-same-indent",
+	ALT_KEY('}'):  "next-paragraph",
+	ALT_KEY('{'):  "prev-paragraph",
+	ALT_KEY('e'):  "next-sentence",
+	ALT_KEY('a'):  "prev-sentence",
+	CTRL_KEY('t'): "transpose",
+	ALT_KEY('u'):  "upcase-word",
+	ALT_KEY('l'):  "downcase-word",
+	ALT_KEY('c'):  "titlecase-word",
+	CTRL_KEY('j'): "join-lines",
+	CTRL_KEY('u'): "delete-to-start",
+	CTRL_KEY('_'): "toggle-comment",
+	CTRL_KEY('v'): "block-select",
+	CTRL_KEY('n'): "add-cursor-below",
+	CTRL_KEY('d'): "add-cursor-match",
+	ALT_KEY('f'):  "format",
+	ALT_KEY('!'):  "filter",
+	ALT_KEY('m'):  "build",
+	ALT_KEY('.'):  "next-error",
+	ALT_KEY(','):  "prev-error",
+	CTRL_KEY(']'): "goto-definition",
+	ALT_KEY('t'):  "tag-back",
+	ALT_KEY('o'):  "browse",
+	ALT_KEY('g'):  "grep",
+	ALT_KEY('s'):  "toggle-spell",
+	ALT_KEY('$'):  "spell-suggest",
+	ALT_KEY('|'):  "goto-column",
+	ALT_KEY('b'):  "toggle-scrollbar",
+	ALT_KEY('d'):  "insert-date",
+	ALT_KEY('/'):  "complete",
+	ALT_KEY('h'):  "highlight-line",
+	ALT_KEY('`'):  "last-edit",
+	ALT_KEY('k'):  "set-mark",
+	CTRL_KEY('o'): "jump-back",
+	ALT_KEY('w'):  "highlight-word",
+	ALT_KEY('r'):  "find-backward",
+	ALT_KEY('i'):  "jump-forward",
+	ALT_KEY('\''): "goto-mark",
+	CTRL_KEY('a'): "select-all",
+	CTRL_KEY('z'): "undo",
+	CTRL_KEY('y'): "redo",
+	ALT_KEY('+'):  "increment",
+	ALT_KEY('-'):  "decrement",
+	CTRL_KEY('p'): "command-palette",
+	CTRL_KEY('l'): "center-view",
+
+	CTRL_ARROW_RIGHT: "next-word",
+	CTRL_ARROW_LEFT:  "prev-word",
+	ALT_ARROW_RIGHT:  "next-subword",
+	ALT_ARROW_LEFT:   "prev-subword",
+}
+
+// Actions that must always have a key, or the user could get stuck.
+var essentialActions = []string{"quit", "save"}
+
+// Set once the user has confirmed they want to quit.
+var shouldQuit bool
+
+func editorRegisterActions() {
+	editorActions = map[string]editorAction{
+		"quit":              {"Quit kilo", editorQuit},
+		"save":              {"Save the file", editorSave},
+		"find":              {"Search the file", editorFind},
+		"find-backward":     {"Search the file upwards from the cursor", editorFindBackward},
+		"reload":            {"Reload the file from disk", editorReloadCommand},
+		"toggle-whitespace": {"Show or hide whitespace", editorToggleWhitespace},
+		"help":              {"Show this help", editorShowHelp},
+		"next-same-indent":  {"Jump to the next line indented like this one", editorNextSameIndent},
+		"prev-same-indent":  {"Jump to the previous line indented like this one", editorPrevSameIndent},
+		"next-paragraph":    {"Jump past the end of the paragraph", editorNextParagraph},
+		"prev-paragraph":    {"Jump before the start of the paragraph", editorPrevParagraph},
+		"next-word":         {"Jump to the end of the next word", editorNextWord},
+		"prev-word":         {"Jump to the start of the word before the cursor", editorPrevWord},
+		"next-subword":      {"Jump to the end of the next part of a camelCase or snake_case name", editorNextSubword},
+		"prev-subword":      {"Jump to the start of the part of a camelCase or snake_case name before the cursor", editorPrevSubword},
+		"next-sentence":     {"Jump to the start of the next sentence", editorNextSentence},
+		"prev-sentence":     {"Jump to the start of the sentence", editorPrevSentence},
+		"transpose":         {"Swap the characters around the cursor", func() { editorTransposeChars(&config) }},
+		"upcase-word":       {"Make the word at the cursor, or the selection, UPPERCASE", editorUpcaseWord},
+		"downcase-word":     {"Make the word at the cursor, or the selection, lowercase", editorDowncaseWord},
+		"titlecase-word":    {"Make the word at the cursor, or each one selected, Titlecase", editorTitlecaseWord},
+		"join-lines":        {"Join the next line onto this one", func() { editorJoinLines(&config) }},
+		"delete-to-start":   {"Delete from the start of the line to the cursor", func() { editorDeleteToLineStart(&config) }},
+		"toggle-comment":    {"Comment or uncomment the line, or the selected lines", func() { editorToggleComment(&config) }},
+		"block-select":      {"Start or stop selecting a rectangle of text", editorToggleBlockSelect},
+		"add-cursor-below":  {"Add a cursor on the next line, Esc to drop extra cursors", editorAddCursorBelow},
+		"add-cursor-match":  {"Add a cursor on the next match of the word at the cursor", editorAddCursorAtNextMatch},
+		"format":            {"Run the file through its formatter", editorFormat},
+		"filter":            {"Replace the line or block rows with a shell command's output", editorFilterCommand},
+		"build":             {"Run the build command in the background, to jump between its errors", editorBuild},
+		"next-error":        {"Jump to the next build error or grep match", editorNextLocation},
+		"prev-error":        {"Jump to the previous build error or grep match", editorPrevLocation},
+		"goto-definition":   {"Jump to the definition of the identifier at the cursor, using ctags", editorJumpToTag},
+		"tag-back":          {"Jump back to before the last goto-definition", editorPopTag},
+		"browse":            {"Browse the files in this file's directory", editorBrowseCommand},
+		"grep":              {"Search the files in this file's directory", editorGrep},
+		"toggle-spell":      {"Underline misspelled words in prose", editorToggleSpellCheck},
+		"spell-suggest":     {"Replace the word at the cursor with the next spelling suggestion", editorSpellSuggest},
+		"goto-column":       {"Jump to a column on this line", editorGotoColumn},
+		"tab-width":         {"Change how many columns a tab shows as", editorSetTabWidth},
+		"hex-view":          {"Show and edit the file's bytes in hex, or go back to text", editorToggleHexView},
+		"elastic-tabs":      {"Line tabs up into columns with the lines around them, or stop", editorToggleElasticTabs},
+		"clean-up-indent":   {"Indent every line with tabs or spaces, whichever the file uses", editorCleanUpIndent},
+		"toggle-scrollbar":  {"Show or hide the scrollbar", editorToggleScrollbar},
+		"insert-date":       {"Insert the current date and time", func() { editorInsertDate(&config) }},
+		"highlight-word":    {"Highlight the word at the cursor everywhere on screen, or stop", editorToggleWordHighlight},
+		"sort-lines":        {"Sort the selected lines, or the whole file", editorSortLines},
+		"dedupe-lines":      {"Remove repeated lines from the selection, or the whole file", editorDedupeLines},
+		"reverse-lines":     {"Reverse the order of the selected lines, or the whole file", editorReverseLines},
+		"rot13":             {"Apply ROT13 to the selected lines, or the current one", editorRot13},
+		"select-all":        {"Select the whole file", editorSelectAll},
+		"undo":              {"Undo the last change", editorUndo},
+		"redo":              {"Redo the last change that was undone", editorRedo},
+		"increment":         {"Add 1 to the number at or after the cursor", func() { editorAddToNumber(&config, 1) }},
+		"decrement":         {"Take 1 from the number at or after the cursor", func() { editorAddToNumber(&config, -1) }},
+		"add-to-number":     {"Ask for an amount to add to the number at or after the cursor", editorAddToNumberPrompt},
+		"command-palette":   {"Pick an action to run by typing part of its name", editorCommandPalette},
+		"jump-back":         {"Go back to where the cursor was before the last jump", editorJumpBack},
+		"jump-forward":      {"Go forward again after jump-back", editorJumpForward},
+		"set-mark":          {"Name the cursor's place with a letter", editorSetMark},
+		"goto-mark":         {"Jump to a place named with set-mark", editorGoToMark},
+		"last-edit":         {"Jump to the last edit, again for the one before", editorLastEdit},
+		"complete":          {"Complete the word before the cursor from words in the file", editorComplete},
+		"highlight-line":    {"Highlight the line the cursor is on, or stop", editorToggleCursorLine},
+		"search-wrap":       {"Turn searching around the ends of the file on or off", editorToggleSearchWrap},
+		"scratch":           {"Start an empty buffer that's never saved, for notes", editorNewScratch},
+		"center-view":       {"Scroll so the cursor's line is in the middle of the screen", editorCenterView},
+		"view-top":          {"Scroll so the cursor's line is at the top of the screen", editorViewTop},
+		"view-bottom":       {"Scroll so the cursor's line is at the bottom of the screen", editorViewBottom},
+	}
+}
+
+func editorQuit() {
+	if editorHasUnsavedChanges() && quitTimes > 0 {
+		editorSetStatusMessage("HEY!! The file has unsaved changes. Press %s %d more times to quit.", editorKeyForAction("quit"), quitTimes)
+		quitTimes--
+		return
+	}
+	cleanScreen(&mainBuffer)
+	flushBuffer(&mainBuffer)
+	shouldQuit = true
+}
+
+func editorToggleWhitespace() {
+	config.showWhitespace = !config.showWhitespace
+}
+
+func editorToggleScrollbar() {
+	config.showScrollbar = !config.showScrollbar
+}
+
+func editorToggleCursorLine() {
+	config.showCursorLine = !config.showCursorLine
+}
+
+func editorToggleSearchWrap() {
+	config.searchWrap = !config.searchWrap
+	if config.searchWrap {
+		editorSetStatusMessage("Search wraps around")
+	} else {
+		editorSetStatusMessage("Search stops at the ends of the file")
+	}
+}
+
+// Keys that do the same thing no matter how kilo is configured.
+var fixedKeyHelp = [][2]string{
+	{"Arrows", "Move the cursor"},
+	{"Home/End", "Jump to the start/end of the line"},
+	{"PageUp/PageDown", "Scroll a screen up/down"},
+	{"Backspace/Delete", "Delete the character before/under the cursor"},
+	{"Enter", "Insert a new line"},
+}
+
+// The text of the help screen, listing what every key does.
+func editorHelpLines() []string {
+	lines := []string{fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION), ""}
+
+	// Sort the actions by name so the list doesn't shuffle around.
+	var names []string
+	for name := range editorActions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		keys := strings.Join(editorKeysForAction(name), ", ")
+		if len(keys) == 0 {
+			keys = "(unbound)"
+		}
+		lines = append(lines, fmt.Sprintf("  %-18s %-20s %s", keys, name, editorActions[name].description))
+	}
+	lines = append(lines, "")
+	for _, help := range fixedKeyHelp {
+		lines = append(lines, fmt.Sprintf("  %-18s %s", help[0], help[1]))
+	}
+	return lines
+}
+
+// Cover the rows with the help screen until the user dismisses it.
+func editorShowHelp() {
+	lines := editorHelpLines()
+	savedMsg, savedMsgTime := config.statusMsg, config.statusMsgTime
+	// Put the view back the way it was, no matter how we leave.
+	defer func() {
+		overlayLines = nil
+		config.statusMsg, config.statusMsgTime = savedMsg, savedMsgTime
+	}()
+
+	offset := 0
+	for {
+		maxOffset := MAX(len(lines)-config.screenrows, 0)
+		offset = MAX(MIN(offset, maxOffset), 0)
+		overlayLines = lines[offset:]
+		editorSetStatusMessage("Help: Up/Down/PageUp/PageDown to scroll, Esc to close")
+		editorRefreshScreen()
+
+		key, _ := editorReadKey()
+		switch key {
+		case ESC, 'q', F1_KEY:
+			return
+		case ARROW_UP:
+			offset--
+		case ARROW_DOWN:
+			offset++
+		case PAGE_UP:
+			offset -= config.screenrows
+		case PAGE_DOWN:
+			offset += config.screenrows
+		}
+	}
+}
+
+// How well query matches text, if its characters appear in text in order, ignoring case.
+// Matches next to each other and at the start of words score higher, gaps lower.
+func fuzzyScore(query, text string) (score int, ok bool) {
+	query, text = strings.ToLower(query), strings.ToLower(text)
+	textRunes := []rune(text)
+	last := -1
+	for _, char := range query {
+		i := last + 1
+		for i < len(textRunes) && textRunes[i] != char {
+			i++
+		}
+		if i == len(textRunes) {
+			return 0, false
+		}
+		switch {
+		case i == last+1 && last >= 0:
+			score += 3
+		case i == 0 || !isWordChar(textRunes[i-1]):
+			score += 2
+		default:
+			score -= MIN(i-last-1, 3)
+		}
+		last = i
+	}
+	return score, true
+}
+
+// Pick an action by typing part of its name, and run it.
+func editorCommandPalette() {
+	var names []string
+	for name := range editorActions {
+		if name != "command-palette" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	name, ok := func() (string, bool) {
+		savedMsg, savedMsgTime := config.statusMsg, config.statusMsgTime
+		defer func() {
+			overlayLines = nil
+			config.statusMsg, config.statusMsgTime = savedMsg, savedMsgTime
+		}()
+
+		query := ""
+		selected, offset := 0, 0
+		for {
+			// Best matches first. The sort is stable, so equal ones stay in name order.
+			type match struct {
+				name  string
+				score int
+			}
+			var matches []match
+			for _, name := range names {
+				if score, ok := fuzzyScore(query, name); ok {
+					matches = append(matches, match{name, score})
+				}
+			}
+			slices.SortStableFunc(matches, func(a, b match) bool { return a.score > b.score })
+			lines := make([]string, len(matches))
+			for i, m := range matches {
+				lines[i] = fmt.Sprintf("%-20s %-12s %s", m.name, strings.Join(editorKeysForAction(m.name), ", "), editorActions[m.name].description)
+			}
+
+			selected = editorShowList(lines, selected, &offset)
+			editorSetStatusMessage("Run: %s", query)
+			editorRefreshScreen()
+
+			key, _ := editorReadKey()
+			selected = editorMoveInList(key, selected, len(lines))
+			switch {
+			case key == ESC:
+				return "", false
+			case key == '\r':
+				if len(matches) == 0 {
+					continue
+				}
+				return matches[selected].name, true
+			case key == BACKSPACE || key == CTRL_KEY('h') || key == DEL_KEY:
+				if len(query) > 0 {
+					_, size := utf8.DecodeLastRuneInString(query)
+					query = query[:len(query)-size]
+					selected, offset = 0, 0
+				}
+			case isTypedChar(key):
+				query += string(rune(key))
+				selected, offset = 0, 0
+			}
+		}
+	}()
+	if ok {
+		editorActions[name].run()
+	}
+}
+
+// Names for keys that aren't Ctrl combinations.
+var specialKeyNames = map[int]string{
+	ARROW_LEFT:  "Left",
+	ARROW_RIGHT: "Right",
+	ARROW_UP:    "Up",
+	ARROW_DOWN:  "Down",
+	DEL_KEY:     "Delete",
+	HOME_KEY:    "Home",
+	END_KEY:     "End",
+	PAGE_UP:     "PageUp",
+	PAGE_DOWN:   "PageDown",
+	ESC:         "Esc",
+	F1_KEY:      "F1",
+	// Arrows with a modifier.
+	CTRL_ARROW_LEFT:  "Ctrl-Left",
+	CTRL_ARROW_RIGHT: "Ctrl-Right",
+	ALT_ARROW_LEFT:   "Alt-Left",
+	ALT_ARROW_RIGHT:  "Alt-Right",
+	// Terminals send Ctrl-/ as Ctrl-_
+	CTRL_KEY('_'): "Ctrl-/",
+	CTRL_KEY(']'): "Ctrl-]",
+}
+
+// A readable name for a key, like Ctrl-S.
+func keyName(key int) string {
+	if name, ok := specialKeyNames[key]; ok {
+		return name
+	}
+	if key >= CTRL_KEY('a') && key <= CTRL_KEY('z') {
+		return "Ctrl-" + string(rune('A'+key-1))
+	}
+	if key > ALT_KEY_BASE {
+		return "Alt-" + string(rune(key-ALT_KEY_BASE))
+	}
+	return string(rune(key))
+}
+
+// The reverse of keyName, ignoring case.
+func parseKeyName(name string) (int, error) {
+	for key, special := range specialKeyNames {
+		if strings.EqualFold(name, special) {
+			return key, nil
+		}
+	}
+	lower := strings.ToLower(name)
+	if len(lower) == len("ctrl-a") && strings.HasPrefix(lower, "ctrl-") && lower[5] >= 'a' && lower[5] <= 'z' {
+		return CTRL_KEY(rune(lower[5])), nil
+	}
+	if strings.HasPrefix(lower, "alt-") {
+		// Alt keys keep their case, Alt-N is different from Alt-n.
+		if char := []rune(name[len("alt-"):]); len(char) == 1 {
+			return ALT_KEY(char[0]), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key %q", name)
+}
+
+// The names of every key bound to the action, sorted.
+func editorKeysForAction(action string) []string {
+	var names []string
+	for key, name := range keyBindings {
+		if name == action {
+			names = append(names, keyName(key))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// The name of a key bound to the action, or the action's name if nothing is.
+func editorKeyForAction(action string) string {
+	if names := editorKeysForAction(action); len(names) > 0 {
+		return names[0]
+	}
+	return action
+}
+
+// Bind key to the named action, replacing whatever it did before.
+func editorBindKey(keyName, action string) error {
+	key, err := parseKeyName(keyName)
+	if err != nil {
+		return err
+	}
+	if action == "none" {
+		delete(keyBindings, key)
+		return nil
+	}
+	if _, ok := editorActions[action]; !ok {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	keyBindings[key] = action
+	return nil
+}
+
+// Make sure essential actions are still reachable, restoring their default key if not.
+func editorCheckBindings() error {
+	defaults := map[string]int{"quit": CTRL_KEY('q'), "save": CTRL_KEY('s')}
+	var missing []string
+	for _, action := range essentialActions {
+		if editorKeyForAction(action) == action {
+			keyBindings[defaults[action]] = action
+			missing = append(missing, action)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s must be bound, restored default keys", strings.Join(missing, " and "))
+	}
+	return nil
+}
+
+// ==========================================
+// ================= Config =================
+// ==========================================
+
+// The rc file lives in the home directory. The KILORC environment variable can point somewhere else.
+const KILO_RC_FILE = ".kilorc"
+
+// Settings that can be changed in the rc file, and how to apply them.
+var rcOptions = map[string]func(value string) error{
+	"auto_pair":        boolOption(&config.autoPair),
+	"build_command":    stringOption(&config.buildCommand),
+	"spell_check":      boolOption(&config.spellCheck),
+	"ruler_column":     intOption(&config.rulerColumn),
+	"scrollbar":        boolOption(&config.showScrollbar),
+	"cursor_line":      boolOption(&config.showCursorLine),
+	"highlight_word":   boolOption(&config.highlightWord),
+	"search_wrap":      boolOption(&config.searchWrap),
+	"grow_at_eof":      boolOption(&config.growAtEOF),
+	"delete_empty_row": boolOption(&config.deleteEmptyRow),
+	"strip_controls":   boolOption(&config.stripControls),
+	"elastic_tabs":     boolOption(&config.elasticTabs),
+	"scrolloff":        intOption(&config.scrollOff),
+	"sidescrolloff":    intOption(&config.sideScrollOff),
+	"smooth_scroll":    boolOption(&config.smoothScroll),
+	"welcome_file":     linesFileOption(&config.welcome),
+	"rainbow_brackets": boolOption(&config.rainbowBrackets),
+	"trailing_spaces":  boolOption(&config.highlightTrailing),
+	"todo_keywords":    wordsOption(&config.todoKeywords),
+	"cursor_shape":     cursorShapeOption(&config.cursorShape),
+	"save_flash":       intOption(&config.saveFlash),
+	"message_timeout":  intOption(&config.messageTimeout),
+	"quit_times":       intOption(&config.quitTimes),
+	"relative_path":    boolOption(&config.relativePath),
+	"change_gutter":    boolOption(&config.showChanges),
+	"save_flash_color": stringOption(&config.saveFlashColor),
+	"date_format":      stringOption(&config.dateFormat),
+	"max_line_length":  intOption(&defaultFileSettings.maxLineLength),
+	"spell_dictionary": stringOption(&config.spellDictionary),
+	"preserve_bom":     boolOption(&config.preserveBOM),
+	"whitespace_space": runeOption(&config.whitespaceSpace),
+	"whitespace_tab":   runeOption(&config.whitespaceTab),
+	"paged_threshold":  intOption(&config.pagedThreshold),
+	"undo_file_levels": intOption(&config.undoFileLevels),
+}
+
+// An rc option that sets target from values like true/false, yes/no, or on/off.
+func boolOption(target *bool) func(string) error {
+	return func(value string) error {
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1":
+			*target = true
+		case "false", "no", "off", "0":
+			*target = false
+		default:
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		return nil
+	}
+}
+
+// How to indent one kind of file, from an indent line in the rc file.
+type indentRule struct {
+	softTabs bool
+	// 0 if the width wasn't given.
+	width int
+}
+
+// Indentation rules by file type, like go, or by extension, like .yaml.
+var indentRules = map[string]indentRule{}
+
+// Parse an indent rule, like "tabs" or "spaces 2", for a file type or extension.
+func editorSetIndent(kind, rule string) error {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 || len(fields) > 2 || (fields[0] != "tabs" && fields[0] != "spaces") {
+		return fmt.Errorf("expected tabs or spaces and a width, got %q", rule)
+	}
+	indent := indentRule{softTabs: fields[0] == "spaces"}
+	if len(fields) == 2 {
+		width, err := strconv.Atoi(fields[1])
+		if err != nil || width <= 0 {
+			return fmt.Errorf("expected a width, got %q", fields[1])
 		}
-		editorDelChar()
-	case PAGE_UP:
-		fallthrough
-	case PAGE_DOWN:
-		// Move the cursor to the first/last visible row on the screen and scroll the view accordingly.
-		if char == PAGE_UP {
-			config.cy = config.rowOffset
-		} else if char == PAGE_DOWN {
-			config.cy = config.rowOffset + config.screenrows - 1
-			config.cy = MIN(config.cy, config.numrows)
+		indent.width = width
+	}
+	if kind[0] != '.' && !slices.ContainsFunc(highlightDB, func(syntax editorSyntax) bool { return syntax.filetype == kind }) {
+		return fmt.Errorf("unknown file type %q", kind)
+	}
+	indentRules[kind] = indent
+	return nil
+}
+
+// Apply the indent rule for the file's extension, or failing that its file type.
+func editorApplyIndentRule() {
+	indent, ok := indentRules[filepath.Ext(config.filename)]
+	if !ok && config.syntax != nil {
+		indent, ok = indentRules[config.syntax.filetype]
+	}
+	if !ok {
+		return
+	}
+	config.softTabs = indent.softTabs
+	if indent.width > 0 {
+		config.indentSize = indent.width
+		if !indent.softTabs {
+			config.tabStop = indent.width
 		}
+	}
+}
 
-		// PAGE_UP/PAGE_DOWN is implemented as repeated ARROW_UP/ARROW_DOWN movements.
-		times := config.screenrows
-		for ; 0 < times; times-- {
-			if char == PAGE_UP {
-				editorMoveCursor(ARROW_UP)
+// Use command to format files of the given type. An empty command turns formatting off.
+func editorSetFormatter(filetype, command string) error {
+	for i := range highlightDB {
+		if highlightDB[i].filetype == filetype {
+			highlightDB[i].formatter = command
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown file type %q", filetype)
+}
+
+// An rc option that takes a whole number, 0 or more.
+func intOption(target *int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		*target = n
+		return nil
+	}
+}
+
+// Cursor shapes, by name, and the DECSCUSR number that asks the terminal for them.
+// https://vt100.net/docs/vt510-rm/DECSCUSR.html
+var cursorShapes = map[string]int{
+	"default":   0,
+	"block":     2,
+	"underline": 4,
+	"bar":       6,
+}
+
+// The sequence that asks the terminal for a cursor shape.
+func cursorShapeSequence(shape int) string {
+	return fmt.Sprintf("\x1b[%d q", shape)
+}
+
+// An rc option that takes the name of a cursor shape.
+func cursorShapeOption(target *int) func(string) error {
+	return func(value string) error {
+		shape, ok := cursorShapes[strings.ToLower(value)]
+		if !ok {
+			return fmt.Errorf("expected block, underline, bar or default, got %q", value)
+		}
+		*target = shape
+		return nil
+	}
+}
+
+// An rc option that takes a list of words separated by spaces.
+func wordsOption(target *[]string) func(string) error {
+	return func(value string) error {
+		*target = strings.Fields(value)
+		return nil
+	}
+}
+
+// An rc option naming a file whose lines are read in.
+func linesFileOption(target *[]string) func(string) error {
+	return func(value string) error {
+		if len(value) == 0 {
+			*target = nil
+			return nil
+		}
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return err
+		}
+		*target = strings.Split(strings.TrimRight(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), "\n")
+		return nil
+	}
+}
+
+// An rc option that sets target to a single character, like a glyph.
+func runeOption(target *rune) func(string) error {
+	return func(value string) error {
+		runes := []rune(value)
+		if len(runes) != 1 || !unicode.IsPrint(runes[0]) {
+			return fmt.Errorf("expected a single character, got %q", value)
+		}
+		*target = runes[0]
+		return nil
+	}
+}
+
+// An rc option that takes any text.
+func stringOption(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+// editorLoadConfig reads the user's rc file, if there is one. Each line is either
+//
+//	name = value
+//	bind <key> = <action>
+//	format <filetype> = <command>
+//	indent <filetype or .extension> = tabs|spaces [width]
+//	snippet <trigger> = <body>
+//	abbrev <word> = <replacement>
+//
+// Blank lines and lines starting with # are ignored. Problems with one line don't
+// stop the rest of the file from being applied.
+func editorLoadConfig() error {
+	path := os.Getenv("KILORC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, KILO_RC_FILE)
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var problems []string
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if err := editorApplyConfigLine(scanner.Text()); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %s", lineNum, err.Error()))
+		}
+	}
+	if err := editorCheckBindings(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func editorApplyConfigLine(line string) error {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+	name, value, found := strings.Cut(line, "=")
+	if !found {
+		return fmt.Errorf("expected name = value")
+	}
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+
+	if key, isBind := strings.CutPrefix(name, "bind "); isBind {
+		return editorBindKey(strings.TrimSpace(key), value)
+	}
+	if filetype, isFormat := strings.CutPrefix(name, "format "); isFormat {
+		return editorSetFormatter(strings.TrimSpace(filetype), value)
+	}
+	if kind, isIndent := strings.CutPrefix(name, "indent "); isIndent && len(strings.TrimSpace(kind)) > 0 {
+		return editorSetIndent(strings.TrimSpace(kind), value)
+	}
+	if trigger, isSnippet := strings.CutPrefix(name, "snippet "); isSnippet {
+		return editorAddSnippet(strings.TrimSpace(trigger), value)
+	}
+	if word, isAbbrev := strings.CutPrefix(name, "abbrev "); isAbbrev {
+		return editorAddAbbreviation(strings.TrimSpace(word), value)
+	}
+	apply, ok := rcOptions[name]
+	if !ok {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return apply(value)
+}
+
+// ==========================================
+// ============== EditorConfig ==============
+// ==========================================
+
+// The name of EditorConfig files. See https://editorconfig.org
+const EDITORCONFIG_FILE = ".editorconfig"
+
+// A [section] of an .editorconfig file, with the properties under it.
+type editorConfigSection struct {
+	pattern    *regexp.Regexp
+	properties map[string]string
+}
+
+// Read an .editorconfig file. root is true if files further up shouldn't be read.
+func parseEditorConfig(path string) (sections []editorConfigSection, root bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	dir := filepath.Dir(path)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			pattern, err := editorConfigGlob(dir, line[1:len(line)-1])
+			if err != nil {
+				// Nothing under a section that can't be understood applies.
+				pattern = nil
+			}
+			sections = append(sections, editorConfigSection{pattern, map[string]string{}})
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.ToLower(strings.TrimSpace(value))
+		if len(sections) == 0 {
+			// Before any section, only root means anything.
+			root = root || name == "root" && value == "true"
+			continue
+		}
+		sections[len(sections)-1].properties[name] = value
+	}
+	return sections, root, scanner.Err()
+}
+
+// Convert an .editorconfig section glob to a regular expression matching absolute paths.
+// Globs without a slash match files of that name in any directory under dir.
+func editorConfigGlob(dir, glob string) (*regexp.Regexp, error) {
+	var pattern strings.Builder
+	pattern.WriteString("^" + regexp.QuoteMeta(filepath.ToSlash(dir)) + "/")
+	if !strings.Contains(glob, "/") {
+		pattern.WriteString("(?:.*/)?")
+	}
+	glob = strings.TrimPrefix(glob, "/")
+
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		switch char := glob[i]; char {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				pattern.WriteString(".*")
+				i++
 			} else {
-				editorMoveCursor(ARROW_DOWN)
+				pattern.WriteString("[^/]*")
+			}
+		case '?':
+			pattern.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				pattern.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			pattern.WriteString("[" + class + "]")
+			i += end
+		case '{':
+			braces++
+			pattern.WriteString("(?:")
+		case '}':
+			if braces == 0 {
+				pattern.WriteString(`\}`)
+				continue
+			}
+			braces--
+			pattern.WriteString(")")
+		case ',':
+			if braces == 0 {
+				pattern.WriteString(",")
+				continue
+			}
+			pattern.WriteString("|")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				pattern.WriteString(regexp.QuoteMeta(glob[i : i+1]))
 			}
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(char)))
 		}
+	}
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
 
-	case ARROW_UP:
-		fallthrough
-	case ARROW_LEFT:
-		fallthrough
-	case ARROW_DOWN:
-		fallthrough
-	case ARROW_RIGHT:
-		editorMoveCursor(char)
+// The properties that apply to path from the .editorconfig files above it.
+// Closer files win over ones further up, and later sections over earlier ones.
+func editorConfigProperties(path string) map[string]string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	// Collect the files from closest to furthest, stopping at root.
+	var files [][]editorConfigSection
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		sections, root, err := parseEditorConfig(filepath.Join(dir, EDITORCONFIG_FILE))
+		if err == nil {
+			files = append(files, sections)
+		}
+		if root || filepath.Dir(dir) == dir {
+			break
+		}
+	}
 
-	// Ignore these
-	// Ctrl+l refreshes terminal screen but we're doing that all the time.
-	case CTRL_KEY('l'):
-		fallthrough
-	case ESC:
-		break
+	properties := map[string]string{}
+	for i := len(files) - 1; i >= 0; i-- {
+		for _, section := range files[i] {
+			if section.pattern == nil || !section.pattern.MatchString(filepath.ToSlash(path)) {
+				continue
+			}
+			for name, value := range section.properties {
+				properties[name] = value
+			}
+		}
+	}
+	return properties
+}
+
+// Apply the .editorconfig settings for the current file.
+func editorApplyEditorConfig() {
+	if len(config.filename) == 0 {
+		return
+	}
+	properties := editorConfigProperties(config.filename)
+	number := func(name string) (int, bool) {
+		n, err := strconv.Atoi(properties[name])
+		return n, err == nil && n > 0
+	}
 
+	switch properties["indent_style"] {
+	case "tab":
+		config.softTabs = false
+	case "space":
+		config.softTabs = true
+	}
+	if n, ok := number("tab_width"); ok {
+		config.tabStop = n
+	}
+	if n, ok := number("indent_size"); ok {
+		config.indentSize = n
+		if _, ok := number("tab_width"); !ok {
+			// tab_width defaults to indent_size.
+			config.tabStop = n
+		}
+	} else if properties["indent_size"] == "tab" {
+		config.indentSize = config.tabStop
+	}
+	switch properties["end_of_line"] {
+	case "lf":
+		config.lineEnding = "\n"
+	case "crlf":
+		config.lineEnding = "\r\n"
+	case "cr":
+		config.lineEnding = "\r"
+	}
+	if n, ok := number("max_line_length"); ok {
+		config.maxLineLength = n
+	} else if properties["max_line_length"] == "off" {
+		config.maxLineLength = 0
+	}
+	switch properties["trim_trailing_whitespace"] {
+	case "true":
+		config.trimTrailingWhitespace = true
+	case "false":
+		config.trimTrailingWhitespace = false
+	}
+	switch properties["insert_final_newline"] {
+	case "true":
+		config.insertFinalNewline = true
+	case "false":
+		config.insertFinalNewline = false
+	}
+}
+
+// ==========================================
+// =============== Scripting ================
+// ==========================================
+
+// Set when kilo is driven by JSON requests instead of a terminal. Nothing is
+// drawn, and prompts are cancelled since there's nobody to answer them.
+var headless bool
+
+// A request to the scripting interface, one JSON object per line, like
+//
+//	{"id": 1, "method": "insert", "params": {"text": "hello\n"}}
+type rpcRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params struct {
+		Text     string `json:"text"`
+		Count    int    `json:"count"`
+		Row      int    `json:"row"`
+		Col      int    `json:"col"`
+		Name     string `json:"name"`
+		Filename string `json:"filename"`
+	} `json:"params"`
+}
+
+// The reply to a request, with the state of the editor after it ran.
+type rpcResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result *rpcState       `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type rpcState struct {
+	Row      int      `json:"row"`
+	Col      int      `json:"col"`
+	Dirty    bool     `json:"dirty"`
+	Filename string   `json:"filename"`
+	Status   string   `json:"status"`
+	Lines    []string `json:"lines,omitempty"`
+}
+
+// Read requests from input until it ends, writing a response for each to output.
+func editorServeRPC(input io.Reader, output io.Writer) error {
+	encoder := json.NewEncoder(output)
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var request rpcRequest
+		var response rpcResponse
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response.Error = "bad request: " + err.Error()
+		} else {
+			response = editorHandleRPC(request)
+		}
+		if err := encoder.Encode(response); err != nil {
+			return err
+		}
+		if shouldQuit {
+			// Either the quit method, or the quit action once it was confirmed.
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Run a single request against the editor.
+func editorHandleRPC(request rpcRequest) (response rpcResponse) {
+	response.ID = request.ID
+	config.statusMsg = ""
+	editorStartUndoGroup(&config)
+
+	params := request.Params
+	withLines := false
+	switch request.Method {
+	case "insert":
+		for _, char := range params.Text {
+			if char == '\n' {
+				editorInsertNewline(&config)
+			} else {
+				editorInsertChar(&config, char)
+			}
+		}
+	case "delete":
+		// Like pressing Backspace count times.
+		for i := 0; i < MAX(params.Count, 1); i++ {
+			editorDelChar(&config)
+		}
+	case "move":
+		config.cy = MAX(MIN(params.Row, config.numrows), 0)
+		config.cx = 0
+		if config.cy < config.numrows {
+			config.cx = MAX(MIN(params.Col, config.rows[config.cy].Len()), 0)
+		}
+	case "action":
+		action, ok := editorActions[params.Name]
+		if !ok {
+			response.Error = fmt.Sprintf("unknown action %q", params.Name)
+			return response
+		}
+		action.run()
+	case "open":
+		if _, err := os.Stat(params.Filename); err != nil {
+			response.Error = err.Error()
+			return response
+		}
+		editorClosePaged()
+		config.rows, config.numrows = nil, 0
+		config.cx, config.cy = 0, 0
+		if err := editorOpen(params.Filename); err != nil {
+			response.Error = err.Error()
+			return response
+		}
+	case "save":
+		if len(params.Filename) > 0 {
+			config.filename = params.Filename
+			editorSelectSyntaxHighlight()
+		}
+		if len(config.filename) == 0 {
+			response.Error = "no filename to save to"
+			return response
+		}
+		editorSave()
+		if config.dirty {
+			response.Error = config.statusMsg
+			return response
+		}
+	case "get":
+		withLines = true
+	case "quit":
+		// Skips the unsaved changes check, there's nobody to confirm it.
+		shouldQuit = true
 	default:
-		editorInsertChar(rune(char))
+		response.Error = fmt.Sprintf("unknown method %q", request.Method)
+		return response
 	}
 
-	// Reset counter
-	quitTimes = KILO_QUIT_TIMES
+	response.Result = &rpcState{
+		Row:      config.cy,
+		Col:      config.cx,
+		Dirty:    config.dirty,
+		Filename: config.filename,
+		Status:   config.statusMsg,
+	}
+	if withLines {
+		response.Result.Lines = []string{}
+		for i := range config.rows {
+			if config.rows[i].unloaded {
+				editorPageInRow(&config.rows[i])
+			}
+			response.Result.Lines = append(response.Result.Lines, config.rows[i].content.String())
+		}
+	}
+	return response
+}
 
-	return true
+// Run kilo without a terminal, taking JSON requests from input and answering on output.
+func editorRunHeadless(args []string, input io.Reader, output io.Writer) error {
+	headless = true
+	// There's no status bar to report rc file problems on, so give up instead.
+	if err := editorLoadSettings(); err != nil {
+		return fmt.Errorf("problem with rc file: %w", err)
+	}
+	if len(args) >= 1 {
+		if err := editorOpen(args[0]); err != nil {
+			return err
+		}
+	}
+	return editorServeRPC(input, output)
 }
 
 // ==========================================
 // ================= Main ===================
 // ==========================================
+// Set up the editor's settings before the rc file or a file changes them.
+func editorSetDefaults() {
+	editorRegisterActions()
+	config.fileSettings = defaultFileSettings
+	config.buildCommand = KILO_BUILD_COMMAND
+	config.spellDictionary = KILO_SPELL_DICTIONARY
+	config.dateFormat = time.RFC3339
+	config.now = time.Now
+	config.todoKeywords = strings.Fields(KILO_TODO_KEYWORDS)
+	config.saveFlash = KILO_SAVE_FLASH
+	config.preserveBOM = KILO_PRESERVE_BOM
+	config.whitespaceSpace = KILO_WHITESPACE_SPACE
+	config.whitespaceTab = KILO_WHITESPACE_TAB
+	config.messageTimeout = KILO_MESSAGE_TIMEOUT
+	config.quitTimes = KILO_QUIT_TIMES
+	config.saveFlashColor = KILO_SAVE_FLASH_COLOR
+	config.searchWrap = true
+	config.growAtEOF = true
+}
+
+// Set up the editor's settings, then let the rc file change them.
+// The settings are in place even if the rc file had problems.
+func editorLoadSettings() error {
+	editorSetDefaults()
+	err := editorLoadConfig()
+	// The rc file may have changed the defaults.
+	config.fileSettings = defaultFileSettings
+	quitTimes = config.quitTimes
+	return err
+}
+
 // Set initial editor state.
-func initializeEditor() {
-	config.screenrows, config.screencols = getWindowSize()
+func initializeEditor() error {
+	if err := editorUpdateWindowSize(); err != nil {
+		return err
+	}
+
+	// Start listening for input and other events.
+	signal.Notify(resizeEvents, unix.SIGWINCH)
+	tickEvents = time.Tick(time.Second)
+	go editorDecodeKeys(os.Stdin, keyEvents)
+	// Have the terminal mark where pasted text starts and ends, so it can go in as is.
+	terminal.WriteString("\x1b[?2004h")
+	return nil
+}
+
+// Fit the editor to the current size of the terminal.
+func editorUpdateWindowSize() error {
+	rows, cols, err := getWindowSize()
+	if err != nil {
+		return err
+	}
+	config.screenrows, config.screencols = rows, cols
 
 	// Fool editorDrawRows into not drawing the last rows, which
 	// we'll use for status
 	config.screenrows -= 2
+
+	// Everything has to be drawn again at the new size.
+	previousFrame = nil
+	return nil
+}
+
+// Matches a file with a position on the end, like main.go:12 or main.go:12:5
+var filePositionPattern = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?$`)
+
+// Pick out the file to open and where to put the cursor in it from the arguments.
+// The position can be given as file:line, file:line:column, or +line file.
+func parseFileArgs(args []string) (files []string, start editorLocation, err error) {
+	if len(args) == 2 && strings.HasPrefix(args[0], "+") {
+		start.line, err = strconv.Atoi(args[0][1:])
+		if err != nil {
+			return nil, start, fmt.Errorf("bad line number %s", args[0])
+		}
+		args = args[1:]
+	} else if len(args) == 1 {
+		// A file that really has a name like that wins.
+		if _, statErr := os.Stat(args[0]); statErr != nil {
+			if match := filePositionPattern.FindStringSubmatch(args[0]); match != nil {
+				args = []string{match[1]}
+				start.line, _ = strconv.Atoi(match[2])
+				start.col, _ = strconv.Atoi(match[3])
+			}
+		}
+	}
+	if len(args) > 1 {
+		return nil, start, errors.New("only one file can be opened at a time")
+	}
+	if len(args) == 1 {
+		start.filename = args[0]
+	}
+	return args, start, nil
 }
 
 func main() {
-	enableRawMode()
-	defer exit()
-	defer disableRawMode()
-	initializeEditor()
+	if err := editorMain(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "kilo: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Run the editor until the user quits. The terminal is always put back the way
+// it was, even if something goes wrong.
+func editorMain(args []string) (err error) {
+	flags := flag.NewFlagSet("kilo", flag.ContinueOnError)
+	showVersion := flags.Bool("version", false, "print the version and exit")
+	rpc := flags.Bool("rpc", false, "read JSON requests from stdin instead of using the terminal")
+	hex := flags.Bool("hex", false, "show and edit the file as a hex dump")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kilo [options] [file or directory]\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	// Parse errors are reported by main, so flags only prints when asked for help.
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); errors.Is(err, flag.ErrHelp) {
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w (see kilo --help)", err)
+	}
+	if *showVersion {
+		fmt.Printf("kilo version %s\n", KILO_VERSION)
+		return nil
+	}
+	args, start, err := parseFileArgs(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *rpc {
+		return editorRunHeadless(args, os.Stdin, os.Stdout)
+	}
+
+	if !isTerminal(os.Stdin) {
+		return errors.New("stdin is not a terminal. Run kilo from a terminal, or use --rpc to script it")
+	}
+	if err := enableRawMode(); err != nil {
+		return err
+	}
+	defer func() {
+		if restoreErr := disableRawMode(); err == nil {
+			err = restoreErr
+		}
+	}()
+	if err := initializeEditor(); err != nil {
+		return err
+	}
 
-	args := os.Args[1:]
+	configErr := editorLoadSettings()
+	if config.cursorShape != 0 {
+		mainBuffer.WriteString(cursorShapeSequence(config.cursorShape))
+	}
 
+	browseDir := ""
 	if len(args) >= 1 {
-		editorOpen(args[0])
+		if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+			browseDir = args[0]
+		} else if err := editorOpen(args[0]); err != nil {
+			return err
+		} else if start.line > 0 {
+			editorGoToLocation(start)
+		}
+	}
+	if *hex {
+		editorToggleHexView()
 	}
 
-	editorSetStatusMessage("HELP: Ctrl-Q - quit | Ctrl-S - save | Ctrl-F - find")
+	editorSetStatusMessage("HELP: %s - quit | %s - save | %s - find | %s - reload",
+		editorKeyForAction("quit"), editorKeyForAction("save"), editorKeyForAction("find"), editorKeyForAction("reload"))
+	if configErr != nil {
+		editorSetStatusMessage("Problem with rc file: %s", configErr.Error())
+	}
+	if len(browseDir) > 0 {
+		editorBrowse(browseDir)
+	}
 
 	for {
 		editorRefreshScreen()
-		if !editorProcessKeypress() {
-			break
+		if keepGoing, err := editorProcessKeypress(); !keepGoing {
+			return err
 		}
 	}
 }
@@ -0,0 +1,5453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// ==========================================
+// ================ Helpers =================
+// ==========================================
+
+// Start over with a fresh editor holding lines, as if they had just been opened.
+// The screen is drawn to nowhere and keys come from typeKeys.
+func newTestEditor(t testing.TB, lines ...string) *editorConfig {
+	t.Helper()
+	config = editorConfig{}
+	wordCounts = map[string]int{}
+	completeCycle = nil
+	spellCycle = nil
+	editorSetDefaults()
+	config.screenrows, config.screencols = 22, 80
+	for i, line := range lines {
+		editorInsertRow(&config, i, line)
+	}
+	config.dirty = false
+	config.undoStack = nil
+	editorClearChanges()
+
+	headless = false
+	shouldQuit = false
+	quitTimes = config.quitTimes
+	terminal = bufio.NewWriter(io.Discard)
+	previousFrame = nil
+	buildEvents = nil
+	flashEvents = nil
+	scrollEvents = nil
+	typeKeys()
+	return &config
+}
+
+// Queue keys for editorReadKey to hand out in order.
+// Once they run out, reading fails like a closed terminal.
+func typeKeys(keys ...int) {
+	keyEvents = make(chan int, len(keys))
+	for _, key := range keys {
+		keyEvents <- key
+	}
+	close(keyEvents)
+	keyEventsErr = io.EOF
+}
+
+// The keys that type out text, followed by any extra keys.
+func textKeys(text string, extra ...int) []int {
+	var keys []int
+	for _, char := range text {
+		keys = append(keys, int(char))
+	}
+	return append(keys, extra...)
+}
+
+// The editor's rows joined with newlines.
+func editorText(e *editorConfig) string {
+	lines := make([]string, e.numrows)
+	for i := range lines {
+		lines[i] = e.rows[i].content.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Process keypresses until the queued keys run out.
+func processKeys(t testing.TB, keys ...int) {
+	t.Helper()
+	typeKeys(keys...)
+	for {
+		ok, err := editorProcessKeypress()
+		if !ok {
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatalf("processing keys: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// ==========================================
+// ============= Input & Saving =============
+// ==========================================
+
+func TestDecodeKeysSendsKeysOnChannel(t *testing.T) {
+	input := "a\x1b[A\x1b[3~\x1b[1;2C\x1bxé\x1bOP\x1b[200~h\x1bi\x1b[201~\r"
+	want := []int{
+		'a', ARROW_UP, DEL_KEY, SHIFT_ARROW_RIGHT, ALT_KEY('x'), 'é', F1_KEY,
+		PASTE_START, 'h', ESC, 'i', PASTE_END, '\r',
+	}
+	// Reading the terminal only stops on an error, running out of input just means waiting.
+	gone := errors.New("terminal gone")
+	reader, writer := io.Pipe()
+	go func() {
+		io.WriteString(writer, input)
+		writer.CloseWithError(gone)
+	}()
+
+	keys := make(chan int)
+	go editorDecodeKeys(reader, keys)
+	var got []int
+	for key := range keys {
+		got = append(got, key)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("decoded keys %v, want %v", got, want)
+	}
+	if !errors.Is(keyEventsErr, gone) {
+		t.Errorf("keyEventsErr = %v, want %v", keyEventsErr, gone)
+	}
+}
+
+func TestReadKeyReturnsErrorWhenInputEnds(t *testing.T) {
+	newTestEditor(t, "hello")
+	typeKeys('a')
+
+	if key, err := editorReadKey(); key != 'a' || err != nil {
+		t.Fatalf("editorReadKey() = %d, %v, want 'a', nil", key, err)
+	}
+	key, err := editorReadKey()
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("editorReadKey() error = %v, want io.EOF", err)
+	}
+	if key != ESC {
+		t.Errorf("editorReadKey() key = %d, want ESC so prompts back out", key)
+	}
+}
+
+func TestReadKeyReturnsErrorWhenPasteIsCutOff(t *testing.T) {
+	newTestEditor(t)
+	typeKeys(PASTE_START, 'a', 'b')
+
+	if _, err := editorReadKey(); !errors.Is(err, io.EOF) {
+		t.Fatalf("editorReadKey() error = %v, want io.EOF", err)
+	}
+}
+
+func TestBracketedPasteGoesInAtOnce(t *testing.T) {
+	e := newTestEditor(t, "  xy")
+	e.autoPair = true
+	e.cx = 3
+	typeKeys(decodeKeys("\x1b[200~(a\r  b\r\tc\x1b[201~")...)
+
+	// One keypress for the whole paste.
+	if ok, err := editorProcessKeypress(); !ok || err != nil {
+		t.Fatalf("editorProcessKeypress() = %v, %v", ok, err)
+	}
+	// Nothing is paired or indented, and the line breaks are real ones.
+	if got, want := editorText(e), "  x(a\n  b\n\tcy"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if e.cx != 2 || e.cy != 2 {
+		t.Errorf("cursor at (%d, %d), want the end of the paste at (2, 2)", e.cx, e.cy)
+	}
+}
+
+func TestBracketedPasteIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "  xy")
+	e.cx = 3
+	processKeys(t, decodeKeys("\x1b[200~(a\r  b\r\tc\x1b[201~")...)
+
+	undoOnce(t, e, "  xy", 3, 0)
+}
+
+func TestBracketedPasteStripControls(t *testing.T) {
+	tests := []struct {
+		strip bool
+		want  string
+	}{
+		{false, "\x1b[31mred\x1b[0m\a\ttext\nx"},
+		{true, "red\ttext\nx"},
+	}
+	for _, tt := range tests {
+		e := newTestEditor(t, "x")
+		e.stripControls = tt.strip
+		processKeys(t, decodeKeys("\x1b[200~\x1b[31mred\x1b[0m\x07\ttext\r\n\x1b[201~")...)
+
+		if got := editorText(e); got != tt.want {
+			t.Errorf("with strip_controls %v, text = %q, want %q", tt.strip, got, tt.want)
+		}
+	}
+}
+
+func TestBracketedPasteInPromptTakesFirstLine(t *testing.T) {
+	e := newTestEditor(t, "one", "two", "three")
+	keys := append([]int{CTRL_KEY('f')}, decodeKeys("\x1b[200~thr\rone\x1b[201~")...)
+	processKeys(t, append(keys, '\r')...)
+
+	if e.cy != 2 {
+		t.Errorf("cursor on line %d, want the search for the first pasted line to find 2", e.cy)
+	}
+}
+
+func TestRestoringTerminalEndsBracketedPaste(t *testing.T) {
+	e := newTestEditor(t)
+	e.originalTermios = &unix.Termios{}
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+	pipeStdin(t, "")
+
+	disableRawMode()
+
+	if !strings.Contains(out.String(), "\x1b[?2004l") {
+		t.Errorf("wrote %q, want bracketed paste turned off", out.String())
+	}
+}
+
+func TestProcessKeypressStopsOnReadError(t *testing.T) {
+	newTestEditor(t, "hello")
+	typeKeys()
+
+	ok, err := editorProcessKeypress()
+	if ok || !errors.Is(err, io.EOF) {
+		t.Fatalf("editorProcessKeypress() = %v, %v, want false, io.EOF", ok, err)
+	}
+}
+
+func TestSaveReportsCreateError(t *testing.T) {
+	e := newTestEditor(t, "hello")
+	e.filename = filepath.Join(t.TempDir(), "missing", "file.txt")
+	e.dirty = true
+
+	editorSave()
+
+	if !strings.HasPrefix(e.statusMsg, "Can't save!") {
+		t.Errorf("status = %q, want a save error", e.statusMsg)
+	}
+	if !e.dirty {
+		t.Error("buffer marked clean after a failed save")
+	}
+}
+
+func TestSpecialKeysAreNotTyped(t *testing.T) {
+	for key := ARROW_LEFT; key < SPECIAL_KEYS_END; key++ {
+		if isTypedChar(key) {
+			t.Errorf("isTypedChar(%d) = true, want false", key)
+		}
+	}
+	for _, key := range []int{'a', 'Z', 'é', '世', ALT_KEY_BASE - 1} {
+		if !isTypedChar(key) {
+			t.Errorf("isTypedChar(%q) = false, want true", rune(key))
+		}
+	}
+}
+
+func TestBlockSelectMovesOnShiftArrow(t *testing.T) {
+	e := newTestEditor(t, "abc", "def")
+	editorToggleBlockSelect()
+
+	if editorProcessBlockKey(SHIFT_ARROW_RIGHT) {
+		t.Error("editorProcessBlockKey(SHIFT_ARROW_RIGHT) handled it as text")
+	}
+	if got := editorText(e); got != "abc\ndef" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+}
+
+func TestMultiCursorLetsGoOnCtrlArrow(t *testing.T) {
+	e := newTestEditor(t, "abc", "def")
+	e.cursors = []editorCursor{{cx: 0, cy: 1}}
+
+	if editorProcessMultiCursorKey(CTRL_ARROW_RIGHT) {
+		t.Error("editorProcessMultiCursorKey(CTRL_ARROW_RIGHT) handled it as text")
+	}
+	if got := editorText(e); got != "abc\ndef" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+}
+
+func TestStripControlsDropsStrayPasteEnd(t *testing.T) {
+	e := newTestEditor(t, "abc")
+	e.stripControls = true
+
+	processKeys(t, PASTE_END, 'x')
+
+	if got := editorText(e); got != "xabc" {
+		t.Errorf("text = %q, want %q", got, "xabc")
+	}
+}
+
+func TestStripControlsFromTypedText(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip bool
+		// What's left of the status message.
+		status string
+	}{
+		{"off", false, "Ctrl-G isn't bound to anything"},
+		{"on", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, "")
+			e.stripControls = tt.strip
+			// Colored text with a bell, as if pasted without brackets.
+			processKeys(t, decodeKeys("\x1b[1;31mred\x1b[0m \x1b[38;5;196mtext\x07!")...)
+
+			// Whole sequences are skipped, never typed as text.
+			if got := editorText(e); got != "red text!" {
+				t.Errorf("text = %q, want %q", got, "red text!")
+			}
+			if e.statusMsg != tt.status {
+				t.Errorf("status = %q, want %q", e.statusMsg, tt.status)
+			}
+		})
+	}
+}
+
+func TestUnknownSequenceIsEscWithoutStripControls(t *testing.T) {
+	e := newTestEditor(t, "abc")
+	e.selecting = true
+	processKeys(t, UNKNOWN_SEQUENCE)
+	if e.selecting {
+		t.Error("an unknown sequence didn't back out like Esc")
+	}
+
+	e.stripControls = true
+	e.selecting = true
+	processKeys(t, UNKNOWN_SEQUENCE)
+	if !e.selecting {
+		t.Error("an unknown sequence was taken as Esc with strip_controls")
+	}
+}
+
+func TestUnboundAltKeyIsNotTyped(t *testing.T) {
+	e := newTestEditor(t, "abc")
+	if _, ok := keyBindings[ALT_KEY('z')]; ok {
+		t.Fatal("Alt-z is bound, pick another key")
+	}
+
+	processKeys(t, ALT_KEY('z'))
+
+	if got := editorText(e); got != "abc" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+	if e.statusMsg != "Alt-z isn't bound to anything" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+// ==========================================
+// ============ Row Operations ==============
+// ==========================================
+
+// An editor of its own, apart from the global one.
+func newLocalEditor(lines ...string) *editorConfig {
+	e := &editorConfig{fileSettings: defaultFileSettings, growAtEOF: true}
+	for i, line := range lines {
+		editorInsertRow(e, i, line)
+	}
+	e.undoStack = nil
+	return e
+}
+
+func TestEditsOnLocalEditor(t *testing.T) {
+	global := newTestEditor(t, "global")
+	e := newLocalEditor()
+
+	for _, char := range "hello" {
+		editorInsertChar(e, char)
+	}
+	editorInsertNewline(e)
+	for _, char := range "world" {
+		editorInsertChar(e, char)
+	}
+	editorMoveCursor(e, ARROW_UP)
+	editorMoveCursor(e, ARROW_LEFT)
+	editorDelChar(e)
+
+	if got := editorText(e); got != "helo\nworld" {
+		t.Errorf("text = %q, want %q", got, "helo\nworld")
+	}
+	if e.cx != 3 || e.cy != 0 || !e.dirty {
+		t.Errorf("cursor at (%d, %d), dirty %v, want (3, 0), dirty", e.cx, e.cy, e.dirty)
+	}
+	if got := editorText(global); got != "global" || global.dirty {
+		t.Errorf("global editor changed to %q", got)
+	}
+}
+
+func TestLineEditsOnLocalEditor(t *testing.T) {
+	global := newTestEditor(t, "global")
+	e := newLocalEditor("// ab = 41", "  joined")
+	e.syntax = &highlightDB[0]
+	e.now = func() time.Time { return time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC) }
+	e.dateFormat = "2006-01-02"
+
+	e.cx = 4
+	editorTransposeChars(e)
+	editorAddToNumber(e, 1)
+	editorToggleComment(e)
+	editorJoinLines(e)
+	editorInsertDate(e)
+	editorPaste(e, " on\rthe ")
+	if got, want := editorText(e), "ba = 422024-05-06 on\nthe  joined"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	e.cx = 3
+	editorDeleteToLineStart(e)
+
+	if got, want := editorText(e), "ba = 422024-05-06 on\n  joined"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if !e.dirty {
+		t.Error("local editor wasn't marked dirty")
+	}
+	if got := editorText(global); got != "global" || global.dirty {
+		t.Errorf("global editor changed to %q", got)
+	}
+}
+
+func TestLocalEditorsKeepTheirOwnSettings(t *testing.T) {
+	narrow, wide := newLocalEditor("\tx"), newLocalEditor("\tx")
+	narrow.tabStop = 2
+
+	if got := editorRowCxToRx(narrow, &narrow.rows[0], 1); got != 2 {
+		t.Errorf("narrow rx = %d, want 2", got)
+	}
+	if got := editorRowCxToRx(wide, &wide.rows[0], 1); got != KILO_TAB_STOP {
+		t.Errorf("wide rx = %d, want %d", got, KILO_TAB_STOP)
+	}
+}
+
+func TestJoinLinesOnLocalEditor(t *testing.T) {
+	e := newLocalEditor("ab", "cd")
+	e.cy = 1
+
+	editorDelChar(e)
+
+	if got := editorText(e); got != "abcd" {
+		t.Errorf("text = %q, want %q", got, "abcd")
+	}
+	if e.cx != 2 || e.cy != 0 || e.numrows != 1 {
+		t.Errorf("cursor at (%d, %d) with %d rows, want (2, 0) with 1", e.cx, e.cy, e.numrows)
+	}
+	if e.rows[0].id != 0 {
+		t.Errorf("row id = %d, want 0", e.rows[0].id)
+	}
+}
+
+func TestGapBufferEdits(t *testing.T) {
+	g := newGapBuffer([]rune("hello world"))
+
+	g.Insert(5, []rune(", big")...)
+	g.Delete(0, 1)
+	g.Insert(0, 'J')
+	// Far more than the gap holds, so it has to grow.
+	g.Insert(g.Len(), []rune(strings.Repeat("!", 3*GAP_BUFFER_MIN_GAP))...)
+	g.Truncate(g.Len() - 3*GAP_BUFFER_MIN_GAP + 1)
+
+	if got := g.String(); got != "Jello, big world!" {
+		t.Errorf("text = %q, want %q", got, "Jello, big world!")
+	}
+	if g.Len() != len("Jello, big world!") {
+		t.Errorf("Len() = %d", g.Len())
+	}
+	if got := string(g.Slice(3, 9)); got != "lo, bi" {
+		t.Errorf("Slice(3, 9) = %q, want %q", got, "lo, bi")
+	}
+	for i, want := range "Jello, big world!" {
+		if got := g.At(i); got != want {
+			t.Errorf("At(%d) = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestEditedRowIsRenderedWhenNeeded(t *testing.T) {
+	e := newTestEditor(t, "ab", "cd", "ef")
+	e.filename = "main.go"
+	editorSelectSyntaxHighlight()
+	editorRenderRowsThrough(2)
+
+	e.cx = 1
+	editorInsertChar(e, '\t')
+	for _, char := range "/*" {
+		editorInsertChar(e, char)
+	}
+	if !e.rows[0].stale {
+		t.Fatal("edited row was rendered straight away")
+	}
+	editorRenderRowsThrough(2)
+
+	if got := string(e.rows[0].render); got != "a       /*b\x00" {
+		t.Errorf("render = %q", got)
+	}
+	// Opening the comment carries on to the rows below.
+	if got := e.rows[2].highlights[0]; got != HL_MLCOMMENT {
+		t.Errorf("highlight below = %d, want HL_MLCOMMENT", got)
+	}
+}
+
+func TestEditOnlyHighlightsRowsItAffects(t *testing.T) {
+	tests := []struct {
+		name  string
+		typed string
+		// The rows highlighted again after typing on the first one.
+		want []int
+	}{
+		{"same comment state", "x", []int{0}},
+		{"comment opened", "/*", []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, "a", "b", "c", "*/ d", "e", "f")
+			e.filename = "main.go"
+			editorSelectSyntaxHighlight()
+			editorRenderRowsThrough(e.numrows - 1)
+			// Mark every row, so rows highlighted again lose the mark.
+			const mark = 0xFF
+			for i := range e.rows {
+				e.rows[i].highlights[0] = mark
+			}
+
+			e.cx = 1
+			for _, char := range tt.typed {
+				editorInsertChar(e, char)
+			}
+			editorRenderRowsThrough(e.numrows - 1)
+
+			var got []int
+			for i := range e.rows {
+				if e.rows[i].highlights[0] != mark {
+					got = append(got, i)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("highlighted rows %v again, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The highlight of each bracket in a row's render, as the depth color 1-3 or
+// - for any other highlight.
+func bracketColors(row *editorRow) string {
+	var colors strings.Builder
+	for i, char := range row.render {
+		if !strings.ContainsRune("()[]{}", char) {
+			continue
+		}
+		if highlight := row.highlights[i]; highlight >= HL_BRACKET1 && highlight <= HL_BRACKET3 {
+			colors.WriteByte(byte('1' + highlight - HL_BRACKET1))
+		} else {
+			colors.WriteByte('-')
+		}
+	}
+	return colors.String()
+}
+
+func TestRainbowBrackets(t *testing.T) {
+	e := newTestEditor(t, "f(a[b{c{d}}])", `g("(") // {`, "h(", "\tx(y)", ")")
+	e.rainbowBrackets = true
+	e.filename = "main.go"
+	editorSelectSyntaxHighlight()
+	editorRenderRowsThrough(e.numrows - 1)
+
+	want := []string{"12311321", "1-1-", "1", "22", "1"}
+	for y := range want {
+		if got := bracketColors(&e.rows[y]); got != want[y] {
+			t.Errorf("row %d brackets colored %q, want %q", y, got, want[y])
+		}
+	}
+
+	// Opening a bracket above recolors the rows below.
+	e.cy, e.cx = 2, 0
+	editorInsertChar(e, '(')
+	editorRenderRowsThrough(e.numrows - 1)
+	want = []string{"12311321", "1-1-", "12", "33", "2"}
+	for y := range want {
+		if got := bracketColors(&e.rows[y]); got != want[y] {
+			t.Errorf("after the edit, row %d brackets colored %q, want %q", y, got, want[y])
+		}
+	}
+}
+
+func TestTrailingWhitespaceHighlight(t *testing.T) {
+	e := newTestEditor(t, "a b  ", "\tc\t", " ", "d")
+	e.highlightTrailing = true
+	editorRenderRowsThrough(e.numrows - 1)
+
+	for y, want := range []string{"   xx", "         xxxxxxx", "x", " "} {
+		var got strings.Builder
+		for _, highlight := range e.rows[y].highlights[:e.rows[y].RLen()-1] {
+			got.WriteString(map[bool]string{true: "x", false: " "}[highlight == HL_TRAILING])
+		}
+		if got.String() != want {
+			t.Errorf("row %d trailing whitespace marked %q, want %q", y, got.String(), want)
+		}
+	}
+
+	// A blank row isn't lit up while the cursor is on it.
+	frame := make([]string, e.screenrows)
+	e.cy = 2
+	editorDrawRows(frame)
+	if !strings.Contains(frame[0], KILO_TRAILING_COLOR) || strings.Contains(frame[2], KILO_TRAILING_COLOR) {
+		t.Errorf("with the cursor on the blank row, drawn as %q", frame[:3])
+	}
+	e.cy = 3
+	editorDrawRows(frame)
+	if !strings.Contains(frame[2], KILO_TRAILING_COLOR) {
+		t.Errorf("with the cursor off the blank row, drawn as %q", frame[2])
+	}
+}
+
+func TestTodoKeywordsInComments(t *testing.T) {
+	e := newTestEditor(t, `x := "TODO" // TODO: fix, not TODOS`, "/* XXX */ FIXME")
+	e.filename = "main.go"
+	editorSelectSyntaxHighlight()
+	editorRenderRowsThrough(e.numrows - 1)
+
+	for y, want := range []string{"               xxxx                ", "   xxx         "} {
+		var got strings.Builder
+		for _, highlight := range e.rows[y].highlights[:e.rows[y].RLen()-1] {
+			got.WriteString(map[bool]string{true: "x", false: " "}[highlight == HL_TODO])
+		}
+		if got.String() != want {
+			t.Errorf("row %d keywords marked %q, want %q", y, got.String(), want)
+		}
+	}
+}
+
+func TestTodoKeywordsFromRC(t *testing.T) {
+	e := newTestEditor(t, "// NOTE and TODO")
+	if err := loadRC(t, "todo_keywords = NOTE\n"); err != nil {
+		t.Fatal(err)
+	}
+	e.filename = "main.go"
+	editorSelectSyntaxHighlight()
+	editorRenderRowsThrough(0)
+
+	for i, highlight := range e.rows[0].highlights[:e.rows[0].RLen()-1] {
+		if isNote := i >= 3 && i < 7; (highlight == HL_TODO) != isNote {
+			t.Errorf("highlight at %d = %d", i, highlight)
+		}
+	}
+}
+
+func TestControlCharactersRenderVisibly(t *testing.T) {
+	e := newTestEditor(t, "a\x01b\x7fc\u0085d")
+	row := &e.rows[0]
+	editorRenderRowsThrough(0)
+
+	if got, want := string(row.render), "a^Ab^?c\\u0085d\x00"; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+	want := []uint8{HL_NORMAL, HL_ESCAPE, HL_ESCAPE, HL_NORMAL, HL_ESCAPE, HL_ESCAPE, HL_NORMAL}
+	if got := row.highlights[:len(want)]; !slices.Equal(got, want) {
+		t.Errorf("highlights = %v, want %v", got, want)
+	}
+	// The cursor steps over each escape as the one character it stands for.
+	for cx, rx := range []int{0, 1, 3, 4, 6, 7, 13, 14} {
+		if got := editorRowCxToRx(e, row, cx); got != rx {
+			t.Errorf("editorRowCxToRx(%d) = %d, want %d", cx, got, rx)
+		}
+		if got := editorRowRxToCx(e, row, rx); got != cx {
+			t.Errorf("editorRowRxToCx(%d) = %d, want %d", rx, got, cx)
+		}
+	}
+}
+
+// Typing in the middle of a line costs the same however long the line is,
+// since the row isn't rendered again until it's drawn.
+func BenchmarkInsertChar(b *testing.B) {
+	for _, length := range []int{100, 10_000, 1_000_000} {
+		b.Run(fmt.Sprintf("line=%d", length), func(b *testing.B) {
+			e := newLocalEditor(strings.Repeat("x", length))
+			e.cx = length / 2
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				editorInsertChar(e, 'a')
+			}
+		})
+	}
+}
+
+// The same goes for typing and backspacing over it.
+func BenchmarkInsertAndDeleteChar(b *testing.B) {
+	for _, length := range []int{100, 10_000, 1_000_000} {
+		b.Run(fmt.Sprintf("line=%d", length), func(b *testing.B) {
+			e := newLocalEditor(strings.Repeat("x", length))
+			e.cx = length / 2
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				editorInsertChar(e, 'a')
+				editorDelChar(e)
+			}
+		})
+	}
+}
+
+// Typing out a long line from nothing, one character at a time.
+func BenchmarkTypeLongLine(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e := newLocalEditor("")
+		for j := 0; j < 10_000; j++ {
+			editorInsertChar(e, 'a')
+		}
+	}
+}
+
+func TestTypingDoesntAllocatePerChar(t *testing.T) {
+	e := newLocalEditor(strings.Repeat("x", 10_000))
+	e.cx = 5_000
+
+	// The gap grows now and then, but most characters go straight into it.
+	allocs := testing.AllocsPerRun(1000, func() {
+		editorInsertChar(e, 'a')
+	})
+	if allocs >= 1 {
+		t.Errorf("typing a character made %v allocations, want less than one", allocs)
+	}
+}
+
+// Write a file of numLines numbered lines.
+func writeLines(t testing.TB, numLines int) string {
+	t.Helper()
+	var text strings.Builder
+	for i := 0; i < numLines; i++ {
+		fmt.Fprintf(&text, "line %d\tof some text\n", i)
+	}
+	path := filepath.Join(t.TempDir(), "lines.txt")
+	if err := os.WriteFile(path, []byte(text.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProgressIsShownNowAndThen(t *testing.T) {
+	e := newTestEditor(t)
+	e.filename = filepath.Join("dir", "big.txt")
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+
+	progress := &loadProgress{size: 200}
+	progress.update(50)
+	if want := "Loading big.txt… 25%"; e.statusMsg != want {
+		t.Errorf("status = %q, want %q", e.statusMsg, want)
+	}
+	if !strings.Contains(stripEscapes(out.String()), "Loading big.txt… 25%") {
+		t.Error("progress wasn't drawn")
+	}
+	// Too soon to show it again.
+	progress.update(100)
+	if want := "Loading big.txt… 25%"; e.statusMsg != want {
+		t.Errorf("status = %q straight after, want %q", e.statusMsg, want)
+	}
+
+	progress.done()
+	if e.statusMsg != "" {
+		t.Errorf("status = %q once loaded, want it cleared", e.statusMsg)
+	}
+}
+
+func TestLoadProgressNotShownForQuickLoads(t *testing.T) {
+	e := newTestEditor(t)
+	editorSetStatusMessage("before")
+	progress := newLoadProgress(200)
+	progress.update(200)
+	progress.done()
+	if e.statusMsg != "before" {
+		t.Errorf("status = %q, want a quick load to leave it alone", e.statusMsg)
+	}
+
+	// An empty file has nothing to show progress through.
+	progress = &loadProgress{}
+	progress.update(0)
+	if e.statusMsg != "before" {
+		t.Errorf("status = %q for an empty file, want it left alone", e.statusMsg)
+	}
+}
+
+func TestOpenOnlyRendersRowsOnScreen(t *testing.T) {
+	path := writeLines(t, 1000)
+	e := newTestEditor(t)
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := range e.rows {
+		if !e.rows[i].stale {
+			t.Fatalf("row %d was rendered on open", i)
+		}
+	}
+
+	editorRefreshScreen()
+
+	for i := range e.rows {
+		if onScreen := i <= e.screenrows; e.rows[i].stale == onScreen {
+			t.Fatalf("row %d stale = %v after drawing the top of the file", i, e.rows[i].stale)
+		}
+	}
+}
+
+// Opening a file doesn't render its rows, so a bigger file only costs the
+// reading and splitting of its lines.
+func BenchmarkOpen(b *testing.B) {
+	for _, numLines := range []int{1_000, 100_000} {
+		b.Run(fmt.Sprintf("lines=%d", numLines), func(b *testing.B) {
+			path := writeLines(b, numLines)
+			newTestEditor(b).filename = path
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := editorReload(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ==========================================
+// =========== Editor Operations ============
+// ==========================================
+
+func TestTransposeChars(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		cx       int
+		wantLine string
+		wantCx   int
+	}{
+		{"middle", "abcd", 2, "acbd", 3},
+		{"end of line", "abcd", 4, "abdc", 4},
+		{"start of line", "abcd", 0, "abcd", 0},
+		{"multibyte", "héllo", 2, "hlélo", 3},
+		{"one character", "a", 1, "a", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, tt.line)
+			e.cx = tt.cx
+
+			processKeys(t, CTRL_KEY('t'))
+
+			if got := editorText(e); got != tt.wantLine || e.cx != tt.wantCx {
+				t.Errorf("got %q with cx %d, want %q with cx %d", got, e.cx, tt.wantLine, tt.wantCx)
+			}
+		})
+	}
+}
+
+func TestTransposeIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "abcd")
+	e.cx = 2
+	processKeys(t, CTRL_KEY('t'))
+
+	undoOnce(t, e, "abcd", 2, 0)
+}
+
+func TestTypingPastLastLine(t *testing.T) {
+	tests := []struct {
+		growAtEOF bool
+		lines     []string
+		want      string
+		cx, cy    int
+	}{
+		{true, []string{"a", "b"}, "a\nb\nx", 1, 2},
+		{false, []string{"a", "b"}, "a\nbx", 2, 1},
+		// With no lines there's nothing to go on the end of.
+		{false, nil, "x", 1, 0},
+	}
+	for _, tt := range tests {
+		e := newTestEditor(t, tt.lines...)
+		e.growAtEOF = tt.growAtEOF
+		e.cy = e.numrows
+		processKeys(t, 'x')
+
+		if got := editorText(e); got != tt.want || e.cx != tt.cx || e.cy != tt.cy {
+			t.Errorf("grow_at_eof %v: text %q with the cursor at (%d, %d), want %q at (%d, %d)",
+				tt.growAtEOF, got, e.cx, e.cy, tt.want, tt.cx, tt.cy)
+		}
+	}
+}
+
+func TestEnterPastLastLineStillAddsLine(t *testing.T) {
+	e := newTestEditor(t, "a")
+	e.growAtEOF = false
+	e.cy = 1
+	processKeys(t, '\r')
+	if e.numrows != 2 {
+		t.Errorf("numrows = %d after Enter past the end, want 2", e.numrows)
+	}
+}
+
+func TestDeleteAtEndOfLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		cx, cy int
+		want   string
+	}{
+		{"middle line", 5, 0, "wörldnext\nlast"},
+		{"inside a line", 1, 0, "wrld\nnext\nlast"},
+		{"last line", 4, 2, "wörld\nnext\nlast"},
+		{"past the end", 0, 3, "wörld\nnext\nlast"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, "wörld", "next", "last")
+			e.cx, e.cy = tt.cx, tt.cy
+			processKeys(t, DEL_KEY)
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if e.cx != tt.cx || e.cy != tt.cy {
+				t.Errorf("cursor moved to (%d, %d), want it left at (%d, %d)", e.cx, e.cy, tt.cx, tt.cy)
+			}
+			if e.dirty != (tt.want != "wörld\nnext\nlast") {
+				t.Errorf("dirty = %v", e.dirty)
+			}
+		})
+	}
+}
+
+func TestBackspaceAtLineStart(t *testing.T) {
+	tests := []struct {
+		name           string
+		deleteEmptyRow bool
+		cy             int
+		want           string
+		// Where the cursor ends up on the line above, and how that line is marked.
+		cx     int
+		change uint8
+	}{
+		{"joins a line", false, 2, "one\ntwothree\n\nfour", 3, CHANGE_MODIFIED},
+		{"joins a line with the option", true, 2, "one\ntwothree\n\nfour", 3, CHANGE_MODIFIED},
+		{"joins an empty line", false, 3, "one\ntwo\nthree\nfour", 5, CHANGE_MODIFIED},
+		{"removes an empty line", true, 3, "one\ntwo\nthree\nfour", 5, CHANGE_NONE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, "one", "two", "three", "", "four")
+			e.showChanges = true
+			e.deleteEmptyRow = tt.deleteEmptyRow
+			e.cy = tt.cy
+			processKeys(t, BACKSPACE)
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if e.cy != tt.cy-1 || e.cx != tt.cx {
+				t.Errorf("cursor at (%d, %d), want (%d, %d)", e.cx, e.cy, tt.cx, tt.cy-1)
+			}
+			if got := e.rows[tt.cy-1].change; got != tt.change {
+				t.Errorf("line above marked %d, want %d", got, tt.change)
+			}
+		})
+	}
+}
+
+func TestDeleteToLineStart(t *testing.T) {
+	tests := []struct {
+		cx   int
+		want string
+	}{
+		{3, "lo world"},
+		{5, " world"},
+		{11, ""},
+		// At the start there's nothing before the cursor, and the line above is left alone.
+		{0, "hello world"},
+	}
+	for _, tt := range tests {
+		e := newTestEditor(t, "above", "hello world")
+		e.cx, e.cy = tt.cx, 1
+		processKeys(t, CTRL_KEY('u'))
+
+		if got := e.rows[1].content.String(); got != tt.want || e.numrows != 2 {
+			t.Errorf("from %d, line = %q with %d rows, want %q with 2", tt.cx, got, e.numrows, tt.want)
+		}
+		if e.cx != 0 {
+			t.Errorf("from %d, cx = %d, want 0", tt.cx, e.cx)
+		}
+		if e.dirty != (tt.cx > 0) {
+			t.Errorf("from %d, dirty = %v", tt.cx, e.dirty)
+		}
+	}
+}
+
+func TestDeleteToLineStartIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "hello world")
+	e.cx = 6
+	processKeys(t, CTRL_KEY('u'))
+
+	undoOnce(t, e, "hello world", 6, 0)
+}
+
+func TestJoinLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		cy     int
+		want   string
+		wantCx int
+	}{
+		{"two lines", []string{"hello", "world"}, 0, "hello world", 5},
+		{"indented", []string{"if x {", "\t\treturn"}, 0, "if x { return", 6},
+		{"trailing space", []string{"hello  ", "  world"}, 0, "hello world", 5},
+		{"empty line", []string{"", "world"}, 0, "world", 0},
+		{"onto empty line", []string{"hello", ""}, 0, "hello", 5},
+		{"last line", []string{"hello", "world"}, 1, "hello\nworld", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, tt.lines...)
+			e.cy, e.cx = tt.cy, 2
+
+			processKeys(t, CTRL_KEY('j'))
+
+			if got := editorText(e); got != tt.want || e.cx != tt.wantCx || e.cy != tt.cy {
+				t.Errorf("got %q with cursor (%d, %d), want %q with cursor (%d, %d)", got, e.cx, e.cy, tt.want, tt.wantCx, tt.cy)
+			}
+		})
+	}
+}
+
+func TestJoinLinesIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "hello", "\tworld")
+	processKeys(t, CTRL_KEY('j'))
+
+	undoOnce(t, e, "hello\n\tworld", 0, 0)
+}
+
+func TestAutoPair(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		keys   []int
+		want   string
+		wantCx int
+	}{
+		{"opener", "", textKeys("("), "()", 1},
+		{"type over closer", "", textKeys("(x)"), "(x)", 3},
+		{"nested", "", textKeys("f(["), "f([])", 3},
+		{"backspace empty pair", "", textKeys("(", BACKSPACE), "", 0},
+		{"backspace in full pair", "", textKeys("(x", BACKSPACE), "()", 1},
+		{"quote", "", textKeys(`"`), `""`, 1},
+		{"apostrophe", "don", textKeys("'t"), "don't", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, tt.line)
+			e.autoPair = true
+			e.cx = len(tt.line)
+
+			processKeys(t, tt.keys...)
+
+			if got := editorText(e); got != tt.want || e.cx != tt.wantCx {
+				t.Errorf("got %q with cx %d, want %q with cx %d", got, e.cx, tt.want, tt.wantCx)
+			}
+		})
+	}
+}
+
+func TestAutoPairIsOffByDefault(t *testing.T) {
+	e := newTestEditor(t)
+
+	processKeys(t, textKeys("(")...)
+
+	if got := editorText(e); got != "(" {
+		t.Errorf("text = %q, want %q", got, "(")
+	}
+}
+
+func TestToggleCommentOnSelection(t *testing.T) {
+	e := newTestEditor(t, "func f() int {", "\tx := 1", "", "\treturn x", "}")
+	e.filename = "main.go"
+	editorSelectSyntaxHighlight()
+	e.selecting = true
+	e.selectAnchor = editorCursor{0, 1}
+	e.cx, e.cy = 3, 3
+
+	processKeys(t, CTRL_KEY('_'))
+
+	want := "func f() int {\n\t// x := 1\n\n\t// return x\n}"
+	if got := editorText(e); got != want {
+		t.Errorf("commented = %q, want %q", got, want)
+	}
+	if e.cx != 6 {
+		t.Errorf("cx = %d, want it kept on the same text at 6", e.cx)
+	}
+
+	processKeys(t, CTRL_KEY('_'))
+
+	want = "func f() int {\n\tx := 1\n\n\treturn x\n}"
+	if got := editorText(e); got != want {
+		t.Errorf("uncommented = %q, want %q", got, want)
+	}
+}
+
+func TestToggleCommentOnShellLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"echo hi", "# echo hi"},
+		{"# echo hi", "echo hi"},
+		{"  #echo hi", "  echo hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			e := newTestEditor(t, tt.line)
+			e.filename = "run.sh"
+			editorSelectSyntaxHighlight()
+
+			processKeys(t, CTRL_KEY('_'))
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("toggled %q to %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToggleCommentWithoutSyntax(t *testing.T) {
+	e := newTestEditor(t, "plain text")
+
+	processKeys(t, CTRL_KEY('_'))
+
+	if got := editorText(e); got != "plain text" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+	if e.statusMsg != "Don't know how to comment this file type" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestAddToNumber(t *testing.T) {
+	tests := []struct {
+		line  string
+		cx    int
+		delta int64
+		want  string
+	}{
+		{"x = 007", 0, 1, "x = 008"},
+		{"x = 009", 0, 1, "x = 010"},
+		{"007", 0, -8, "-001"},
+		{"1", 0, -1, "0"},
+		{"0", 0, -1, "-1"},
+		{"-1", 0, 1, "0"},
+		{"-1", 1, -1, "-2"},
+		{"a-1", 0, 1, "a-2"},
+		{"x 9 y", 0, 1, "x 10 y"},
+		{"123", 1, 1, "124"},
+		{"12 and 5", 3, 1, "12 and 6"},
+		{"12 and 5", 2, 10, "12 and 15"},
+	}
+	for _, tt := range tests {
+		e := newLocalEditor(tt.line)
+		e.cx = tt.cx
+		editorAddToNumber(e, tt.delta)
+		if got := editorText(e); got != tt.want {
+			t.Errorf("adding %d to %q at %d = %q, want %q", tt.delta, tt.line, tt.cx, got, tt.want)
+		}
+	}
+}
+
+func TestAddToNumberWithoutNumber(t *testing.T) {
+	for line, status := range map[string]string{
+		"no digits":           "No number on this line",
+		"12 and then":         "No number on this line",
+		"9223372036854775807": "Number is too big",
+	} {
+		e := newTestEditor(t, line)
+		e.cx = 3
+		editorAddToNumber(e, 1)
+		if got := editorText(e); got != line || e.statusMsg != status {
+			t.Errorf("incrementing %q gave %q with status %q, want status %q", line, got, e.statusMsg, status)
+		}
+	}
+}
+
+func TestIncrementKeysAndCount(t *testing.T) {
+	e := newTestEditor(t, "width: 10px")
+	processKeys(t, ALT_KEY('+'), ALT_KEY('+'), ALT_KEY('-'))
+	if got := editorText(e); got != "width: 11px" || e.cx != 8 {
+		t.Errorf("text = %q with cx %d, want %q with the cursor on the last digit", got, e.cx, "width: 11px")
+	}
+	typeKeys(textKeys("-15\r")...)
+	editorAddToNumberPrompt()
+	if got := editorText(e); got != "width: -4px" {
+		t.Errorf("text = %q, want %q", got, "width: -4px")
+	}
+}
+
+func TestInsertDate(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{time.RFC3339, "Day: 2024-03-05T14:07:09Z!"},
+		{"2006-01-02", "Day: 2024-03-05!"},
+		{"Mon Jan 2 15:04", "Day: Tue Mar 5 14:07!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			e := newTestEditor(t, "Day: !")
+			e.now = func() time.Time { return time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC) }
+			e.dateFormat = tt.format
+			e.cx = 5
+
+			processKeys(t, ALT_KEY('d'))
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if want := len(tt.want) - 1; e.cx != want {
+				t.Errorf("cx = %d, want %d, just past the date", e.cx, want)
+			}
+		})
+	}
+}
+
+func TestInsertDateIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "Day: !")
+	e.now = func() time.Time { return time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC) }
+	e.cx = 5
+	processKeys(t, ALT_KEY('d'))
+
+	undoOnce(t, e, "Day: !", 5, 0)
+}
+
+func TestSnippetExpandsAndVisitsStops(t *testing.T) {
+	e := newTestEditor(t, "\tfn rest")
+	if err := loadRC(t, `snippet fn = func $1($2) {\n\t$0\n}`); err != nil {
+		t.Fatal(err)
+	}
+	e.cx = 3
+
+	processKeys(t, '\t')
+
+	if got, want := editorText(e), "\tfunc () {\n\t\t\n\t} rest"; got != want {
+		t.Fatalf("expanded to %q, want %q", got, want)
+	}
+	if e.cx != 6 || e.cy != 0 {
+		t.Errorf("cursor at (%d, %d), want the first stop at (6, 0)", e.cx, e.cy)
+	}
+
+	processKeys(t, textKeys("add\ta int\treturn a")...)
+
+	if got, want := editorText(e), "\tfunc add(a int) {\n\t\treturn a\n\t} rest"; got != want {
+		t.Errorf("filled in to %q, want %q", got, want)
+	}
+	if e.cx != 10 || e.cy != 1 {
+		t.Errorf("cursor at (%d, %d), want (10, 1) after the last stop", e.cx, e.cy)
+	}
+}
+
+func TestParseSnippet(t *testing.T) {
+	lines, stops := parseSnippet(`a $2 b\n\t$0 \\ $$1 $1`)
+
+	if want := []string{"a  b", "\t \\ $1 "}; !slices.Equal(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if want := []editorCursor{{7, 1}, {2, 0}, {1, 1}}; !slices.Equal(stops, want) {
+		t.Errorf("stops = %v, want %v", stops, want)
+	}
+}
+
+func TestAbbreviationsExpandAtWordEnd(t *testing.T) {
+	tests := []struct {
+		typed string
+		want  string
+	}{
+		{"teh ", "the "},
+		{"teh.", "the."},
+		{"teh\r", "the\n"},
+		{"tehx ", "tehx "},
+		{"steh ", "steh "},
+		{"teh", "teh"},
+		{"btw, ", "by the way, "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typed, func(t *testing.T) {
+			e := newTestEditor(t)
+			if err := loadRC(t, "abbrev teh = the\nabbrev btw = by the way\n"); err != nil {
+				t.Fatal(err)
+			}
+
+			processKeys(t, textKeys(tt.typed)...)
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("typing %q gave %q, want %q", tt.typed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbbreviationUndoesWithItsSpace(t *testing.T) {
+	e := newTestEditor(t)
+	if err := loadRC(t, "abbrev teh = the\n"); err != nil {
+		t.Fatal(err)
+	}
+	processKeys(t, textKeys("teh")...)
+	e.undoStack = nil
+	processKeys(t, ' ')
+
+	// Undoing the space that expanded it brings back what was typed.
+	undoOnce(t, e, "teh", 3, 0)
+}
+
+func TestAbbreviationMustBeOneWord(t *testing.T) {
+	newTestEditor(t)
+
+	err := loadRC(t, "abbrev two words = nope\n")
+
+	if err == nil || !strings.Contains(err.Error(), "single word") {
+		t.Errorf("editorLoadSettings() = %v, want a single word error", err)
+	}
+}
+
+func TestCompleteCyclesThroughWords(t *testing.T) {
+	e := newTestEditor(t, "counter counter country", "count_all", "x co")
+	e.cx, e.cy = 4, 2
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		processKeys(t, ALT_KEY('/'))
+		got = append(got, e.rows[2].content.String())
+	}
+
+	// The most used first, then back to what was typed.
+	want := []string{"x counter", "x count_all", "x country", "x co", "x counter"}
+	if !slices.Equal(got, want) {
+		t.Errorf("completions = %q, want %q", got, want)
+	}
+	if e.cx != 9 {
+		t.Errorf("cx = %d, want it after the completion", e.cx)
+	}
+}
+
+func TestCompleteWithoutCandidates(t *testing.T) {
+	e := newTestEditor(t, "alpha", "zz")
+	e.cx, e.cy = 2, 1
+
+	processKeys(t, ALT_KEY('/'))
+
+	if got := editorText(e); got != "alpha\nzz" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+	if e.statusMsg != "No completions for zz" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestWordCountsFollowEdits(t *testing.T) {
+	e := newTestEditor(t, "alpha beta", "beta gamma", "delta")
+	editorUpdateDictionary()
+	want := map[string]int{"alpha": 1, "beta": 2, "gamma": 1, "delta": 1}
+	if !maps.Equal(wordCounts, want) {
+		t.Fatalf("counted %v, want %v", wordCounts, want)
+	}
+
+	// Typing takes the row's words out until it's counted again.
+	e.cx = 5
+	processKeys(t, textKeys(" beta")...)
+	delete(want, "alpha")
+	want["beta"] = 1
+	if !maps.Equal(wordCounts, want) {
+		t.Errorf("after typing, counted %v, want %v", wordCounts, want)
+	}
+	editorUpdateDictionary()
+	want["alpha"], want["beta"] = 1, 3
+	if !maps.Equal(wordCounts, want) {
+		t.Errorf("after counting again, counted %v, want %v", wordCounts, want)
+	}
+
+	// Deleted rows are gone straight away.
+	editorDelRow(e, 1)
+	want["beta"] = 2
+	delete(want, "gamma")
+	if !maps.Equal(wordCounts, want) {
+		t.Errorf("after deleting a line, counted %v, want %v", wordCounts, want)
+	}
+}
+
+func TestCompleteForgetsDeletedWords(t *testing.T) {
+	e := newTestEditor(t, "gone", "goal goal", "g")
+	e.cx, e.cy = 1, 2
+	processKeys(t, ALT_KEY('/'))
+	if got := e.rows[2].content.String(); got != "goal" {
+		t.Fatalf("completed to %q, want the most used word", got)
+	}
+
+	// Put the g back and lose the only gone.
+	processKeys(t, BACKSPACE, BACKSPACE, BACKSPACE)
+	editorDelRow(e, 0)
+	e.cx, e.cy = 1, 1
+	processKeys(t, ALT_KEY('/'), ALT_KEY('/'))
+	if got := e.rows[1].content.String(); got != "g" {
+		t.Errorf("completed to %q, want goal and then back to g, with nothing left of gone", got)
+	}
+}
+
+// ==========================================
+// ============ Block Selection =============
+// ==========================================
+
+func TestBlockInsertAcrossRows(t *testing.T) {
+	e := newTestEditor(t, "alpha", "beta", "gamma", "delta")
+
+	processKeys(t, append([]int{CTRL_KEY('v'), ARROW_DOWN, ARROW_DOWN}, textKeys("- ", ESC)...)...)
+
+	if got, want := editorText(e), "- alpha\n- beta\n- gamma\ndelta"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if e.cx != 2 || e.cy != 2 || e.blockSelect {
+		t.Errorf("cursor at (%d, %d), block select %v, want (2, 2) and stopped", e.cx, e.cy, e.blockSelect)
+	}
+}
+
+func TestBlockInsertSkipsShortRows(t *testing.T) {
+	e := newTestEditor(t, "\tone", "", "\ttwo")
+	e.cx = 1
+	processKeys(t, CTRL_KEY('v'))
+	// Jump straight down, moving through the empty row would pull the cursor to its start.
+	e.cy = 2
+
+	processKeys(t, 'x')
+
+	if got, want := editorText(e), "\txone\n\n\txtwo"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
+
+func TestBlockDeleteColumns(t *testing.T) {
+	e := newTestEditor(t, "abcd", "ij", "efgh")
+	e.cx = 1
+
+	// The block takes in the columns of b and c, and the cursor's character is part of it.
+	processKeys(t, CTRL_KEY('v'), ARROW_DOWN, ARROW_DOWN, ARROW_RIGHT, DEL_KEY)
+
+	if got, want := editorText(e), "ad\ni\neh"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
+
+// ==========================================
+// ============= Line Commands ==============
+// ==========================================
+
+func TestSortLines(t *testing.T) {
+	lines := []string{"b 10", "10 b", "a", "B", "9 c", "-2.5 x", "c"}
+	tests := []struct {
+		how  string
+		want []string
+	}{
+		{"a", []string{"-2.5 x", "10 b", "9 c", "B", "a", "b 10", "c"}},
+		{"r", []string{"c", "b 10", "a", "B", "9 c", "10 b", "-2.5 x"}},
+		{"i", []string{"-2.5 x", "10 b", "9 c", "a", "B", "b 10", "c"}},
+		{"n", []string{"B", "a", "b 10", "c", "-2.5 x", "9 c", "10 b"}},
+		{"rn", []string{"10 b", "9 c", "-2.5 x", "c", "b 10", "a", "B"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.how, func(t *testing.T) {
+			e := newTestEditor(t, lines...)
+			typeKeys(textKeys(tt.how + "\r")...)
+			editorSortLines()
+			if got, want := editorText(e), strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("sorted = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSortSelectedLines(t *testing.T) {
+	e := newTestEditor(t, "z", "c", "b", "a", "y")
+	e.showChanges = true
+	e.cy = 1
+	processKeys(t, CTRL_KEY('v'), ARROW_DOWN, ARROW_DOWN)
+	typeKeys(textKeys("a\r")...)
+	editorSortLines()
+
+	if got, want := editorText(e), "z\na\nb\nc\ny"; got != want {
+		t.Errorf("sorted = %q, want %q", got, want)
+	}
+	// The rows that didn't move aren't marked as changed.
+	want := []uint8{CHANGE_NONE, CHANGE_MODIFIED, CHANGE_NONE, CHANGE_MODIFIED, CHANGE_NONE}
+	if got := rowChanges(e); !slices.Equal(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+}
+
+func TestSortLinesKeepsFinalNewline(t *testing.T) {
+	e, path := openFile(t, "b\nc\na\n")
+	typeKeys(textKeys("a\r")...)
+	editorSortLines()
+	editorSave()
+	if got := readFile(t, path); got != "a\nb\nc\n" {
+		t.Errorf("saved %q, want %q", got, "a\nb\nc\n")
+	}
+	if e.numrows != 3 {
+		t.Errorf("numrows = %d, want 3", e.numrows)
+	}
+}
+
+func TestSortLinesIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "b", "c", "a")
+	e.cy = 1
+	runAction(t, "sort-lines", textKeys("a\r")...)
+	if got := editorText(e); got != "a\nb\nc" {
+		t.Fatalf("sorted = %q", got)
+	}
+
+	undoOnce(t, e, "b\nc\na", 0, 1)
+}
+
+func TestDedupeLines(t *testing.T) {
+	lines := []string{"a", "a", "b", "a", "c", "b", "b"}
+	tests := []struct {
+		how  string
+		want []string
+		// The status message reports this many removed.
+		removed int
+	}{
+		{"a", []string{"a", "b", "a", "c", "b"}, 2},
+		{"g", []string{"a", "b", "c"}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.how, func(t *testing.T) {
+			e := newTestEditor(t, lines...)
+			typeKeys(textKeys(tt.how + "\r")...)
+			editorDedupeLines()
+			if got, want := editorText(e), strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("deduped = %q, want %q", got, want)
+			}
+			if want := fmt.Sprintf("Removed %d duplicate lines", tt.removed); e.statusMsg != want {
+				t.Errorf("status = %q, want %q", e.statusMsg, want)
+			}
+		})
+	}
+}
+
+func TestDedupeSelectedLines(t *testing.T) {
+	e := newTestEditor(t, "x", "a", "b", "a", "x")
+	e.cy = 1
+	processKeys(t, CTRL_KEY('v'), ARROW_DOWN, ARROW_DOWN)
+	typeKeys(textKeys("g\r")...)
+	editorDedupeLines()
+
+	// The x outside the selection isn't a duplicate of the one above it.
+	if got, want := editorText(e), "x\na\nb\nx"; got != want {
+		t.Errorf("deduped = %q, want %q", got, want)
+	}
+}
+
+func TestDedupeLinesIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "a", "a", "b", "a")
+	runAction(t, "dedupe-lines", textKeys("g\r")...)
+	if got := editorText(e); got != "a\nb" {
+		t.Fatalf("deduped = %q", got)
+	}
+
+	undoOnce(t, e, "a\na\nb\na", 0, 0)
+}
+
+func TestDedupeLinesAborted(t *testing.T) {
+	e := newTestEditor(t, "a", "a")
+	typeKeys(textKeys("q\r")...)
+	editorDedupeLines()
+	if got := editorText(e); got != "a\na" || e.statusMsg != "Remove duplicates aborted" {
+		t.Errorf("text = %q and status %q after an unknown answer", got, e.statusMsg)
+	}
+}
+
+func TestReverseLines(t *testing.T) {
+	e := newTestEditor(t, "one", "two", "three", "four")
+	e.cx, e.cy = 2, 1
+	editorReverseLines()
+
+	if got, want := editorText(e), "four\nthree\ntwo\none"; got != want {
+		t.Errorf("reversed = %q, want %q", got, want)
+	}
+	if e.cx != 2 || e.cy != 2 {
+		t.Errorf("cursor at (%d, %d), want it kept on two at (2, 2)", e.cx, e.cy)
+	}
+}
+
+func TestReverseSelectedLines(t *testing.T) {
+	e := newTestEditor(t, "one", "two", "three", "four")
+	e.selecting = true
+	e.selectAnchor = editorCursor{0, 1}
+	// Nothing on the last row is selected, so it's left out.
+	e.cx, e.cy = 0, 3
+	editorReverseLines()
+
+	if got, want := editorText(e), "one\nthree\ntwo\nfour"; got != want {
+		t.Errorf("reversed = %q, want %q", got, want)
+	}
+}
+
+func TestReverseLinesIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "one", "two", "three")
+	e.cx, e.cy = 2, 1
+	runAction(t, "reverse-lines")
+	if got := editorText(e); got != "three\ntwo\none" {
+		t.Fatalf("reversed = %q", got)
+	}
+
+	undoOnce(t, e, "one\ntwo\nthree", 2, 1)
+}
+
+func TestReverseOneOrNoLines(t *testing.T) {
+	e := newTestEditor(t, "only")
+	editorReverseLines()
+	if got := editorText(e); got != "only" || e.dirty {
+		t.Errorf("reversing one line gave %q, dirty %v", got, e.dirty)
+	}
+
+	e = newTestEditor(t)
+	editorReverseLines()
+	if e.numrows != 0 || e.statusMsg != "No lines to reverse" {
+		t.Errorf("reversing nothing gave %d rows, status %q", e.numrows, e.statusMsg)
+	}
+}
+
+func TestRot13RoundTrips(t *testing.T) {
+	e := newTestEditor(t, "Hello, World! ünï 123", "left alone")
+	editorRot13()
+	if got, want := editorText(e), "Uryyb, Jbeyq! üaï 123\nleft alone"; got != want {
+		t.Errorf("ROT13 = %q, want %q", got, want)
+	}
+	editorRot13()
+	if got, want := editorText(e), "Hello, World! ünï 123\nleft alone"; got != want {
+		t.Errorf("ROT13 twice = %q, want %q", got, want)
+	}
+}
+
+func TestRot13OnSelection(t *testing.T) {
+	e := newTestEditor(t, "abc", "nop", "xyz")
+	e.cx = 1
+	processKeys(t, CTRL_KEY('v'), ARROW_DOWN)
+	editorRot13()
+
+	if got, want := editorText(e), "nop\nabc\nxyz"; got != want {
+		t.Errorf("ROT13 = %q, want %q", got, want)
+	}
+}
+
+func TestRot13IsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "abc", "nop", "xyz")
+	e.cx = 1
+	processKeys(t, CTRL_KEY('v'), ARROW_DOWN)
+	runAction(t, "rot13")
+	if got := editorText(e); got != "nop\nabc\nxyz" {
+		t.Fatalf("ROT13 = %q", got)
+	}
+
+	undoOnce(t, e, "abc\nnop\nxyz", 1, 1)
+}
+
+// ==========================================
+// =============== Selection ================
+// ==========================================
+
+// The keys decoded from input, read the way the terminal is.
+func decodeKeys(input string) []int {
+	reader, writer := io.Pipe()
+	go func() {
+		io.WriteString(writer, input)
+		writer.CloseWithError(io.ErrUnexpectedEOF)
+	}()
+	keys := make(chan int)
+	go editorDecodeKeys(reader, keys)
+	var got []int
+	for key := range keys {
+		got = append(got, key)
+	}
+	return got
+}
+
+func TestDecodeShiftedKeys(t *testing.T) {
+	input := "\x1b[1;2A\x1b[1;2B\x1b[1;2C\x1b[1;2D\x1b[1;2H\x1b[1;2F\x1b[1;5C\x1b[1;6A"
+	want := []int{
+		SHIFT_ARROW_UP, SHIFT_ARROW_DOWN, SHIFT_ARROW_RIGHT, SHIFT_ARROW_LEFT, SHIFT_HOME_KEY, SHIFT_END_KEY,
+		// Other modifiers aren't shift.
+		CTRL_ARROW_RIGHT, ARROW_UP,
+	}
+	if got := decodeKeys(input); !slices.Equal(got, want) {
+		t.Errorf("decoded keys %v, want %v", got, want)
+	}
+}
+
+func TestShiftArrowsSelect(t *testing.T) {
+	e := newTestEditor(t, "hello", "world")
+	e.cx = 1
+
+	processKeys(t, SHIFT_ARROW_RIGHT, SHIFT_ARROW_RIGHT, SHIFT_ARROW_DOWN)
+	start, end := editorSelectionBounds(e)
+	if !e.selecting || start != (editorCursor{1, 0}) || end != (editorCursor{3, 1}) {
+		t.Errorf("selected %v to %v (selecting %v), want {1 0} to {3 1}", start, end, e.selecting)
+	}
+
+	// Going back past where it started selects the other way.
+	processKeys(t, SHIFT_ARROW_UP, SHIFT_HOME_KEY)
+	if start, end = editorSelectionBounds(e); start != (editorCursor{0, 0}) || end != (editorCursor{1, 0}) {
+		t.Errorf("selected %v to %v, want {0 0} to {1 0}", start, end)
+	}
+
+	processKeys(t, SHIFT_END_KEY)
+	if start, end = editorSelectionBounds(e); start != (editorCursor{1, 0}) || end != (editorCursor{5, 0}) {
+		t.Errorf("selected %v to %v, want {1 0} to {5 0}", start, end)
+	}
+
+	// Moving without shift lets go of the selection.
+	processKeys(t, ARROW_LEFT)
+	if e.selecting || e.cx != 4 {
+		t.Errorf("after a plain arrow, selecting %v with cx %d, want no selection and cx 4", e.selecting, e.cx)
+	}
+	if got := editorText(e); got != "hello\nworld" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+}
+
+func TestTypingReplacesSelection(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []int
+		want string
+	}{
+		{"char", []int{'X'}, "heXorld"},
+		{"enter", []int{'\r'}, "he\norld"},
+		{"backspace", []int{BACKSPACE}, "heorld"},
+		{"delete", []int{DEL_KEY}, "heorld"},
+		{"paste", append([]int{PASTE_START}, textKeys("ab", PASTE_END)...), "heaborld"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, "hello", "world")
+			e.cx = 2
+			processKeys(t, SHIFT_ARROW_DOWN, SHIFT_ARROW_LEFT)
+			processKeys(t, tt.keys...)
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if e.selecting {
+				t.Error("still selecting after replacing the selection")
+			}
+		})
+	}
+}
+
+func TestTypingOverSelectionIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "hello", "world")
+	e.cx = 2
+	processKeys(t, SHIFT_ARROW_DOWN, SHIFT_ARROW_LEFT, 'X')
+	if got := editorText(e); got != "heXorld" {
+		t.Fatalf("text = %q", got)
+	}
+
+	undoOnce(t, e, "hello\nworld", 1, 1)
+}
+
+func TestEscapeKeepsSelectedText(t *testing.T) {
+	e := newTestEditor(t, "hello")
+	processKeys(t, SHIFT_ARROW_RIGHT, ESC, 'x')
+	if got := editorText(e); got != "hxello" || e.selecting {
+		t.Errorf("text = %q, selecting %v, want Esc to let go and typing to insert", got, e.selecting)
+	}
+}
+
+func TestSelectAll(t *testing.T) {
+	lines := numberedLines(50)
+	e := newTestEditor(t, lines...)
+	e.cy = 10
+	processKeys(t, CTRL_KEY('a'))
+
+	start, end := editorSelectionBounds(e)
+	if want := (editorCursor{len(lines[49]), 49}); start != (editorCursor{0, 0}) || end != want {
+		t.Errorf("selected %v to %v, want {0 0} to %v", start, end, want)
+	}
+	editorScroll()
+	if e.cy < e.rowOffset || e.cy >= e.rowOffset+e.screenrows {
+		t.Errorf("rows %d on are shown, want the end of the selection on screen", e.rowOffset)
+	}
+	editorRenderRowsThrough(e.numrows - 1)
+	for y := range lines {
+		// The end of every row but the last is selected too, for the line break.
+		want := len(lines[y]) + 1
+		if y == len(lines)-1 {
+			want--
+		}
+		if left, right := editorSelectedColumns(y); left != 0 || right != want {
+			t.Errorf("row %d has columns %d to %d selected, want 0 to %d", y, left, right, want)
+		}
+	}
+
+	processKeys(t, BACKSPACE)
+	if got := editorText(e); got != "" {
+		t.Errorf("text = %q after deleting everything", got)
+	}
+}
+
+func TestSelectAllInEmptyFile(t *testing.T) {
+	e := newTestEditor(t)
+	processKeys(t, CTRL_KEY('a'))
+	if e.selecting {
+		t.Error("selecting in a file with nothing to select")
+	}
+}
+
+// ==========================================
+// ============= Multiple Cursors ===========
+// ==========================================
+
+func TestTypingAtTwoCursors(t *testing.T) {
+	e := newTestEditor(t, "one", "two", "three")
+	e.cx = 1
+
+	processKeys(t, append([]int{CTRL_KEY('n')}, textKeys("xy")...)...)
+
+	if got, want := editorText(e), "oxyne\ntxywo\nthree"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	want := []editorCursor{{3, 1}}
+	if e.cx != 3 || e.cy != 0 || !slices.Equal(e.cursors, want) {
+		t.Errorf("cursors at (%d, %d) and %v, want (3, 0) and %v", e.cx, e.cy, e.cursors, want)
+	}
+}
+
+func TestTypingAtMatchesOnOneRow(t *testing.T) {
+	e := newTestEditor(t, "foo(foo, bar)", "foo")
+
+	// Each edit shifts the cursors after it along the row.
+	processKeys(t, CTRL_KEY('d'), CTRL_KEY('d'), ARROW_RIGHT, ARROW_RIGHT, ARROW_RIGHT, '1', BACKSPACE, '2')
+
+	if got, want := editorText(e), "foo2(foo2, bar)\nfoo2"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+}
+
+// ==========================================
+// ============== Navigation ================
+// ==========================================
+
+// A short document of two paragraphs, for moving through.
+var prose = []string{
+	"One sentence here. Another one!",
+	"Is this a third? Yes.",
+	"",
+	"",
+	"Second paragraph. It ends here",
+}
+
+func TestArrowsOverMultibyteLine(t *testing.T) {
+	e := newTestEditor(t, "héllo wörld", "日本")
+
+	for i := 1; i <= 11; i++ {
+		processKeys(t, ARROW_RIGHT)
+		if e.cx != i || e.cy != 0 {
+			t.Fatalf("after %d rights, cursor at (%d, %d), want (%d, 0)", i, e.cx, e.cy, i)
+		}
+	}
+	processKeys(t, ARROW_RIGHT)
+	if e.cx != 0 || e.cy != 1 {
+		t.Errorf("right at the end of the line went to (%d, %d), want (0, 1)", e.cx, e.cy)
+	}
+	processKeys(t, ARROW_LEFT)
+	if e.cx != 11 || e.cy != 0 {
+		t.Errorf("left at the start of the line went to (%d, %d), want (11, 0)", e.cx, e.cy)
+	}
+	// Going down to a shorter line stops at its last character, counted in runes.
+	processKeys(t, ARROW_DOWN)
+	if e.cx != 2 || e.cy != 1 {
+		t.Errorf("down to the shorter line went to (%d, %d), want (2, 1)", e.cx, e.cy)
+	}
+}
+
+func TestParagraphMotions(t *testing.T) {
+	e := newTestEditor(t, prose...)
+
+	var stops []editorCursor
+	for i := 0; i < 3; i++ {
+		editorNextParagraph()
+		stops = append(stops, editorCursor{e.cx, e.cy})
+	}
+	want := []editorCursor{{0, 2}, {30, 4}, {30, 4}}
+	if !slices.Equal(stops, want) {
+		t.Errorf("next paragraph stopped at %v, want %v", stops, want)
+	}
+
+	stops = nil
+	for i := 0; i < 2; i++ {
+		editorPrevParagraph()
+		stops = append(stops, editorCursor{e.cx, e.cy})
+	}
+	want = []editorCursor{{0, 3}, {0, 0}}
+	if !slices.Equal(stops, want) {
+		t.Errorf("previous paragraph stopped at %v, want %v", stops, want)
+	}
+}
+
+func TestSentenceMotions(t *testing.T) {
+	e := newTestEditor(t, prose...)
+	sentences := []editorCursor{{0, 0}, {19, 0}, {0, 1}, {17, 1}, {0, 4}, {18, 4}}
+
+	var stops []editorCursor
+	for range sentences[1:] {
+		editorNextSentence()
+		stops = append(stops, editorCursor{e.cx, e.cy})
+	}
+	if !slices.Equal(stops, sentences[1:]) {
+		t.Errorf("next sentence stopped at %v, want %v", stops, sentences[1:])
+	}
+
+	// From the middle of the last sentence, back to its start and then each one before.
+	e.cx = 22
+	stops = nil
+	for range sentences {
+		editorPrevSentence()
+		stops = append(stops, editorCursor{e.cx, e.cy})
+	}
+	want := []editorCursor{{18, 4}, {0, 4}, {17, 1}, {0, 1}, {19, 0}, {0, 0}}
+	if !slices.Equal(stops, want) {
+		t.Errorf("previous sentence stopped at %v, want %v", stops, want)
+	}
+}
+
+func TestMoveToSameIndent(t *testing.T) {
+	lines := []string{
+		"func main() {",
+		"\tif ok {",
+		"\t\tdone()",
+		"",
+		"\t\tagain()",
+		"\t}",
+		"        for {",
+		"}",
+	}
+	tests := []struct {
+		name      string
+		from      int
+		direction int
+		wantY     int
+		wantX     int
+	}{
+		{"next sibling", 1, 1, 5, 1},
+		{"skips blank lines", 2, 1, 4, 2},
+		{"tab matches spaces", 5, 1, 6, 8},
+		{"previous", 6, -1, 5, 1},
+		{"top level", 0, 1, 7, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(t, lines...)
+			e.cy = test.from
+
+			editorMoveToSameIndent(test.direction)
+
+			if e.cy != test.wantY || e.cx != test.wantX {
+				t.Errorf("cursor at (%d, %d), want (%d, %d)", e.cx, e.cy, test.wantX, test.wantY)
+			}
+		})
+	}
+}
+
+func TestMoveToSameIndentWithNoMatch(t *testing.T) {
+	e := newTestEditor(t, "a", "  b", "c")
+	e.cy = 1
+
+	editorMoveToSameIndent(1)
+
+	if e.cy != 1 {
+		t.Errorf("cursor moved to line %d", e.cy)
+	}
+	if e.statusMsg != "No other line at this indentation" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestLastEditCyclesThroughEdits(t *testing.T) {
+	e := newTestEditor(t, numberedLines(60)...)
+
+	processKeys(t, ALT_KEY('`'))
+	if e.statusMsg != "No edits yet" {
+		t.Errorf("status before editing = %q, want %q", e.statusMsg, "No edits yet")
+	}
+
+	e.cy, e.cx = 5, 2
+	processKeys(t, 'x')
+	e.cy, e.cx = 40, 0
+	processKeys(t, 'y', 'z')
+	e.cy, e.cx = 58, 0
+	processKeys(t, PAGE_UP, PAGE_UP)
+
+	for _, want := range []editorCursor{{2, 40}, {3, 5}, {2, 40}} {
+		processKeys(t, ALT_KEY('`'))
+		if got := (editorCursor{e.cx, e.cy}); got != want {
+			t.Errorf("last-edit went to %v, want %v", got, want)
+		}
+	}
+}
+
+func TestEditRingIsBounded(t *testing.T) {
+	e := newTestEditor(t, numberedLines(60)...)
+	for y := 0; y < KILO_EDIT_RING_SIZE+5; y++ {
+		e.cy, e.cx = y, 0
+		processKeys(t, 'x')
+	}
+	if len(e.editRing) != KILO_EDIT_RING_SIZE {
+		t.Fatalf("edit ring holds %d edits, want %d", len(e.editRing), KILO_EDIT_RING_SIZE)
+	}
+	if want := (editorCursor{1, 5}); e.editRing[0] != want {
+		t.Errorf("oldest edit = %v, want %v", e.editRing[0], want)
+	}
+}
+
+func TestMarkFollowsRowsAddedAndRemovedAbove(t *testing.T) {
+	e := newTestEditor(t, numberedLines(20)...)
+	e.cy, e.cx = 10, 4
+	processKeys(t, ALT_KEY('k'), 'a')
+
+	e.cy, e.cx = 2, 0
+	processKeys(t, '\r', '\r', '\r')
+	editorDelRow(e, 0)
+	e.cy, e.cx = 19, 0
+	processKeys(t, ALT_KEY('\''), 'a')
+
+	if want := (editorCursor{4, 12}); (editorCursor{e.cx, e.cy}) != want {
+		t.Errorf("goto-mark went to %v, want %v", editorCursor{e.cx, e.cy}, want)
+	}
+	if got := e.rows[e.cy].content.String(); got != "line 10 of some text" {
+		t.Errorf("mark is on %q, want the row it was set on", got)
+	}
+}
+
+func TestMarksAreNamed(t *testing.T) {
+	e := newTestEditor(t, numberedLines(20)...)
+	e.cy = 3
+	processKeys(t, ALT_KEY('k'), 'a')
+	e.cy = 7
+	processKeys(t, ALT_KEY('k'), 'b')
+
+	processKeys(t, ALT_KEY('\''), 'a')
+	if e.cy != 3 {
+		t.Errorf("mark a is on row %d, want 3", e.cy)
+	}
+	processKeys(t, ALT_KEY('\''), 'b')
+	if e.cy != 7 {
+		t.Errorf("mark b is on row %d, want 7", e.cy)
+	}
+	processKeys(t, ALT_KEY('\''), 'c')
+	if e.statusMsg != "No mark c" {
+		t.Errorf("status = %q, want %q", e.statusMsg, "No mark c")
+	}
+}
+
+func TestJumpBackAndForward(t *testing.T) {
+	e := newTestEditor(t, numberedLines(100)...)
+	var stops []int
+	for i := 0; i < 3; i++ {
+		stops = append(stops, e.cy)
+		processKeys(t, PAGE_DOWN)
+		editorScroll()
+	}
+	stops = append(stops, e.cy)
+	if len(slices.Compact(slices.Clone(stops))) != len(stops) {
+		t.Fatalf("page down stopped at rows %v, want each on a new row", stops)
+	}
+
+	for i := len(stops) - 2; i >= 0; i-- {
+		processKeys(t, CTRL_KEY('o'))
+		if e.cy != stops[i] {
+			t.Errorf("jump-back went to row %d, want %d", e.cy, stops[i])
+		}
+	}
+	processKeys(t, CTRL_KEY('o'))
+	if e.cy != stops[0] || e.statusMsg != "No earlier jumps" {
+		t.Errorf("jump-back past the start went to row %d with status %q", e.cy, e.statusMsg)
+	}
+
+	for i := 1; i < len(stops); i++ {
+		processKeys(t, ALT_KEY('i'))
+		if e.cy != stops[i] {
+			t.Errorf("jump-forward went to row %d, want %d", e.cy, stops[i])
+		}
+	}
+	processKeys(t, ALT_KEY('i'))
+	if e.cy != stops[len(stops)-1] || e.statusMsg != "No later jumps" {
+		t.Errorf("jump-forward past the end went to row %d with status %q", e.cy, e.statusMsg)
+	}
+}
+
+func TestJumpingAfterJumpBackDropsLaterJumps(t *testing.T) {
+	e := newTestEditor(t, numberedLines(100)...)
+	processKeys(t, PAGE_DOWN)
+	editorScroll()
+	processKeys(t, PAGE_DOWN)
+	editorScroll()
+	processKeys(t, CTRL_KEY('o'))
+	from := e.cy
+	processKeys(t, PAGE_DOWN)
+
+	processKeys(t, ALT_KEY('i'))
+	if e.statusMsg != "No later jumps" {
+		t.Errorf("jump-forward after a new jump gave status %q, want %q", e.statusMsg, "No later jumps")
+	}
+	processKeys(t, CTRL_KEY('o'))
+	if e.cy != from {
+		t.Errorf("jump-back went to row %d, want %d", e.cy, from)
+	}
+}
+
+func TestJumpListIsBounded(t *testing.T) {
+	e := newTestEditor(t, numberedLines(10)...)
+	for i := 0; i < KILO_JUMP_LIST_SIZE+20; i++ {
+		editorPushJump(0, i%10)
+	}
+	if len(e.jumps) != KILO_JUMP_LIST_SIZE {
+		t.Errorf("jump list holds %d jumps, want %d", len(e.jumps), KILO_JUMP_LIST_SIZE)
+	}
+}
+
+func TestSearchWrap(t *testing.T) {
+	tests := []struct {
+		wrap bool
+		keys []int
+		want int
+	}{
+		{true, []int{ARROW_DOWN}, 2},
+		{true, []int{ARROW_DOWN, ARROW_DOWN}, 0},
+		{true, []int{ARROW_UP}, 2},
+		{false, []int{ARROW_DOWN, ARROW_DOWN}, 2},
+		{false, []int{ARROW_UP}, 0},
+	}
+	for _, tt := range tests {
+		e := newTestEditor(t, "x a", "b", "c x")
+		e.searchWrap = tt.wrap
+		var out bytes.Buffer
+		terminal = bufio.NewWriter(&out)
+		keys := append([]int{CTRL_KEY('f'), 'x'}, tt.keys...)
+		processKeys(t, append(keys, '\r')...)
+
+		if e.cy != tt.want {
+			t.Errorf("wrap %v, keys %v: search stopped on row %d, want %d", tt.wrap, tt.keys, e.cy, tt.want)
+		}
+		if stopped := strings.Contains(out.String(), "(no more matches)"); stopped == tt.wrap {
+			t.Errorf("wrap %v, keys %v: said there were no more matches: %v", tt.wrap, tt.keys, stopped)
+		}
+	}
+}
+
+func TestSearchWrapSetting(t *testing.T) {
+	e := newTestEditor(t)
+	if !e.searchWrap {
+		t.Error("search doesn't wrap by default")
+	}
+	if err := loadRC(t, "search_wrap = false\n"); err != nil {
+		t.Fatal(err)
+	}
+	if e.searchWrap {
+		t.Error("search_wrap = false left it on")
+	}
+	editorToggleSearchWrap()
+	if !e.searchWrap || e.statusMsg != "Search wraps around" {
+		t.Errorf("toggled to %v with status %q", e.searchWrap, e.statusMsg)
+	}
+}
+
+func TestSearchRenderWholeWord(t *testing.T) {
+	tests := []struct {
+		render    string
+		wholeWord bool
+		want      int
+	}{
+		{"the cat", true, 4},
+		{"category", true, -1},
+		{"category", false, 0},
+		{"cat_x (cat)", true, 7},
+		{"cat", true, 0},
+	}
+	for _, tt := range tests {
+		if got := searchRender([]rune(tt.render), []rune("cat"), tt.wholeWord); got != tt.want {
+			t.Errorf("searchRender(%q, cat, %v) = %d, want %d", tt.render, tt.wholeWord, got, tt.want)
+		}
+	}
+}
+
+func TestSearchWholeWordToggle(t *testing.T) {
+	e := newTestEditor(t, "category", "the cat sat")
+	t.Cleanup(func() { searchWholeWord = false })
+
+	processKeys(t, CTRL_KEY('f'), 'c', 'a', 't', CTRL_KEY('w'), '\r')
+	if e.cy != 1 || e.cx != 4 {
+		t.Errorf("whole word cat found at (%d, %d), want (4, 1)", e.cx, e.cy)
+	}
+
+	processKeys(t, CTRL_KEY('f'), 'c', 'a', 't', CTRL_KEY('w'), '\r')
+	if e.cy != 0 || e.cx != 0 {
+		t.Errorf("with whole words off again, cat found at (%d, %d), want (0, 0)", e.cx, e.cy)
+	}
+}
+
+func TestSearchHighlightsWholeWordMatch(t *testing.T) {
+	e := newTestEditor(t, "category", "the cat sat")
+	searchWholeWord = true
+	t.Cleanup(func() { searchWholeWord = false })
+	searchOrigin, searchDirection = -1, 1
+
+	editorOnInputFind("cat", 't')
+	for i, highlight := range e.rows[1].highlights[:e.rows[1].RLen()-1] {
+		if isMatch := i >= 4 && i < 7; (highlight == HL_MATCH) != isMatch {
+			t.Errorf("highlight at %d = %d while searching", i, highlight)
+		}
+	}
+
+	editorOnInputFind("cat", '\r')
+	if slices.Contains(e.rows[1].highlights, HL_MATCH) {
+		t.Error("match still highlighted after the search")
+	}
+}
+
+func TestReverseSearchFindsNearestAbove(t *testing.T) {
+	e := newTestEditor(t, "x 0", "b", "x 2", "c", "x 4")
+	e.cy = 3
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+	processKeys(t, ALT_KEY('r'), 'x', '\r')
+
+	if e.cy != 2 {
+		t.Errorf("reverse search found row %d, want 2", e.cy)
+	}
+	if !strings.Contains(out.String(), "Reverse search: x") {
+		t.Error("prompt didn't say the search goes backwards")
+	}
+
+	// Going on past the top comes round from the bottom.
+	processKeys(t, ALT_KEY('r'), 'x', ARROW_UP, '\r')
+	if e.cy != 4 {
+		t.Errorf("reverse search round the top found row %d, want 4", e.cy)
+	}
+}
+
+func TestCancelledSearchPutsCursorBack(t *testing.T) {
+	lines := numberedLines(100)
+	lines[80] = "a needle here"
+	e := newTestEditor(t, lines...)
+	e.cx, e.cy, e.rowOffset, e.colOffset = 3, 5, 2, 1
+
+	processKeys(t, append([]int{CTRL_KEY('f')}, textKeys("needle", ARROW_DOWN, ESC)...)...)
+	if e.cx != 3 || e.cy != 5 || e.rowOffset != 2 || e.colOffset != 1 {
+		t.Errorf("after Esc, cursor (%d, %d) and offsets (%d, %d), want (3, 5) and (2, 1)",
+			e.cx, e.cy, e.rowOffset, e.colOffset)
+	}
+
+	processKeys(t, append([]int{CTRL_KEY('f')}, textKeys("needle\r")...)...)
+	editorScroll()
+	if e.cx != 2 || e.cy != 80 {
+		t.Errorf("after Enter, cursor at (%d, %d), want the match at (2, 80)", e.cx, e.cy)
+	}
+	if e.cy < e.rowOffset || e.cy >= e.rowOffset+e.screenrows {
+		t.Errorf("rows %d on are shown, want the match on screen", e.rowOffset)
+	}
+}
+
+// Where the cursor stops moving along line with move, until it leaves the line.
+func wordStops(t *testing.T, line string, from int, move func()) []int {
+	t.Helper()
+	e := newTestEditor(t, line, "next")
+	e.cx = from
+	var stops []int
+	for i := 0; i < 20; i++ {
+		move()
+		if e.cy != 0 {
+			return stops
+		}
+		stops = append(stops, e.cx)
+		if e.cx == 0 {
+			return stops
+		}
+	}
+	t.Fatalf("moving along %q never left the line", line)
+	return nil
+}
+
+func TestSubwordMotion(t *testing.T) {
+	tests := []struct {
+		line       string
+		rightStops []int
+		leftStops  []int
+	}{
+		{"getHTTPResponseCode", []int{3, 7, 15, 19}, []int{15, 7, 3, 0}},
+		{"some_long_name", []int{4, 9, 14}, []int{10, 5, 0}},
+		{"abc123def", []int{3, 6, 9}, []int{6, 3, 0}},
+		{"x = fooBar(1)", []int{1, 7, 10, 12, 13}, []int{11, 7, 4, 0}},
+	}
+	for _, tt := range tests {
+		if got := wordStops(t, tt.line, 0, editorNextSubword); !slices.Equal(got, tt.rightStops) {
+			t.Errorf("next-subword along %q stops at %v, want %v", tt.line, got, tt.rightStops)
+		}
+		if got := wordStops(t, tt.line, len(tt.line), editorPrevSubword); !slices.Equal(got, tt.leftStops) {
+			t.Errorf("prev-subword along %q stops at %v, want %v", tt.line, got, tt.leftStops)
+		}
+	}
+}
+
+func TestWordMotion(t *testing.T) {
+	line := "getHTTPResponseCode some_long_name (x)"
+	if got, want := wordStops(t, line, 0, editorNextWord), []int{19, 34, 37, 38}; !slices.Equal(got, want) {
+		t.Errorf("next-word stops at %v, want %v", got, want)
+	}
+	if got, want := wordStops(t, line, len(line), editorPrevWord), []int{36, 20, 0}; !slices.Equal(got, want) {
+		t.Errorf("prev-word stops at %v, want %v", got, want)
+	}
+}
+
+func TestWordMotionKeys(t *testing.T) {
+	e := newTestEditor(t, "fooBar baz")
+	processKeys(t, ALT_ARROW_RIGHT)
+	if e.cx != 3 {
+		t.Errorf("Alt-Right moved to %d, want 3", e.cx)
+	}
+	processKeys(t, CTRL_ARROW_RIGHT)
+	if e.cx != 6 {
+		t.Errorf("Ctrl-Right moved to %d, want 6", e.cx)
+	}
+	processKeys(t, CTRL_ARROW_LEFT, CTRL_ARROW_LEFT)
+	if e.cx != 0 {
+		t.Errorf("Ctrl-Left twice moved to %d, want 0", e.cx)
+	}
+}
+
+// ==========================================
+// =============== File I/O =================
+// ==========================================
+
+// Open a file holding text in a fresh editor.
+func openFile(t *testing.T, text string) (*editorConfig, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEditor(t)
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+	return e, path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSaveWarnsWhenFileChangedOnDisk(t *testing.T) {
+	tests := []struct {
+		answer     string
+		wantText   string
+		wantDisk   string
+		wantStatus string
+	}{
+		{"c", "xours", "theirs, longer\n", "Save aborted"},
+		{"o", "xours", "xours\n", "6 bytes written to disk"},
+		{"r", "theirs, longer", "theirs, longer\n", "Reloaded "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			e, path := openFile(t, "ours\n")
+			processKeys(t, 'x')
+			if err := os.WriteFile(path, []byte("theirs, longer\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			typeKeys(textKeys(tt.answer, '\r')...)
+			editorSave()
+
+			if got := editorText(e); got != tt.wantText {
+				t.Errorf("text = %q, want %q", got, tt.wantText)
+			}
+			if got := readFile(t, path); got != tt.wantDisk {
+				t.Errorf("on disk = %q, want %q", got, tt.wantDisk)
+			}
+			if !strings.HasPrefix(e.statusMsg, tt.wantStatus) {
+				t.Errorf("status = %q, want %q", e.statusMsg, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSaveUnchangedFileDoesntPrompt(t *testing.T) {
+	e, path := openFile(t, "hello\n")
+	processKeys(t, 'x')
+	// Nothing queued for a prompt, so one would cancel the save.
+	typeKeys()
+
+	editorSave()
+
+	if got := readFile(t, path); got != "xhello\n" {
+		t.Errorf("on disk = %q, want %q", got, "xhello\n")
+	}
+	if e.dirty {
+		t.Error("buffer still dirty after saving")
+	}
+}
+
+// Draw the status bar and return it.
+func drawStatusBar() string {
+	var bar strings.Builder
+	editorDrawStatusBar(&bar)
+	return bar.String()
+}
+
+func TestStatusBarShowsLineEndingAndEncoding(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"a\nb\n", "UTF-8 LF"},
+		{"a\r\nb\r\n", "UTF-8 CRLF"},
+		{"\ufeffa\nb\n", "UTF-8 BOM LF"},
+		{"\ufeffa\r\nb\r\n", "UTF-8 BOM CRLF"},
+		{"a\x00b\n", "binary LF"},
+		{"caf\xe9\n", "binary LF"},
+	}
+	for _, tt := range tests {
+		openFile(t, tt.text)
+		if bar := stripEscapes(drawStatusBar()); !strings.Contains(bar, tt.want+" no ft") {
+			t.Errorf("status bar for %q = %q, want it to show %q", tt.text, bar, tt.want)
+		}
+	}
+}
+
+func TestChangingTabWidthRendersAgain(t *testing.T) {
+	e := newTestEditor(t, "\ta", "ab\tc", "none")
+	editorRenderRowsThrough(e.numrows - 1)
+	if got := string(e.rows[1].render); got != "ab      c\x00" {
+		t.Fatalf("render at tab width 8 = %q", got)
+	}
+
+	typeKeys(textKeys("4\r")...)
+	editorSetTabWidth()
+	editorRenderRowsThrough(e.numrows - 1)
+
+	for y, want := range []string{"    a\x00", "ab  c\x00", "none\x00"} {
+		if got := string(e.rows[y].render); got != want {
+			t.Errorf("row %d rendered as %q at tab width 4, want %q", y, got, want)
+		}
+	}
+	if got := editorText(e); got != "\ta\nab\tc\nnone" || e.dirty {
+		t.Errorf("text = %q, dirty %v, want the file left alone", got, e.dirty)
+	}
+	if rx := editorRowCxToRx(e, &e.rows[0], 1); rx != 4 {
+		t.Errorf("after the tab, the cursor is drawn at column %d, want 4", rx)
+	}
+
+	typeKeys(textKeys("0\r")...)
+	editorSetTabWidth()
+	if e.tabStop != 4 || e.statusMsg != "Not a tab width: 0" {
+		t.Errorf("tab width %d and status %q after answering 0", e.tabStop, e.statusMsg)
+	}
+}
+
+// The render column each of words starts at in a row's render.
+func wordColumns(row *editorRow, words ...string) []int {
+	render := string(row.render)
+	var cols []int
+	for _, word := range words {
+		cols = append(cols, strings.Index(render, word))
+	}
+	return cols
+}
+
+func TestElasticTabsLineUpColumns(t *testing.T) {
+	e := newTestEditor(t, "name\tage\tcity", "alexander\t3\tzz", "bo\t100\tyy", "", "a\tb")
+	e.elasticTabs = true
+	editorRenderRowsThrough(e.numrows - 1)
+
+	// The first column is as wide as alexander and the padding, the second the tab width.
+	for y, words := range [][]string{{"age", "city"}, {"3", "zz"}, {"100", "yy"}} {
+		if got := wordColumns(&e.rows[y], words...); !slices.Equal(got, []int{11, 19}) {
+			t.Errorf("row %d cells start at %v, want [11 19]", y, got)
+		}
+	}
+	// A blank row ends the block, so the rows after it don't line up with it.
+	if got := wordColumns(&e.rows[4], "b"); !slices.Equal(got, []int{8}) {
+		t.Errorf("row after the block has cells at %v, want [8]", got)
+	}
+
+	// A wider cell moves the whole column.
+	e.cy, e.cx = 2, 0
+	for _, char := range "bobobobobo" {
+		editorInsertChar(e, char)
+	}
+	editorRenderRowsThrough(e.numrows - 1)
+	for y, word := range []string{"age", "3", "100"} {
+		if got := wordColumns(&e.rows[y], word); !slices.Equal(got, []int{14}) {
+			t.Errorf("after widening, row %d second cell starts at %v, want [14]", y, got)
+		}
+	}
+	if rx := editorRowCxToRx(e, &e.rows[0], 5); rx != 14 {
+		t.Errorf("cursor after the first tab is drawn at %d, want 14", rx)
+	}
+}
+
+func TestElasticTabsToggle(t *testing.T) {
+	e := newTestEditor(t, "alexander\tx", "a\ty")
+	editorRenderRowsThrough(e.numrows - 1)
+	if got := wordColumns(&e.rows[1], "y"); !slices.Equal(got, []int{8}) {
+		t.Fatalf("with fixed tabs, y is at %v, want [8]", got)
+	}
+	editorToggleElasticTabs()
+	editorRenderRowsThrough(e.numrows - 1)
+	if got := wordColumns(&e.rows[1], "y"); !slices.Equal(got, []int{11}) {
+		t.Errorf("with elastic tabs, y is at %v, want [11]", got)
+	}
+}
+
+func TestCenterWelcomeLine(t *testing.T) {
+	tests := []struct {
+		msg   string
+		width int
+		want  string
+	}{
+		{"abc", 9, "~  abc"},
+		{"abc", 5, "~abc"},
+		{"abc", 4, "abc"},
+		{"abc", 3, "abc"},
+		{"abc", 1, "a"},
+		{"abc", 0, ""},
+		{"abc", -1, ""},
+		{"héllo", 3, "hél"},
+		{"日本語", 8, "~日本語"},
+		{"日本語", 7, "日本語"},
+		{"日本語", 5, "日本"},
+		{"日本語", 1, ""},
+	}
+	for _, tt := range tests {
+		if got := centerWelcomeLine(tt.msg, tt.width); got != tt.want {
+			t.Errorf("centerWelcomeLine(%q, %d) = %q, want %q", tt.msg, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestWelcomeOnNarrowScreens(t *testing.T) {
+	e := newTestEditor(t)
+	welcome := fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION)
+	var line string
+	for _, cols := range []int{1, 2, 5, 40} {
+		e.screencols = cols
+		frame := make([]string, e.screenrows)
+		editorDrawRows(frame)
+
+		line = stripEscapes(frame[e.screenrows/3])
+		if n := utf8.RuneCountInString(line); n > cols {
+			t.Errorf("%d columns: welcome drawn %d wide as %q", cols, n, line)
+		}
+		if !strings.Contains(welcome, strings.TrimLeft(line, "~ ")) {
+			t.Errorf("%d columns: welcome drawn as %q", cols, line)
+		}
+	}
+	// The last drawing, 40 wide, has room for all of it.
+	if padding := (40 - len(welcome)) / 2; line != "~"+strings.Repeat(" ", padding-1)+welcome {
+		t.Errorf("welcome drawn as %q, want it centered", line)
+	}
+}
+
+func TestCustomWelcome(t *testing.T) {
+	e := newTestEditor(t)
+	art := []string{"/\\_/\\", "( o.o )", " > ^ <", "", "hi"}
+	path := filepath.Join(t.TempDir(), "welcome.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(art, "\r\n")+"\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRC(t, "welcome_file = "+path+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(e.welcome, art) {
+		t.Fatalf("welcome = %q, want %q", e.welcome, art)
+	}
+
+	frame := make([]string, e.screenrows)
+	editorDrawRows(frame)
+	top := e.screenrows / 3
+	for i, line := range art {
+		if got, want := stripEscapes(frame[top+i]), centerWelcomeLine(line, e.screencols); got != want {
+			t.Errorf("welcome line %d drawn as %q, want %q", i, got, want)
+		}
+	}
+	if strings.Contains(strings.Join(frame, ""), "Kilo editor") {
+		t.Error("version message drawn as well as the custom welcome")
+	}
+
+	// A file, even an empty one, doesn't get the welcome.
+	e.filename = "empty.txt"
+	editorDrawRows(frame)
+	if got := stripEscapes(frame[top]); got != "~" {
+		t.Errorf("empty file's row drawn as %q, want just a tilde", got)
+	}
+}
+
+func TestWelcomeFitsShortScreens(t *testing.T) {
+	e := newTestEditor(t)
+	e.welcome = []string{"1", "2", "3", "4"}
+	e.screenrows = 3
+	frame := make([]string, e.screenrows)
+	editorDrawRows(frame)
+	for i, want := range []string{"1", "2", "3"} {
+		if got := strings.TrimLeft(stripEscapes(frame[i]), "~ "); got != want {
+			t.Errorf("row %d drawn as %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestWelcomeFileErrors(t *testing.T) {
+	newTestEditor(t)
+	if err := loadRC(t, "welcome_file = "+filepath.Join(t.TempDir(), "missing")+"\n"); err == nil {
+		t.Error("a missing welcome file loaded without an error")
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"héllo wörld", 4, "héll"},
+		{"日本語のテキスト", 3, "日本語"},
+		{"short", 10, "short"},
+		{"abc", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateRunes(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMultibyteMessageIsCutCleanly(t *testing.T) {
+	e := newTestEditor(t)
+	for cols := 1; cols < 12; cols++ {
+		e.screencols = cols
+		editorSetStatusMessage("Ünïcödé 日本語 message")
+
+		var bar strings.Builder
+		editorDrawMessageBar(&bar)
+
+		if got := bar.String(); !utf8.ValidString(got) || utf8.RuneCountInString(got) != cols {
+			t.Errorf("message at %d columns = %q", cols, got)
+		}
+	}
+}
+
+func TestMultibyteStatusBarFitsScreen(t *testing.T) {
+	e := newTestEditor(t, "text")
+	e.filename = "ディレクトリ/ファイル名.txt"
+	for _, cols := range []int{10, 30, 50, 80} {
+		e.screencols = cols
+
+		bar := stripEscapes(drawStatusBar())
+
+		if !utf8.ValidString(bar) || utf8.RuneCountInString(bar) != cols {
+			t.Errorf("status bar at %d columns = %q", cols, bar)
+		}
+	}
+}
+
+func TestShortenPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		width int
+		want  string
+	}{
+		{"src/main.go", 20, "src/main.go"},
+		{"/home/user/projects/kilo/main.go", 20, ".../kilo/main.go"},
+		{"/home/user/projects/kilo/main.go", 25, ".../projects/kilo/main.go"},
+		{"/home/user/projects/kilo/main.go", 10, "main.go"},
+		{"/home/user/a_very_long_file_name.go", 10, "a_very_lon"},
+		{"/ホーム/ユーザー/プロジェクト/ファイル.go", 20, ".../プロジェクト/ファイル.go"},
+		{"/ホーム/ユーザー/プロジェクト/ファイル.go", 16, "ファイル.go"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s in %d", tt.path, tt.width), func(t *testing.T) {
+			if got := shortenPath(tt.path, tt.width); got != tt.want {
+				t.Errorf("shortenPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusBarShortensLongPath(t *testing.T) {
+	e := newTestEditor(t, "text")
+	e.filename = "/home/user/projects/some/deeply/nested/directory/main.go"
+	e.screencols = 60
+
+	bar := stripEscapes(drawStatusBar())
+
+	if !strings.HasPrefix(bar, ".../nested/directory/main.go - 1 lines") {
+		t.Errorf("status bar = %q", bar)
+	}
+}
+
+func TestDisplayFilenameRelativeToWorkingDir(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd := filepath.Join(root, "work")
+	if err := os.Mkdir(wd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(before) })
+
+	tests := []struct {
+		filename string
+		relative bool
+		want     string
+	}{
+		{filepath.Join(wd, "src", "main.go"), true, filepath.Join("src", "main.go")},
+		{filepath.Join(wd, "src", "main.go"), false, filepath.Join(wd, "src", "main.go")},
+		{filepath.Join("src", "..", "main.go"), true, "main.go"},
+		{filepath.Join(root, "other", "main.go"), true, filepath.Join(root, "other", "main.go")},
+		{filepath.Join("..", "other", "main.go"), true, filepath.Join(root, "other", "main.go")},
+		{filepath.Join(root, "..work", "main.go"), true, filepath.Join(root, "..work", "main.go")},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s relative %v", tt.filename, tt.relative), func(t *testing.T) {
+			e := newTestEditor(t)
+			e.filename = tt.filename
+			e.relativePath = tt.relative
+
+			if got := editorDisplayFilename(); got != tt.want {
+				t.Errorf("editorDisplayFilename() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveFlashesStatusBar(t *testing.T) {
+	e, _ := openFile(t, "hello\n")
+	e.saveFlash = 20
+	e.saveFlashColor = "42"
+
+	editorSave()
+
+	if bar := drawStatusBar(); !strings.HasPrefix(bar, "\x1b[42m") {
+		t.Errorf("status bar right after saving = %q, want it flashed", bar)
+	}
+	select {
+	case <-flashEvents:
+	case <-time.After(time.Second):
+		t.Fatal("flash never ended")
+	}
+	if bar := drawStatusBar(); !strings.HasPrefix(bar, "\x1b[7m") {
+		t.Errorf("status bar after the flash = %q, want it back to normal", bar)
+	}
+}
+
+func TestSaveFlashCanBeTurnedOff(t *testing.T) {
+	e, _ := openFile(t, "hello\n")
+	e.saveFlash = 0
+
+	editorSave()
+
+	if bar := drawStatusBar(); !strings.HasPrefix(bar, "\x1b[7m") || flashEvents != nil {
+		t.Errorf("status bar = %q, want no flash", bar)
+	}
+}
+
+func TestReloadMatchesDisk(t *testing.T) {
+	e, path := openFile(t, "one\ntwo\n")
+	if err := os.WriteFile(path, []byte("three\nfour\nfive\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.cy, e.cx = 1, 2
+
+	editorReloadCommand()
+
+	if got := editorText(e); got != "three\nfour\nfive" {
+		t.Errorf("text = %q, want what's on disk", got)
+	}
+	if e.cx != 0 || e.cy != 0 || e.dirty {
+		t.Errorf("cursor at (%d, %d), dirty %v, want (0, 0), clean", e.cx, e.cy, e.dirty)
+	}
+}
+
+func TestReloadConfirmsDiscardingChanges(t *testing.T) {
+	tests := []struct {
+		answer   string
+		wantText string
+	}{
+		{"n", "xone"},
+		{"y", "one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			e, _ := openFile(t, "one\n")
+			processKeys(t, 'x')
+
+			typeKeys(textKeys(tt.answer, '\r')...)
+			editorReloadCommand()
+
+			if got := editorText(e); got != tt.wantText {
+				t.Errorf("text = %q, want %q", got, tt.wantText)
+			}
+			if e.dirty != (tt.answer == "n") {
+				t.Errorf("dirty = %v after answering %q", e.dirty, tt.answer)
+			}
+		})
+	}
+}
+
+func TestScratchBufferQuitsWithoutConfirming(t *testing.T) {
+	e, path := openFile(t, "one\n")
+	editorNewScratch()
+	if !e.scratch || e.filename != "" || editorText(e) != "" {
+		t.Fatalf("scratch buffer holds %q from %q", editorText(e), e.filename)
+	}
+	if got := drawStatusBar(); !strings.Contains(got, "[Scratch]") {
+		t.Errorf("status bar = %q, want it to name the scratch buffer", got)
+	}
+
+	processKeys(t, textKeys("notes")...)
+	if !e.dirty {
+		t.Fatal("typing didn't mark the buffer dirty")
+	}
+	processKeys(t, CTRL_KEY('s'))
+	if got := readFile(t, path); got != "one\n" {
+		t.Errorf("saving the scratch buffer wrote %q to the old file", got)
+	}
+	processKeys(t, CTRL_KEY('q'))
+	if !shouldQuit {
+		t.Error("quitting a scratch buffer asked for confirmation")
+	}
+}
+
+func TestScratchBufferKeepsUnsavedChanges(t *testing.T) {
+	e, _ := openFile(t, "one\n")
+	processKeys(t, 'x')
+	editorNewScratch()
+	if e.scratch || editorText(e) != "xone" {
+		t.Errorf("started a scratch buffer over unsaved changes, text %q", editorText(e))
+	}
+}
+
+func TestOpeningAFileEndsScratch(t *testing.T) {
+	e, path := openFile(t, "one\n")
+	editorNewScratch()
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+	processKeys(t, 'x', CTRL_KEY('q'))
+	if e.scratch || shouldQuit {
+		t.Error("the opened file was still treated as scratch")
+	}
+}
+
+func TestBOMIsStrippedAndSavedAgain(t *testing.T) {
+	for _, preserve := range []bool{true, false} {
+		t.Run(fmt.Sprintf("preserve=%v", preserve), func(t *testing.T) {
+			e, path := openFile(t, UTF8_BOM+"first\nsecond\n")
+			e.preserveBOM = preserve
+
+			if got := e.rows[0].content.String(); got != "first" {
+				t.Errorf("first row = %q, want it without the BOM", got)
+			}
+			processKeys(t, 'x')
+			editorSave()
+
+			want := "xfirst\nsecond\n"
+			if preserve {
+				want = UTF8_BOM + want
+			}
+			if got := readFile(t, path); got != want {
+				t.Errorf("on disk = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLatin1FileSavesByteExact(t *testing.T) {
+	latin1 := "caf\xe9 cr\xe8me\nna\xefve \xa9 2024\n"
+	e, path := openFile(t, latin1)
+	if !e.binary {
+		t.Error("file wasn't noticed as not UTF-8")
+	}
+
+	e.cy = 1
+	processKeys(t, END_KEY, '!')
+	editorSave()
+
+	if got, want := readFile(t, path), "caf\xe9 cr\xe8me\nna\xefve \xa9 2024!\n"; got != want {
+		t.Errorf("on disk = %q, want %q", got, want)
+	}
+	editorRenderRowsThrough(0)
+	if got := string(e.rows[0].render); !strings.HasPrefix(got, "caf\\xE9 cr\\xE8me") {
+		t.Errorf("render = %q, want the bytes shown as escapes", got)
+	}
+}
+
+func TestLongLineOpens(t *testing.T) {
+	long := strings.Repeat("x", 100<<10)
+	e, path := openFile(t, long+"\nend\n")
+	if e.numrows != 2 || e.rows[0].Len() != len(long) {
+		t.Fatalf("opened %d rows, the first %d long", e.numrows, e.rows[0].Len())
+	}
+
+	e.cy = 1
+	processKeys(t, '!')
+	editorSave()
+	if got := readFile(t, path); got != long+"\n!end\n" {
+		t.Errorf("on disk, %d bytes ending %q", len(got), got[len(got)-8:])
+	}
+}
+
+func TestMixedLineEndingsSaveAsTheyWere(t *testing.T) {
+	tests := []struct {
+		text string
+		// After typing at the start of the second line.
+		want string
+	}{
+		{"a\r\nb\nc\r\n", "a\r\n!b\nc\r\n"},
+		{"a\nb\r\nc\n", "a\n!b\r\nc\n"},
+		// The last line gets the file's line ending, as insert_final_newline is on.
+		{"a\r\nb\nc", "a\r\n!b\nc\r\n"},
+	}
+	for _, tt := range tests {
+		e, path := openFile(t, tt.text)
+		if got := editorText(e); got != "a\nb\nc" {
+			t.Errorf("%q opened as %q, want no line endings left in it", tt.text, got)
+		}
+
+		e.cy = 1
+		processKeys(t, '!')
+		editorSave()
+		if got := readFile(t, path); got != tt.want {
+			t.Errorf("%q saved as %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPagedMixedLineEndingsSaveAsTheyWere(t *testing.T) {
+	path := writeBigFile(t, "big.txt", 3000, wordFiller, nil)
+	// Make every other line end with CRLF.
+	var text strings.Builder
+	for i, line := range strings.SplitAfter(readFile(t, path), "\n") {
+		if i%2 == 1 {
+			line = strings.Replace(line, "\n", "\r\n", 1)
+		}
+		text.WriteString(line)
+	}
+	if err := os.WriteFile(path, []byte(text.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := openPaged(t, path)
+	editorRenderRowsThrough(10)
+
+	processKeys(t, '!')
+	editorSave()
+	if got, want := readFile(t, path), "!"+text.String(); got != want {
+		t.Errorf("saved %d bytes, want %d with the endings as they were", len(got), len(want))
+	}
+	if e.lineEnding != "\n" {
+		t.Errorf("line ending = %q, want the first line's", e.lineEnding)
+	}
+}
+
+func TestEditorConfigEvensOutLineEndings(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		".editorconfig": "root = true\n\n[*]\nend_of_line = lf\n",
+		"mixed.txt":     "a\r\nb\nc\r\n",
+	})
+	newTestEditor(t)
+	path := filepath.Join(dir, "mixed.txt")
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+
+	editorSave()
+	if got := readFile(t, path); got != "a\nb\nc\n" {
+		t.Errorf("saved %q, want every line ending with LF", got)
+	}
+}
+
+// The change marked on each row.
+func rowChanges(e *editorConfig) []uint8 {
+	changes := make([]uint8, e.numrows)
+	for i := range changes {
+		changes[i] = e.rows[i].change
+	}
+	return changes
+}
+
+func TestChangeGutterMarksEditsUntilSaved(t *testing.T) {
+	e, _ := openFile(t, "a\nb\nc\nd\ne\n")
+	e.showChanges = true
+
+	e.cy = 1
+	processKeys(t, 'x')
+	e.cy, e.cx = 2, 1
+	processKeys(t, '\r', 'y')
+	e.cy, e.cx = 4, 0
+	editorDelRow(e, 4)
+
+	want := []uint8{CHANGE_NONE, CHANGE_MODIFIED, CHANGE_NONE, CHANGE_ADDED, CHANGE_DELETED}
+	if got := rowChanges(e); !slices.Equal(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+	editorRenderRowsThrough(e.numrows)
+	frame := make([]string, e.screenrows)
+	editorDrawRows(frame)
+	for y, change := range want {
+		if !strings.HasPrefix(frame[y], changeSigns[change]) {
+			t.Errorf("row %d drawn as %q, want it to start with %q", y, frame[y], changeSigns[change])
+		}
+	}
+
+	editorSave()
+
+	if got := rowChanges(e); slices.ContainsFunc(got, func(change uint8) bool { return change != CHANGE_NONE }) {
+		t.Errorf("changes after saving = %v, want none", got)
+	}
+}
+
+func TestLineChanges(t *testing.T) {
+	const (
+		N = CHANGE_NONE
+		A = CHANGE_ADDED
+		M = CHANGE_MODIFIED
+		D = CHANGE_DELETED
+	)
+	tests := []struct {
+		name    string
+		base    string
+		current string
+		want    []uint8
+	}{
+		{"same", "a b c", "a b c", []uint8{N, N, N}},
+		{"added", "a b c", "a x b c", []uint8{N, A, N, N}},
+		{"added at end", "a b", "a b x y", []uint8{N, N, A, A}},
+		{"modified", "a b c", "a x c", []uint8{N, M, N}},
+		{"deleted", "a b c d", "a d", []uint8{N, D}},
+		{"deleted at start", "a b c", "c", []uint8{D}},
+		{"modified and added", "a b c", "a x y c", []uint8{N, M, A, N}},
+		{"modified and deleted", "a b c d", "a x d", []uint8{N, M, D}},
+		{"new file", "", "a b", []uint8{A, A}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lineChanges(strings.Fields(tt.base), strings.Fields(tt.current))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lineChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ==========================================
+// ============== Key Bindings ==============
+// ==========================================
+
+// Load settings from an rc file holding text. Bindings, snippets and
+// abbreviations it changes are put back after the test.
+func loadRC(t *testing.T, text string) error {
+	t.Helper()
+	rc := filepath.Join(t.TempDir(), "kilorc")
+	if err := os.WriteFile(rc, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KILORC", rc)
+	bindings, snippetsBefore, abbreviationsBefore := maps.Clone(keyBindings), maps.Clone(snippets), maps.Clone(abbreviations)
+	indentRulesBefore := maps.Clone(indentRules)
+	t.Cleanup(func() {
+		keyBindings, snippets, abbreviations = bindings, snippetsBefore, abbreviationsBefore
+		indentRules = indentRulesBefore
+	})
+	return editorLoadSettings()
+}
+
+func TestReboundSaveKeySaves(t *testing.T) {
+	e, path := openFile(t, "hello\n")
+	if err := loadRC(t, "bind Ctrl-e = save\nbind Ctrl-s = none\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	processKeys(t, 'x', CTRL_KEY('s'))
+	if got := readFile(t, path); got != "hello\n" {
+		t.Errorf("Ctrl-s still saved after unbinding it")
+	}
+	if got := editorText(e); got != "xhello" {
+		t.Errorf("text = %q, want the unbound key left out", got)
+	}
+	processKeys(t, CTRL_KEY('e'))
+	if got := readFile(t, path); got != "xhello\n" || e.dirty {
+		t.Errorf("on disk = %q after Ctrl-e, want %q", got, "xhello\n")
+	}
+}
+
+func TestQuitTimesFromRC(t *testing.T) {
+	tests := []struct {
+		rc string
+		// How many presses of quit it takes to leave with unsaved changes.
+		presses int
+	}{
+		{"", KILO_QUIT_TIMES + 1},
+		{"quit_times = 1\n", 2},
+		{"quit_times = 0\n", 1},
+	}
+	for _, tt := range tests {
+		newTestEditor(t, "hello")
+		if err := loadRC(t, tt.rc); err != nil {
+			t.Fatal(err)
+		}
+		processKeys(t, 'x')
+
+		for i := 1; i <= tt.presses; i++ {
+			processKeys(t, CTRL_KEY('q'))
+			if shouldQuit != (i == tt.presses) {
+				t.Errorf("rc %q: after %d presses, quitting is %v", tt.rc, i, shouldQuit)
+			}
+		}
+	}
+}
+
+func TestQuitCountStartsOverAfterOtherKeys(t *testing.T) {
+	newTestEditor(t, "hello")
+	if err := loadRC(t, "quit_times = 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	processKeys(t, 'x', CTRL_KEY('q'), 'y', CTRL_KEY('q'))
+	if shouldQuit {
+		t.Fatal("quit after the count was started over")
+	}
+	processKeys(t, CTRL_KEY('q'))
+	if !shouldQuit {
+		t.Error("didn't quit on the last press")
+	}
+}
+
+func TestMessageTimeoutFromRC(t *testing.T) {
+	tests := []struct {
+		rc  string
+		age time.Duration
+		// Whether a message that old is still shown.
+		shown bool
+	}{
+		{"", KILO_MESSAGE_TIMEOUT*time.Second - time.Second, true},
+		{"", KILO_MESSAGE_TIMEOUT*time.Second + time.Second, false},
+		{"message_timeout = 1\n", 2 * time.Second, false},
+		{"message_timeout = 60\n", 30 * time.Second, true},
+		{"message_timeout = 0\n", time.Hour, true},
+	}
+	for _, tt := range tests {
+		e := newTestEditor(t)
+		if err := loadRC(t, tt.rc); err != nil {
+			t.Fatal(err)
+		}
+		editorSetStatusMessage("hello")
+		e.statusMsgTime = time.Now().Add(-tt.age)
+
+		var bar strings.Builder
+		editorDrawMessageBar(&bar)
+		if shown := bar.String() == "hello"; shown != tt.shown {
+			t.Errorf("rc %q: message %v old drawn as %q, want shown %v", tt.rc, tt.age, bar.String(), tt.shown)
+		}
+	}
+}
+
+func TestCursorShapeFromRC(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"block", "\x1b[2 q", false},
+		{"Underline", "\x1b[4 q", false},
+		{"bar", "\x1b[6 q", false},
+		{"default", "\x1b[0 q", false},
+		{"triangle", "\x1b[0 q", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			e := newTestEditor(t)
+
+			err := loadRC(t, "cursor_shape = "+tt.value+"\n")
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("editorLoadSettings() = %v, want error %v", err, tt.wantErr)
+			}
+			if got := cursorShapeSequence(e.cursorShape); got != tt.want {
+				t.Errorf("cursor shape sequence = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoringTerminalResetsCursorShape(t *testing.T) {
+	e := newTestEditor(t)
+	e.cursorShape = cursorShapes["bar"]
+	e.originalTermios = &unix.Termios{}
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+	// Not a terminal, so only the output can be checked.
+	pipeStdin(t, "")
+
+	disableRawMode()
+
+	if !strings.HasPrefix(out.String(), "\x1b[0 q") {
+		t.Errorf("wrote %q, want the cursor shape reset first", out.String())
+	}
+}
+
+func TestEssentialActionsStayBound(t *testing.T) {
+	newTestEditor(t)
+	err := loadRC(t, "bind Ctrl-q = none\nbind Ctrl-x = nonsense\n")
+
+	if err == nil || !strings.Contains(err.Error(), "line 2: unknown action") || !strings.Contains(err.Error(), "quit must be bound") {
+		t.Errorf("editorLoadSettings() = %v, want both problems", err)
+	}
+	if keyBindings[CTRL_KEY('q')] != "quit" {
+		t.Error("Ctrl-q wasn't bound to quit again")
+	}
+}
+
+func TestHelpListsCurrentBindings(t *testing.T) {
+	newTestEditor(t)
+	if err := loadRC(t, "bind Alt-s = save\nbind Ctrl-f = none\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := editorHelpLines()
+
+	for _, want := range []string{
+		fmt.Sprintf("  %-18s %-20s %s", "Alt-s, Ctrl-S", "save", editorActions["save"].description),
+		fmt.Sprintf("  %-18s %-20s %s", "(unbound)", "find", editorActions["find"].description),
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("help doesn't list %q", want)
+		}
+	}
+}
+
+func TestHelpCoversViewUntilClosed(t *testing.T) {
+	e := newTestEditor(t, "some text")
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+
+	typeKeys(ESC)
+	editorShowHelp()
+
+	screen := stripEscapes(out.String())
+	if !strings.Contains(screen, "Kilo editor -- version") || strings.Contains(screen, "some text") {
+		t.Errorf("help screen drawn as %q", screen)
+	}
+	if overlayLines != nil || editorText(e) != "some text" {
+		t.Error("closing help didn't leave the buffer as it was")
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	for _, tt := range []struct {
+		query, text string
+		ok          bool
+	}{
+		{"", "save", true},
+		{"sl", "sort-lines", true},
+		{"SL", "sort-lines", true},
+		{"ls", "sort-lines", true},
+		{"sz", "sort-lines", false},
+		{"lines-sort", "sort-lines", false},
+	} {
+		if _, ok := fuzzyScore(tt.query, tt.text); ok != tt.ok {
+			t.Errorf("fuzzyScore(%q, %q) matched %v, want %v", tt.query, tt.text, ok, tt.ok)
+		}
+	}
+
+	// Each pair is better first, worse second.
+	for _, tt := range [][3]string{
+		{"sort", "sort-lines", "s-o-r-t"},
+		{"l", "sort-lines", "fill"},
+		{"rl", "reverse-lines", "reload"},
+	} {
+		better, _ := fuzzyScore(tt[0], tt[1])
+		worse, _ := fuzzyScore(tt[0], tt[2])
+		if better <= worse {
+			t.Errorf("%q scores %d for %q and %d for %q, want the first higher", tt[0], better, tt[1], worse, tt[2])
+		}
+	}
+}
+
+func TestCommandPaletteRunsBestMatch(t *testing.T) {
+	e := newTestEditor(t, "b", "a")
+	processKeys(t, append([]int{CTRL_KEY('p')}, textKeys("revl\r")...)...)
+
+	if got := editorText(e); got != "a\nb" {
+		t.Errorf("text = %q, want it reversed by reverse-lines", got)
+	}
+	if overlayLines != nil {
+		t.Error("palette was left on screen")
+	}
+}
+
+func TestCommandPalettePicksWithArrows(t *testing.T) {
+	e := newTestEditor(t, "abc")
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+	// Backspace takes the x off again.
+	typeKeys(append(textKeys("rot1x"), BACKSPACE, ARROW_DOWN, ARROW_UP, '\r')...)
+	editorCommandPalette()
+
+	if got := editorText(e); got != "nop" {
+		t.Errorf("text = %q, want it changed by rot13", got)
+	}
+	if screen := stripEscapes(out.String()); !strings.Contains(screen, "Run: rot1") || !strings.Contains(screen, "rot13") {
+		t.Errorf("palette drawn as %q", screen)
+	}
+}
+
+func TestCommandPaletteEscape(t *testing.T) {
+	e := newTestEditor(t, "b", "a")
+	editorSetStatusMessage("before")
+	typeKeys(append(textKeys("revl"), ESC)...)
+	editorCommandPalette()
+
+	if got := editorText(e); got != "b\na" || e.statusMsg != "before" || overlayLines != nil {
+		t.Errorf("after Esc, text %q and status %q, want both as they were", got, e.statusMsg)
+	}
+}
+
+func TestIndentStyleIsDetectedOnOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		softTabs   bool
+		indentSize int
+	}{
+		{"spaces", "func f() {\n  if x {\n    y()\n  }\n}\n", true, 2},
+		{"tabs", "func f() {\n\tif x {\n\t\ty()\n\t}\n}\n", false, KILO_TAB_STOP},
+		{"mostly spaces", "a\n    b\n    c\n\td\n", true, 4},
+		{"comment stars", "/*\n * one\n * two\n */\n\tx\n", false, KILO_TAB_STOP},
+		{"no indentation", "a\nb\n", false, KILO_TAB_STOP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := openFile(t, tt.text)
+			if e.softTabs != tt.softTabs || e.indentSize != tt.indentSize {
+				t.Errorf("softTabs %v, indentSize %d, want %v, %d", e.softTabs, e.indentSize, tt.softTabs, tt.indentSize)
+			}
+		})
+	}
+}
+
+func TestIndentRuleOverridesDetection(t *testing.T) {
+	newTestEditor(t)
+	if err := loadRC(t, "indent .txt = tabs\n"); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := openFile(t, "a\n  b\n  c\n")
+	if e.softTabs {
+		t.Error("guessed spaces, want the rc file's tabs")
+	}
+}
+
+func TestCleanUpIndentBothWays(t *testing.T) {
+	e := newTestEditor(t, "\tif x {", "\t\ty\tz", "  \tw", "   v", "}")
+	e.tabStop = 4
+	e.softTabs = true
+	e.cx, e.cy = 2, 1
+
+	editorCleanUpIndent()
+	if got, want := editorText(e), "    if x {\n        y\tz\n    w\n   v\n}"; got != want {
+		t.Errorf("with spaces = %q, want %q", got, want)
+	}
+	if e.cx != 8 {
+		t.Errorf("cx = %d, want it kept on y at 8", e.cx)
+	}
+	if e.statusMsg != "Cleaned up the indentation of 3 lines" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+
+	e.softTabs = false
+	editorCleanUpIndent()
+	if got, want := editorText(e), "\tif x {\n\t\ty\tz\n\tw\n   v\n}"; got != want {
+		t.Errorf("with tabs = %q, want %q", got, want)
+	}
+	if e.cx != 2 {
+		t.Errorf("cx = %d, want it kept on y at 2", e.cx)
+	}
+}
+
+func TestCleanUpIndentIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "\tif x {", "\t\ty", "}")
+	e.tabStop = 4
+	e.softTabs = true
+	e.cx, e.cy = 2, 1
+	runAction(t, "clean-up-indent")
+	if got := editorText(e); got != "    if x {\n        y\n}" {
+		t.Fatalf("cleaned up = %q", got)
+	}
+
+	undoOnce(t, e, "\tif x {\n\t\ty\n}", 2, 1)
+}
+
+func TestIndentRulesByFileType(t *testing.T) {
+	newTestEditor(t)
+	if err := loadRC(t, "indent go = tabs 4\nindent .yaml = spaces 2\nindent sh = spaces\n"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filename   string
+		softTabs   bool
+		indentSize int
+		tabStop    int
+	}{
+		{"main.go", false, 4, 4},
+		{"config.yaml", true, 2, KILO_TAB_STOP},
+		{"run.sh", true, KILO_TAB_STOP, KILO_TAB_STOP},
+		{"notes.txt", false, KILO_TAB_STOP, KILO_TAB_STOP},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.filename)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := editorOpen(path); err != nil {
+			t.Fatal(err)
+		}
+		if config.softTabs != tt.softTabs || config.indentSize != tt.indentSize || config.tabStop != tt.tabStop {
+			t.Errorf("%s: softTabs %v, indentSize %d, tabStop %d, want %v, %d, %d", tt.filename,
+				config.softTabs, config.indentSize, config.tabStop, tt.softTabs, tt.indentSize, tt.tabStop)
+		}
+	}
+}
+
+func TestBadIndentRules(t *testing.T) {
+	for _, line := range []string{
+		"indent go = dots",
+		"indent go = spaces two",
+		"indent go = spaces 0",
+		"indent go = tabs 4 8",
+		"indent cobol = tabs",
+	} {
+		newTestEditor(t)
+		if err := loadRC(t, line+"\n"); err == nil {
+			t.Errorf("%q loaded without an error", line)
+		}
+	}
+}
+
+// ==========================================
+// ============== EditorConfig ==============
+// ==========================================
+
+// A project with .editorconfig files in it and above it.
+var editorConfigTree = map[string]string{
+	".editorconfig": "[*]\nmax_line_length = 100\n",
+	"proj/.editorconfig": "root = true\n\n" +
+		"[*]\nindent_style = tab\nindent_size = 8\nend_of_line = lf\n\n" +
+		"[*.go]\nindent_size = 4\n\n" +
+		"[*.{md,txt}]\ntrim_trailing_whitespace = true\ninsert_final_newline = false\n",
+	"proj/sub/.editorconfig": "[*.go]\nindent_style = space\nindent_size = 2\nend_of_line = crlf\n",
+	"proj/main.go":           "package main\n",
+	"proj/notes.md":          "notes  \n",
+	"proj/sub/sub.go":        "package sub\n",
+}
+
+func TestEditorConfigProperties(t *testing.T) {
+	dir := writeTree(t, editorConfigTree)
+
+	tests := []struct {
+		path string
+		want map[string]string
+	}{
+		{"proj/main.go", map[string]string{"indent_style": "tab", "indent_size": "4", "end_of_line": "lf"}},
+		{"proj/notes.md", map[string]string{"indent_style": "tab", "indent_size": "8", "end_of_line": "lf",
+			"trim_trailing_whitespace": "true", "insert_final_newline": "false"}},
+		{"proj/sub/sub.go", map[string]string{"indent_style": "space", "indent_size": "2", "end_of_line": "crlf"}},
+		{"other.go", map[string]string{"max_line_length": "100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got := editorConfigProperties(filepath.Join(dir, tt.path))
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("properties = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditorConfigAppliesOnOpen(t *testing.T) {
+	dir := writeTree(t, editorConfigTree)
+	e := newTestEditor(t)
+	if err := editorOpen(filepath.Join(dir, "proj/sub/sub.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.softTabs || e.indentSize != 2 || e.tabStop != 2 || e.lineEnding != "\r\n" {
+		t.Errorf("soft tabs %v, indent %d, tab stop %d, line ending %q, want spaces of 2 and CRLF",
+			e.softTabs, e.indentSize, e.tabStop, e.lineEnding)
+	}
+	processKeys(t, '\t')
+	editorSave()
+	if got := readFile(t, e.filename); got != "  package sub\r\n" {
+		t.Errorf("on disk = %q", got)
+	}
+}
+
+func TestEditorConfigTrimsOnSave(t *testing.T) {
+	dir := writeTree(t, editorConfigTree)
+	e := newTestEditor(t)
+	if err := editorOpen(filepath.Join(dir, "proj/notes.md")); err != nil {
+		t.Fatal(err)
+	}
+
+	editorSave()
+
+	if got := readFile(t, e.filename); got != "notes\n" {
+		t.Errorf("on disk = %q, want the trailing whitespace gone", got)
+	}
+}
+
+// ==========================================
+// =============== Scripting ================
+// ==========================================
+
+// Run kilo headless on the requests, one per line, and decode its responses.
+func runRPC(t *testing.T, args []string, requests ...string) []rpcResponse {
+	t.Helper()
+	newTestEditor(t)
+	var output bytes.Buffer
+	input := strings.NewReader(strings.Join(requests, "\n"))
+	if err := editorRunHeadless(args, input, &output); err != nil {
+		t.Fatalf("editorRunHeadless() = %v", err)
+	}
+	if strings.Contains(output.String(), "\x1b") {
+		t.Errorf("output has terminal escapes: %q", output.String())
+	}
+
+	var responses []rpcResponse
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var response rpcResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatalf("bad response: %v", err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+func TestRPCEditsAndReportsState(t *testing.T) {
+	t.Setenv("KILORC", filepath.Join(t.TempDir(), "none"))
+	responses := runRPC(t, nil,
+		`{"id": 1, "method": "insert", "params": {"text": "hi\nthere"}}`,
+		`{"id": 2, "method": "move", "params": {"row": 0, "col": 2}}`,
+		`{"id": 3, "method": "delete", "params": {"count": 1}}`,
+		`{"id": 4, "method": "get"}`,
+	)
+	if len(responses) != 4 {
+		t.Fatalf("got %d responses, want 4", len(responses))
+	}
+	if got := responses[0].Result; got.Row != 1 || got.Col != 5 || !got.Dirty {
+		t.Errorf("after insert, state = %+v", got)
+	}
+	last := responses[3]
+	if string(last.ID) != "4" {
+		t.Errorf("id = %s, want 4", last.ID)
+	}
+	if want := []string{"h", "there"}; !slices.Equal(last.Result.Lines, want) {
+		t.Errorf("lines = %q, want %q", last.Result.Lines, want)
+	}
+	if last.Result.Row != 0 || last.Result.Col != 1 {
+		t.Errorf("cursor at (%d, %d), want (1, 0)", last.Result.Col, last.Result.Row)
+	}
+}
+
+func TestRPCReportsBadRequests(t *testing.T) {
+	t.Setenv("KILORC", filepath.Join(t.TempDir(), "none"))
+	responses := runRPC(t, nil,
+		`{"id": 1, "method": `,
+		`{"id": 2, "method": "dance"}`,
+		`{"id": 3, "method": "action", "params": {"name": "dance"}}`,
+		`{"id": 4, "method": "save"}`,
+	)
+	wantErrors := []string{"bad request: ", `unknown method "dance"`, `unknown action "dance"`, "no filename to save to"}
+	if len(responses) != len(wantErrors) {
+		t.Fatalf("got %d responses, want %d", len(responses), len(wantErrors))
+	}
+	for i, want := range wantErrors {
+		if !strings.HasPrefix(responses[i].Error, want) || responses[i].Result != nil {
+			t.Errorf("response %d = %+v, want error %q", i, responses[i], want)
+		}
+	}
+}
+
+func TestRPCOpensAndSaves(t *testing.T) {
+	t.Setenv("KILORC", filepath.Join(t.TempDir(), "none"))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	copyPath := filepath.Join(dir, "copy.txt")
+
+	responses := runRPC(t, []string{path},
+		`{"id": 1, "method": "insert", "params": {"text": "zero\n"}}`,
+		`{"id": 2, "method": "save", "params": {"filename": "`+copyPath+`"}}`,
+	)
+	if len(responses) != 2 || len(responses[1].Error) > 0 {
+		t.Fatalf("responses = %+v", responses)
+	}
+	if responses[1].Result.Dirty {
+		t.Error("still dirty after saving")
+	}
+	data, err := os.ReadFile(copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "zero\none\ntwo\n" {
+		t.Errorf("saved %q", data)
+	}
+}
+
+func TestRPCQuitActionStopsServing(t *testing.T) {
+	rc := filepath.Join(t.TempDir(), "kilorc")
+	// Without the rc file, the first quit would only warn about the unsaved insert.
+	if err := os.WriteFile(rc, []byte("quit_times=0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KILORC", rc)
+
+	responses := runRPC(t, nil,
+		`{"id": 1, "method": "insert", "params": {"text": "unsaved"}}`,
+		`{"id": 2, "method": "action", "params": {"name": "quit"}}`,
+		`{"id": 3, "method": "get"}`,
+	)
+	if len(responses) != 2 {
+		t.Fatalf("got %d responses, want 2 since the quit ends it", len(responses))
+	}
+}
+
+func TestRPCQuitMethodStopsServing(t *testing.T) {
+	t.Setenv("KILORC", filepath.Join(t.TempDir(), "none"))
+	responses := runRPC(t, nil,
+		`{"id": 1, "method": "quit"}`,
+		`{"id": 2, "method": "get"}`,
+	)
+	if len(responses) != 1 || len(responses[0].Error) > 0 {
+		t.Fatalf("responses = %+v, want only the quit", responses)
+	}
+}
+
+func TestRunHeadlessReportsRCProblems(t *testing.T) {
+	rc := filepath.Join(t.TempDir(), "kilorc")
+	if err := os.WriteFile(rc, []byte("no_such_option=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KILORC", rc)
+	newTestEditor(t)
+
+	err := editorRunHeadless(nil, strings.NewReader(""), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "rc file") {
+		t.Errorf("editorRunHeadless() = %v, want an rc file error", err)
+	}
+}
+
+// ==========================================
+// ============ Case Transforms =============
+// ==========================================
+
+func TestCaseTransformsOnWord(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		cx        int
+		transform func()
+		want      string
+	}{
+		{"upcase", "say hELLo there", 5, editorUpcaseWord, "say HELLO there"},
+		{"upcase multibyte", "grüße aus köln", 10, editorUpcaseWord, "grüße aus KÖLN"},
+		{"downcase", "ÉCOLE Été", 0, editorDowncaseWord, "école Été"},
+		{"titlecase", "mIXed case", 2, editorTitlecaseWord, "Mixed case"},
+		{"titlecase digraph", "ǆemal", 0, editorTitlecaseWord, "ǅemal"},
+		{"titlecase greek", "ΣΟΦΙΑ", 4, editorTitlecaseWord, "Σοφια"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(t, test.line)
+			e.cx = test.cx
+
+			test.transform()
+
+			if got := editorText(e); got != test.want {
+				t.Errorf("text = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCaseTransformMovesPastWord(t *testing.T) {
+	e := newTestEditor(t, "one twö three")
+	e.cx = 5
+
+	editorUpcaseWord()
+
+	if e.cx != 7 {
+		t.Errorf("cx = %d, want 7", e.cx)
+	}
+}
+
+func TestCaseTransformsOnSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform func()
+		want      string
+	}{
+		{"upcase", editorUpcaseWord, "aBC DÉF\nÖL ghi"},
+		{"downcase", editorDowncaseWord, "abc déf\nöl ghi"},
+		{"titlecase", editorTitlecaseWord, "aBc Déf\nÖl ghi"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(t, "aBc dÉf", "öL ghi")
+			// Select from the middle of the first word to the end of "öL".
+			e.selecting = true
+			e.selectAnchor = editorCursor{cx: 1, cy: 0}
+			e.cx, e.cy = 2, 1
+
+			test.transform()
+
+			if got := editorText(e); got != test.want {
+				t.Errorf("text = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCaseTransformIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "aBc dÉf", "öL ghi")
+	e.selecting = true
+	e.selectAnchor = editorCursor{cx: 1, cy: 0}
+	e.cx, e.cy = 2, 1
+	processKeys(t, ALT_KEY('u'))
+
+	undoOnce(t, e, "aBc dÉf\nöL ghi", 2, 1)
+}
+
+// ==========================================
+// ================= Undo ===================
+// ==========================================
+
+// Check there's one change to undo, then press Ctrl-z and check it put the text back to want, with the cursor at cx, cy.
+func undoOnce(t *testing.T, e *editorConfig, want string, cx, cy int) {
+	t.Helper()
+	if len(e.undoStack) != 1 {
+		t.Fatalf("%d changes to undo, want 1", len(e.undoStack))
+	}
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != want {
+		t.Errorf("after undo, text = %q, want %q", got, want)
+	}
+	if e.cx != cx || e.cy != cy {
+		t.Errorf("after undo, cursor at (%d, %d), want (%d, %d)", e.cx, e.cy, cx, cy)
+	}
+}
+
+// Run the action called name from the command palette, like a keypress would,
+// then answer any prompts it has with keys.
+func runAction(t *testing.T, name string, keys ...int) {
+	t.Helper()
+	processKeys(t, append(append([]int{CTRL_KEY('p')}, textKeys(name+"\r")...), keys...)...)
+}
+
+func TestUndoAndRedoKeypresses(t *testing.T) {
+	e := newTestEditor(t, "hello")
+	e.cx = 5
+	processKeys(t, textKeys("ab")...)
+
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != "helloa" || e.cx != 6 {
+		t.Fatalf("after undo, text = %q, cx = %d, want %q, 6", got, e.cx, "helloa")
+	}
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != "hello" || e.cx != 5 {
+		t.Fatalf("after second undo, text = %q, cx = %d, want %q, 5", got, e.cx, "hello")
+	}
+	processKeys(t, CTRL_KEY('z'))
+	if e.statusMsg != "Nothing to undo" {
+		t.Errorf("status = %q, want %q", e.statusMsg, "Nothing to undo")
+	}
+
+	processKeys(t, CTRL_KEY('y'), CTRL_KEY('y'))
+	if got := editorText(e); got != "helloab" || e.cx != 7 {
+		t.Errorf("after redo, text = %q, cx = %d, want %q, 7", got, e.cx, "helloab")
+	}
+}
+
+func TestUndoSplitLine(t *testing.T) {
+	e := newTestEditor(t, "helloworld", "next")
+	e.cx = 5
+	processKeys(t, '\r')
+	if got := editorText(e); got != "hello\nworld\nnext" {
+		t.Fatalf("text = %q", got)
+	}
+
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != "helloworld\nnext" {
+		t.Errorf("text = %q, want %q", got, "helloworld\nnext")
+	}
+	if e.cx != 5 || e.cy != 0 {
+		t.Errorf("cursor = %d,%d, want 5,0", e.cx, e.cy)
+	}
+}
+
+func TestChangeAfterUndoDropsRedo(t *testing.T) {
+	e := newTestEditor(t, "")
+	processKeys(t, textKeys("a")...)
+	processKeys(t, CTRL_KEY('z'))
+	processKeys(t, textKeys("b")...)
+
+	processKeys(t, CTRL_KEY('y'))
+	if got := editorText(e); got != "b" {
+		t.Errorf("text = %q, want %q", got, "b")
+	}
+	if e.statusMsg != "Nothing to redo" {
+		t.Errorf("status = %q, want %q", e.statusMsg, "Nothing to redo")
+	}
+}
+
+func TestUndoHistorySurvivesReopening(t *testing.T) {
+	e, path := openFile(t, "one\n")
+	e.undoFileLevels = 2
+	e.cx = 3
+	processKeys(t, textKeys("abc")...)
+	editorSave()
+
+	e.undoStack = nil
+	if err := editorReload(); err != nil {
+		t.Fatal(err)
+	}
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != "oneab" {
+		t.Errorf("after undo, text = %q, want %q", got, "oneab")
+	}
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != "onea" {
+		t.Errorf("after second undo, text = %q, want %q", got, "onea")
+	}
+	// Only two changes were kept.
+	processKeys(t, CTRL_KEY('z'))
+	if got := editorText(e); got != "onea" || e.statusMsg != "Nothing to undo" {
+		t.Errorf("after third undo, text = %q, status = %q, want %q, %q", got, e.statusMsg, "onea", "Nothing to undo")
+	}
+	if got := readFile(t, path); got != "oneabc\n" {
+		t.Errorf("file = %q, want %q", got, "oneabc\n")
+	}
+}
+
+func TestUndoHistoryDroppedWhenFileChanged(t *testing.T) {
+	e, path := openFile(t, "one\n")
+	e.undoFileLevels = 10
+	processKeys(t, textKeys("x")...)
+	editorSave()
+
+	if err := os.WriteFile(path, []byte("xone, changed elsewhere\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorReload(); err != nil {
+		t.Fatal(err)
+	}
+	processKeys(t, CTRL_KEY('z'))
+	if e.statusMsg != "Nothing to undo" {
+		t.Errorf("status = %q, want %q", e.statusMsg, "Nothing to undo")
+	}
+}
+
+func TestUndoHistoryNotKeptByDefault(t *testing.T) {
+	_, path := openFile(t, "one\n")
+	processKeys(t, textKeys("x")...)
+	editorSave()
+
+	if _, err := os.Stat(undoFilePath(path)); !os.IsNotExist(err) {
+		t.Errorf("undo file exists, or can't tell: %v", err)
+	}
+}
+
+// ==========================================
+// ============== Paged Files ===============
+// ==========================================
+
+// Write lines to a file named name, padded out past a megabyte so it's paged in
+// when paged_threshold is 1. Lines without an index in lines are filler.
+func writeBigFile(t *testing.T, name string, numLines int, filler string, lines map[int]string) string {
+	t.Helper()
+	var text strings.Builder
+	for i := 0; i < numLines; i++ {
+		line, ok := lines[i]
+		if !ok {
+			line = filler
+		}
+		text.WriteString(line + "\n")
+	}
+	if text.Len() <= 1<<20 {
+		t.Fatalf("%d lines is only %d bytes, too small to page", numLines, text.Len())
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Filler lines for big files. In code, a string is quick to highlight.
+var wordFiller = strings.TrimSpace(strings.Repeat("word ", 80))
+var stringFiller = `"` + wordFiller + `"`
+
+// Open path in a fresh editor that pages files over a megabyte.
+func openPaged(t *testing.T, path string) *editorConfig {
+	t.Helper()
+	e := newTestEditor(t)
+	e.pagedThreshold = 1
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(editorClosePaged)
+	if e.pagedFile == nil {
+		t.Fatal("file wasn't paged")
+	}
+	return e
+}
+
+func TestPagingIsOffByDefault(t *testing.T) {
+	path := writeBigFile(t, "big.txt", 3000, wordFiller, nil)
+	e := newTestEditor(t)
+
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.pagedFile != nil || e.numrows != 3000 || e.rows[2999].unloaded {
+		t.Errorf("file was paged, %d rows", e.numrows)
+	}
+}
+
+func TestPagedMotionsReadRowsOffScreen(t *testing.T) {
+	// Well past KILO_PAGED_WINDOW rows below the screen.
+	path := writeBigFile(t, "big.txt", 3000, wordFiller, map[int]string{
+		0:    "top",
+		2:    "  indented",
+		2500: "",
+		2600: "  indented too",
+	})
+	e := openPaged(t, path)
+
+	e.cy = 2
+	editorMoveToSameIndent(1)
+	if e.cy != 2600 || e.cx != 2 {
+		t.Errorf("same indent moved to (%d, %d), want (2, 2600)", e.cx, e.cy)
+	}
+
+	e.cy, e.cx = 0, 0
+	editorNextParagraph()
+	if e.cy != 2500 {
+		t.Errorf("next paragraph moved to line %d, want 2500", e.cy)
+	}
+
+	e.cy = 2501
+	editorNextParagraph()
+	if e.cy != 2999 || e.cx != e.rows[2999].Len() || e.cx == 0 {
+		t.Errorf("next paragraph moved to (%d, %d), want the end of line 2999", e.cx, e.cy)
+	}
+
+	if !e.rows[1500].unloaded {
+		t.Error("rows scanned over were kept in memory")
+	}
+}
+
+func TestPagedHighlightKeepsCommentOpenAboveWindow(t *testing.T) {
+	path := writeBigFile(t, "big.go", 4000, stringFiller, map[int]string{0: "/* a comment", 3999: "*/"})
+	e := openPaged(t, path)
+	e.rowOffset = 3500
+
+	editorRenderRowsThrough(3510)
+
+	if got := e.rows[3505].highlights[0]; got != HL_MLCOMMENT {
+		t.Errorf("highlight of line 3505 = %d, want HL_MLCOMMENT", got)
+	}
+	if !e.rows[100].unloaded {
+		t.Error("rows above the window were kept in memory")
+	}
+}
+
+func TestPagedEditAboveRedoesCommentState(t *testing.T) {
+	path := writeBigFile(t, "big.go", 4000, stringFiller, map[int]string{0: "/* a comment", 3999: "*/"})
+	e := openPaged(t, path)
+	e.rowOffset = 3500
+	editorRenderRowsThrough(3510)
+
+	// Close the comment on the first line, far above the window.
+	e.rowOffset = 0
+	editorRenderRowsThrough(10)
+	e.cy, e.cx = 0, e.rows[0].Len()
+	for _, char := range " */" {
+		editorInsertChar(e, char)
+	}
+	editorPageOutDistantRows()
+	e.rowOffset = 3500
+	editorRenderRowsThrough(3510)
+
+	if got := e.rows[3505].highlights[0]; got != HL_STRING {
+		t.Errorf("highlight of line 3505 = %d, want HL_STRING now the comment is closed", got)
+	}
+}
+
+// ==========================================
+// ================ Drawing =================
+// ==========================================
+
+// Draw the rows on screen and return the first one.
+func drawFirstRow(t *testing.T) string {
+	t.Helper()
+	editorRenderRowsThrough(config.rowOffset + config.screenrows)
+	frame := make([]string, config.screenrows)
+	editorDrawRows(frame)
+	return frame[0]
+}
+
+func TestMisspelledSelectionIsInvertedAndUnderlined(t *testing.T) {
+	e := newTestEditor(t, "helo world")
+	saved := spellDictionary
+	t.Cleanup(func() { spellDictionary = saved })
+	spellDictionary = map[string]bool{"world": true}
+	editorToggleSpellCheck()
+	e.selecting = true
+	e.selectAnchor = editorCursor{cx: 0, cy: 0}
+	e.cx = 2
+
+	row := drawFirstRow(t)
+
+	if !strings.Contains(row, "\x1b[7m\x1b[4mh\x1b[24m\x1b[27m") {
+		t.Errorf("selected misspelled character isn't inverted and underlined: %q", row)
+	}
+	if !strings.Contains(row, "\x1b[4ml\x1b[24m") || strings.Contains(row, "\x1b[7m\x1b[4ml") {
+		t.Errorf("unselected misspelled character should only be underlined: %q", row)
+	}
+	if strings.Contains(row, "\x1b[4mw") {
+		t.Errorf("correctly spelled word is underlined: %q", row)
+	}
+}
+
+func TestOverflowStartCountsColumns(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		max  int
+		want int
+	}{
+		{"ascii", "abcdefgh", 5, 5},
+		{"fits", "abcde", 5, -1},
+		{"off", "abcdefgh", 0, -1},
+		{"wide", "日本語abc", 5, 2},
+		{"wide at the limit", "ab日本", 4, 3},
+		{"tab", "\tx", 4, 4},
+		{"combining", "e\u0301e\u0301e\u0301x", 3, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newLocalEditor(test.line)
+			e.maxLineLength = test.max
+			editorUpdateRow(e, &e.rows[0])
+
+			if got := editorOverflowStart(e, &e.rows[0]); got != test.want {
+				t.Errorf("editorOverflowStart() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOverflowHighlight(t *testing.T) {
+	e := newTestEditor(t, "\tx := \"abc\"", "short")
+	e.filename = "main.go"
+	e.maxLineLength = 12
+	editorSelectSyntaxHighlight()
+	editorRenderRowsThrough(1)
+
+	// The tab takes up 8 columns, so the overflow starts on the b.
+	row := &e.rows[0]
+	for i, highlight := range row.highlights[:row.RLen()-1] {
+		if overflowed := highlight&HL_OVERFLOW != 0; overflowed != (i >= 12) {
+			t.Errorf("column %d (%q) overflowed %v", i, row.render[i], overflowed)
+		}
+	}
+	if got := row.highlights[13] &^ HL_OVERFLOW; got != HL_STRING {
+		t.Errorf("overflowed string highlighted %d, want it still HL_STRING", got)
+	}
+	if slices.ContainsFunc(e.rows[1].highlights, func(highlight uint8) bool { return highlight&HL_OVERFLOW != 0 }) {
+		t.Error("a short line overflowed")
+	}
+
+	// Without the tab, it fits.
+	processKeys(t, DEL_KEY)
+	editorRenderRowsThrough(0)
+	if slices.ContainsFunc(row.highlights, func(highlight uint8) bool { return highlight&HL_OVERFLOW != 0 }) {
+		t.Errorf("%q still overflowed", string(row.render))
+	}
+}
+
+func TestOverflowKeepsSyntaxColor(t *testing.T) {
+	e := newTestEditor(t, `s := "abcdef"`)
+	e.filename = "main.go"
+	editorSelectSyntaxHighlight()
+	e.maxLineLength = 6
+
+	row := drawFirstRow(t)
+
+	stringColor := fmt.Sprintf("\x1b[%dm", editorSyntaxToColor(HL_STRING))
+	overflowColor := fmt.Sprintf("\x1b[%dm", editorSyntaxToColor(HL_OVERFLOW))
+	want := stringColor + `"` + overflowColor + "a\x1b[49m" + overflowColor + "b"
+	if !strings.Contains(row, want) {
+		t.Errorf("row = %q, want the string drawn in its color over the overflow background", row)
+	}
+	if strings.Contains(row[:strings.Index(row, `"`)], overflowColor) {
+		t.Errorf("row = %q, overflow starts too early", row)
+	}
+}
+
+// Drop the escape sequences from drawn text, leaving what shows on screen.
+func stripEscapes(drawn string) string {
+	return regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`).ReplaceAllString(drawn, "")
+}
+
+func TestWhitespaceGlyphsOnlyShowOnScreen(t *testing.T) {
+	e, path := openFile(t, "\tx y\n")
+	e.whitespaceTab = '>'
+	editorToggleWhitespace()
+
+	if got, want := stripEscapes(drawFirstRow(t)), ">       x·y"; got != want {
+		t.Errorf("drawn row = %q, want %q", got, want)
+	}
+	if got := editorRowCxToRx(e, &e.rows[0], 3); got != 10 {
+		t.Errorf("rx of y = %d, want 10", got)
+	}
+	editorSave()
+	if got := readFile(t, path); got != "\tx y\n" {
+		t.Errorf("on disk = %q, want the whitespace as it was", got)
+	}
+}
+
+// The screen column the ruler is drawn in on a drawn row, or -1 if it isn't.
+func rulerScreenColumn(row string) int {
+	at := strings.Index(row, KILO_RULER_COLOR)
+	if at < 0 {
+		return -1
+	}
+	return len([]rune(stripEscapes(row[:at])))
+}
+
+// The first row the cursor is on when moving down a row at a time scrolls the screen.
+func firstScrollingRow(t *testing.T, scrollOff int) int {
+	t.Helper()
+	e := newTestEditor(t, numberedLines(100)...)
+	e.scrollOff = scrollOff
+	for e.cy < e.numrows {
+		processKeys(t, ARROW_DOWN)
+		editorScroll()
+		if e.rowOffset > 0 {
+			return e.cy
+		}
+	}
+	t.Fatal("moving down never scrolled")
+	return 0
+}
+
+func TestScrollOff(t *testing.T) {
+	for _, tt := range []struct{ scrollOff, want int }{
+		{0, 22},
+		{3, 19},
+		// It can't be more than half the screen.
+		{100, 12},
+	} {
+		if got := firstScrollingRow(t, tt.scrollOff); got != tt.want {
+			t.Errorf("scrolloff %d: first scrolled with the cursor on row %d, want %d", tt.scrollOff, got, tt.want)
+		}
+	}
+}
+
+func TestScrollOffAtEdges(t *testing.T) {
+	e := newTestEditor(t, numberedLines(100)...)
+	e.scrollOff = 3
+
+	e.cy = 99
+	editorScroll()
+	// Not scrolled past the line after the end just to keep the margin.
+	if e.rowOffset != 79 {
+		t.Errorf("at the last row, rowOffset = %d, want 79", e.rowOffset)
+	}
+
+	e.cy = 50
+	editorScroll()
+	if e.rowOffset != 47 {
+		t.Errorf("moving up to row 50, rowOffset = %d, want 47", e.rowOffset)
+	}
+
+	e.cy = 1
+	editorScroll()
+	if e.rowOffset != 0 {
+		t.Errorf("near the top, rowOffset = %d, want 0", e.rowOffset)
+	}
+}
+
+func TestSideScrollOff(t *testing.T) {
+	long := "\t" + strings.Repeat("x", 200)
+	for _, tt := range []struct{ sideScrollOff, want int }{
+		// The tab takes the first 8 columns, so x's start at 8.
+		{0, 80 - 7},
+		{5, 75 - 7},
+	} {
+		e := newTestEditor(t, long)
+		e.sideScrollOff = tt.sideScrollOff
+		for e.cx = 1; e.cx < len(long); e.cx++ {
+			editorScroll()
+			if e.colOffset > 0 {
+				break
+			}
+		}
+		if e.cx != tt.want {
+			t.Errorf("sidescrolloff %d: first scrolled with the cursor on %d, want %d", tt.sideScrollOff, e.cx, tt.want)
+		}
+	}
+}
+
+func TestSideScrollOffAtEdges(t *testing.T) {
+	e := newTestEditor(t, strings.Repeat("x", 100))
+	e.sideScrollOff = 5
+
+	e.cx = 100
+	editorScroll()
+	// Not scrolled past the end of the row just to keep the margin.
+	if e.colOffset != 21 {
+		t.Errorf("at the end of the row, colOffset = %d, want 21", e.colOffset)
+	}
+	e.cx = 30
+	editorScroll()
+	if e.colOffset != 21 {
+		t.Errorf("back to 30, colOffset = %d, want 21", e.colOffset)
+	}
+	e.cx = 24
+	editorScroll()
+	if e.colOffset != 19 {
+		t.Errorf("back to 24, colOffset = %d, want 19", e.colOffset)
+	}
+	e.cx = 2
+	editorScroll()
+	if e.colOffset != 0 {
+		t.Errorf("near the start, colOffset = %d, want 0", e.colOffset)
+	}
+}
+
+func TestSmoothScrollStepsToTarget(t *testing.T) {
+	e := newTestEditor(t, numberedLines(200)...)
+	e.smoothScroll = true
+	e.cy = 150
+
+	var offsets []int
+	for i := 0; i < 50; i++ {
+		editorScroll()
+		offsets = append(offsets, e.rowOffset)
+		if scrollEvents == nil {
+			break
+		}
+	}
+	if len(offsets) < 3 || offsets[len(offsets)-1] != 129 || scrollEvents != nil {
+		t.Fatalf("scrolled through %v, want a few frames ending on 129", offsets)
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] <= offsets[i-1] {
+			t.Errorf("scrolled through %v, want each frame closer to the target", offsets)
+			break
+		}
+	}
+	// Each frame covers a third of what's left.
+	if offsets[0] != 43 {
+		t.Errorf("first frame at %d, want 43", offsets[0])
+	}
+}
+
+func TestSmoothScrollSkipsSmallMoves(t *testing.T) {
+	e := newTestEditor(t, numberedLines(200)...)
+	e.smoothScroll = true
+	e.cy = 25
+	editorScroll()
+	if e.rowOffset != 4 || scrollEvents != nil {
+		t.Errorf("rowOffset = %d (scrolling %v), want a jump straight to 4", e.rowOffset, scrollEvents != nil)
+	}
+}
+
+func TestKeypressFinishesSmoothScroll(t *testing.T) {
+	e := newTestEditor(t, numberedLines(200)...)
+	e.smoothScroll = true
+	e.cy = 150
+	editorScroll()
+	if scrollEvents == nil {
+		t.Fatal("jump didn't start a smooth scroll")
+	}
+
+	processKeys(t, ARROW_DOWN)
+	if e.rowOffset != 129 || scrollEvents != nil {
+		t.Errorf("after a key, rowOffset = %d (scrolling %v), want it on 129", e.rowOffset, scrollEvents != nil)
+	}
+}
+
+func TestScrollCursorLineInView(t *testing.T) {
+	tests := []struct {
+		name   string
+		scroll func()
+		cy     int
+		want   int
+	}{
+		{"center", editorCenterView, 100, 89},
+		{"top", editorViewTop, 100, 100},
+		{"bottom", editorViewBottom, 100, 79},
+		{"center near the start", editorCenterView, 3, 0},
+		{"bottom near the start", editorViewBottom, 10, 0},
+		{"top near the end", editorViewTop, 198, 179},
+		{"center near the end", editorCenterView, 195, 179},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, numberedLines(200)...)
+			e.cy = tt.cy
+			tt.scroll()
+			if e.rowOffset != tt.want {
+				t.Errorf("rowOffset = %d, want %d", e.rowOffset, tt.want)
+			}
+			// Drawing the screen leaves it there.
+			editorScroll()
+			if e.rowOffset != tt.want {
+				t.Errorf("rowOffset = %d after editorScroll, want %d", e.rowOffset, tt.want)
+			}
+		})
+	}
+}
+
+func TestCtrlLCentersView(t *testing.T) {
+	e := newTestEditor(t, numberedLines(200)...)
+	e.cy = 100
+	processKeys(t, CTRL_KEY('l'))
+	if e.rowOffset != 89 {
+		t.Errorf("rowOffset = %d after Ctrl-L, want 89", e.rowOffset)
+	}
+}
+
+func TestRulerStaysOnColumnWhenScrolled(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		colOffset int
+		want      int
+	}{
+		{"long row", strings.Repeat("x", 100), 0, 79},
+		{"long row scrolled", strings.Repeat("x", 100), 10, 69},
+		{"short row", "abc", 0, 79},
+		{"short row scrolled", "abc", 10, 69},
+		{"scrolled past", strings.Repeat("x", 200), 90, -1},
+		{"tabs", "\t\t" + strings.Repeat("x", 100), 5, 74},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEditor(t, tt.line)
+			e.rulerColumn = 80
+			e.colOffset = tt.colOffset
+
+			row := drawFirstRow(t)
+
+			if got := rulerScreenColumn(row); got != tt.want {
+				t.Errorf("ruler drawn in screen column %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGotoColumnCountsScreenColumns(t *testing.T) {
+	tests := []struct {
+		answer string
+		wantCx int
+	}{
+		{"10", 2},
+		{"5", 0},
+		{"99", 3},
+		{"zero", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			e := newTestEditor(t, "\tab")
+
+			processKeys(t, append([]int{ALT_KEY('|')}, textKeys(tt.answer+"\r")...)...)
+
+			if e.cx != tt.wantCx {
+				t.Errorf("cx = %d, want %d", e.cx, tt.wantCx)
+			}
+		})
+	}
+}
+
+func TestScrollbarThumb(t *testing.T) {
+	tests := []struct {
+		numrows, rowOffset int
+		wantTop, wantSize  int
+	}{
+		{10, 0, 0, 22},
+		{220, 0, 0, 2},
+		{220, 110, 11, 2},
+		{220, 198, 19, 2},
+		{10_000, 0, 0, 1},
+		{10_000, 5_000, 11, 1},
+		{10_000, 9_978, 21, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d at %d", tt.numrows, tt.rowOffset), func(t *testing.T) {
+			e := newTestEditor(t)
+			e.numrows, e.rowOffset = tt.numrows, tt.rowOffset
+
+			top, size := editorScrollbarThumb()
+
+			if top != tt.wantTop || size != tt.wantSize {
+				t.Errorf("thumb at %d covering %d, want %d covering %d", top, size, tt.wantTop, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestScrollbarTakesLastColumn(t *testing.T) {
+	lines := make([]string, 220)
+	for i := range lines {
+		lines[i] = strings.Repeat("x", 100)
+	}
+	e := newTestEditor(t, lines...)
+	editorToggleScrollbar()
+	e.rowOffset = 110
+	editorRenderRowsThrough(e.rowOffset + e.screenrows)
+
+	frame := make([]string, e.screenrows)
+	editorDrawRows(frame)
+
+	for y, row := range frame {
+		thumb := strings.HasSuffix(row, "\x1b[7m \x1b[m")
+		if want := y >= 11 && y < 13; thumb != want {
+			t.Errorf("row %d has thumb %v, want %v", y, thumb, want)
+		}
+		if got := strings.Count(stripEscapes(row), "x"); got != e.screencols-1 {
+			t.Errorf("row %d drew %d columns of text, want %d", y, got, e.screencols-1)
+		}
+	}
+}
+
+func TestCursorLineOnlyOnCursorRow(t *testing.T) {
+	e := newTestEditor(t, "one", "two", "three")
+	e.showCursorLine = true
+
+	for _, cy := range []int{1, 2, 3} {
+		e.cy = cy
+		editorRenderRowsThrough(e.screenrows)
+		frame := make([]string, e.screenrows)
+		editorDrawRows(frame)
+
+		for y, row := range frame {
+			lit := strings.Contains(row, KILO_CURSOR_LINE_COLOR)
+			if lit != (y == cy) {
+				t.Errorf("cursor on row %d, row %d has the cursor line color: %v", cy, y, lit)
+			}
+			// The whole width is filled, and the color doesn't leak into the next row.
+			if lit && (!strings.HasPrefix(row, KILO_CURSOR_LINE_COLOR+"\x1b[K") || !strings.HasSuffix(row, "\x1b[49m")) {
+				t.Errorf("cursor line drawn as %q", row)
+			}
+		}
+	}
+}
+
+func TestWordMatches(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"foo bar foo", "xxx     xxx"},
+		{"food foo_x xfoo", ""},
+		{"(foo)", " xxx "},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		newTestEditor(t, tt.line)
+		editorRenderRowsThrough(1)
+		got := ""
+		if matches := editorWordMatches(&config.rows[0], []rune("foo")); matches != nil {
+			for _, match := range matches {
+				got += map[bool]string{true: "x", false: " "}[match]
+			}
+		}
+		if got != tt.want {
+			t.Errorf("matches of foo in %q = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestWordAtCursorIsHighlightedAfterDelay(t *testing.T) {
+	e := newTestEditor(t, "foo bar", "baz foo")
+	t.Cleanup(func() { cursorWord, wordHighlightEvents = "", nil })
+	e.highlightWord = true
+	e.cy, e.cx = 1, 5
+
+	if got := editorWordToHighlight(); got != "" {
+		t.Errorf("word highlighted as soon as the cursor got to it: %q", got)
+	}
+	if wordHighlightEvents == nil {
+		t.Error("no redraw was scheduled for when the delay is over")
+	}
+	cursorWordSince = time.Now().Add(-KILO_WORD_HIGHLIGHT_DELAY * time.Millisecond)
+	editorRenderRowsThrough(e.numrows)
+	frame := make([]string, e.screenrows)
+	editorDrawRows(frame)
+	match := fmt.Sprintf("\x1b[%dmfoo", editorSyntaxToColor(HL_MATCH))
+	for y := 0; y < 2; y++ {
+		if !strings.Contains(frame[y], match) {
+			t.Errorf("row %d drawn as %q, want foo highlighted", y, frame[y])
+		}
+	}
+
+	e.cx = 0
+	editorDrawRows(frame)
+	if strings.Contains(frame[0], match) {
+		t.Errorf("foo still highlighted after the cursor left it: %q", frame[0])
+	}
+}
+
+// Lines of text, numbered so no two are the same.
+func numberedLines(numLines int) []string {
+	lines := make([]string, numLines)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d of some text", i)
+	}
+	return lines
+}
+
+func TestCursorMoveOnlyRedrawsStatusBar(t *testing.T) {
+	newTestEditor(t, numberedLines(100)...)
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+	editorRefreshScreen()
+	if !strings.Contains(out.String(), "line 1 of some text") {
+		t.Fatalf("first refresh didn't draw the rows: %q", out.String())
+	}
+
+	out.Reset()
+	editorMoveCursor(&config, ARROW_DOWN)
+	editorRefreshScreen()
+
+	if strings.Contains(out.String(), "of some text") {
+		t.Errorf("moving the cursor redrew rows: %q", out.String())
+	}
+	if moves := strings.Count(out.String(), "\x1b[2K"); moves > 1 {
+		t.Errorf("moving the cursor cleared %d lines, want just the status bar", moves)
+	}
+}
+
+// Only the status bar and cursor change when the cursor moves down a row,
+// so that's all that gets written.
+func BenchmarkRefreshAfterCursorMove(b *testing.B) {
+	newTestEditor(b, numberedLines(1000)...)
+	var out bytes.Buffer
+	terminal = bufio.NewWriter(&out)
+	editorRefreshScreen()
+	out.Reset()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if config.cy == config.screenrows-1 {
+			config.cy = 0
+		}
+		editorMoveCursor(&config, ARROW_DOWN)
+		editorRefreshScreen()
+	}
+	b.ReportMetric(float64(out.Len())/float64(b.N), "bytes/refresh")
+}
+
+// A writer that counts how many writes it gets.
+type countingWriter struct {
+	writes int
+	bytes  int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += len(p)
+	return len(p), nil
+}
+
+func TestRefreshWritesFrameInFewWrites(t *testing.T) {
+	newTestEditor(t, numberedLines(100)...)
+	out := &countingWriter{}
+	terminal = bufio.NewWriter(out)
+
+	editorRefreshScreen()
+
+	if terminal.Buffered() != 0 || mainBuffer.Len() != 0 {
+		t.Errorf("%d bytes buffered and %d left in mainBuffer after a refresh", terminal.Buffered(), mainBuffer.Len())
+	}
+	// One write per buffer full, rather than one per row or escape sequence.
+	if want := (out.bytes + terminal.Size() - 1) / terminal.Size(); out.writes != want {
+		t.Errorf("%d bytes took %d writes, want %d", out.bytes, out.writes, want)
+	}
+}
+
+// Drawing the whole screen, as after a resize.
+func BenchmarkRefresh(b *testing.B) {
+	newTestEditor(b, numberedLines(1000)...)
+	terminal = bufio.NewWriter(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		previousFrame = nil
+		editorRefreshScreen()
+	}
+}
+
+// ==========================================
+// =========== External Commands ============
+// ==========================================
+
+// Use command to format a file type for the rest of the test.
+func setFormatter(t *testing.T, filetype, command string) {
+	t.Helper()
+	var old string
+	for _, syntax := range highlightDB {
+		if syntax.filetype == filetype {
+			old = syntax.formatter
+		}
+	}
+	if err := editorSetFormatter(filetype, command); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { editorSetFormatter(filetype, old) })
+}
+
+func TestFormatReplacesBuffer(t *testing.T) {
+	e := newTestEditor(t, "echo one", "echo two")
+	e.filename = "run.sh"
+	setFormatter(t, "sh", "tr a-z A-Z")
+	editorSelectSyntaxHighlight()
+	e.cx, e.cy = 3, 1
+
+	processKeys(t, ALT_KEY('f'))
+
+	if got, want := editorText(e), "ECHO ONE\nECHO TWO"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if e.cx != 3 || e.cy != 1 || !e.dirty {
+		t.Errorf("cursor at (%d, %d), dirty %v, want (3, 1), dirty", e.cx, e.cy, e.dirty)
+	}
+	if e.statusMsg != "Formatted with tr a-z A-Z" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestFormatFailureLeavesBuffer(t *testing.T) {
+	e := newTestEditor(t, "echo one")
+	e.filename = "run.sh"
+	setFormatter(t, "sh", "echo 'line 1: bad syntax' >&2; echo more >&2; exit 1")
+	editorSelectSyntaxHighlight()
+
+	processKeys(t, ALT_KEY('f'))
+
+	if got := editorText(e); got != "echo one" || e.dirty {
+		t.Errorf("text = %q, dirty %v, want it unchanged", got, e.dirty)
+	}
+	if e.statusMsg != "Format failed: line 1: bad syntax" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestFormatWithoutFormatter(t *testing.T) {
+	e := newTestEditor(t, "plain text")
+
+	processKeys(t, ALT_KEY('f'))
+
+	if e.statusMsg != "No formatter for this file type" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestFilterSelectionThroughSort(t *testing.T) {
+	e := newTestEditor(t, "keep", "pear", "apple", "fig", "keep")
+	e.selecting = true
+	e.selectAnchor = editorCursor{0, 1}
+	e.cx, e.cy = 2, 3
+
+	processKeys(t, append([]int{ALT_KEY('!')}, textKeys("sort\r")...)...)
+
+	if got, want := editorText(e), "keep\napple\nfig\npear\nkeep"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if e.selecting || e.cx != 0 || e.cy != 1 {
+		t.Errorf("cursor at (%d, %d), selecting %v, want (0, 1) without a selection", e.cx, e.cy, e.selecting)
+	}
+}
+
+func TestFilterIsOneUndo(t *testing.T) {
+	e := newTestEditor(t, "keep", "pear", "apple", "fig", "keep")
+	e.selecting = true
+	e.selectAnchor = editorCursor{0, 1}
+	e.cx, e.cy = 2, 3
+	processKeys(t, append([]int{ALT_KEY('!')}, textKeys("sort\r")...)...)
+
+	undoOnce(t, e, "keep\npear\napple\nfig\nkeep", 2, 3)
+}
+
+func TestFilterLine(t *testing.T) {
+	tests := []struct {
+		command    string
+		want       string
+		wantStatus string
+	}{
+		{"tr a-z A-Z", "one\nTWO\nthree", ""},
+		{"echo nope >&2; exit 2", "one\ntwo\nthree", "Filter failed: nope"},
+		{"true", "one\ntwo\nthree", "true printed nothing, lines left alone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			e := newTestEditor(t, "one", "two", "three")
+			e.cy = 1
+
+			processKeys(t, append([]int{ALT_KEY('!')}, textKeys(tt.command+"\r")...)...)
+
+			if got := editorText(e); got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if e.statusMsg != tt.wantStatus {
+				t.Errorf("status = %q, want %q", e.statusMsg, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// ==========================================
+// ================== Tags ==================
+// ==========================================
+
+// Write files, by path relative to a new temp dir, and return the dir.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// A project with a tags file, as written by ctags.
+var tagsTree = map[string]string{
+	"tags": "!_TAG_FILE_FORMAT\t2\t/extended format/\n" +
+		"helper\tlib/helper.go\t/^func helper() int {$/;\"\tf\n" +
+		"main\tmain.go\t3;\"\tf\n" +
+		"missing\tlib/helper.go\t/^func missing() {$/;\"\tf\n",
+	"main.go":       "package main\n\nfunc main() {\n\thelper()\n}\n",
+	"lib/helper.go": "package main\n\n// helper helps.\nfunc helper() int {\n\treturn 1\n}\n",
+}
+
+func TestLookupTag(t *testing.T) {
+	dir := writeTree(t, tagsTree)
+	tags := filepath.Join(dir, "tags")
+
+	tests := []struct {
+		name    string
+		want    editorLocation
+		wantErr string
+	}{
+		{"main", editorLocation{filename: filepath.Join(dir, "main.go"), line: 3, message: "main"}, ""},
+		{"helper", editorLocation{filename: filepath.Join(dir, "lib/helper.go"), line: 4, message: "helper"}, ""},
+		{"missing", editorLocation{}, "/^func missing() {$/ not found in " + filepath.Join(dir, "lib/helper.go")},
+		{"nothing", editorLocation{}, "no tag for nothing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupTag(tags, tt.name)
+			if err != nil && err.Error() != tt.wantErr || err == nil && tt.wantErr != "" {
+				t.Fatalf("lookupTag() error = %v, want %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("lookupTag() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJumpToTagAndBack(t *testing.T) {
+	dir := writeTree(t, tagsTree)
+	e := newTestEditor(t)
+	if err := editorOpen(filepath.Join(dir, "main.go")); err != nil {
+		t.Fatal(err)
+	}
+	e.cx, e.cy = 3, 3
+
+	editorJumpToTag()
+
+	if e.filename != filepath.Join(dir, "lib/helper.go") || e.cy != 3 || e.cx != 0 {
+		t.Errorf("jumped to %s at (%d, %d), want the helper definition", e.filename, e.cx, e.cy)
+	}
+
+	editorPopTag()
+
+	if e.filename != filepath.Join(dir, "main.go") || e.cy != 3 || e.cx != 3 {
+		t.Errorf("jumped back to %s at (%d, %d), want main.go at (3, 3)", e.filename, e.cx, e.cy)
+	}
+	if len(e.tagStack) != 0 {
+		t.Errorf("tag stack = %v, want it empty", e.tagStack)
+	}
+}
+
+// ==========================================
+// ============== File Browser ==============
+// ==========================================
+
+var browseTree = map[string]string{
+	"b.txt":          "b\n",
+	"a.txt":          "a\n",
+	"docs/readme.md": "read me\n",
+	"src/main.go":    "package main\n",
+	"src/util/x.go":  "package util\n",
+}
+
+func TestFileTreeEntries(t *testing.T) {
+	dir := writeTree(t, browseTree)
+
+	entries := fileTreeEntries(dir, 0, map[string]bool{filepath.Join(dir, "src"): true})
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.String())
+	}
+	want := []string{"docs/", "src/", "  util/", "  main.go", "a.txt", "b.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestBrowseOpensSelectedFile(t *testing.T) {
+	dir := writeTree(t, browseTree)
+	e := newTestEditor(t)
+
+	// Expand src/, then go down past util/ to main.go.
+	typeKeys(ARROW_DOWN, '\r', ARROW_DOWN, ARROW_DOWN, '\r')
+	editorBrowse(dir)
+
+	if want := filepath.Join(dir, "src", "main.go"); e.filename != want {
+		t.Errorf("opened %q, want %q", e.filename, want)
+	}
+	if got := editorText(e); got != "package main" {
+		t.Errorf("text = %q", got)
+	}
+	if overlayLines != nil {
+		t.Error("file list still covers the view")
+	}
+}
+
+func TestBrowseCollapsesDirectory(t *testing.T) {
+	dir := writeTree(t, browseTree)
+	e := newTestEditor(t)
+
+	// Expanding and collapsing src/ leaves b.txt two rows below it.
+	typeKeys(ARROW_DOWN, '\r', '\r', ARROW_DOWN, ARROW_DOWN, '\r')
+	editorBrowse(dir)
+
+	if want := filepath.Join(dir, "b.txt"); e.filename != want {
+		t.Errorf("opened %q, want %q", e.filename, want)
+	}
+}
+
+// ==========================================
+// =========== Search Across Files ==========
+// ==========================================
+
+var grepTree = map[string]string{
+	"a.txt":       "no match\nfind the needle\n",
+	"sub/b.go":    "package sub\n\n// needle twice, needle\n",
+	".git/config": "needle in a hidden dir\n",
+	"image.bin":   "needle\x00binary\n",
+}
+
+func TestGrepFiles(t *testing.T) {
+	dir := writeTree(t, grepTree)
+
+	got, err := grepFiles(dir, "needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []editorLocation{
+		{filename: filepath.Join(dir, "a.txt"), line: 2, col: 10, message: "find the needle"},
+		{filename: filepath.Join(dir, "sub", "b.go"), line: 3, col: 4, message: "// needle twice, needle"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("grepFiles() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGrepOpensPickedMatch(t *testing.T) {
+	dir := writeTree(t, grepTree)
+	e := newTestEditor(t)
+	if err := editorOpen(filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	typeKeys(textKeys("needle\r", ARROW_DOWN, '\r')...)
+	editorGrep()
+
+	if want := filepath.Join(dir, "sub", "b.go"); e.filename != want || e.cy != 2 || e.cx != 3 {
+		t.Errorf("at %s (%d, %d), want %s (3, 2)", e.filename, e.cx, e.cy, want)
+	}
+	if len(e.locations) != 2 || e.locationIndex != 1 {
+		t.Errorf("%d locations at index %d, want 2 at index 1 for stepping through", len(e.locations), e.locationIndex)
+	}
+}
+
+// ==========================================
+// ============= Spell Checking =============
+// ==========================================
+
+// Check spelling in a fresh editor against a word list holding words.
+func newSpellEditor(t *testing.T, filename string, words []string, lines ...string) *editorConfig {
+	t.Helper()
+	dictionary := filepath.Join(t.TempDir(), "words")
+	if err := os.WriteFile(dictionary, []byte(strings.Join(words, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := spellDictionary
+	t.Cleanup(func() { spellDictionary = saved })
+	spellDictionary = nil
+
+	e := newTestEditor(t, lines...)
+	e.spellDictionary = dictionary
+	e.filename = filename
+	editorSelectSyntaxHighlight()
+	editorToggleSpellCheck()
+	editorRenderRowsThrough(e.numrows)
+	return e
+}
+
+// The runs of a row's render highlighted as misspelled.
+func misspelledWords(row *editorRow) []string {
+	var words []string
+	for i := 0; i < row.RLen(); i++ {
+		if row.highlights[i] != HL_MISSPELLED {
+			continue
+		}
+		start := i
+		for i < row.RLen() && row.highlights[i] == HL_MISSPELLED {
+			i++
+		}
+		words = append(words, string(row.render[start:i]))
+	}
+	return words
+}
+
+func TestMisspelledWordsInCode(t *testing.T) {
+	e := newSpellEditor(t, "main.go", []string{"the", "count", "of", "lines", "don't"},
+		"// teh count of linse",
+		`msg := "Don't count speling"`,
+		"misspeled := linse_2 // the count",
+		"/* the lnes",
+		"of cuont */ nomber",
+	)
+
+	want := [][]string{
+		{"teh", "linse"},
+		{"speling"},
+		// Code isn't prose, and words glued to digits or underscores are identifiers.
+		nil,
+		{"lnes"},
+		{"cuont"},
+	}
+	for y, words := range want {
+		if got := misspelledWords(&e.rows[y]); !slices.Equal(got, words) {
+			t.Errorf("line %d: misspelled %q, want %q", y, got, words)
+		}
+	}
+	// What's left of a misspelled comment is still a comment.
+	if got := e.rows[0].highlights[4]; got != HL_MISSPELLED {
+		t.Errorf("highlight of teh = %d, want HL_MISSPELLED", got)
+	}
+	if got := e.rows[0].highlights[8]; got != HL_COMMENT {
+		t.Errorf("highlight of count = %d, want HL_COMMENT", got)
+	}
+}
+
+func TestMisspelledWordsInProse(t *testing.T) {
+	e := newSpellEditor(t, "notes.txt", []string{"a", "word", "list", "or"}, "A wrod list, or 2 wrods")
+
+	if got, want := misspelledWords(&e.rows[0]), []string{"wrod", "wrods"}; !slices.Equal(got, want) {
+		t.Errorf("misspelled %q, want %q", got, want)
+	}
+
+	// Turning it off takes the highlight away again.
+	editorToggleSpellCheck()
+	editorRenderRowsThrough(0)
+	if got := misspelledWords(&e.rows[0]); got != nil {
+		t.Errorf("misspelled %q with spell checking off", got)
+	}
+}
+
+func TestMisspelledWordsFollowEdits(t *testing.T) {
+	e := newSpellEditor(t, "notes.txt", []string{"word"}, "wrd")
+
+	e.cx = 1
+	processKeys(t, 'o')
+	editorRenderRowsThrough(0)
+	if got := misspelledWords(&e.rows[0]); got != nil {
+		t.Errorf("misspelled %q after fixing the word", got)
+	}
+}
+
+func TestSpellCheckWithoutWordList(t *testing.T) {
+	e := newSpellEditor(t, "notes.txt", nil, "anything")
+	e.spellDictionary = filepath.Join(t.TempDir(), "missing")
+	spellDictionary = nil
+	editorRehighlightRows()
+	editorRenderRowsThrough(0)
+
+	if e.spellCheck || misspelledWords(&e.rows[0]) != nil {
+		t.Error("spell checking stayed on without a word list")
+	}
+	if !strings.HasPrefix(e.statusMsg, "Can't spell check") {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestSpellSuggestCycles(t *testing.T) {
+	e := newSpellEditor(t, "notes.txt", []string{"halo", "hello", "help", "world"}, "say Helo world")
+	e.cx = 5
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		processKeys(t, ALT_KEY('$'))
+		got = append(got, e.rows[0].content.String())
+	}
+
+	// In order, keeping the capital, then back to what was typed.
+	want := []string{"say Halo world", "say Hello world", "say Help world", "say Helo world"}
+	if !slices.Equal(got, want) {
+		t.Errorf("suggestions = %q, want %q", got, want)
+	}
+	if e.cx != 8 {
+		t.Errorf("cx = %d, want it after the word", e.cx)
+	}
+}
+
+func TestSpellSuggestWithoutSuggestions(t *testing.T) {
+	e := newSpellEditor(t, "notes.txt", []string{"word"}, "xyzzy")
+
+	processKeys(t, ALT_KEY('$'))
+
+	if got := editorText(e); got != "xyzzy" {
+		t.Errorf("text = %q, want it unchanged", got)
+	}
+	if e.statusMsg != "No suggestions for xyzzy" {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+// ==========================================
+// ============ Build Locations =============
+// ==========================================
+
+// Write a file for a build to point at, returning its path.
+func writeSourceFile(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseBuildErrors(t *testing.T) {
+	path := writeSourceFile(t, "package main\n")
+	output := strings.Join([]string{
+		"# github.com/braheezy/kilo",
+		path + ":12:5: undefined: foo",
+		path + ":3: warning: unused variable",
+		"/no/such/file.c:1:1: error: skipped, it doesn't exist",
+		"make: *** [all] Error 1",
+	}, "\n")
+
+	locations := parseBuildErrors(output)
+
+	want := []editorLocation{
+		{filename: path, line: 12, col: 5, message: "undefined: foo"},
+		{filename: path, line: 3, col: 0, message: "warning: unused variable"},
+	}
+	if !slices.Equal(locations, want) {
+		t.Errorf("parseBuildErrors() = %+v, want %+v", locations, want)
+	}
+}
+
+func TestGoToLocationCountsBytes(t *testing.T) {
+	path := writeSourceFile(t, "first\nhéllo wörld\n")
+	tests := []struct {
+		name   string
+		col    int
+		wantCx int
+	}{
+		{"start", 1, 0},
+		{"after multibyte", 8, 6},
+		{"inside multibyte", 3, 1},
+		{"past the end", 40, 11},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEditor(t)
+			if err := editorOpen(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if !editorGoToLocation(editorLocation{filename: path, line: 2, col: test.col}) {
+				t.Fatalf("editorGoToLocation() failed: %s", e.statusMsg)
+			}
+			if e.cy != 1 || e.cx != test.wantCx {
+				t.Errorf("cursor at (%d, %d), want (%d, 1)", e.cx, e.cy, test.wantCx)
+			}
+		})
+	}
+}
+
+func TestBuildRunsInBackground(t *testing.T) {
+	path := writeSourceFile(t, "package main\n")
+	e := newTestEditor(t, "text")
+	e.buildCommand = "sleep 0.1; echo '" + path + ":1:9: expected name'; exit 1"
+	e.cx = 2
+
+	editorBuild()
+	if buildEvents == nil || !strings.HasPrefix(e.statusMsg, "Running") {
+		t.Fatalf("build didn't start in the background, status %q", e.statusMsg)
+	}
+	editorBuild()
+	if e.statusMsg != "Still running the last build" {
+		t.Errorf("second build status = %q", e.statusMsg)
+	}
+
+	editorBuildFinished(<-buildEvents)
+
+	if buildEvents != nil {
+		t.Error("build still marked as running")
+	}
+	if len(e.locations) != 1 || e.locations[0].col != 9 {
+		t.Errorf("locations = %+v", e.locations)
+	}
+	if e.cx != 2 || e.cy != 0 {
+		t.Errorf("cursor moved to (%d, %d)", e.cx, e.cy)
+	}
+	if !strings.Contains(e.statusMsg, "found 1 problems") {
+		t.Errorf("status = %q", e.statusMsg)
+	}
+}
+
+func TestRPCBuildWaitsForResult(t *testing.T) {
+	rc := filepath.Join(t.TempDir(), "kilorc")
+	if err := os.WriteFile(rc, []byte("build_command = exit 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KILORC", rc)
+
+	responses := runRPC(t, nil, `{"id": 1, "method": "action", "params": {"name": "build"}}`)
+
+	if len(responses) != 1 || responses[0].Result == nil {
+		t.Fatalf("responses = %+v", responses)
+	}
+	if want := "exit 3 failed: exit status 3"; responses[0].Result.Status != want {
+		t.Errorf("status = %q, want %q", responses[0].Result.Status, want)
+	}
+}
+
+// ==========================================
+// ================ Hex View ================
+// ==========================================
+
+func TestHexDumpLayout(t *testing.T) {
+	e, _ := openFile(t, "Hello\x00\x01world!\tline two\n")
+	editorToggleHexView()
+	if !e.hexMode {
+		t.Fatal("hex view didn't start")
+	}
+	frame := make([]string, e.screenrows)
+	editorDrawHex(frame)
+
+	want := []string{
+		"00000000  48 65 6c 6c 6f 00 01 77  6f 72 6c 64 21 09 6c 69  |Hello..world!.li|",
+		"00000010  6e 65 20 74 77 6f 0a                              |ne two.|",
+		"~",
+	}
+	for y := range want {
+		if got := stripEscapes(frame[y]); got != want[y] {
+			t.Errorf("line %d = %q, want %q", y, got, want[y])
+		}
+	}
+	if !strings.Contains(frame[0], "|\x1b[7mH\x1b[m") {
+		t.Errorf("cursor not shown on the first byte: %q", frame[0])
+	}
+}
+
+func TestHexDumpFitsNarrowScreen(t *testing.T) {
+	e, _ := openFile(t, "Hello world, this is text\n")
+	e.screencols = 20
+	editorToggleHexView()
+	frame := make([]string, e.screenrows)
+	_, col := editorDrawHex(frame)
+	if line := stripEscapes(frame[0]); len(line) != 20 {
+		t.Errorf("line drawn %d wide as %q, want 20", len(line), line)
+	}
+	if col >= 20 {
+		t.Errorf("cursor at column %d, want it on screen", col)
+	}
+}
+
+func TestHexEditSavesBytes(t *testing.T) {
+	e, path := openFile(t, "abc\n")
+	editorToggleHexView()
+
+	// Overwrite b, then move past the end and try to go on.
+	processKeys(t, ARROW_RIGHT, '4', '2', 'g', ARROW_DOWN, 'e', '2')
+	if got := string(e.hexData); got != "aBc\xe2" || e.hexCursor != 3 {
+		t.Errorf("bytes = %q with the cursor on %d, want %q on 3", got, e.hexCursor, "aBc\xe2")
+	}
+	processKeys(t, '0', 'a', CTRL_KEY('t'))
+	if e.statusMsg != "transpose doesn't work in hex view" {
+		t.Errorf("status = %q, want text actions turned away", e.statusMsg)
+	}
+
+	processKeys(t, CTRL_KEY('s'))
+	if got := readFile(t, path); got != "aBc\n" {
+		t.Errorf("saved %q, want %q", got, "aBc\n")
+	}
+
+	processKeys(t, ARROW_LEFT, '7', '8', ESC)
+	if e.hexMode {
+		t.Fatal("Esc didn't leave hex view")
+	}
+	if got := editorText(e); got != "aBx" || !e.dirty {
+		t.Errorf("text = %q, dirty %v, want the edited bytes as unsaved rows", got, e.dirty)
+	}
+}
+
+// ==========================================
+// ================= Main ===================
+// ==========================================
+
+// Swap os.Stdin for a pipe with input in it, for the rest of the test.
+func pipeStdin(t *testing.T, input string) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(writer, input)
+	writer.Close()
+	stdin := os.Stdin
+	os.Stdin = reader
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		reader.Close()
+	})
+}
+
+func TestMainNeedsTerminal(t *testing.T) {
+	newTestEditor(t)
+	t.Setenv("KILORC", filepath.Join(t.TempDir(), "none"))
+	pipeStdin(t, "")
+
+	if isTerminal(os.Stdin) {
+		t.Fatal("isTerminal() = true for a pipe")
+	}
+	err := editorMain(nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "stdin is not a terminal") {
+		t.Errorf("editorMain() = %v, want a clear error about stdin", err)
+	}
+}
+
+// Collect what f prints to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	stdout := os.Stdout
+	os.Stdout = file
+	defer func() { os.Stdout = stdout }()
+
+	f()
+
+	return readFile(t, file.Name())
+}
+
+func TestMainFlagsExitEarly(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{"--version", "kilo version " + KILO_VERSION + "\n"},
+		{"--help", "Usage: kilo [options] [file or directory]"},
+		{"-h", "Usage: kilo [options] [file or directory]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			newTestEditor(t)
+			// If the editor started, it would fail here on stdin not being a terminal.
+			pipeStdin(t, "")
+
+			var err error
+			out := captureStdout(t, func() { err = editorMain([]string{tt.flag, "file.txt"}) })
+
+			if err != nil {
+				t.Errorf("editorMain() = %v, want nil", err)
+			}
+			if !strings.HasPrefix(out, tt.want) {
+				t.Errorf("printed %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestMainRejectsUnknownFlag(t *testing.T) {
+	newTestEditor(t)
+
+	err := editorMain([]string{"--nope"})
+
+	if err == nil || !strings.HasSuffix(err.Error(), "(see kilo --help)") {
+		t.Errorf("editorMain() = %v, want a pointer to --help", err)
+	}
+}
+
+func TestMainOpensFileArgument(t *testing.T) {
+	newTestEditor(t)
+	t.Setenv("KILORC", filepath.Join(t.TempDir(), "none"))
+	path := filepath.Join(t.TempDir(), "--help")
+	if err := os.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pipeStdin(t, `{"id": 1, "method": "get"}`+"\n")
+
+	var err error
+	out := captureStdout(t, func() { err = editorMain([]string{"--rpc", "--", path}) })
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"hello`) {
+		t.Errorf("--rpc printed %q, want the opened file's text", out)
+	}
+}
+
+func TestParseFileArgs(t *testing.T) {
+	dir := t.TempDir()
+	odd := filepath.Join(dir, "odd:3")
+	if err := os.WriteFile(odd, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args    []string
+		want    editorLocation
+		wantErr bool
+	}{
+		{[]string{"main.go"}, editorLocation{filename: "main.go"}, false},
+		{[]string{"main.go:42"}, editorLocation{filename: "main.go", line: 42}, false},
+		{[]string{"main.go:42:8"}, editorLocation{filename: "main.go", line: 42, col: 8}, false},
+		{[]string{"+42", "main.go"}, editorLocation{filename: "main.go", line: 42}, false},
+		{[]string{odd}, editorLocation{filename: odd}, false},
+		{[]string{"+x", "main.go"}, editorLocation{}, true},
+		{[]string{"a.go", "b.go"}, editorLocation{}, true},
+		{nil, editorLocation{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			files, got, err := parseFileArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFileArgs() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseFileArgs() start = %+v, want %+v", got, tt.want)
+			}
+			if len(tt.want.filename) > 0 && !slices.Equal(files, []string{tt.want.filename}) {
+				t.Errorf("parseFileArgs() files = %q, want %q", files, tt.want.filename)
+			}
+		})
+	}
+}
+
+func TestStartPositionIsClamped(t *testing.T) {
+	tests := []struct {
+		start          editorLocation
+		wantCx, wantCy int
+	}{
+		{editorLocation{line: 2, col: 3}, 2, 1},
+		{editorLocation{line: 2}, 0, 1},
+		{editorLocation{line: 99, col: 99}, 5, 2},
+		{editorLocation{line: 3, col: 99}, 5, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d:%d", tt.start.line, tt.start.col), func(t *testing.T) {
+			e, path := openFile(t, "one\ntwo\nthree\n")
+			tt.start.filename = path
+
+			editorGoToLocation(tt.start)
+
+			if e.cx != tt.wantCx || e.cy != tt.wantCy {
+				t.Errorf("cursor at (%d, %d), want (%d, %d)", e.cx, e.cy, tt.wantCx, tt.wantCy)
+			}
+		})
+	}
+}